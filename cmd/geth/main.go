@@ -18,10 +18,14 @@
 package main
 
 import (
+	"os"
+	"os/signal"
 	"runtime"
+	"syscall"
 
 	"myeth/common"
 	"myeth/eth"
+	"myeth/log"
 	"myeth/node"
 	"myeth/utils"
 )
@@ -45,6 +49,7 @@ func makeConfigNode() *node.Node {
 
 	cfg := node.Config{}
 	cfg.P2P.ListenAddr = nodelist[0]
+	cfg.IPCPath = "geth.ipc"
 	stack, err := node.New(&cfg)
 	if err != nil {
 		//utils.Fatalf("Failed to create the protocol stack: %v", err)
@@ -75,6 +80,25 @@ func geth() error {
 	return nil
 }
 
+// startNode 启动节点 同时监听退出信号
+// 收到SIGINT/SIGTERM后停止节点 node.Wait随之返回
 func startNode(stack *node.Node) {
-	stack.Start()
+	if err := stack.Start(); err != nil {
+		log.Crit("Error starting protocol stack", "err", err)
+	}
+	go func() {
+		sigc := make(chan os.Signal, 1)
+		signal.Notify(sigc, syscall.SIGINT, syscall.SIGTERM)
+		defer signal.Stop(sigc)
+		<-sigc
+		log.Info("Got interrupt, shutting down...")
+		go stack.Stop()
+		for i := 10; i > 0; i-- {
+			<-sigc
+			if i > 1 {
+				log.Warn("Already shutting down, interrupt more to panic.", "times", i-1)
+			}
+		}
+		panic("boom")
+	}()
 }
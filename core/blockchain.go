@@ -0,0 +1,460 @@
+package core
+
+import (
+	"errors"
+	"fmt"
+	"math/big"
+	"sync"
+	"sync/atomic"
+
+	"myeth/common"
+	"myeth/consensus"
+	"myeth/core/rawdb"
+	"myeth/core/types"
+	"myeth/ethdb"
+	"myeth/event"
+	"myeth/log"
+	"myeth/params"
+	"myeth/rlp"
+	"myeth/trie"
+)
+
+// ErrNoGenesis is returned when the database holds no genesis block.
+var ErrNoGenesis = errors.New("genesis not found in chain")
+
+// BlockChain represents the canonical chain given a database with a genesis
+// block. The BlockChain manages chain imports, reverts and chain reorganisations.
+//
+// Importing blocks in to the block chain happens according to the set of rules
+// defined by the consensus engine. The chain switches to a fork once its total
+// difficulty exceeds the one of the current head.
+// 全节点的链 区块头 区块体 收据都存在本地数据库里
+//NEED DO!! 还没有EVM 导入区块时不执行交易 也就不校验状态根和收据
+type BlockChain struct {
+	chainConfig *params.ChainConfig // Chain & network configuration
+
+	db      ethdb.Database // Low level persistent database to store final content in
+	triedb  *trie.Database // Trie nodes and contract code served to syncing peers
+	engine  consensus.Engine
+	genesis *types.Block
+
+	currentHeader    atomic.Value // Current head of the header chain
+	currentBlock     atomic.Value // Current head of the block chain
+	currentFastBlock atomic.Value // Current head of the fast-sync chain (may be above the block chain!)
+
+	chainHeadFeed event.Feed
+
+	mu sync.Mutex // Lock protecting chain insertion and head changes
+}
+
+// NewBlockChain returns a fully initialised block chain using information
+// available in the database. The database must already hold a genesis block,
+// see SetupGenesisBlock.
+func NewBlockChain(db ethdb.Database, chainConfig *params.ChainConfig, engine consensus.Engine) (*BlockChain, error) {
+	bc := &BlockChain{
+		chainConfig: chainConfig,
+		db:          db,
+		triedb:      trie.NewDatabase(db),
+		engine:      engine,
+	}
+	bc.genesis = bc.GetBlockByNumber(0)
+	if bc.genesis == nil {
+		return nil, ErrNoGenesis
+	}
+	bc.loadLastState()
+	return bc, nil
+}
+
+// loadLastState loads the last known chain state from the database, falling
+// back to the genesis block for any head that is missing.
+func (bc *BlockChain) loadLastState() {
+	currentBlock := bc.genesis
+	if block := bc.GetBlockByHash(rawdb.ReadHeadBlockHash(bc.db)); block != nil {
+		currentBlock = block
+	}
+	bc.currentBlock.Store(currentBlock)
+
+	currentHeader := currentBlock.Header()
+	if header := bc.GetHeaderByHash(rawdb.ReadHeadHeaderHash(bc.db)); header != nil {
+		currentHeader = header
+	}
+	bc.currentHeader.Store(currentHeader)
+
+	currentFastBlock := currentBlock
+	if block := bc.GetBlockByHash(rawdb.ReadHeadFastBlockHash(bc.db)); block != nil {
+		currentFastBlock = block
+	}
+	bc.currentFastBlock.Store(currentFastBlock)
+
+	log.Info("Loaded most recent local header", "number", currentHeader.Number, "hash", currentHeader.Hash())
+	log.Info("Loaded most recent local full block", "number", currentBlock.Number(), "hash", currentBlock.Hash())
+	log.Info("Loaded most recent local fast block", "number", currentFastBlock.Number(), "hash", currentFastBlock.Hash())
+}
+
+// Config retrieves the chain's fork configuration.
+func (bc *BlockChain) Config() *params.ChainConfig { return bc.chainConfig }
+
+// Engine retrieves the blockchain's consensus engine.
+func (bc *BlockChain) Engine() consensus.Engine { return bc.engine }
+
+// Genesis retrieves the chain's genesis block.
+func (bc *BlockChain) Genesis() *types.Block { return bc.genesis }
+
+// CurrentHeader retrieves the current head header of the canonical chain.
+func (bc *BlockChain) CurrentHeader() *types.Header {
+	return bc.currentHeader.Load().(*types.Header)
+}
+
+// CurrentBlock retrieves the current head block of the canonical chain.
+func (bc *BlockChain) CurrentBlock() *types.Block {
+	return bc.currentBlock.Load().(*types.Block)
+}
+
+// CurrentFastBlock retrieves the current fast-sync head block of the canonical
+// chain.
+func (bc *BlockChain) CurrentFastBlock() *types.Block {
+	return bc.currentFastBlock.Load().(*types.Block)
+}
+
+// GetTd retrieves a block's total difficulty in the canonical chain from the
+// database by hash and number.
+func (bc *BlockChain) GetTd(hash common.Hash, number uint64) *big.Int {
+	return rawdb.ReadTd(bc.db, hash, number)
+}
+
+// GetHeader retrieves a block header from the database by hash and number.
+func (bc *BlockChain) GetHeader(hash common.Hash, number uint64) *types.Header {
+	return rawdb.ReadHeader(bc.db, hash, number)
+}
+
+// GetHeaderByHash retrieves a block header from the database by hash.
+func (bc *BlockChain) GetHeaderByHash(hash common.Hash) *types.Header {
+	number := rawdb.ReadHeaderNumber(bc.db, hash)
+	if number == nil {
+		return nil
+	}
+	return bc.GetHeader(hash, *number)
+}
+
+// GetHeaderByNumber retrieves a block header from the database by number.
+func (bc *BlockChain) GetHeaderByNumber(number uint64) *types.Header {
+	hash := rawdb.ReadCanonicalHash(bc.db, number)
+	if hash == (common.Hash{}) {
+		return nil
+	}
+	return bc.GetHeader(hash, number)
+}
+
+// HasHeader checks if a block header is present in the database or not.
+func (bc *BlockChain) HasHeader(hash common.Hash, number uint64) bool {
+	return rawdb.HasHeader(bc.db, hash, number)
+}
+
+// GetBlock retrieves a block from the database by hash and number.
+func (bc *BlockChain) GetBlock(hash common.Hash, number uint64) *types.Block {
+	return rawdb.ReadBlock(bc.db, hash, number)
+}
+
+// GetBlockByHash retrieves a block from the database by hash.
+func (bc *BlockChain) GetBlockByHash(hash common.Hash) *types.Block {
+	number := rawdb.ReadHeaderNumber(bc.db, hash)
+	if number == nil {
+		return nil
+	}
+	return bc.GetBlock(hash, *number)
+}
+
+// GetBlockByNumber retrieves a block from the database by number.
+func (bc *BlockChain) GetBlockByNumber(number uint64) *types.Block {
+	hash := rawdb.ReadCanonicalHash(bc.db, number)
+	if hash == (common.Hash{}) {
+		return nil
+	}
+	return bc.GetBlock(hash, number)
+}
+
+// HasBlock checks if a block is fully present in the database or not.
+func (bc *BlockChain) HasBlock(hash common.Hash, number uint64) bool {
+	return rawdb.HasBody(bc.db, hash, number)
+}
+
+// GetBodyRLP retrieves a block body in RLP encoding from the database by hash.
+func (bc *BlockChain) GetBodyRLP(hash common.Hash) rlp.RawValue {
+	number := rawdb.ReadHeaderNumber(bc.db, hash)
+	if number == nil {
+		return nil
+	}
+	return rawdb.ReadBodyRLP(bc.db, hash, *number)
+}
+
+// GetReceiptsByHash retrieves the receipts for all transactions in a given block.
+func (bc *BlockChain) GetReceiptsByHash(hash common.Hash) types.Receipts {
+	number := rawdb.ReadHeaderNumber(bc.db, hash)
+	if number == nil {
+		return nil
+	}
+	return rawdb.ReadReceipts(bc.db, hash, *number)
+}
+
+// TrieNode retrieves a blob of data associated with a trie node (or code hash)
+// either from ephemeral in-memory cache, or from persistent storage.
+func (bc *BlockChain) TrieNode(hash common.Hash) ([]byte, error) {
+	return bc.triedb.Node(hash)
+}
+
+// InsertHeaderChain attempts to insert the given header chain in to the local
+// chain, possibly creating a reorg. The headers must be ordered and linked,
+// the first one having a locally known parent. It returns the index of the
+// failing header on error.
+//
+// The checkFreq parameter sets how many of the headers get their seals
+// verified.
+// 共识引擎还不校验工作量证明 所以checkFreq现在不起作用 每个区块头都做字段检查
+func (bc *BlockChain) InsertHeaderChain(chain []*types.Header, checkFreq int) (int, error) {
+	if i, err := checkHeaderChain(chain); err != nil {
+		return i, err
+	}
+	bc.mu.Lock()
+	defer bc.mu.Unlock()
+
+	for i, header := range chain {
+		if err := bc.engine.VerifyHeader(bc, header, false); err != nil {
+			return i, err
+		}
+		if _, err := bc.writeHeader(header); err != nil {
+			return i, err
+		}
+	}
+	return len(chain), nil
+}
+
+// checkHeaderChain verifies that the headers are ordered and linked.
+func checkHeaderChain(chain []*types.Header) (int, error) {
+	for i := 1; i < len(chain); i++ {
+		if chain[i].Number.Uint64() != chain[i-1].Number.Uint64()+1 || chain[i].ParentHash != chain[i-1].Hash() {
+			return i, fmt.Errorf("non contiguous insert: item %d is #%d [%x…], item %d is #%d [%x…] (parent [%x…])",
+				i-1, chain[i-1].Number, chain[i-1].Hash().Bytes()[:4], i, chain[i].Number, chain[i].Hash().Bytes()[:4], chain[i].ParentHash[:4])
+		}
+	}
+	return 0, nil
+}
+
+// writeHeader stores a header and its total difficulty, making it the head of
+// the header chain if it has more work than the current one. It returns the
+// total difficulty of the header.
+func (bc *BlockChain) writeHeader(header *types.Header) (*big.Int, error) {
+	hash, number := header.Hash(), header.Number.Uint64()
+	if number == 0 {
+		return nil, consensus.ErrUnknownAncestor
+	}
+	ptd := bc.GetTd(header.ParentHash, number-1)
+	if ptd == nil {
+		return nil, consensus.ErrUnknownAncestor
+	}
+	td := new(big.Int).Add(header.Difficulty, ptd)
+	if !bc.HasHeader(hash, number) {
+		rawdb.WriteHeader(bc.db, header)
+		rawdb.WriteTd(bc.db, hash, number, td)
+	}
+	head := bc.CurrentHeader()
+	if td.Cmp(bc.GetTd(head.Hash(), head.Number.Uint64())) > 0 {
+		bc.setHeadHeader(header, head)
+	}
+	return td, nil
+}
+
+// setHeadHeader makes header the new canonical head, rewriting the canonical
+// number to hash mappings back to the common ancestor with the old head.
+func (bc *BlockChain) setHeadHeader(header, old *types.Header) {
+	// Delete any canonical number assignments above the new head
+	for i := header.Number.Uint64() + 1; i <= old.Number.Uint64(); i++ {
+		rawdb.DeleteCanonicalHash(bc.db, i)
+	}
+	// Overwrite any stale canonical number assignments
+	var (
+		hash   = header.Hash()
+		number = header.Number.Uint64()
+		cur    = header
+	)
+	for rawdb.ReadCanonicalHash(bc.db, number) != hash {
+		rawdb.WriteCanonicalHash(bc.db, hash, number)
+		if number == 0 {
+			break
+		}
+		hash, number = cur.ParentHash, number-1
+		if cur = bc.GetHeader(hash, number); cur == nil {
+			break
+		}
+	}
+	rawdb.WriteHeadHeaderHash(bc.db, header.Hash())
+	bc.currentHeader.Store(types.CopyHeader(header))
+}
+
+// InsertChain attempts to insert the given batch of blocks in to the canonical
+// chain or, otherwise, create a fork. The blocks must be ordered and linked,
+// the parent of the first one being a locally known full block. It returns
+// the index of the failing block along with the error.
+func (bc *BlockChain) InsertChain(chain types.Blocks) (int, error) {
+	headers := make([]*types.Header, len(chain))
+	for i, block := range chain {
+		headers[i] = block.Header()
+	}
+	if i, err := checkHeaderChain(headers); err != nil {
+		return i, err
+	}
+	bc.mu.Lock()
+	defer bc.mu.Unlock()
+
+	var head *types.Block
+	for i, block := range chain {
+		hash, number := block.Hash(), block.NumberU64()
+		if bc.HasBlock(hash, number) {
+			continue
+		}
+		if number == 0 || !bc.HasBlock(block.ParentHash(), number-1) {
+			return i, consensus.ErrUnknownAncestor
+		}
+		if err := bc.engine.VerifyHeader(bc, block.Header(), true); err != nil {
+			return i, err
+		}
+		if err := validateBody(block); err != nil {
+			return i, err
+		}
+		rawdb.WriteBody(bc.db, hash, number, block.Body())
+		td, err := bc.writeHeader(block.Header())
+		if err != nil {
+			return i, err
+		}
+		current := bc.CurrentBlock()
+		if td.Cmp(bc.GetTd(current.Hash(), current.NumberU64())) > 0 {
+			bc.setHeadBlock(block)
+			head = block
+		}
+	}
+	if head != nil {
+		bc.chainHeadFeed.Send(ChainHeadEvent{Block: head})
+	}
+	return len(chain), nil
+}
+
+// validateBody checks that the transactions and uncles of a block match the
+// roots in its header.
+func validateBody(block *types.Block) error {
+	header := block.Header()
+	if hash := types.CalcUncleHash(block.Uncles()); hash != header.UncleHash {
+		return fmt.Errorf("uncle root hash mismatch: have %x, want %x", hash, header.UncleHash)
+	}
+	if hash := types.DeriveSha(block.Transactions()); hash != header.TxHash {
+		return fmt.Errorf("transaction root hash mismatch: have %x, want %x", hash, header.TxHash)
+	}
+	return nil
+}
+
+// setHeadBlock makes block the head of the block chain. The header chain is
+// moved over to it as well if the block isn't canonical yet.
+func (bc *BlockChain) setHeadBlock(block *types.Block) {
+	if rawdb.ReadCanonicalHash(bc.db, block.NumberU64()) != block.Hash() {
+		bc.setHeadHeader(block.Header(), bc.CurrentHeader())
+	}
+	rawdb.WriteHeadBlockHash(bc.db, block.Hash())
+	bc.currentBlock.Store(block)
+
+	//全同步的区块比快速同步的头还新的话 快速同步的头也跟着前进
+	if fast := bc.CurrentFastBlock(); fast.NumberU64() < block.NumberU64() {
+		rawdb.WriteHeadFastBlockHash(bc.db, block.Hash())
+		bc.currentFastBlock.Store(block)
+	}
+}
+
+// InsertReceiptChain attempts to complete an already existing header chain with
+// transaction and receipt data, without executing the transactions.
+func (bc *BlockChain) InsertReceiptChain(blockChain types.Blocks, receiptChain []types.Receipts) (int, error) {
+	if len(blockChain) != len(receiptChain) {
+		return 0, fmt.Errorf("block/receipt count mismatch: %d != %d", len(blockChain), len(receiptChain))
+	}
+	for i := 1; i < len(blockChain); i++ {
+		if blockChain[i].NumberU64() != blockChain[i-1].NumberU64()+1 || blockChain[i].ParentHash() != blockChain[i-1].Hash() {
+			return i, fmt.Errorf("non contiguous insert: item %d is #%d [%x…], item %d is #%d [%x…] (parent [%x…])",
+				i-1, blockChain[i-1].Number(), blockChain[i-1].Hash().Bytes()[:4], i, blockChain[i].Number(), blockChain[i].Hash().Bytes()[:4], blockChain[i].ParentHash().Bytes()[:4])
+		}
+	}
+	bc.mu.Lock()
+	defer bc.mu.Unlock()
+
+	for i, block := range blockChain {
+		hash, number := block.Hash(), block.NumberU64()
+		if !bc.HasHeader(hash, number) {
+			return i, fmt.Errorf("containing header #%d [%x…] unknown", number, hash.Bytes()[:4])
+		}
+		if err := validateBody(block); err != nil {
+			return i, err
+		}
+		if hash := types.DeriveSha(receiptChain[i]); hash != block.Header().ReceiptHash {
+			return i, fmt.Errorf("receipt root hash mismatch: have %x, want %x", hash, block.Header().ReceiptHash)
+		}
+		rawdb.WriteBody(bc.db, hash, number, block.Body())
+		rawdb.WriteReceipts(bc.db, hash, number, receiptChain[i])
+
+		// Advance the fast-sync head if the block is canonical and ahead of it
+		if rawdb.ReadCanonicalHash(bc.db, number) == hash && bc.CurrentFastBlock().NumberU64() < number {
+			rawdb.WriteHeadFastBlockHash(bc.db, hash)
+			bc.currentFastBlock.Store(block)
+		}
+	}
+	return len(blockChain), nil
+}
+
+// Rollback is designed to remove a chain of links from the database that aren't
+// certain enough to be valid.
+// 只把各个链头退回到父区块 数据本身留在数据库里
+func (bc *BlockChain) Rollback(chain []common.Hash) {
+	bc.mu.Lock()
+	defer bc.mu.Unlock()
+
+	for i := len(chain) - 1; i >= 0; i-- {
+		hash := chain[i]
+
+		if head := bc.CurrentHeader(); head.Hash() == hash {
+			parent := bc.GetHeader(head.ParentHash, head.Number.Uint64()-1)
+			rawdb.DeleteCanonicalHash(bc.db, head.Number.Uint64())
+			rawdb.WriteHeadHeaderHash(bc.db, parent.Hash())
+			bc.currentHeader.Store(parent)
+		}
+		if fast := bc.CurrentFastBlock(); fast.Hash() == hash {
+			parent := bc.GetBlock(fast.ParentHash(), fast.NumberU64()-1)
+			rawdb.WriteHeadFastBlockHash(bc.db, parent.Hash())
+			bc.currentFastBlock.Store(parent)
+		}
+		if block := bc.CurrentBlock(); block.Hash() == hash {
+			parent := bc.GetBlock(block.ParentHash(), block.NumberU64()-1)
+			rawdb.WriteHeadBlockHash(bc.db, parent.Hash())
+			bc.currentBlock.Store(parent)
+		}
+	}
+}
+
+// FastSyncCommitHead sets the current head block to the one defined by the hash
+// irrelevant what the chain contents were prior.
+func (bc *BlockChain) FastSyncCommitHead(hash common.Hash) error {
+	// Make sure that both the block as well at its state trie exists
+	block := bc.GetBlockByHash(hash)
+	if block == nil {
+		return fmt.Errorf("non existent block [%x…]", hash[:4])
+	}
+	if _, err := trie.NewSecure(block.Root(), bc.triedb, 0); err != nil {
+		return err
+	}
+	bc.mu.Lock()
+	defer bc.mu.Unlock()
+
+	rawdb.WriteHeadBlockHash(bc.db, hash)
+	bc.currentBlock.Store(block)
+
+	log.Info("Committed new head block", "number", block.Number(), "hash", hash)
+	return nil
+}
+
+// SubscribeChainHeadEvent registers a subscription of ChainHeadEvent.
+func (bc *BlockChain) SubscribeChainHeadEvent(ch chan<- ChainHeadEvent) event.Subscription {
+	return bc.chainHeadFeed.Subscribe(ch)
+}
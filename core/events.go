@@ -0,0 +1,15 @@
+package core
+
+import (
+	"myeth/core/types"
+)
+
+// NewTxsEvent is posted when a batch of transactions enter the transaction pool.
+// 交易池收到新交易之后发出 eth用它把交易广播给其他节点
+type NewTxsEvent struct{ Txs []*types.Transaction }
+
+// NewMinedBlockEvent is posted when a block has been imported.
+type NewMinedBlockEvent struct{ Block *types.Block }
+
+// ChainHeadEvent is posted when the canonical chain head changes.
+type ChainHeadEvent struct{ Block *types.Block }
@@ -0,0 +1,39 @@
+package rawdb
+
+import (
+	"encoding/json"
+
+	"myeth/common"
+	"myeth/log"
+	"myeth/params"
+)
+
+// ReadChainConfig retrieves the consensus settings based on the given genesis hash.
+func ReadChainConfig(db DatabaseReader, hash common.Hash) *params.ChainConfig {
+	data, _ := db.Get(configKey(hash))
+	if len(data) == 0 {
+		return nil
+	}
+	var config params.ChainConfig
+	if err := json.Unmarshal(data, &config); err != nil {
+		log.Error("Invalid chain config JSON", "hash", hash, "err", err)
+		return nil
+	}
+	return &config
+}
+
+// WriteChainConfig writes the chain config settings to the database.
+//配置按创世块hash存 同一个数据库只对应一条链
+func WriteChainConfig(db DatabaseWriter, hash common.Hash, cfg *params.ChainConfig) {
+	if cfg == nil {
+		return
+	}
+	data, err := json.Marshal(cfg)
+	if err != nil {
+		log.Error("Failed to JSON encode chain config", "err", err)
+		return
+	}
+	if err := db.Put(configKey(hash), data); err != nil {
+		log.Error("Failed to store chain config", "err", err)
+	}
+}
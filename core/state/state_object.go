@@ -192,3 +192,14 @@ func (self *stateObject) updateRoot(db Database) {
 	self.updateTrie(db)
 	self.data.Root = self.trie.Hash()
 }
+
+// CommitTrie the storage trie of the object to db.
+// This updates the trie root.
+func (self *stateObject) CommitTrie(db Database) error {
+	self.updateTrie(db)
+	root, err := self.trie.Commit(nil)
+	if err == nil {
+		self.data.Root = root
+	}
+	return err
+}
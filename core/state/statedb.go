@@ -7,6 +7,11 @@ import (
 	"myeth/rlp"
 )
 
+var (
+	// emptyRoot is the known root hash of an empty trie.
+	emptyRoot = common.HexToHash("56e81f171bcc55a6ff8345e692c0f86e5b48e01b996cadc001622fb5e363b421")
+)
+
 //StateDB 用来存储 和 Merkle trie相关的所有事情
 type StateDB struct {
 	db   Database
@@ -20,8 +25,24 @@ type StateDB struct {
 	journal *journal
 }
 
+// New creates a new state from a given trie.
 func New(root common.Hash, db Database) (*StateDB, error) {
-	return &StateDB{}, nil
+	tr, err := db.OpenTrie(root)
+	if err != nil {
+		return nil, err
+	}
+	return &StateDB{
+		db:                db,
+		trie:              tr,
+		stateObjects:      make(map[common.Address]*stateObject),
+		stateObjectsDirty: make(map[common.Address]struct{}),
+		journal:           newJournal(),
+	}, nil
+}
+
+// Database retrieves the low level database supporting the lower level trie ops.
+func (self *StateDB) Database() Database {
+	return self.db
 }
 
 //根据地址查找一个StateObject
@@ -144,4 +165,33 @@ func (s *StateDB) Finalise(deleteEmptyObjects bool) {
 		}
 		s.stateObjectsDirty[addr] = struct{}{}
 	}
+	//修改已经写进树里了 清掉日志 下一次只处理之后的修改
+	s.journal = newJournal()
+}
+
+// Commit writes the state to the underlying in-memory trie database.
+func (s *StateDB) Commit(deleteEmptyObjects bool) (root common.Hash, err error) {
+	s.Finalise(deleteEmptyObjects)
+
+	// Commit objects to the trie.
+	for addr := range s.stateObjectsDirty {
+		if stateObject := s.stateObjects[addr]; !stateObject.deleted {
+			if err := stateObject.CommitTrie(s.db); err != nil {
+				return common.Hash{}, err
+			}
+		}
+		delete(s.stateObjectsDirty, addr)
+	}
+	// Write trie changes.
+	//账户的存储树挂在账户树的叶子下面 提交时把引用关系告诉trie.Database 否则回收节点时会被删掉
+	return s.trie.Commit(func(leaf []byte, parent common.Hash) error {
+		var account Account
+		if err := rlp.DecodeBytes(leaf, &account); err != nil {
+			return nil
+		}
+		if account.Root != emptyRoot {
+			s.db.TrieDB().Reference(account.Root, parent)
+		}
+		return nil
+	})
 }
@@ -0,0 +1,26 @@
+package state
+
+import (
+	"bytes"
+
+	"myeth/common"
+	"myeth/rlp"
+	"myeth/trie"
+)
+
+// NewStateSync create a new state trie download scheduler.
+// 账户树的叶子是Account 每碰到一个账户就把它的存储树和合约代码也加进下载计划
+func NewStateSync(root common.Hash, database trie.DatabaseReader) *trie.Sync {
+	var syncer *trie.Sync
+	callback := func(leaf []byte, parent common.Hash) error {
+		var obj Account
+		if err := rlp.Decode(bytes.NewReader(leaf), &obj); err != nil {
+			return err
+		}
+		syncer.AddSubTrie(obj.Root, 64, parent, nil)
+		syncer.AddRawEntry(common.BytesToHash(obj.CodeHash), 64, parent)
+		return nil
+	}
+	syncer = trie.NewSync(root, database, callback)
+	return syncer
+}
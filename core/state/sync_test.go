@@ -0,0 +1,182 @@
+package state
+
+import (
+	"bytes"
+	"math/big"
+	"testing"
+
+	"myeth/common"
+	"myeth/crypto"
+	"myeth/ethdb"
+	"myeth/rlp"
+	"myeth/trie"
+)
+
+// testAccount is the data associated with an account used by the state tests.
+type testAccount struct {
+	address common.Address
+	balance *big.Int
+	nonce   uint64
+	code    []byte
+	storage map[common.Hash]common.Hash
+}
+
+// makeTestState create a sample test state to test node-wise reconstruction.
+// 没有SetCode和SetState 合约代码和存储树直接写进数据库
+func makeTestState(t *testing.T) (*ethdb.MemDatabase, common.Hash, []*testAccount) {
+	db := ethdb.NewMemDatabase()
+	triedb := trie.NewDatabase(db)
+
+	accTrie, err := trie.NewSecure(common.Hash{}, triedb, 0)
+	if err != nil {
+		t.Fatalf("failed to create account trie: %v", err)
+	}
+	var accounts []*testAccount
+	for i := byte(0); i < 96; i++ {
+		acc := &testAccount{
+			address: common.BytesToAddress([]byte{i}),
+			balance: big.NewInt(int64(11 * i)),
+			nonce:   uint64(42 * i),
+		}
+		data := Account{Nonce: acc.nonce, Balance: acc.balance, Root: emptyRoot, CodeHash: emptyCodeHash}
+
+		// Every third account is a contract with some code
+		if i%3 == 0 {
+			acc.code = []byte{i, i, i, i, i}
+			data.CodeHash = crypto.Keccak256(acc.code)
+			db.Put(data.CodeHash, acc.code)
+		}
+		// Every fifth account has a few storage slots
+		if i%5 == 0 {
+			storage, err := trie.NewSecure(common.Hash{}, triedb, 0)
+			if err != nil {
+				t.Fatalf("failed to create storage trie: %v", err)
+			}
+			acc.storage = make(map[common.Hash]common.Hash)
+			for j := byte(1); j <= 4; j++ {
+				key, value := common.Hash{j}, common.Hash{i, j}
+				acc.storage[key] = value
+				storage.Update(key[:], value[:])
+			}
+			if data.Root, err = storage.Commit(nil); err != nil {
+				t.Fatalf("failed to commit storage trie: %v", err)
+			}
+			if err := triedb.Commit(data.Root, false); err != nil {
+				t.Fatalf("failed to write storage trie: %v", err)
+			}
+		}
+		enc, _ := rlp.EncodeToBytes(&data)
+		accTrie.Update(acc.address[:], enc)
+
+		accounts = append(accounts, acc)
+	}
+	root, err := accTrie.Commit(nil)
+	if err != nil {
+		t.Fatalf("failed to commit account trie: %v", err)
+	}
+	if err := triedb.Commit(root, false); err != nil {
+		t.Fatalf("failed to write account trie: %v", err)
+	}
+	// Return the generated state
+	return db, root, accounts
+}
+
+// checkStateAccounts cross references a reconstructed state with an expected
+// account array, including the storage and the code of the contracts.
+func checkStateAccounts(t *testing.T, db ethdb.Database, root common.Hash, accounts []*testAccount) {
+	triedb := trie.NewDatabase(db)
+
+	accTrie, err := trie.NewSecure(root, triedb, 0)
+	if err != nil {
+		t.Fatalf("failed to open account trie: %v", err)
+	}
+	for i, acc := range accounts {
+		enc, err := accTrie.TryGet(acc.address[:])
+		if err != nil || enc == nil {
+			t.Fatalf("account %d: missing: %v", i, err)
+		}
+		var data Account
+		if err := rlp.DecodeBytes(enc, &data); err != nil {
+			t.Fatalf("account %d: failed to decode: %v", i, err)
+		}
+		if data.Balance.Cmp(acc.balance) != 0 {
+			t.Errorf("account %d: balance mismatch: have %v, want %v", i, data.Balance, acc.balance)
+		}
+		if data.Nonce != acc.nonce {
+			t.Errorf("account %d: nonce mismatch: have %v, want %v", i, data.Nonce, acc.nonce)
+		}
+		if acc.code != nil {
+			if code, err := db.Get(data.CodeHash); err != nil || !bytes.Equal(code, acc.code) {
+				t.Errorf("account %d: code mismatch: have %x, want %x (%v)", i, code, acc.code, err)
+			}
+		}
+		if acc.storage != nil {
+			storage, err := trie.NewSecure(data.Root, triedb, 0)
+			if err != nil {
+				t.Fatalf("account %d: failed to open storage trie: %v", i, err)
+			}
+			for key, value := range acc.storage {
+				if have, err := storage.TryGet(key[:]); err != nil || !bytes.Equal(have, value[:]) {
+					t.Errorf("account %d: slot %x mismatch: have %x, want %x (%v)", i, key, have, value, err)
+				}
+			}
+		}
+	}
+}
+
+// Tests that an empty state is not scheduled for syncing.
+func TestEmptyStateSync(t *testing.T) {
+	if req := NewStateSync(emptyRoot, ethdb.NewMemDatabase()).Missing(1); len(req) != 0 {
+		t.Errorf("content requested for empty state: %v", req)
+	}
+}
+
+// Tests that given a root hash, a state can sync iteratively on a single thread,
+// requesting retrieval tasks and returning all of them in one go.
+func TestIterativeStateSyncIndividual(t *testing.T) { testIterativeStateSync(t, 1) }
+func TestIterativeStateSyncBatched(t *testing.T)    { testIterativeStateSync(t, 100) }
+
+func testIterativeStateSync(t *testing.T, batch int) {
+	// Create a random state to copy
+	srcDb, srcRoot, srcAccounts := makeTestState(t)
+
+	// Create a destination state and sync with the scheduler
+	dstDb := ethdb.NewMemDatabase()
+	sched := NewStateSync(srcRoot, dstDb)
+
+	codes := make(map[common.Hash]bool)
+	for _, acc := range srcAccounts {
+		if acc.code != nil {
+			codes[crypto.Keccak256Hash(acc.code)] = true
+		}
+	}
+	fetched := 0
+
+	queue := append([]common.Hash{}, sched.Missing(batch)...)
+	for len(queue) > 0 {
+		results := make([]trie.SyncResult, len(queue))
+		for i, hash := range queue {
+			data, err := srcDb.Get(hash.Bytes())
+			if err != nil {
+				t.Fatalf("failed to retrieve node data for %x: %v", hash, err)
+			}
+			if codes[hash] {
+				fetched++
+			}
+			results[i] = trie.SyncResult{Hash: hash, Data: data}
+		}
+		if _, index, err := sched.Process(results); err != nil {
+			t.Fatalf("failed to process result #%d: %v", index, err)
+		}
+		if index, err := sched.Commit(dstDb); err != nil {
+			t.Fatalf("failed to commit data #%d: %v", index, err)
+		}
+		queue = append(queue[:0], sched.Missing(batch)...)
+	}
+	// The contract codes must have been requested as raw entries along the way
+	if fetched != len(codes) {
+		t.Errorf("contract code requests mismatch: have %d, want %d", fetched, len(codes))
+	}
+	// Cross check that the two states are in sync
+	checkStateAccounts(t, dstDb, srcRoot, srcAccounts)
+}
@@ -0,0 +1,251 @@
+package core
+
+import (
+	"errors"
+	"sort"
+	"sync"
+
+	"myeth/common"
+	"myeth/core/types"
+	"myeth/event"
+	"myeth/log"
+	"myeth/params"
+)
+
+const (
+	// chainHeadChanSize is the size of channel listening to ChainHeadEvent.
+	chainHeadChanSize = 10
+
+	// maxTxSize is the largest transaction accepted into the pool.
+	maxTxSize = 32 * 1024
+)
+
+var (
+	// ErrKnownTransaction is returned if a transaction is already in the pool.
+	ErrKnownTransaction = errors.New("known transaction")
+
+	// ErrInvalidSender is returned if the transaction contains an invalid signature.
+	ErrInvalidSender = errors.New("invalid sender")
+
+	// ErrNegativeValue is a sanity error to ensure noone is able to specify a
+	// transaction with a negative value.
+	ErrNegativeValue = errors.New("negative value")
+
+	// ErrOversizedData is returned if the input data of a transaction is greater
+	// than some meaningful limit a user might use. This is not a consensus error
+	// making the transaction invalid, rather a DOS protection.
+	ErrOversizedData = errors.New("oversized data")
+
+	// ErrReplaceUnderpriced is returned if a transaction is attempted to be replaced
+	// with a different one without the required price bump.
+	ErrReplaceUnderpriced = errors.New("replacement transaction underpriced")
+
+	// ErrTxPoolOverflow is returned if the pool is full.
+	ErrTxPoolOverflow = errors.New("txpool is full")
+)
+
+// TxPoolConfig are the configuration parameters of the transaction pool.
+type TxPoolConfig struct {
+	GlobalSlots uint64 // Maximum number of transactions held by the pool
+}
+
+// DefaultTxPoolConfig contains the default configurations for the transaction
+// pool.
+var DefaultTxPoolConfig = TxPoolConfig{
+	GlobalSlots: 4096,
+}
+
+// chainHeadSubscriber is the part of the chain the pool follows to drop the
+// transactions which made it into a block.
+type chainHeadSubscriber interface {
+	SubscribeChainHeadEvent(ch chan<- ChainHeadEvent) event.Subscription
+}
+
+// TxPool contains all currently known transactions. Transactions enter the pool
+// when they are received from the network, and leave it once they are included
+// in a new chain head.
+// 交易按发送者分组 每组按nonce排序
+//NEED DO!! 没有状态可以查 不检查余额和账户的nonce 也不区分pending和queue
+type TxPool struct {
+	config TxPoolConfig
+	signer types.Signer
+
+	mu      sync.RWMutex
+	all     map[common.Hash]*types.Transaction    // All transactions to allow lookups
+	senders map[common.Address]types.Transactions // Transactions of each sender sorted by nonce
+
+	txFeed event.Feed
+
+	chainHeadCh  chan ChainHeadEvent
+	chainHeadSub event.Subscription
+	wg           sync.WaitGroup
+}
+
+// NewTxPool creates a new transaction pool to gather, sort and filter inbound
+// transactions from the network.
+func NewTxPool(config TxPoolConfig, chainconfig *params.ChainConfig, chain chainHeadSubscriber) *TxPool {
+	pool := &TxPool{
+		config:      config,
+		signer:      types.NewEIP155Signer(chainconfig.ChainID),
+		all:         make(map[common.Hash]*types.Transaction),
+		senders:     make(map[common.Address]types.Transactions),
+		chainHeadCh: make(chan ChainHeadEvent, chainHeadChanSize),
+	}
+	pool.chainHeadSub = chain.SubscribeChainHeadEvent(pool.chainHeadCh)
+
+	pool.wg.Add(1)
+	go pool.loop()
+	return pool
+}
+
+// loop drops the transactions included in new chain heads.
+func (pool *TxPool) loop() {
+	defer pool.wg.Done()
+
+	for {
+		select {
+		case ev := <-pool.chainHeadCh:
+			pool.removeIncluded(ev.Block)
+
+		// Be unsubscribed due to system stopped
+		case <-pool.chainHeadSub.Err():
+			return
+		}
+	}
+}
+
+// Stop terminates the transaction pool.
+func (pool *TxPool) Stop() {
+	// Unsubscribe subscriptions registered from blockchain
+	pool.chainHeadSub.Unsubscribe()
+	pool.wg.Wait()
+
+	log.Info("Transaction pool stopped")
+}
+
+// SubscribeNewTxsEvent registers a subscription of NewTxsEvent and
+// starts sending event to the given channel.
+func (pool *TxPool) SubscribeNewTxsEvent(ch chan<- NewTxsEvent) event.Subscription {
+	return pool.txFeed.Subscribe(ch)
+}
+
+// Get returns a transaction if it is contained in the pool
+// and nil otherwise.
+func (pool *TxPool) Get(hash common.Hash) *types.Transaction {
+	pool.mu.RLock()
+	defer pool.mu.RUnlock()
+
+	return pool.all[hash]
+}
+
+// Pending retrieves all currently known transactions, grouped by origin
+// account and sorted by nonce. The returned transaction set is a copy and can be
+// freely modified by calling code.
+func (pool *TxPool) Pending() (map[common.Address]types.Transactions, error) {
+	pool.mu.RLock()
+	defer pool.mu.RUnlock()
+
+	pending := make(map[common.Address]types.Transactions, len(pool.senders))
+	for addr, txs := range pool.senders {
+		pending[addr] = append(types.Transactions(nil), txs...)
+	}
+	return pending, nil
+}
+
+// AddRemotes enqueues a batch of transactions into the pool if they are valid.
+// The returned errors line up with the transactions, nil meaning the
+// transaction was accepted.
+func (pool *TxPool) AddRemotes(txs []*types.Transaction) []error {
+	pool.mu.Lock()
+	errs := make([]error, len(txs))
+	added := make([]*types.Transaction, 0, len(txs))
+	for i, tx := range txs {
+		if errs[i] = pool.add(tx); errs[i] == nil {
+			added = append(added, tx)
+		}
+	}
+	pool.mu.Unlock()
+
+	//新交易通知出去 eth会把它们广播给还不知道的节点
+	if len(added) > 0 {
+		go pool.txFeed.Send(NewTxsEvent{added})
+	}
+	return errs
+}
+
+// add validates a transaction and inserts it into the pool, replacing a
+// cheaper transaction of the same sender and nonce.
+func (pool *TxPool) add(tx *types.Transaction) error {
+	hash := tx.Hash()
+	if pool.all[hash] != nil {
+		return ErrKnownTransaction
+	}
+	from, err := pool.validateTx(tx)
+	if err != nil {
+		return err
+	}
+	txs := pool.senders[from]
+	i := sort.Search(len(txs), func(i int) bool { return txs[i].Nonce() >= tx.Nonce() })
+	if i < len(txs) && txs[i].Nonce() == tx.Nonce() {
+		old := txs[i]
+		if old.GasPrice().Cmp(tx.GasPrice()) >= 0 {
+			return ErrReplaceUnderpriced
+		}
+		delete(pool.all, old.Hash())
+		txs[i] = tx
+	} else {
+		if uint64(len(pool.all)) >= pool.config.GlobalSlots {
+			return ErrTxPoolOverflow
+		}
+		txs = append(txs, nil)
+		copy(txs[i+1:], txs[i:])
+		txs[i] = tx
+	}
+	pool.senders[from] = txs
+	pool.all[hash] = tx
+	return nil
+}
+
+// validateTx checks whether a transaction is valid on its own and returns
+// its sender.
+func (pool *TxPool) validateTx(tx *types.Transaction) (common.Address, error) {
+	// Heuristic limit, reject transactions over 32KB to prevent DOS attacks
+	if tx.Size() > maxTxSize {
+		return common.Address{}, ErrOversizedData
+	}
+	// Transactions can't be negative. This may never happen using RLP decoded
+	// transactions but may occur if you create a transaction using the RPC.
+	if tx.Value().Sign() < 0 || tx.GasPrice().Sign() < 0 {
+		return common.Address{}, ErrNegativeValue
+	}
+	// Make sure the transaction is signed properly
+	from, err := types.Sender(pool.signer, tx)
+	if err != nil {
+		return common.Address{}, ErrInvalidSender
+	}
+	return from, nil
+}
+
+// removeIncluded drops the transactions of a block from the pool, along with
+// any transaction of their senders with a lower nonce.
+func (pool *TxPool) removeIncluded(block *types.Block) {
+	pool.mu.Lock()
+	defer pool.mu.Unlock()
+
+	for _, tx := range block.Transactions() {
+		from, err := types.Sender(pool.signer, tx)
+		if err != nil {
+			continue
+		}
+		txs := pool.senders[from]
+		n := 0
+		for ; n < len(txs) && txs[n].Nonce() <= tx.Nonce(); n++ {
+			delete(pool.all, txs[n].Hash())
+		}
+		if n == len(txs) {
+			delete(pool.senders, from)
+		} else {
+			pool.senders[from] = txs[n:]
+		}
+	}
+}
@@ -0,0 +1,103 @@
+package types
+
+import (
+	"math/big"
+
+	"myeth/crypto"
+)
+
+const (
+	// BloomByteLength represents the number of bytes used in a header log bloom.
+	BloomByteLength = 256
+
+	// BloomBitLength represents the number of bits used in a header log bloom.
+	BloomBitLength = 8 * BloomByteLength
+)
+
+// Bloom represents a 2048 bit bloom filter.
+// 日志的布隆过滤器 用来快速判断一个区块里有没有某个地址或者topic的日志
+type Bloom [BloomByteLength]byte
+
+// BytesToBloom converts a byte slice to a bloom filter.
+// It panics if b is not of suitable size.
+func BytesToBloom(b []byte) Bloom {
+	var bloom Bloom
+	bloom.SetBytes(b)
+	return bloom
+}
+
+// SetBytes sets the content of b to the given bytes.
+// It panics if d is not of suitable size.
+func (b *Bloom) SetBytes(d []byte) {
+	if len(b) < len(d) {
+		panic("bloom bytes too big")
+	}
+	copy(b[BloomByteLength-len(d):], d)
+}
+
+// Add adds d to the filter. Future calls of Test(d) will return true.
+func (b *Bloom) Add(d *big.Int) {
+	bin := new(big.Int).SetBytes(b[:])
+	bin.Or(bin, bloom9(d.Bytes()))
+	b.SetBytes(bin.Bytes())
+}
+
+// Big converts b to a big integer.
+func (b Bloom) Big() *big.Int {
+	return new(big.Int).SetBytes(b[:])
+}
+
+func (b Bloom) Bytes() []byte {
+	return b[:]
+}
+
+func (b Bloom) Test(test *big.Int) bool {
+	return BloomLookup(b, test)
+}
+
+// CreateBloom creates a bloom filter out of the logs of the given receipts.
+func CreateBloom(receipts Receipts) Bloom {
+	bin := new(big.Int)
+	for _, receipt := range receipts {
+		bin.Or(bin, LogsBloom(receipt.Logs))
+	}
+
+	return BytesToBloom(bin.Bytes())
+}
+
+func LogsBloom(logs []*Log) *big.Int {
+	bin := new(big.Int)
+	for _, log := range logs {
+		bin.Or(bin, bloom9(log.Address.Bytes()))
+		for _, b := range log.Topics {
+			bin.Or(bin, bloom9(b[:]))
+		}
+	}
+
+	return bin
+}
+
+func bloom9(b []byte) *big.Int {
+	b = crypto.Keccak256(b)
+
+	r := new(big.Int)
+
+	for i := 0; i < 6; i += 2 {
+		t := big.NewInt(1)
+		b := (uint(b[i+1]) + (uint(b[i]) << 8)) & 2047
+		r.Or(r, t.Lsh(t, b))
+	}
+
+	return r
+}
+
+func BloomLookup(bin Bloom, topic bytesBacked) bool {
+	bloom := bin.Big()
+	cmp := bloom9(topic.Bytes())
+
+	return bloom.And(bloom, cmp).Cmp(cmp) == 0
+}
+
+type bytesBacked interface {
+	Bytes() []byte
+}
@@ -0,0 +1,28 @@
+package types
+
+import (
+	"bytes"
+
+	"myeth/common"
+	"myeth/rlp"
+	"myeth/trie"
+)
+
+// DerivableList 可以算出默克尔根的列表 交易和收据都实现了它
+type DerivableList interface {
+	Len() int
+	GetRlp(i int) []byte
+}
+
+// DeriveSha computes the root hash of a trie keyed by the RLP encoded index of
+// each list item, as used for the transaction and receipt roots in headers.
+func DeriveSha(list DerivableList) common.Hash {
+	keybuf := new(bytes.Buffer)
+	trie := new(trie.Trie)
+	for i := 0; i < list.Len(); i++ {
+		keybuf.Reset()
+		rlp.Encode(keybuf, uint(i))
+		trie.Update(keybuf.Bytes(), list.GetRlp(i))
+	}
+	return common.Hash(trie.Hash())
+}
@@ -0,0 +1,44 @@
+package eth
+
+import (
+	"context"
+	"errors"
+
+	"myeth/common"
+	"myeth/core"
+	"myeth/core/rawdb"
+	"myeth/core/types"
+	"myeth/event"
+	"myeth/rlp"
+)
+
+// EthAPIBackend implements filters.Backend for full nodes
+type EthAPIBackend struct {
+	eth *Ethereum
+}
+
+// GetReceipts retrieves the receipts of a block from the local database.
+func (b *EthAPIBackend) GetReceipts(ctx context.Context, hash common.Hash, number uint64) (types.Receipts, error) {
+	return rawdb.ReadReceipts(b.eth.chainDb, hash, number), nil
+}
+
+// GetBody retrieves the body of a block from the local database.
+func (b *EthAPIBackend) GetBody(ctx context.Context, hash common.Hash, number uint64) (*types.Body, error) {
+	data := rawdb.ReadBodyRLP(b.eth.chainDb, hash, number)
+	if len(data) == 0 {
+		return nil, errors.New("block body not found")
+	}
+	body := new(types.Body)
+	if err := rlp.DecodeBytes(data, body); err != nil {
+		return nil, err
+	}
+	return body, nil
+}
+
+func (b *EthAPIBackend) SubscribeNewTxsEvent(ch chan<- core.NewTxsEvent) event.Subscription {
+	return b.eth.txPool.SubscribeNewTxsEvent(ch)
+}
+
+func (b *EthAPIBackend) SubscribeChainHeadEvent(ch chan<- core.ChainHeadEvent) event.Subscription {
+	return b.eth.blockchain.SubscribeChainHeadEvent(ch)
+}
@@ -1,56 +1,163 @@
 package eth
 
 import (
+	"errors"
+
+	"myeth/consensus"
+	"myeth/consensus/ethash"
 	"myeth/core"
+	"myeth/eth/downloader"
+	"myeth/eth/filters"
+	"myeth/log"
 	"myeth/node"
 	"myeth/p2p"
+	"myeth/rpc"
 
 	"myeth/ethdb"
-
-	"github.com/ethereum/go-ethereum/params"
 )
 
+// LesServer is the light client server attached to a full node, kept as an
+// interface so that eth does not depend on les.
+type LesServer interface {
+	Start(srvr *p2p.Server)
+	Stop()
+	Protocols() []p2p.Protocol
+}
+
 type Ethereum struct {
+	config *Config
+
+	chainDb ethdb.Database // Block chain database
+
+	engine          consensus.Engine
+	blockchain      *core.BlockChain
+	txPool          *core.TxPool
 	protocolManager *ProtocolManager
+	lesServer       LesServer
+
+	APIBackend    *EthAPIBackend
+	netRPCService *PublicNetAPI
+}
+
+// AddLesServer attaches a light client server whose protocols are run along
+// with the eth ones.
+func (s *Ethereum) AddLesServer(ls LesServer) {
+	s.lesServer = ls
 }
 
 // New creates a new Ethereum object (including the
 // initialisation of the common Ethereum object)
-func New(ctx *node.ServiceContext) (*Ethereum, error) {
+func New(ctx *node.ServiceContext, config *Config) (*Ethereum, error) {
+	//轻节点由les包实现 不走这里
+	if config.SyncMode == downloader.LightSync {
+		return nil, errors.New("can't run eth.Ethereum in light sync mode, use les.LightEthereum")
+	}
 
 	chainDb, err := CreateDB(ctx, "chaindata")
 	if err != nil {
 		return nil, err
 	}
 
-	chainConfig, genesisHash, genesisErr := core.SetupGenesisBlock(chainDb)
-	if _, ok := genesisErr.(*params.ConfigCompatError); genesisErr != nil && !ok {
-		return nil, genesisErr
+	chainConfig, genesisHash, err := core.SetupGenesisBlock(chainDb, config.Genesis)
+	if err != nil {
+		chainDb.Close()
+		return nil, err
+	}
+	log.Info("Initialised chain configuration", "config", chainConfig, "genesis", genesisHash)
+
+	eth := &Ethereum{
+		config:  config,
+		chainDb: chainDb,
+		engine:  ethash.New(),
 	}
+	eth.APIBackend = &EthAPIBackend{eth}
 
-	eth := Ethereum{}
+	if eth.blockchain, err = core.NewBlockChain(chainDb, chainConfig, eth.engine); err != nil {
+		chainDb.Close()
+		return nil, err
+	}
+	eth.txPool = core.NewTxPool(config.TxPool, chainConfig, eth.blockchain)
 
-	if eth.protocolManager, err = NewProtocolManager(); err != nil {
+	if eth.protocolManager, err = NewProtocolManager(config.NetworkId, config.SyncMode, eth.engine, eth.blockchain, eth.txPool, chainDb); err != nil {
+		eth.txPool.Stop()
+		chainDb.Close()
 		return nil, err
 	}
 
-	return &eth, nil
+	return eth, nil
 }
 
 // Protocols implements node.Service, returning all the currently configured
 // network protocols to start.
 func (s *Ethereum) Protocols() []p2p.Protocol {
-	return s.protocolManager.SubProtocols
+	if s.lesServer == nil {
+		return s.protocolManager.SubProtocols
+	}
+	return append(s.protocolManager.SubProtocols, s.lesServer.Protocols()...)
+}
+
+// APIs implements node.Service, returning the collection of RPC services the
+// ethereum package offers.
+func (s *Ethereum) APIs() []rpc.API {
+	return []rpc.API{
+		{
+			Namespace: "eth",
+			Version:   "1.0",
+			Service:   NewPublicEthereumAPI(s),
+			Public:    true,
+		}, {
+			Namespace: "eth",
+			Version:   "1.0",
+			Service:   downloader.NewPublicDownloaderAPI(s.protocolManager.downloader),
+			Public:    true,
+		}, {
+			Namespace: "eth",
+			Version:   "1.0",
+			Service:   filters.NewPublicFilterAPI(s.APIBackend),
+			Public:    true,
+		}, {
+			Namespace: "net",
+			Version:   "1.0",
+			Service:   s.netRPCService,
+			Public:    true,
+		},
+	}
 }
 
+// Start implements node.Service, starting all internal goroutines needed by the
+// Ethereum protocol implementation.
 func (s *Ethereum) Start(server *p2p.Server) error {
+	// Start the RPC service
+	s.netRPCService = NewPublicNetAPI(server, s.config.NetworkId)
+
+	s.protocolManager.Start()
+	if s.lesServer != nil {
+		s.lesServer.Start(server)
+	}
 	return nil
 }
 
+// Stop implements node.Service, terminating all internal goroutines used by the
+// Ethereum protocol.
 func (s *Ethereum) Stop() error {
+	if s.lesServer != nil {
+		s.lesServer.Stop()
+	}
+	s.protocolManager.Stop()
+	s.txPool.Stop()
+	s.chainDb.Close()
 	return nil
 }
 
+// BlockChain returns the chain of the full node.
+func (s *Ethereum) BlockChain() *core.BlockChain { return s.blockchain }
+
+// TxPool returns the transaction pool of the full node.
+func (s *Ethereum) TxPool() *core.TxPool { return s.txPool }
+
+// ChainDb returns the chain database of the full node.
+func (s *Ethereum) ChainDb() ethdb.Database { return s.chainDb }
+
 // CreateDB creates the chain database.
 func CreateDB(ctx *node.ServiceContext, name string) (ethdb.Database, error) {
 	db, err := ctx.OpenDatabase(name, 1, 1)
@@ -1,4 +1,38 @@
 package eth
 
+import (
+	"myeth/core"
+	"myeth/eth/downloader"
+	"myeth/params"
+)
+
+// DefaultConfig contains default settings for use on the Ethereum main net.
+var DefaultConfig = Config{
+	SyncMode:   downloader.FastSync,
+	NetworkId:  1,
+	LightPeers: 100,
+	TxPool:     core.DefaultTxPoolConfig,
+}
+
 type Config struct {
+	// The genesis block, which is inserted if the database is empty.
+	// If nil, the Ethereum main net block is used.
+	Genesis *core.Genesis `toml:",omitempty"`
+
+	// Protocol options
+	// 网络ID 握手时不同网络的节点会被断开 主网是1
+	NetworkId uint64
+	// 同步模式 空链第一次同步用快速同步 之后都是全同步
+	SyncMode downloader.SyncMode
+
+	// Light client options
+	// LightServ为0表示全节点不给轻节点提供服务
+	LightServ  int `toml:",omitempty"` // Percentage of the default flow control recharge rate granted to LES clients
+	LightPeers int `toml:",omitempty"` // Maximum number of LES client peers
+
+	// Transaction pool options
+	TxPool core.TxPoolConfig
+
+	// Checkpoint is a trusted CHT root the light client starts syncing from.
+	Checkpoint *params.TrustedCheckpoint `toml:",omitempty"`
 }
@@ -0,0 +1,62 @@
+package downloader
+
+import (
+	"context"
+
+	"myeth/rpc"
+)
+
+// PublicDownloaderAPI provides an API which gives information about the current synchronisation status.
+// It offers only methods that operates on data that can be available to anyone without security risks.
+type PublicDownloaderAPI struct {
+	d *Downloader
+}
+
+// NewPublicDownloaderAPI create a new PublicDownloaderAPI.
+func NewPublicDownloaderAPI(d *Downloader) *PublicDownloaderAPI {
+	return &PublicDownloaderAPI{d: d}
+}
+
+// SyncingResult provides information about the current synchronisation status for this node.
+type SyncingResult struct {
+	Syncing bool         `json:"syncing"`
+	Status  SyncProgress `json:"status"`
+}
+
+// Syncing provides information when this nodes starts synchronising with the Ethereum network and when it's finished.
+// A sync start is reported with the current progress, a finished or failed sync with false.
+func (api *PublicDownloaderAPI) Syncing(ctx context.Context) (*rpc.Subscription, error) {
+	notifier, supported := rpc.NotifierFromContext(ctx)
+	if !supported {
+		return &rpc.Subscription{}, rpc.ErrNotificationsUnsupported
+	}
+
+	rpcSub := notifier.CreateSubscription()
+
+	go func() {
+		//同步事件由下载器的feed发出 每个订阅单独挂一个通道
+		events := make(chan *SyncEvent, 16)
+		sub := api.d.SubscribeSyncEvents(events)
+		defer sub.Unsubscribe()
+
+		for {
+			select {
+			case ev := <-events:
+				var status interface{}
+				switch ev.Type {
+				case SyncEventTypeStart:
+					status = &SyncingResult{Syncing: true, Status: api.d.Progress()}
+				case SyncEventTypeDone, SyncEventTypeFailed:
+					status = false
+				}
+				notifier.Notify(rpcSub.ID, status)
+			case <-rpcSub.Err():
+				return
+			case <-notifier.Closed():
+				return
+			}
+		}
+	}()
+
+	return rpcSub, nil
+}
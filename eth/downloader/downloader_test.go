@@ -0,0 +1,333 @@
+package downloader
+
+import (
+	"math/big"
+	"sync"
+	"testing"
+
+	"myeth/common"
+	"myeth/consensus/ethash"
+	"myeth/core"
+	"myeth/core/types"
+	"myeth/ethdb"
+	"myeth/params"
+)
+
+// Reduce some of the parameters to make the tester faster.
+func init() {
+	MaxForkAncestry = uint64(10000)
+}
+
+var (
+	testGspec   = &core.Genesis{Config: params.TestChainConfig}
+	testGenesis = testGspec.MustCommit(ethdb.NewMemDatabase())
+)
+
+// makeChain creates a chain of n blocks starting at and including parent. Every
+// third block contains a transaction so the bodies need to be fetched, seed
+// makes the chains built from the same parent differ.
+// 同步时不执行交易 交易不需要签名
+func makeChain(n int, seed byte, parent *types.Block) []*types.Block {
+	blocks := make([]*types.Block, n)
+	for i := 0; i < n; i++ {
+		header := &types.Header{
+			ParentHash: parent.Hash(),
+			Coinbase:   common.Address{seed},
+			Difficulty: params.GenesisDifficulty,
+			Number:     new(big.Int).Add(parent.Number(), common.Big1),
+			GasLimit:   parent.Header().GasLimit,
+			Time:       new(big.Int).Add(parent.Time(), big.NewInt(10)),
+		}
+		var txs []*types.Transaction
+		if i%3 == 0 {
+			txs = append(txs, types.NewTransaction(uint64(i), common.Address{seed}, big.NewInt(1000), 21000, big.NewInt(1), nil))
+		}
+		blocks[i] = types.NewBlock(header, txs, nil, nil)
+		parent = blocks[i]
+	}
+	return blocks
+}
+
+// newTestChain creates an in-memory block chain on top of the test genesis and
+// imports the given blocks into it.
+func newTestChain(t *testing.T, blocks []*types.Block) *core.BlockChain {
+	db := ethdb.NewMemDatabase()
+	testGspec.MustCommit(db)
+
+	chain, err := core.NewBlockChain(db, testGspec.Config, ethash.New())
+	if err != nil {
+		t.Fatalf("failed to create block chain: %v", err)
+	}
+	if len(blocks) > 0 {
+		if _, err := chain.InsertChain(blocks); err != nil {
+			t.Fatalf("failed to import blocks: %v", err)
+		}
+	}
+	return chain
+}
+
+// downloadTester is a test simulator for mocking out local block chain.
+type downloadTester struct {
+	downloader *Downloader
+	chain      *core.BlockChain // Local chain the downloader imports into
+
+	peers map[string]*downloadTesterPeer
+	lock  sync.RWMutex
+}
+
+// newTester creates a new downloader test mocker on top of a local chain.
+func newTester(t *testing.T, blocks []*types.Block) *downloadTester {
+	tester := &downloadTester{
+		chain: newTestChain(t, blocks),
+		peers: make(map[string]*downloadTesterPeer),
+	}
+	tester.downloader = New(FullSync, ethdb.NewMemDatabase(), tester.chain, tester.dropPeer)
+	return tester
+}
+
+// terminate aborts any operations on the embedded downloader and releases all
+// held resources.
+func (dl *downloadTester) terminate() {
+	dl.downloader.Terminate()
+}
+
+// sync starts synchronizing with a remote peer, blocking until it completes.
+func (dl *downloadTester) sync(id string) error {
+	dl.lock.RLock()
+	hash, td := dl.peers[id].Head()
+	dl.lock.RUnlock()
+
+	return dl.downloader.synchronise(id, hash, td, FullSync)
+}
+
+// newPeer registers a new block download source into the downloader.
+func (dl *downloadTester) newPeer(id string, version int, chain *core.BlockChain) error {
+	dl.lock.Lock()
+	defer dl.lock.Unlock()
+
+	peer := &downloadTesterPeer{dl: dl, id: id, chain: chain}
+	dl.peers[id] = peer
+	return dl.downloader.RegisterPeer(id, version, peer)
+}
+
+// dropPeer simulates a hard peer removal from the connection pool.
+func (dl *downloadTester) dropPeer(id string) {
+	dl.lock.Lock()
+	delete(dl.peers, id)
+	dl.lock.Unlock()
+
+	dl.downloader.UnregisterPeer(id)
+}
+
+// downloadTesterPeer serves the blocks of a remote chain to the downloader.
+type downloadTesterPeer struct {
+	dl    *downloadTester
+	id    string
+	chain *core.BlockChain
+
+	lock     sync.Mutex
+	requests int // Number of header requests served
+}
+
+// Head constructs a function to retrieve a peer's current head hash
+// and total difficulty.
+func (dlp *downloadTesterPeer) Head() (common.Hash, *big.Int) {
+	head := dlp.chain.CurrentBlock()
+	return head.Hash(), dlp.chain.GetTd(head.Hash(), head.NumberU64())
+}
+
+// RequestHeadersByHash constructs a GetBlockHeaders function based on a hashed
+// origin; associated with a particular peer in the download tester. The returned
+// function can be used to retrieve batches of headers from the particular peer.
+func (dlp *downloadTesterPeer) RequestHeadersByHash(origin common.Hash, amount int, skip int, reverse bool) error {
+	header := dlp.chain.GetHeaderByHash(origin)
+	if header == nil {
+		return dlp.dl.downloader.DeliverHeaders(dlp.id, nil)
+	}
+	return dlp.RequestHeadersByNumber(header.Number.Uint64(), amount, skip, reverse)
+}
+
+// RequestHeadersByNumber constructs a GetBlockHeaders function based on a numbered
+// origin; associated with a particular peer in the download tester. The returned
+// function can be used to retrieve batches of headers from the particular peer.
+func (dlp *downloadTesterPeer) RequestHeadersByNumber(origin uint64, amount int, skip int, reverse bool) error {
+	dlp.lock.Lock()
+	dlp.requests++
+	dlp.lock.Unlock()
+
+	headers := make([]*types.Header, 0, amount)
+	for len(headers) < amount {
+		header := dlp.chain.GetHeaderByNumber(origin)
+		if header == nil {
+			break
+		}
+		headers = append(headers, header)
+
+		if reverse {
+			if origin < uint64(skip)+1 {
+				break
+			}
+			origin -= uint64(skip) + 1
+		} else {
+			origin += uint64(skip) + 1
+		}
+	}
+	return dlp.dl.downloader.DeliverHeaders(dlp.id, headers)
+}
+
+// RequestBodies constructs a getBlockBodies method associated with a particular
+// peer in the download tester. The returned function can be used to retrieve
+// batches of block bodies from the particularly requested peer.
+func (dlp *downloadTesterPeer) RequestBodies(hashes []common.Hash) error {
+	var (
+		txs    [][]*types.Transaction
+		uncles [][]*types.Header
+	)
+	for _, hash := range hashes {
+		if block := dlp.chain.GetBlockByHash(hash); block != nil {
+			txs = append(txs, block.Transactions())
+			uncles = append(uncles, block.Uncles())
+		}
+	}
+	return dlp.dl.downloader.DeliverBodies(dlp.id, txs, uncles)
+}
+
+// RequestReceipts constructs a getReceipts method associated with a particular
+// peer in the download tester. The returned function can be used to retrieve
+// batches of block receipts from the particularly requested peer.
+func (dlp *downloadTesterPeer) RequestReceipts(hashes []common.Hash) error {
+	var receipts [][]*types.Receipt
+	for _, hash := range hashes {
+		receipts = append(receipts, dlp.chain.GetReceiptsByHash(hash))
+	}
+	return dlp.dl.downloader.DeliverReceipts(dlp.id, receipts)
+}
+
+// RequestNodeData constructs a getNodeData method associated with a particular
+// peer in the download tester. The returned function can be used to retrieve
+// batches of node state data from the particularly requested peer.
+func (dlp *downloadTesterPeer) RequestNodeData(hashes []common.Hash) error {
+	var results [][]byte
+	for _, hash := range hashes {
+		if data, err := dlp.chain.TrieNode(hash); err == nil {
+			results = append(results, data)
+		}
+	}
+	return dlp.dl.downloader.DeliverNodeData(dlp.id, results)
+}
+
+// assertOwnChain checks if the local chain contains the correct number of items
+// and that its head is the given block.
+func assertOwnChain(t *testing.T, tester *downloadTester, head *types.Block) {
+	if current := tester.chain.CurrentBlock(); current.Hash() != head.Hash() {
+		t.Fatalf("head block mismatch: have %d [%x], want %d [%x]", current.NumberU64(), current.Hash().Bytes()[:4], head.NumberU64(), head.Hash().Bytes()[:4])
+	}
+	for number := uint64(0); number <= head.NumberU64(); number++ {
+		if tester.chain.GetBlockByNumber(number) == nil {
+			t.Fatalf("block %d missing from the local chain", number)
+		}
+	}
+}
+
+// Tests that the common ancestor is found by the head header span if the chains
+// only diverge close to the local head, and by binary search if the fork is
+// deeper than that.
+func TestFindAncestor(t *testing.T) {
+	base := makeChain(3*MaxHeaderFetch, 0, testGenesis)
+
+	tests := []struct {
+		name     string
+		local    int    // Number of base blocks known locally
+		fork     int    // Number of base blocks shared by the remote chain
+		extra    int    // Number of remote blocks on top of the shared ones
+		ancestor uint64 // Expected common ancestor
+		searched bool   // Whether a binary search is needed
+	}{
+		{"remote ahead", 2 * MaxHeaderFetch, 3 * MaxHeaderFetch, 0, uint64(2 * MaxHeaderFetch), false},
+		{"remote behind", 2 * MaxHeaderFetch, MaxHeaderFetch, 0, uint64(MaxHeaderFetch), false},
+		// 头部附近的分叉只能定位到间隔16个块取的那些头上
+		{"shallow fork", 2 * MaxHeaderFetch, 2*MaxHeaderFetch - 10, MaxHeaderFetch, uint64(2*MaxHeaderFetch - 16), false},
+		{"deep fork", 2 * MaxHeaderFetch, MaxHeaderFetch / 2, 2 * MaxHeaderFetch, uint64(MaxHeaderFetch / 2), true},
+		{"genesis fork", 2 * MaxHeaderFetch, 0, 3 * MaxHeaderFetch, 0, true},
+		{"empty local", 0, 3 * MaxHeaderFetch, 0, 0, false},
+	}
+	for _, tt := range tests {
+		tester := newTester(t, base[:tt.local])
+
+		parent := testGenesis
+		if tt.fork > 0 {
+			parent = base[tt.fork-1]
+		}
+		remote := append(append([]*types.Block{}, base[:tt.fork]...), makeChain(tt.extra, 1, parent)...)
+		if err := tester.newPeer("peer", 63, newTestChain(t, remote)); err != nil {
+			t.Fatalf("%s: failed to register peer: %v", tt.name, err)
+		}
+		d := tester.downloader
+		d.cancelCh = make(chan struct{})
+
+		ancestor, err := d.findAncestor(d.peers.Peer("peer"), uint64(len(remote)))
+		if err != nil {
+			t.Fatalf("%s: failed to find ancestor: %v", tt.name, err)
+		}
+		if ancestor != tt.ancestor {
+			t.Errorf("%s: ancestor mismatch: have %d, want %d", tt.name, ancestor, tt.ancestor)
+		}
+		if searched := tester.peers["peer"].requests > 1; searched != tt.searched {
+			t.Errorf("%s: binary search mismatch: have %v, want %v", tt.name, searched, tt.searched)
+		}
+		tester.terminate()
+	}
+}
+
+// Tests that simple synchronization against a canonical chain works correctly.
+func TestCanonicalSynchronisation(t *testing.T) {
+	tester := newTester(t, nil)
+	defer tester.terminate()
+
+	// Create a chain long enough to need a header skeleton and a few body fetches
+	blocks := makeChain(2*MaxHeaderFetch+15, 0, testGenesis)
+	if err := tester.newPeer("peer", 63, newTestChain(t, blocks)); err != nil {
+		t.Fatalf("failed to register peer: %v", err)
+	}
+	if err := tester.sync("peer"); err != nil {
+		t.Fatalf("failed to synchronise blocks: %v", err)
+	}
+	assertOwnChain(t, tester, blocks[len(blocks)-1])
+}
+
+// Tests that synchronising against a heavier fork of the local chain finds the
+// fork point and switches over to the fork, while the old blocks stay known.
+func TestForkedSync(t *testing.T) {
+	tester := newTester(t, nil)
+	defer tester.terminate()
+
+	base := makeChain(MaxHeaderFetch+15, 0, testGenesis)
+	forkA := append(append([]*types.Block{}, base...), makeChain(80, 1, base[len(base)-1])...)
+	forkB := append(append([]*types.Block{}, base...), makeChain(90, 2, base[len(base)-1])...)
+
+	tester.newPeer("fork A", 63, newTestChain(t, forkA))
+	tester.newPeer("fork B", 63, newTestChain(t, forkB))
+
+	// Synchronise with the peer and make sure all blocks were retrieved
+	if err := tester.sync("fork A"); err != nil {
+		t.Fatalf("failed to synchronise blocks: %v", err)
+	}
+	assertOwnChain(t, tester, forkA[len(forkA)-1])
+
+	// Synchronise with the second peer and make sure that fork is pulled too
+	if err := tester.sync("fork B"); err != nil {
+		t.Fatalf("failed to synchronise blocks: %v", err)
+	}
+	assertOwnChain(t, tester, forkB[len(forkB)-1])
+
+	for _, block := range forkA[len(base):] {
+		if !tester.chain.HasBlock(block.Hash(), block.NumberU64()) {
+			t.Fatalf("side chain block %d missing", block.NumberU64())
+		}
+	}
+	// Synchronising with the lighter fork again must not switch back
+	if err := tester.sync("fork A"); err != nil {
+		t.Fatalf("failed to synchronise blocks: %v", err)
+	}
+	assertOwnChain(t, tester, forkB[len(forkB)-1])
+}
@@ -0,0 +1,34 @@
+package downloader
+
+// SyncEventType is the type of events emitted by the downloader
+type SyncEventType string
+
+const (
+	// SyncEventTypeStart is emitted when a synchronisation cycle begins
+	SyncEventTypeStart SyncEventType = "start"
+
+	// SyncEventTypeDone is emitted when a synchronisation cycle finished
+	// successfully
+	SyncEventTypeDone SyncEventType = "done"
+
+	// SyncEventTypeFailed is emitted when a synchronisation cycle was aborted
+	// with an error
+	SyncEventTypeFailed SyncEventType = "failed"
+)
+
+// SyncEvent is an event emitted when a synchronisation cycle starts or ends.
+// 矿工和rpc的syncing订阅都靠这个事件知道同步的状态
+type SyncEvent struct {
+	Type  SyncEventType `json:"type"`
+	Error string        `json:"error,omitempty"`
+}
+
+// SyncProgress gives progress indications when the node is synchronising with
+// the Ethereum network.
+type SyncProgress struct {
+	StartingBlock uint64 // Block number where sync began
+	CurrentBlock  uint64 // Current block number where sync is at
+	HighestBlock  uint64 // Highest alleged block number in the chain
+	PulledStates  uint64 // Number of state trie entries already downloaded
+	KnownStates   uint64 // Total number of state trie entries known about
+}
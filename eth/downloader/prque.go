@@ -0,0 +1,69 @@
+package downloader
+
+import "container/heap"
+
+// prque 优先级队列 优先级高的先出队
+// 任务按区块高度的相反数入队 这样低的区块先被下载
+type prque struct {
+	items []*prqueItem
+}
+
+type prqueItem struct {
+	value    interface{}
+	priority int64
+}
+
+func newPrque() *prque {
+	return new(prque)
+}
+
+// Push adds a value to the queue with the given priority.
+func (q *prque) Push(value interface{}, priority int64) {
+	heap.Push((*prqueHeap)(q), &prqueItem{value: value, priority: priority})
+}
+
+// Pop removes the highest priority item, returning it along with its priority.
+func (q *prque) Pop() (interface{}, int64) {
+	item := heap.Pop((*prqueHeap)(q)).(*prqueItem)
+	return item.value, item.priority
+}
+
+// PopItem removes the highest priority item, discarding its priority.
+func (q *prque) PopItem() interface{} {
+	value, _ := q.Pop()
+	return value
+}
+
+// Empty reports whether the queue holds no items.
+func (q *prque) Empty() bool {
+	return len(q.items) == 0
+}
+
+// Size returns the number of queued items.
+func (q *prque) Size() int {
+	return len(q.items)
+}
+
+// Reset drops all the queued items.
+func (q *prque) Reset() {
+	q.items = nil
+}
+
+// prqueHeap implements heap.Interface over the prque items.
+type prqueHeap prque
+
+func (h *prqueHeap) Len() int           { return len(h.items) }
+func (h *prqueHeap) Less(i, j int) bool { return h.items[i].priority > h.items[j].priority }
+func (h *prqueHeap) Swap(i, j int)      { h.items[i], h.items[j] = h.items[j], h.items[i] }
+
+func (h *prqueHeap) Push(x interface{}) {
+	h.items = append(h.items, x.(*prqueItem))
+}
+
+func (h *prqueHeap) Pop() interface{} {
+	n := len(h.items)
+	item := h.items[n-1]
+	h.items[n-1] = nil
+	h.items = h.items[:n-1]
+	return item
+}
@@ -0,0 +1,39 @@
+package fetcher
+
+import "container/heap"
+
+// injectQueue 等待导入的区块 按高度从低到高排列
+// 高度最低的先出队 这样父块总是比子块先被导入
+type injectQueue []*inject
+
+func (q injectQueue) Len() int           { return len(q) }
+func (q injectQueue) Less(i, j int) bool { return q[i].block.NumberU64() < q[j].block.NumberU64() }
+func (q injectQueue) Swap(i, j int)      { q[i], q[j] = q[j], q[i] }
+
+func (q *injectQueue) Push(x interface{}) {
+	*q = append(*q, x.(*inject))
+}
+
+func (q *injectQueue) Pop() interface{} {
+	old := *q
+	n := len(old)
+	x := old[n-1]
+	old[n-1] = nil
+	*q = old[:n-1]
+	return x
+}
+
+// push schedules an import operation.
+func (q *injectQueue) push(op *inject) {
+	heap.Push(q, op)
+}
+
+// pop removes the lowest block from the queue.
+func (q *injectQueue) pop() *inject {
+	return heap.Pop(q).(*inject)
+}
+
+// empty reports whether there are no queued imports.
+func (q *injectQueue) empty() bool {
+	return len(*q) == 0
+}
@@ -0,0 +1,391 @@
+// Package filters implements the event system behind the eth pub/sub
+// subscriptions: new chain heads, contract logs and pending transactions.
+package filters
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"time"
+
+	"myeth/common"
+	"myeth/core"
+	"myeth/core/types"
+	"myeth/event"
+	"myeth/log"
+	"myeth/rpc"
+)
+
+// Type determines the kind of filter and is used to put the filter in to
+// the correct bucket when added.
+type Type byte
+
+const (
+	// UnknownSubscription indicates an unknown subscription type
+	UnknownSubscription Type = iota
+	// LogsSubscription queries for logs of new chain heads
+	LogsSubscription
+	// PendingTransactionsSubscription queries tx hashes for pending
+	// transactions entering the pending state
+	PendingTransactionsSubscription
+	// BlocksSubscription queries headers of new chain heads
+	BlocksSubscription
+	// LastIndexSubscription keeps track of the last index
+	LastIndexSubscription
+)
+
+const (
+	// txChanSize is the size of channel listening to NewTxsEvent.
+	// The number is referenced from the size of tx pool.
+	txChanSize = 4096
+	// chainEvChanSize is the size of channel listening to ChainHeadEvent.
+	chainEvChanSize = 10
+	// logsChanSize is the size of channel receiving the retrieved logs of new heads.
+	logsChanSize = 10
+	// logsTimeout bounds the retrieval of the receipts of a new head, which
+	// may go to the network on light clients.
+	logsTimeout = 5 * time.Second
+)
+
+// Backend is the chain and transaction pool access the event system needs.
+type Backend interface {
+	// GetReceipts retrieves the receipts of the block with the given hash.
+	GetReceipts(ctx context.Context, hash common.Hash, number uint64) (types.Receipts, error)
+
+	// GetBody retrieves the transactions and uncles of the block with the given hash.
+	GetBody(ctx context.Context, hash common.Hash, number uint64) (*types.Body, error)
+
+	SubscribeNewTxsEvent(chan<- core.NewTxsEvent) event.Subscription
+	SubscribeChainHeadEvent(ch chan<- core.ChainHeadEvent) event.Subscription
+}
+
+type subscription struct {
+	id        rpc.ID
+	typ       Type
+	created   time.Time
+	logsCrit  FilterCriteria
+	logs      chan []*types.Log
+	hashes    chan []common.Hash
+	headers   chan *types.Header
+	installed chan struct{} // closed when the filter is installed
+	err       chan error    // closed when the filter is uninstalled
+	since     uint64        // number of chain heads seen before the filter was installed
+}
+
+// headLogs is a new chain head queued for log retrieval. Heads are numbered in
+// the order the event loop saw them, the logs are filled in by the retriever.
+type headLogs struct {
+	seq   uint64
+	block *types.Block
+	logs  []*types.Log
+}
+
+// EventSystem creates subscriptions, processes events and broadcasts them to the
+// subscription which match the subscription criteria.
+type EventSystem struct {
+	backend Backend
+
+	// Subscriptions
+	txsSub   event.Subscription // Subscription for new transaction event
+	chainSub event.Subscription // Subscription for new chain head event
+
+	// Channels
+	install    chan *subscription       // install filter for event notification
+	uninstall  chan *subscription       // remove filter for event notification
+	txsCh      chan core.NewTxsEvent    // Channel to receive new transactions event
+	chainCh    chan core.ChainHeadEvent // Channel to receive new chain head event
+	retrieveCh chan *headLogs           // Channel to hand new heads to the log retriever
+	logsCh     chan *headLogs           // Channel to receive the retrieved logs of new heads
+	quit       chan struct{}            // closed when the event loop terminates
+}
+
+// NewEventSystem creates a new manager that listens for the chain and transaction
+// pool events of the backend and forwards them to the installed subscriptions.
+// The work loop holds its own index that is used to forward events to filters,
+// it terminates when the backend closes its event subscriptions.
+func NewEventSystem(backend Backend) *EventSystem {
+	m := &EventSystem{
+		backend:    backend,
+		install:    make(chan *subscription),
+		uninstall:  make(chan *subscription),
+		txsCh:      make(chan core.NewTxsEvent, txChanSize),
+		chainCh:    make(chan core.ChainHeadEvent, chainEvChanSize),
+		retrieveCh: make(chan *headLogs),
+		logsCh:     make(chan *headLogs, logsChanSize),
+		quit:       make(chan struct{}),
+	}
+
+	// Subscribe events
+	m.txsSub = m.backend.SubscribeNewTxsEvent(m.txsCh)
+	m.chainSub = m.backend.SubscribeChainHeadEvent(m.chainCh)
+
+	go m.eventLoop()
+	go m.logsLoop()
+	return m
+}
+
+// Subscription is created when the client registers itself for a particular event.
+type Subscription struct {
+	ID        rpc.ID
+	f         *subscription
+	es        *EventSystem
+	unsubOnce sync.Once
+}
+
+// Err returns a channel that is closed when unsubscribed.
+func (sub *Subscription) Err() <-chan error {
+	return sub.f.err
+}
+
+// Unsubscribe uninstalls the subscription from the event broadcast loop.
+func (sub *Subscription) Unsubscribe() {
+	sub.unsubOnce.Do(func() {
+	uninstallLoop:
+		for {
+			// write uninstall request and consume logs/hashes. This prevents
+			// the eventLoop broadcast method to deadlock when writing to the
+			// filter event channel while the subscription loop is waiting for
+			// this method to return (and thus not reading these events).
+			select {
+			case sub.es.uninstall <- sub.f:
+				break uninstallLoop
+			case <-sub.f.logs:
+			case <-sub.f.hashes:
+			case <-sub.f.headers:
+			}
+		}
+
+		// wait for filter to be uninstalled in work loop before returning
+		// this ensures that the manager won't use the event channel which
+		// will probably be closed by the client asap after this method returns.
+		<-sub.Err()
+	})
+}
+
+// subscribe installs the subscription in the event broadcast loop.
+func (es *EventSystem) subscribe(sub *subscription) *Subscription {
+	es.install <- sub
+	<-sub.installed
+	return &Subscription{ID: sub.id, f: sub, es: es}
+}
+
+// SubscribeLogs creates a subscription that will write all logs of new chain
+// heads matching the given criteria to the given logs channel.
+func (es *EventSystem) SubscribeLogs(crit FilterCriteria, logs chan []*types.Log) *Subscription {
+	sub := &subscription{
+		id:        rpc.NewID(),
+		typ:       LogsSubscription,
+		logsCrit:  crit,
+		created:   time.Now(),
+		logs:      logs,
+		hashes:    make(chan []common.Hash),
+		headers:   make(chan *types.Header),
+		installed: make(chan struct{}),
+		err:       make(chan error),
+	}
+	return es.subscribe(sub)
+}
+
+// SubscribeNewHeads creates a subscription that writes the header of a block that is
+// imported in the chain.
+func (es *EventSystem) SubscribeNewHeads(headers chan *types.Header) *Subscription {
+	sub := &subscription{
+		id:        rpc.NewID(),
+		typ:       BlocksSubscription,
+		created:   time.Now(),
+		logs:      make(chan []*types.Log),
+		hashes:    make(chan []common.Hash),
+		headers:   headers,
+		installed: make(chan struct{}),
+		err:       make(chan error),
+	}
+	return es.subscribe(sub)
+}
+
+// SubscribePendingTxs creates a subscription that writes transaction hashes for
+// transactions that enter the transaction pool.
+func (es *EventSystem) SubscribePendingTxs(hashes chan []common.Hash) *Subscription {
+	sub := &subscription{
+		id:        rpc.NewID(),
+		typ:       PendingTransactionsSubscription,
+		created:   time.Now(),
+		logs:      make(chan []*types.Log),
+		hashes:    hashes,
+		headers:   make(chan *types.Header),
+		installed: make(chan struct{}),
+		err:       make(chan error),
+	}
+	return es.subscribe(sub)
+}
+
+type filterIndex map[Type]map[rpc.ID]*subscription
+
+// broadcast event to filters that match criteria.
+func (es *EventSystem) broadcast(filters filterIndex, ev interface{}) {
+	if ev == nil {
+		return
+	}
+
+	switch e := ev.(type) {
+	case core.NewTxsEvent:
+		hashes := make([]common.Hash, 0, len(e.Txs))
+		for _, tx := range e.Txs {
+			hashes = append(hashes, tx.Hash())
+		}
+		for _, f := range filters[PendingTransactionsSubscription] {
+			f.hashes <- hashes
+		}
+	case core.ChainHeadEvent:
+		for _, f := range filters[BlocksSubscription] {
+			f.headers <- e.Block.Header()
+		}
+	case *headLogs:
+		for _, f := range filters[LogsSubscription] {
+			//过滤器装上之前的区块日志不发给它
+			if f.since >= e.seq {
+				continue
+			}
+			if matchedLogs := filterLogs(e.logs, f.logsCrit.Addresses, f.logsCrit.Topics); len(matchedLogs) > 0 {
+				f.logs <- matchedLogs
+			}
+		}
+	}
+}
+
+// logsLoop retrieves the logs of the queued heads one at a time and hands them
+// back to the event loop for delivery, so a slow retrieval doesn't hold up the
+// other events and the logs are still delivered in chain order.
+func (es *EventSystem) logsLoop() {
+	for {
+		select {
+		case head := <-es.retrieveCh:
+			logs, err := es.blockLogs(head.block)
+			if err != nil {
+				log.Warn("Failed to retrieve logs of new head", "number", head.block.NumberU64(), "hash", head.block.Hash(), "err", err)
+				continue
+			}
+			if len(logs) == 0 {
+				continue
+			}
+			head.logs = logs
+			select {
+			case es.logsCh <- head:
+			case <-es.quit:
+				return
+			}
+
+		case <-es.quit:
+			return
+		}
+	}
+}
+
+// blockLogs retrieves the logs of the given block. Receipts only carry the
+// consensus fields of their logs, the derived ones are filled in from the
+// block and its transactions.
+func (es *EventSystem) blockLogs(block *types.Block) ([]*types.Log, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), logsTimeout)
+	defer cancel()
+
+	hash, number := block.Hash(), block.NumberU64()
+	receipts, err := es.backend.GetReceipts(ctx, hash, number)
+	if err != nil {
+		return nil, err
+	}
+	if len(receipts) == 0 {
+		return nil, nil
+	}
+	// Light clients announce header only blocks, fetch the body on demand
+	txs := block.Transactions()
+	if len(txs) != len(receipts) {
+		body, err := es.backend.GetBody(ctx, hash, number)
+		if err != nil {
+			return nil, err
+		}
+		txs = body.Transactions
+	}
+	if len(txs) != len(receipts) {
+		return nil, fmt.Errorf("transaction/receipt count mismatch: %d != %d", len(txs), len(receipts))
+	}
+
+	var (
+		logs     []*types.Log
+		logIndex uint
+	)
+	for i, receipt := range receipts {
+		for _, log := range receipt.Logs {
+			l := *log
+			l.BlockNumber = number
+			l.BlockHash = hash
+			l.TxHash = txs[i].Hash()
+			l.TxIndex = uint(i)
+			l.Index = logIndex
+			logIndex++
+
+			logs = append(logs, &l)
+		}
+	}
+	return logs, nil
+}
+
+// eventLoop (un)installs filters and processes mux events.
+func (es *EventSystem) eventLoop() {
+	// Ensure all subscriptions get cleaned up
+	defer func() {
+		es.txsSub.Unsubscribe()
+		es.chainSub.Unsubscribe()
+		close(es.quit)
+	}()
+
+	index := make(filterIndex)
+	for i := UnknownSubscription; i < LastIndexSubscription; i++ {
+		index[i] = make(map[rpc.ID]*subscription)
+	}
+
+	var (
+		heads   uint64      // Number of chain heads seen so far
+		pending []*headLogs // Heads waiting for their logs to be retrieved
+	)
+	for {
+		//有排队的区块才打开发给retriever的case 一次只交一个 保证日志按链的顺序回来
+		var (
+			retrieveCh chan *headLogs
+			next       *headLogs
+		)
+		if len(pending) > 0 {
+			retrieveCh, next = es.retrieveCh, pending[0]
+		}
+		select {
+		// Handle subscribed events
+		case ev := <-es.txsCh:
+			es.broadcast(index, ev)
+		case ev := <-es.chainCh:
+			heads++
+			es.broadcast(index, ev)
+
+			//没有日志订阅就不去取收据 轻节点上这要走网络
+			if len(index[LogsSubscription]) > 0 {
+				pending = append(pending, &headLogs{seq: heads, block: ev.Block})
+			}
+		case retrieveCh <- next:
+			pending = pending[1:]
+		case ev := <-es.logsCh:
+			es.broadcast(index, ev)
+
+		case f := <-es.install:
+			f.since = heads
+			index[f.typ][f.id] = f
+			close(f.installed)
+
+		case f := <-es.uninstall:
+			delete(index[f.typ], f.id)
+			close(f.err)
+
+		// System stopped
+		case <-es.txsSub.Err():
+			return
+		case <-es.chainSub.Err():
+			return
+		}
+	}
+}
@@ -0,0 +1,157 @@
+package filters
+
+import (
+	"context"
+	"math/big"
+	"sync"
+	"testing"
+	"time"
+
+	"myeth/common"
+	"myeth/core"
+	"myeth/core/types"
+	"myeth/event"
+)
+
+type testBackend struct {
+	txFeed    event.Feed
+	chainFeed event.Feed
+
+	mu       sync.Mutex
+	receipts map[common.Hash]types.Receipts
+	delays   map[common.Hash]time.Duration
+	gates    map[common.Hash]chan struct{}
+}
+
+func newTestBackend() *testBackend {
+	return &testBackend{
+		receipts: make(map[common.Hash]types.Receipts),
+		delays:   make(map[common.Hash]time.Duration),
+		gates:    make(map[common.Hash]chan struct{}),
+	}
+}
+
+func (b *testBackend) GetReceipts(ctx context.Context, hash common.Hash, number uint64) (types.Receipts, error) {
+	b.mu.Lock()
+	receipts, delay, gate := b.receipts[hash], b.delays[hash], b.gates[hash]
+	b.mu.Unlock()
+
+	time.Sleep(delay)
+	if gate != nil {
+		select {
+		case <-gate:
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+	}
+	return receipts, nil
+}
+
+func (b *testBackend) GetBody(ctx context.Context, hash common.Hash, number uint64) (*types.Body, error) {
+	return nil, nil
+}
+
+func (b *testBackend) SubscribeNewTxsEvent(ch chan<- core.NewTxsEvent) event.Subscription {
+	return b.txFeed.Subscribe(ch)
+}
+
+func (b *testBackend) SubscribeChainHeadEvent(ch chan<- core.ChainHeadEvent) event.Subscription {
+	return b.chainFeed.Subscribe(ch)
+}
+
+// makeBlock creates a block with a single transaction whose receipt carries a
+// single log, and registers the receipts with the backend.
+func (b *testBackend) makeBlock(number uint64) *types.Block {
+	var (
+		tx      = types.NewTransaction(number, common.Address{}, new(big.Int), 21000, new(big.Int), nil)
+		receipt = &types.Receipt{Logs: []*types.Log{{Address: common.Address{0x01}}}}
+		header  = &types.Header{Number: new(big.Int).SetUint64(number)}
+	)
+	block := types.NewBlock(header, []*types.Transaction{tx}, nil, []*types.Receipt{receipt})
+
+	b.mu.Lock()
+	b.receipts[block.Hash()] = types.Receipts{receipt}
+	b.mu.Unlock()
+	return block
+}
+
+func waitLogs(t *testing.T, ch chan []*types.Log) []*types.Log {
+	select {
+	case logs := <-ch:
+		return logs
+	case <-time.After(time.Second):
+		t.Fatal("timeout waiting for logs")
+		return nil
+	}
+}
+
+// TestLogsOrdered tests that the logs of new heads are delivered in chain order,
+// even if the retrieval of earlier heads takes longer than of later ones.
+func TestLogsOrdered(t *testing.T) {
+	var (
+		backend = newTestBackend()
+		es      = NewEventSystem(backend)
+		logs    = make(chan []*types.Log, 10)
+		sub     = es.SubscribeLogs(FilterCriteria{}, logs)
+	)
+	defer sub.Unsubscribe()
+
+	var blocks []*types.Block
+	for i := uint64(1); i <= 5; i++ {
+		block := backend.makeBlock(i)
+		backend.delays[block.Hash()] = time.Duration(6-i) * 20 * time.Millisecond
+		blocks = append(blocks, block)
+	}
+	for _, block := range blocks {
+		backend.chainFeed.Send(core.ChainHeadEvent{Block: block})
+	}
+	for i, block := range blocks {
+		have := waitLogs(t, logs)
+		if len(have) != 1 || have[0].BlockHash != block.Hash() {
+			t.Fatalf("logs %d: have block %d, want block %d", i, have[0].BlockNumber, block.NumberU64())
+		}
+	}
+}
+
+// TestLogsInstalledAfterHead tests that a logs subscription installed while the
+// logs of an earlier head are still being retrieved doesn't receive them.
+func TestLogsInstalledAfterHead(t *testing.T) {
+	var (
+		backend = newTestBackend()
+		es      = NewEventSystem(backend)
+
+		headers  = make(chan *types.Header, 10)
+		headsSub = es.SubscribeNewHeads(headers)
+		logs1    = make(chan []*types.Log, 10)
+		sub1     = es.SubscribeLogs(FilterCriteria{}, logs1)
+	)
+	defer headsSub.Unsubscribe()
+	defer sub1.Unsubscribe()
+
+	block1, block2 := backend.makeBlock(1), backend.makeBlock(2)
+	gate := make(chan struct{})
+	backend.gates[block1.Hash()] = gate
+
+	// Announce the first head and wait until the event loop has processed it
+	backend.chainFeed.Send(core.ChainHeadEvent{Block: block1})
+	select {
+	case <-headers:
+	case <-time.After(time.Second):
+		t.Fatal("timeout waiting for the first head")
+	}
+	logs2 := make(chan []*types.Log, 10)
+	sub2 := es.SubscribeLogs(FilterCriteria{}, logs2)
+	defer sub2.Unsubscribe()
+
+	close(gate)
+	backend.chainFeed.Send(core.ChainHeadEvent{Block: block2})
+
+	for _, block := range []*types.Block{block1, block2} {
+		if have := waitLogs(t, logs1); have[0].BlockHash != block.Hash() {
+			t.Fatalf("first subscription: have block %d, want block %d", have[0].BlockNumber, block.NumberU64())
+		}
+	}
+	if have := waitLogs(t, logs2); have[0].BlockHash != block2.Hash() {
+		t.Fatalf("second subscription: have block %d, want block %d", have[0].BlockNumber, block2.NumberU64())
+	}
+}
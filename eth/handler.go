@@ -1,21 +1,189 @@
 package eth
 
-import "myeth/p2p"
+import (
+	"math"
+	"math/big"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"myeth/common"
+	"myeth/consensus"
+	"myeth/core"
+	"myeth/core/forkid"
+	"myeth/core/types"
+	"myeth/eth/downloader"
+	"myeth/eth/fetcher"
+	"myeth/ethdb"
+	"myeth/event"
+	"myeth/log"
+	"myeth/p2p"
+	"myeth/params"
+	"myeth/rlp"
+)
+
+const (
+	softResponseLimit = 2 * 1024 * 1024 // Target maximum size of returned blocks, headers or node data.
+	estHeaderRlpSize  = 500             // Approximate size of an RLP encoded block header
+
+	// txChanSize is the size of channel listening to NewTxsEvent.
+	// The number is referenced from the size of tx pool.
+	txChanSize = 4096
+)
+
+// blockChain is the part of the local chain the protocol manager works with.
+// 协议层只通过这个接口访问本地的链
+type blockChain interface {
+	// Config retrieves the chain's fork configuration.
+	Config() *params.ChainConfig
+
+	// Genesis retrieves the chain's genesis block.
+	Genesis() *types.Block
+
+	// CurrentBlock retrieves the current head block of the canonical chain.
+	CurrentBlock() *types.Block
+
+	// GetTd retrieves a block's total difficulty in the canonical chain from the
+	// database by hash and number.
+	GetTd(hash common.Hash, number uint64) *big.Int
+
+	// CurrentHeader retrieves the current head header of the canonical chain.
+	CurrentHeader() *types.Header
+
+	// CurrentFastBlock retrieves the current fast-sync head block of the canonical
+	// chain.
+	CurrentFastBlock() *types.Block
+
+	// GetBlock retrieves a block from the database by hash and number.
+	GetBlock(hash common.Hash, number uint64) *types.Block
+
+	// GetBlockByHash retrieves a block from the database by hash.
+	GetBlockByHash(hash common.Hash) *types.Block
+
+	// HasBlock checks if a block is fully present in the database or not.
+	HasBlock(hash common.Hash, number uint64) bool
+
+	// HasHeader checks if a block header is present in the database or not.
+	HasHeader(hash common.Hash, number uint64) bool
+
+	// GetHeader retrieves a block header from the database by hash and number.
+	GetHeader(hash common.Hash, number uint64) *types.Header
+
+	// GetHeaderByHash retrieves a block header from the database by hash.
+	GetHeaderByHash(hash common.Hash) *types.Header
+
+	// GetHeaderByNumber retrieves a block header from the database by number,
+	// caching it (associated with its hash) if found.
+	GetHeaderByNumber(number uint64) *types.Header
+
+	// GetBodyRLP retrieves a block body in RLP encoding from the database by hash.
+	GetBodyRLP(hash common.Hash) rlp.RawValue
+
+	// GetReceiptsByHash retrieves the receipts for all transactions in a given block.
+	GetReceiptsByHash(hash common.Hash) types.Receipts
+
+	// TrieNode retrieves a blob of data associated with a trie node (or code hash)
+	// either from ephemeral in-memory cache, or from persistent storage.
+	// 链的实现里就是trie.Database.Node
+	TrieNode(hash common.Hash) ([]byte, error)
+
+	// InsertChain attempts to insert the given batch of blocks in to the canonical
+	// chain or, otherwise, create a fork. It returns the index of the failing
+	// block along with the error.
+	InsertChain(chain types.Blocks) (int, error)
+
+	// InsertHeaderChain attempts to insert the given header chain in to the local
+	// chain, possibly creating a reorg. The checkFreq parameter sets how many of
+	// the headers get their seals verified.
+	InsertHeaderChain(chain []*types.Header, checkFreq int) (int, error)
+
+	// InsertReceiptChain attempts to complete an already existing header chain with
+	// transaction and receipt data, without executing the transactions.
+	InsertReceiptChain(blockChain types.Blocks, receiptChain []types.Receipts) (int, error)
+
+	// Rollback is designed to remove a chain of links from the database that aren't
+	// certain enough to be valid.
+	Rollback(chain []common.Hash)
+
+	// FastSyncCommitHead sets the current head block to the one defined by the hash
+	// irrelevant what the chain contents were prior.
+	FastSyncCommitHead(hash common.Hash) error
+
+	// SubscribeChainHeadEvent registers a subscription of ChainHeadEvent.
+	// les服务端靠它给轻节点广播新的链头
+	SubscribeChainHeadEvent(ch chan<- core.ChainHeadEvent) event.Subscription
+}
+
+// txPool is the part of the transaction pool the protocol manager works with.
+// 交易池 收到的远端交易放进去 新交易从它的事件里拿到再广播出去
+type txPool interface {
+	// AddRemotes should add the given transactions to the pool.
+	AddRemotes([]*types.Transaction) []error
+
+	// Pending should return pending transactions.
+	// The slice should be modifiable by the caller.
+	Pending() (map[common.Address]types.Transactions, error)
+
+	// SubscribeNewTxsEvent should return an event subscription of
+	// NewTxsEvent and send events to the given channel.
+	SubscribeNewTxsEvent(chan<- core.NewTxsEvent) event.Subscription
+}
 
 // Official short name of the protocol used during capability negotiation.
 
 type ProtocolManager struct {
+	networkID  uint64
+	forkFilter forkid.Filter // Fork ID filter, constant across the lifetime of the node
+
+	fastSync  uint32 // Flag whether fast sync is enabled (gets disabled if we already have blocks)
+	acceptTxs uint32 // Flag whether we're considered synchronised (enables transaction processing)
+
+	blockchain blockChain
+	chaindb    ethdb.Database
+	txpool     txPool
+	peers      *peerSet
+	downloader *downloader.Downloader
+	fetcher    *fetcher.Fetcher
+
 	SubProtocols []p2p.Protocol
 
+	txsCh  chan core.NewTxsEvent
+	txsSub event.Subscription
+
+	// channels for fetcher, syncer, txsyncLoop
 	newPeerCh chan *peer
+	txsyncCh  chan *txsync
 	quitSync  chan struct{}
+
+	// wait group is used for graceful shutdowns during downloading
+	// and processing
+	wg sync.WaitGroup
 }
 
 // NewProtocolManager returns a new Ethereum sub protocol manager. The Ethereum sub protocol manages peers capable
 // with the Ethereum network.
-func NewProtocolManager() (*ProtocolManager, error) {
+func NewProtocolManager(networkID uint64, mode downloader.SyncMode, engine consensus.Engine, blockchain blockChain, txpool txPool, chaindb ethdb.Database) (*ProtocolManager, error) {
 	// Create the protocol manager with the base fields
-	manager := &ProtocolManager{}
+	manager := &ProtocolManager{
+		networkID:  networkID,
+		forkFilter: forkid.NewFilter(blockchain.Config(), blockchain.Genesis().Hash(), func() uint64 { return blockchain.CurrentHeader().Number.Uint64() }),
+		blockchain: blockchain,
+		chaindb:    chaindb,
+		txpool:     txpool,
+		peers:      newPeerSet(),
+		newPeerCh:  make(chan *peer),
+		txsyncCh:   make(chan *txsync),
+		quitSync:   make(chan struct{}),
+	}
+	// Figure out whether to allow fast sync or not
+	//本地已经有区块了 就不能再用快速同步 否则状态会不一致
+	if mode == downloader.FastSync && blockchain.CurrentBlock().NumberU64() > 0 {
+		log.Warn("Blockchain not empty, fast sync disabled")
+		mode = downloader.FullSync
+	}
+	if mode == downloader.FastSync {
+		manager.fastSync = uint32(1)
+	}
 
 	//支持几套版本的协议 来创建几个protocol
 	manager.SubProtocols = make([]p2p.Protocol, 0, len(ProtocolVersions))
@@ -30,19 +198,125 @@ func NewProtocolManager() (*ProtocolManager, error) {
 			Run: func(p *p2p.Peer, rw p2p.MsgReadWriter) error {
 				//创建一个上层peer
 				peer := newPeer(int(version), p, rw)
-				return manager.handle(peer)
+				//syncer没有运行之前不接受新的节点
+				select {
+				case manager.newPeerCh <- peer:
+					manager.wg.Add(1)
+					defer manager.wg.Done()
+					return manager.handle(peer)
+				case <-manager.quitSync:
+					return p2p.DiscQuitting
+				}
 			},
 		})
 	}
+
+	// Construct the different synchronisation mechanisms
+	manager.downloader = downloader.New(mode, chaindb, blockchain, manager.removePeer)
+
+	//fetcher 根据新区块的hash通知去拉取区块 校验之后导入本地链
+	validator := func(header *types.Header) error {
+		return engine.VerifyHeader(blockchain, header, true)
+	}
+	heighter := func() uint64 {
+		return blockchain.CurrentBlock().NumberU64()
+	}
+	inserter := func(blocks types.Blocks) (int, error) {
+		// If fast sync is running, deny importing weird blocks
+		if atomic.LoadUint32(&manager.fastSync) == 1 {
+			log.Warn("Discarded bad propagated block", "number", blocks[0].Number(), "hash", blocks[0].Hash())
+			return 0, nil
+		}
+		atomic.StoreUint32(&manager.acceptTxs, 1) // Mark initial sync done on any fetcher import
+		return manager.blockchain.InsertChain(blocks)
+	}
+	manager.fetcher = fetcher.New(blockchain.GetBlockByHash, validator, manager.BroadcastBlock, heighter, inserter, manager.removePeer)
+
 	return manager, nil
 }
 
+func (pm *ProtocolManager) removePeer(id string) {
+	// Short circuit if the peer was already removed
+	peer := pm.peers.Peer(id)
+	if peer == nil {
+		return
+	}
+	log.Debug("Removing Ethereum peer", "peer", id)
+
+	// Unregister the peer from the downloader and Ethereum peer set
+	pm.downloader.UnregisterPeer(id)
+	if err := pm.peers.Unregister(id); err != nil {
+		log.Error("Peer removal failed", "peer", id, "err", err)
+	}
+	// Hard disconnect at the networking layer
+	peer.Peer.Disconnect(p2p.DiscUselessPeer)
+}
+
+// Start launches the transaction broadcast and sync loops.
+func (pm *ProtocolManager) Start() {
+	// broadcast transactions
+	pm.txsCh = make(chan core.NewTxsEvent, txChanSize)
+	pm.txsSub = pm.txpool.SubscribeNewTxsEvent(pm.txsCh)
+	go pm.txBroadcastLoop()
+
+	// start sync handlers
+	go pm.syncer()
+	go pm.txsyncLoop()
+}
+
+// Stop terminates the broadcast loops and disconnects all peers.
+func (pm *ProtocolManager) Stop() {
+	log.Info("Stopping Ethereum protocol")
+
+	pm.txsSub.Unsubscribe() // quits txBroadcastLoop
+
+	// Quit the sync loop.
+	// After this send has completed, no new peers will be accepted.
+	// The syncer stops the fetcher and terminates the downloader on its way out.
+	close(pm.quitSync)
+
+	// Disconnect existing sessions.
+	// This also closes the gate for any new registrations on the peer set.
+	// sessions which are already established but not added to pm.peers yet
+	// will exit when they try to register.
+	pm.peers.Close()
+
+	// Wait for all peer handler goroutines and the loops to come down.
+	pm.wg.Wait()
+
+	log.Info("Ethereum protocol stopped")
+}
+
 //每个p2p peer的生命周期函数 当退出时 peer就断开了
 func (pm *ProtocolManager) handle(p *peer) error {
-
 	//要执行一下 以太坊的握手协议 主要判断测试网 版本 创世块
+	var (
+		genesis = pm.blockchain.Genesis()
+		head    = pm.blockchain.CurrentBlock()
+		hash    = head.Hash()
+		number  = head.NumberU64()
+		td      = pm.blockchain.GetTd(hash, number)
+	)
+	forkID := forkid.NewID(pm.blockchain.Config(), genesis.Hash(), number)
+	if err := p.Handshake(pm.networkID, td, hash, genesis.Hash(), forkID, pm.forkFilter); err != nil {
+		log.Debug("Ethereum handshake failed", "peer", p, "err", err)
+		return err
+	}
 
+	// Register the peer in the downloader. If the downloader considers it banned, we disconnect
+	//先注册到downloader 这样peerSet发出注册事件的时候这个节点已经可以用来同步了
+	if err := pm.downloader.RegisterPeer(p.id, p.version, p); err != nil {
+		return err
+	}
+	// Register the peer locally
+	if err := pm.peers.Register(p); err != nil {
+		log.Error("Ethereum peer registration failed", "peer", p, "err", err)
+		pm.downloader.UnregisterPeer(p.id)
+		return err
+	}
+	defer pm.removePeer(p.id)
 	//同步本节点现在的交易池交易 同步给 这个节点
+	pm.syncTransactions(p)
 
 	//主循环 处理消息
 	for {
@@ -50,8 +324,6 @@ func (pm *ProtocolManager) handle(p *peer) error {
 			return err
 		}
 	}
-
-	return nil
 }
 
 //handleMsg 处理远端节点发来的入站消息
@@ -61,13 +333,320 @@ func (pm *ProtocolManager) handleMsg(p *peer) error {
 	if err != nil {
 		return err
 	}
+	if msg.Size > ProtocolMaxMsgSize {
+		return errResp(ErrMsgTooLarge, "%v > %v", msg.Size, ProtocolMaxMsgSize)
+	}
+	//消息处理完之后 把没有读完的payload丢掉 不然底层的读循环会被卡住
+	defer msg.Discard()
 
-	//不知道这有什么作用
-	//defer msg.Discard()
 	//针对不同的msg code做不同的处理
 	switch {
+	case msg.Code == StatusMsg:
+		// Status messages should never arrive after the handshake
+		return errResp(ErrExtraStatusMsg, "uncontrolled status message")
+
+	// Block header query, collect the requested headers and reply
 	case msg.Code == GetBlockHeadersMsg:
+		// Decode the complex header query
+		var query getBlockHeadersData
+		if err := msg.Decode(&query); err != nil {
+			return errResp(ErrDecode, "%v: %v", msg, err)
+		}
+		// Gather headers until the fetch or network limits is reached
+		amount := query.Amount
+		if amount > uint64(downloader.MaxHeaderFetch) {
+			amount = uint64(downloader.MaxHeaderFetch)
+		}
+		headers := QueryHeaders(pm.blockchain, pm.chaindb, query.Origin.Hash, query.Origin.Number, amount, query.Skip, query.Reverse)
+		return p.SendBlockHeaders(headers)
+
+	case msg.Code == BlockHeadersMsg:
+		// A batch of headers arrived to one of our previous requests
+		var headers []*types.Header
+		if err := msg.Decode(&headers); err != nil {
+			return errResp(ErrDecode, "msg %v: %v", msg, err)
+		}
+		// Filter out any explicitly requested headers, deliver the rest to the downloader
+		//fetcher每次只请求一个头 只有单个头的回复才可能是它要的
+		filter := len(headers) == 1
+		if filter {
+			headers = pm.fetcher.FilterHeaders(p.id, headers, time.Now())
+		}
+		if len(headers) > 0 || !filter {
+			err := pm.downloader.DeliverHeaders(p.id, headers)
+			if err != nil {
+				log.Debug("Failed to deliver headers", "err", err)
+			}
+		}
+
+	case msg.Code == GetBlockBodiesMsg:
+		// Decode the retrieval message
+		msgStream := rlp.NewStream(msg.Payload, uint64(msg.Size))
+		if _, err := msgStream.List(); err != nil {
+			return err
+		}
+		// Gather blocks until the fetch or network limits is reached
+		var (
+			hash   common.Hash
+			bytes  int
+			bodies []rlp.RawValue
+		)
+		for bytes < softResponseLimit && len(bodies) < downloader.MaxBlockFetch {
+			// Retrieve the hash of the next block
+			if err := msgStream.Decode(&hash); err == rlp.EOL {
+				break
+			} else if err != nil {
+				return errResp(ErrDecode, "msg %v: %v", msg, err)
+			}
+			// Retrieve the requested block body, stopping if enough was found
+			if data := pm.blockchain.GetBodyRLP(hash); len(data) != 0 {
+				bodies = append(bodies, data)
+				bytes += len(data)
+			}
+		}
+		return p.SendBlockBodiesRLP(bodies)
+
+	case msg.Code == BlockBodiesMsg:
+		// A batch of block bodies arrived to one of our previous requests
+		var request blockBodiesData
+		if err := msg.Decode(&request); err != nil {
+			return errResp(ErrDecode, "msg %v: %v", msg, err)
+		}
+		// Deliver them all to the downloader for queuing
+		transactions := make([][]*types.Transaction, len(request))
+		uncles := make([][]*types.Header, len(request))
+
+		for i, body := range request {
+			transactions[i] = body.Transactions
+			uncles[i] = body.Uncles
+		}
+		// Filter out any explicitly requested bodies, deliver the rest to the downloader
+		filter := len(transactions) > 0 || len(uncles) > 0
+		if filter {
+			transactions, uncles = pm.fetcher.FilterBodies(p.id, transactions, uncles, time.Now())
+		}
+		if len(transactions) > 0 || len(uncles) > 0 || !filter {
+			err := pm.downloader.DeliverBodies(p.id, transactions, uncles)
+			if err != nil {
+				log.Debug("Failed to deliver bodies", "err", err)
+			}
+		}
+
+	case p.version >= eth63 && msg.Code == GetNodeDataMsg:
+		// Decode the retrieval message
+		msgStream := rlp.NewStream(msg.Payload, uint64(msg.Size))
+		if _, err := msgStream.List(); err != nil {
+			return err
+		}
+		// Gather state data until the fetch or network limits is reached
+		var (
+			hash  common.Hash
+			bytes int
+			data  [][]byte
+		)
+		for bytes < softResponseLimit && len(data) < downloader.MaxStateFetch {
+			// Retrieve the hash of the next state entry
+			if err := msgStream.Decode(&hash); err == rlp.EOL {
+				break
+			} else if err != nil {
+				return errResp(ErrDecode, "msg %v: %v", msg, err)
+			}
+			// Retrieve the requested state entry, stopping if enough was found
+			if entry, err := pm.blockchain.TrieNode(hash); err == nil {
+				data = append(data, entry)
+				bytes += len(entry)
+			}
+		}
+		return p.SendNodeData(data)
+
+	case p.version >= eth63 && msg.Code == NodeDataMsg:
+		// A batch of node state data arrived to one of our previous requests
+		var data [][]byte
+		if err := msg.Decode(&data); err != nil {
+			return errResp(ErrDecode, "msg %v: %v", msg, err)
+		}
+		// Deliver all to the downloader
+		if err := pm.downloader.DeliverNodeData(p.id, data); err != nil {
+			log.Debug("Failed to deliver node state data", "err", err)
+		}
 
+	case p.version >= eth63 && msg.Code == GetReceiptsMsg:
+		// Decode the retrieval message
+		msgStream := rlp.NewStream(msg.Payload, uint64(msg.Size))
+		if _, err := msgStream.List(); err != nil {
+			return err
+		}
+		// Gather state data until the fetch or network limits is reached
+		var (
+			hash     common.Hash
+			bytes    int
+			receipts []rlp.RawValue
+		)
+		for bytes < softResponseLimit && len(receipts) < downloader.MaxReceiptFetch {
+			// Retrieve the hash of the next block
+			if err := msgStream.Decode(&hash); err == rlp.EOL {
+				break
+			} else if err != nil {
+				return errResp(ErrDecode, "msg %v: %v", msg, err)
+			}
+			// Retrieve the requested block's receipts, skipping if unknown to us
+			results := pm.blockchain.GetReceiptsByHash(hash)
+			if results == nil {
+				//没有交易的区块收据本来就是空的 也要回复一个空列表
+				if header := pm.blockchain.GetHeaderByHash(hash); header == nil || header.ReceiptHash != types.EmptyRootHash {
+					continue
+				}
+			}
+			// If known, encode and queue for response packet
+			if encoded, err := rlp.EncodeToBytes(results); err != nil {
+				log.Error("Failed to encode receipt", "err", err)
+			} else {
+				receipts = append(receipts, encoded)
+				bytes += len(encoded)
+			}
+		}
+		return p.SendReceiptsRLP(receipts)
+
+	case p.version >= eth63 && msg.Code == ReceiptsMsg:
+		// A batch of receipts arrived to one of our previous requests
+		var receipts [][]*types.Receipt
+		if err := msg.Decode(&receipts); err != nil {
+			return errResp(ErrDecode, "msg %v: %v", msg, err)
+		}
+		// Deliver all to the downloader
+		if err := pm.downloader.DeliverReceipts(p.id, receipts); err != nil {
+			log.Debug("Failed to deliver receipts", "err", err)
+		}
+
+	case msg.Code == NewBlockHashesMsg:
+		var announces newBlockHashesData
+		if err := msg.Decode(&announces); err != nil {
+			return errResp(ErrDecode, "%v: %v", msg, err)
+		}
+		// Mark the hashes as present at the remote node
+		for _, block := range announces {
+			p.MarkBlock(block.Hash)
+		}
+		// Schedule all the unknown hashes for retrieval
+		unknown := make(newBlockHashesData, 0, len(announces))
+		for _, block := range announces {
+			if !pm.blockchain.HasBlock(block.Hash, block.Number) {
+				unknown = append(unknown, block)
+			}
+		}
+		for _, block := range unknown {
+			pm.fetcher.Notify(p.id, block.Hash, block.Number, time.Now(), p.RequestOneHeader, p.RequestBodies)
+		}
+
+	case msg.Code == NewBlockMsg:
+		// Retrieve and decode the propagated block
+		var request newBlockData
+		if err := msg.Decode(&request); err != nil {
+			return errResp(ErrDecode, "%v: %v", msg, err)
+		}
+		request.Block.ReceivedAt = msg.ReceivedAt
+		request.Block.ReceivedFrom = p
+
+		// Mark the peer as owning the block and schedule it for import
+		p.MarkBlock(request.Block.Hash())
+		pm.fetcher.Enqueue(p.id, request.Block)
+
+		// Assuming the block is importable by the peer, but possibly not yet done so,
+		// calculate the head hash and TD that the peer truly must have.
+		var (
+			trueHead = request.Block.ParentHash()
+			trueTD   = new(big.Int).Sub(request.TD, request.Block.Difficulty())
+		)
+		// Update the peers total difficulty if better than the previous
+		if _, td := p.Head(); trueTD.Cmp(td) > 0 {
+			p.SetHead(trueHead, trueTD)
+		}
+
+	case msg.Code == TxMsg:
+		// Transactions arrived, make sure we have a valid and fresh chain to handle them
+		//还没同步完的时候本地状态是旧的 没法校验交易 直接忽略
+		if atomic.LoadUint32(&pm.acceptTxs) == 0 {
+			break
+		}
+		// Transactions can be processed, parse all of them and deliver to the pool
+		var txs []*types.Transaction
+		if err := msg.Decode(&txs); err != nil {
+			return errResp(ErrDecode, "msg %v: %v", msg, err)
+		}
+		for i, tx := range txs {
+			// Validate and mark the remote transaction
+			if tx == nil {
+				return errResp(ErrDecode, "transaction %d is nil", i)
+			}
+			p.MarkTransaction(tx.Hash())
+		}
+		pm.txpool.AddRemotes(txs)
+
+	default:
+		return errResp(ErrInvalidMsgCode, "%v", msg.Code)
 	}
 	return nil
 }
+
+// BroadcastBlock will either propagate a block to a subset of it's peers, or
+// will only announce it's availability (depending what's requested).
+func (pm *ProtocolManager) BroadcastBlock(block *types.Block, propagate bool) {
+	hash := block.Hash()
+	peers := pm.peers.PeersWithoutBlock(hash)
+
+	// If propagation is requested, send to a subset of the peer
+	if propagate {
+		// Calculate the TD of the block (it's not imported yet, so block.Td is not valid)
+		var td *big.Int
+		if parent := pm.blockchain.GetBlock(block.ParentHash(), block.NumberU64()-1); parent != nil {
+			td = new(big.Int).Add(block.Difficulty(), pm.blockchain.GetTd(block.ParentHash(), block.NumberU64()-1))
+		} else {
+			log.Error("Propagating dangling block", "number", block.Number(), "hash", hash)
+			return
+		}
+		// Send the block to a subset of our peers
+		//只把完整区块发给平方根个节点 其他的节点靠hash通知再来拉取
+		transfer := peers[:int(math.Sqrt(float64(len(peers))))]
+		for _, peer := range transfer {
+			peer.AsyncSendNewBlock(block, td)
+		}
+		return
+	}
+	// Otherwise if the block is indeed in out own chain, announce it
+	if pm.blockchain.HasBlock(hash, block.NumberU64()) {
+		for _, peer := range peers {
+			peer.AsyncSendNewBlockHash(block)
+		}
+	}
+}
+
+// BroadcastTxs will propagate a batch of transactions to all peers which are not known to
+// already have the given transaction.
+func (pm *ProtocolManager) BroadcastTxs(txs types.Transactions) {
+	var txset = make(map[*peer]types.Transactions)
+
+	// Broadcast transactions to a batch of peers not knowing about it
+	for _, tx := range txs {
+		peers := pm.peers.PeersWithoutTx(tx.Hash())
+		for _, peer := range peers {
+			txset[peer] = append(txset[peer], tx)
+		}
+	}
+	for peer, txs := range txset {
+		peer.AsyncSendTransactions(txs)
+	}
+}
+
+//交易池里的新交易 广播给还不知道的节点
+func (pm *ProtocolManager) txBroadcastLoop() {
+	for {
+		select {
+		case event := <-pm.txsCh:
+			pm.BroadcastTxs(event.Txs)
+
+		// Err() channel will be closed when unsubscribing.
+		case <-pm.txsSub.Err():
+			return
+		}
+	}
+}
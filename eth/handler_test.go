@@ -0,0 +1,300 @@
+package eth
+
+import (
+	"math"
+	"testing"
+
+	"myeth/common"
+	"myeth/core/types"
+	"myeth/crypto"
+	"myeth/eth/downloader"
+	"myeth/ethdb"
+	"myeth/p2p"
+	"myeth/trie"
+)
+
+// Tests that block headers can be retrieved from a remote chain based on user queries.
+func TestGetBlockHeaders63(t *testing.T) { testGetBlockHeaders(t, eth63) }
+func TestGetBlockHeaders64(t *testing.T) { testGetBlockHeaders(t, eth64) }
+
+func testGetBlockHeaders(t *testing.T, protocol int) {
+	pm, _ := newTestProtocolManagerMust(t, downloader.FullSync, downloader.MaxHashFetch+15, nil)
+	peer, _ := newTestPeer(t, "peer", protocol, pm, true)
+	defer peer.close()
+
+	// Create a "random" unknown hash for testing
+	var unknown common.Hash
+	for i := range unknown {
+		unknown[i] = byte(i)
+	}
+	var (
+		limit   = uint64(downloader.MaxHeaderFetch)
+		current = pm.blockchain.CurrentBlock().NumberU64()
+		hash    = func(number uint64) common.Hash { return pm.blockchain.GetHeaderByNumber(number).Hash() }
+	)
+	// The headers counting down from the head, up to the protocol limit
+	var limited []common.Hash
+	for i := uint64(0); i < limit; i++ {
+		limited = append(limited, hash(current-1-i))
+	}
+	// Create a batch of tests for various scenarios
+	tests := []struct {
+		query  *getBlockHeadersData // The query to execute for header retrieval
+		expect []common.Hash        // The hashes of the block whose headers are expected
+	}{
+		// A single random block should be retrievable by hash and number too
+		{
+			&getBlockHeadersData{Origin: hashOrNumber{Hash: hash(limit / 2)}, Amount: 1},
+			[]common.Hash{hash(limit / 2)},
+		}, {
+			&getBlockHeadersData{Origin: hashOrNumber{Number: limit / 2}, Amount: 1},
+			[]common.Hash{hash(limit / 2)},
+		},
+		// Multiple headers should be retrievable in both directions
+		{
+			&getBlockHeadersData{Origin: hashOrNumber{Number: limit / 2}, Amount: 3},
+			[]common.Hash{hash(limit / 2), hash(limit/2 + 1), hash(limit/2 + 2)},
+		}, {
+			&getBlockHeadersData{Origin: hashOrNumber{Number: limit / 2}, Amount: 3, Reverse: true},
+			[]common.Hash{hash(limit / 2), hash(limit/2 - 1), hash(limit/2 - 2)},
+		},
+		// Multiple headers with skip lists should be retrievable
+		{
+			&getBlockHeadersData{Origin: hashOrNumber{Number: limit / 2}, Skip: 3, Amount: 3},
+			[]common.Hash{hash(limit / 2), hash(limit/2 + 4), hash(limit/2 + 8)},
+		}, {
+			&getBlockHeadersData{Origin: hashOrNumber{Number: limit / 2}, Skip: 3, Amount: 3, Reverse: true},
+			[]common.Hash{hash(limit / 2), hash(limit/2 - 4), hash(limit/2 - 8)},
+		},
+		// The chain endpoints should be retrievable
+		{
+			&getBlockHeadersData{Origin: hashOrNumber{Number: 0}, Amount: 1},
+			[]common.Hash{hash(0)},
+		}, {
+			&getBlockHeadersData{Origin: hashOrNumber{Number: current}, Amount: 1},
+			[]common.Hash{hash(current)},
+		},
+		// Ensure protocol limits are honored
+		{
+			&getBlockHeadersData{Origin: hashOrNumber{Number: current - 1}, Amount: limit + 10, Reverse: true},
+			limited,
+		},
+		// Check that requesting more than available is handled gracefully
+		{
+			&getBlockHeadersData{Origin: hashOrNumber{Number: current - 4}, Skip: 3, Amount: 3},
+			[]common.Hash{hash(current - 4), hash(current)},
+		}, {
+			&getBlockHeadersData{Origin: hashOrNumber{Number: 4}, Skip: 3, Amount: 3, Reverse: true},
+			[]common.Hash{hash(4), hash(0)},
+		},
+		// Check that requesting more than available is handled gracefully, even if mid skip
+		{
+			&getBlockHeadersData{Origin: hashOrNumber{Number: current - 4}, Skip: 2, Amount: 3},
+			[]common.Hash{hash(current - 4), hash(current - 1)},
+		}, {
+			&getBlockHeadersData{Origin: hashOrNumber{Number: 4}, Skip: 2, Amount: 3, Reverse: true},
+			[]common.Hash{hash(4), hash(1)},
+		},
+		// Check a corner case where requesting more can iterate past the endpoints
+		{
+			&getBlockHeadersData{Origin: hashOrNumber{Number: 2}, Amount: 5, Reverse: true},
+			[]common.Hash{hash(2), hash(1), hash(0)},
+		},
+		// Check a corner case where skipping overflow loops back into the chain start
+		{
+			&getBlockHeadersData{Origin: hashOrNumber{Hash: hash(3)}, Amount: 2, Reverse: false, Skip: math.MaxUint64 - 1},
+			[]common.Hash{hash(3)},
+		},
+		// Check a corner case where skipping overflow loops back to the same header
+		{
+			&getBlockHeadersData{Origin: hashOrNumber{Hash: hash(1)}, Amount: 2, Reverse: false, Skip: math.MaxUint64},
+			[]common.Hash{hash(1)},
+		},
+		// Check that non existing headers aren't returned
+		{
+			&getBlockHeadersData{Origin: hashOrNumber{Hash: unknown}, Amount: 1},
+			[]common.Hash{},
+		}, {
+			&getBlockHeadersData{Origin: hashOrNumber{Number: current + 1}, Amount: 1},
+			[]common.Hash{},
+		},
+	}
+	// Run each of the tests and verify the results against the chain
+	for i, tt := range tests {
+		// Collect the headers to expect in the response
+		headers := []*types.Header{}
+		for _, hash := range tt.expect {
+			headers = append(headers, pm.blockchain.GetHeaderByHash(hash))
+		}
+		// Send the hash request and verify the response
+		p2p.Send(peer.app, GetBlockHeadersMsg, tt.query)
+		if err := p2p.ExpectMsg(peer.app, BlockHeadersMsg, headers); err != nil {
+			t.Errorf("test %d: headers mismatch: %v", i, err)
+		}
+		// If the test used number origins, repeat with hashes as the too
+		if tt.query.Origin.Hash == (common.Hash{}) {
+			if origin := pm.blockchain.GetHeaderByNumber(tt.query.Origin.Number); origin != nil {
+				tt.query.Origin.Hash, tt.query.Origin.Number = origin.Hash(), 0
+
+				p2p.Send(peer.app, GetBlockHeadersMsg, tt.query)
+				if err := p2p.ExpectMsg(peer.app, BlockHeadersMsg, headers); err != nil {
+					t.Errorf("test %d: headers mismatch: %v", i, err)
+				}
+			}
+		}
+	}
+}
+
+// Tests that hash based header queries starting on a side chain stop once they
+// walked MaxNonCanonical headers off the canonical chain, while canonical ones
+// are resolved regardless of the skip.
+func TestGetBlockHeadersNonCanonical(t *testing.T) {
+	pm, _ := newTestProtocolManagerMust(t, downloader.FullSync, 200, nil)
+	peer, _ := newTestPeer(t, "peer", eth63, pm, true)
+	defer peer.close()
+
+	// Create a side chain branching off at block 10 and staying behind the canonical one
+	parent := pm.blockchain.GetHeaderByNumber(10)
+	fork, _ := makeChain(150, 1, pm.blockchain.GetBlock(parent.Hash(), 10))
+	if _, err := pm.blockchain.InsertChain(fork); err != nil {
+		t.Fatalf("failed to insert side chain: %v", err)
+	}
+	if head := pm.blockchain.CurrentBlock().NumberU64(); head != 200 {
+		t.Fatalf("side chain became canonical: head %d", head)
+	}
+	var (
+		side      = func(number uint64) common.Hash { return fork[number-11].Hash() }
+		canonical = func(number uint64) common.Hash { return pm.blockchain.GetHeaderByNumber(number).Hash() }
+	)
+	tests := []struct {
+		query  *getBlockHeadersData // The query to execute for header retrieval
+		expect []common.Hash        // The hashes of the block whose headers are expected
+	}{
+		// Consecutive side chain headers are read one by one, outside the budget
+		{
+			&getBlockHeadersData{Origin: hashOrNumber{Hash: side(160)}, Amount: 3, Reverse: true},
+			[]common.Hash{side(160), side(159), side(158)},
+		},
+		// Skipping walks the side chain until the budget shared by the query runs out
+		{
+			&getBlockHeadersData{Origin: hashOrNumber{Hash: side(160)}, Skip: 49, Amount: 4, Reverse: true},
+			[]common.Hash{side(160), side(110), side(60)},
+		},
+		// A single skip reaching further than the budget isn't served
+		{
+			&getBlockHeadersData{Origin: hashOrNumber{Hash: side(160)}, Skip: 149, Amount: 2, Reverse: true},
+			[]common.Hash{side(160)},
+		},
+		// The same skip on the canonical chain is resolved through the index
+		{
+			&getBlockHeadersData{Origin: hashOrNumber{Hash: canonical(160)}, Skip: 149, Amount: 2, Reverse: true},
+			[]common.Hash{canonical(160), canonical(10)},
+		},
+		// Walking forward from a side chain doesn't cross over to the canonical one
+		{
+			&getBlockHeadersData{Origin: hashOrNumber{Hash: side(50)}, Skip: 9, Amount: 2},
+			[]common.Hash{side(50)},
+		},
+	}
+	for i, tt := range tests {
+		headers := []*types.Header{}
+		for _, hash := range tt.expect {
+			headers = append(headers, pm.blockchain.GetHeaderByHash(hash))
+		}
+		p2p.Send(peer.app, GetBlockHeadersMsg, tt.query)
+		if err := p2p.ExpectMsg(peer.app, BlockHeadersMsg, headers); err != nil {
+			t.Fatalf("test %d: headers mismatch: %v", i, err)
+		}
+	}
+}
+
+// Tests that the node state database can be retrieved based on hashes.
+func TestGetNodeData63(t *testing.T) {
+	pm, db := newTestProtocolManagerMust(t, downloader.FullSync, 4, nil)
+	peer, _ := newTestPeer(t, "peer", eth63, pm, true)
+	defer peer.close()
+
+	// Collect the hashes of all the nodes of the genesis state
+	root := pm.blockchain.Genesis().Root()
+	state, err := trie.NewSecure(root, trie.NewDatabase(db), 0)
+	if err != nil {
+		t.Fatalf("failed to open genesis state: %v", err)
+	}
+	hashes := []common.Hash{}
+	for it := state.NodeIterator(nil); it.Next(true); {
+		if hash := it.Hash(); hash != (common.Hash{}) {
+			hashes = append(hashes, hash)
+		}
+	}
+	if len(hashes) < 2 {
+		t.Fatalf("genesis state too small: %d nodes", len(hashes))
+	}
+	p2p.Send(peer.app, GetNodeDataMsg, hashes)
+	msg, err := peer.app.ReadMsg()
+	if err != nil {
+		t.Fatalf("failed to read node data response: %v", err)
+	}
+	if msg.Code != NodeDataMsg {
+		t.Fatalf("response packet code mismatch: have %x, want %x", msg.Code, NodeDataMsg)
+	}
+	var data [][]byte
+	if err := msg.Decode(&data); err != nil {
+		t.Fatalf("failed to decode response node data: %v", err)
+	}
+	if len(data) != len(hashes) {
+		t.Fatalf("node data count mismatch: have %d, want %d", len(data), len(hashes))
+	}
+	// Verify that all hashes correspond to the requested data, and reconstruct a state tree
+	for i, want := range hashes {
+		if hash := crypto.Keccak256Hash(data[i]); hash != want {
+			t.Errorf("data hash mismatch: have %x, want %x", hash, want)
+		}
+	}
+	statedb := ethdb.NewMemDatabase()
+	for i := 0; i < len(data); i++ {
+		statedb.Put(hashes[i].Bytes(), data[i])
+	}
+	// Sanity check that the accounts can be read from the retrieved nodes
+	rebuilt, err := trie.NewSecure(root, trie.NewDatabase(statedb), 0)
+	if err != nil {
+		t.Fatalf("failed to open reconstructed state: %v", err)
+	}
+	accounts := []common.Address{testBank}
+	for i := byte(1); i <= 16; i++ {
+		accounts = append(accounts, common.Address{i})
+	}
+	for _, addr := range accounts {
+		want, _ := state.TryGet(addr.Bytes())
+		have, err := rebuilt.TryGet(addr.Bytes())
+		if err != nil {
+			t.Fatalf("account %x: failed to read from reconstructed state: %v", addr, err)
+		}
+		if len(want) == 0 || string(have) != string(want) {
+			t.Errorf("account %x: mismatch: have %x, want %x", addr, have, want)
+		}
+	}
+}
+
+// Tests that the transaction receipts can be retrieved based on hashes.
+func TestGetReceipt63(t *testing.T) {
+	pm, _ := newTestProtocolManagerMust(t, downloader.FullSync, 4, nil)
+	peer, _ := newTestPeer(t, "peer", eth63, pm, true)
+	defer peer.close()
+
+	// Collect the hashes to request, and the response to expect
+	hashes, receipts := []common.Hash{}, []types.Receipts{}
+	for i := uint64(0); i <= pm.blockchain.CurrentBlock().NumberU64(); i++ {
+		hash := pm.blockchain.GetHeaderByNumber(i).Hash()
+
+		hashes = append(hashes, hash)
+		receipts = append(receipts, pm.blockchain.GetReceiptsByHash(hash))
+	}
+	// Unknown blocks are skipped in the response
+	hashes = append(hashes, common.Hash{0x01})
+
+	// Send the hash request and verify the response
+	p2p.Send(peer.app, GetReceiptsMsg, hashes)
+	if err := p2p.ExpectMsg(peer.app, ReceiptsMsg, receipts); err != nil {
+		t.Fatalf("receipts mismatch: %v", err)
+	}
+}
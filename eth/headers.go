@@ -0,0 +1,129 @@
+package eth
+
+import (
+	"myeth/common"
+	"myeth/core/rawdb"
+	"myeth/core/types"
+)
+
+// MaxNonCanonical is the number of headers a single header query may walk
+// off the canonical chain. Canonical headers are found with one lookup no
+// matter how far apart they are, so this keeps the cost of a query
+// independent of its Skip.
+const MaxNonCanonical = 100
+
+// HeaderReader is the chain access needed to answer header queries.
+type HeaderReader interface {
+	// GetHeader retrieves a block header by hash and number.
+	GetHeader(hash common.Hash, number uint64) *types.Header
+
+	// GetHeaderByHash retrieves a block header by hash.
+	GetHeaderByHash(hash common.Hash) *types.Header
+
+	// GetHeaderByNumber retrieves a canonical block header by number.
+	GetHeaderByNumber(number uint64) *types.Header
+}
+
+// QueryHeaders collects the headers of a GetBlockHeaders query starting at the
+// given origin, which is a hash if non-zero and a number otherwise. It stops
+// after amount headers, softResponseLimit bytes or at the first header that
+// is not available. Both eth and les serve header queries through it.
+func QueryHeaders(chain HeaderReader, db rawdb.DatabaseReader, hash common.Hash, number, amount, skip uint64, reverse bool) []*types.Header {
+	var (
+		hashMode        = hash != (common.Hash{})
+		maxNonCanonical = uint64(MaxNonCanonical)
+
+		bytes   common.StorageSize
+		headers []*types.Header
+		unknown bool
+	)
+	for !unknown && uint64(len(headers)) < amount && bytes < softResponseLimit {
+		// Retrieve the next header satisfying the query
+		var origin *types.Header
+		if hashMode {
+			origin = chain.GetHeaderByHash(hash)
+		} else {
+			origin = chain.GetHeaderByNumber(number)
+		}
+		if origin == nil {
+			break
+		}
+		headers = append(headers, origin)
+		bytes += estHeaderRlpSize
+
+		// Advance to the next header of the query
+		switch {
+		case hashMode && reverse:
+			// Hash based traversal towards the genesis block
+			hash, _ = ancestor(chain, db, hash, origin.Number.Uint64(), skip+1, &maxNonCanonical)
+			unknown = hash == (common.Hash{})
+
+		case hashMode && !reverse:
+			// Hash based traversal towards the leaf block
+			var (
+				current = origin.Number.Uint64()
+				next    = current + skip + 1
+			)
+			if next <= current {
+				//skip太大导致溢出 这是攻击行为
+				unknown = true
+			} else if header := chain.GetHeaderByNumber(next); header != nil {
+				//只有往回走Skip+1步能回到起点 才说明这个头在同一条链上
+				nextHash := header.Hash()
+				if expOldHash, _ := ancestor(chain, db, nextHash, next, skip+1, &maxNonCanonical); expOldHash == hash {
+					hash = nextHash
+				} else {
+					unknown = true
+				}
+			} else {
+				unknown = true
+			}
+
+		case reverse:
+			// Number based traversal towards the genesis block
+			if number >= skip+1 {
+				number -= skip + 1
+			} else {
+				unknown = true
+			}
+
+		default:
+			// Number based traversal towards the leaf block
+			number += skip + 1
+		}
+	}
+	return headers
+}
+
+// ancestor returns the hash and number of the header the given number of
+// steps before the given one, or the zero hash if it can't be found. Headers
+// on the canonical chain are resolved directly through the canonical index,
+// otherwise the parents are followed while maxNonCanonical allows.
+func ancestor(chain HeaderReader, db rawdb.DatabaseReader, hash common.Hash, number, steps uint64, maxNonCanonical *uint64) (common.Hash, uint64) {
+	if steps > number {
+		return common.Hash{}, 0
+	}
+	if steps == 1 {
+		// in this case it is cheaper to just read the header
+		if header := chain.GetHeader(hash, number); header != nil {
+			return header.ParentHash, number - 1
+		}
+		return common.Hash{}, 0
+	}
+	for steps != 0 {
+		if rawdb.ReadCanonicalHash(db, number) == hash {
+			return rawdb.ReadCanonicalHash(db, number-steps), number - steps
+		}
+		if *maxNonCanonical == 0 {
+			return common.Hash{}, 0
+		}
+		*maxNonCanonical--
+
+		header := chain.GetHeader(hash, number)
+		if header == nil {
+			return common.Hash{}, 0
+		}
+		hash, number, steps = header.ParentHash, number-1, steps-1
+	}
+	return hash, number
+}
@@ -0,0 +1,232 @@
+// This file contains some shared testing functionality, common to multiple
+// different files and modules being tested.
+
+package eth
+
+import (
+	"crypto/rand"
+	"math/big"
+	"sort"
+	"sync"
+	"testing"
+
+	"myeth/common"
+	"myeth/consensus/ethash"
+	"myeth/core"
+	"myeth/core/forkid"
+	"myeth/core/types"
+	"myeth/crypto"
+	"myeth/eth/downloader"
+	"myeth/ethdb"
+	"myeth/event"
+	"myeth/p2p"
+	"myeth/p2p/discover"
+	"myeth/params"
+)
+
+var (
+	testBankKey, _ = crypto.HexToECDSA("b71c71a67e1177ad4e901695e1b4b9ee17ae16c6668d313eac2f96dbcda3f291")
+	testBank       = crypto.PubkeyToAddress(testBankKey.PublicKey)
+	testBankFunds  = big.NewInt(1000000000)
+)
+
+// makeChain creates a chain of n blocks on top of parent. Every block carries a
+// transfer from the test bank with its receipt, seed makes the chains built
+// from the same parent differ.
+// 没有EVM 收据是直接构造的 不是执行交易得到的
+func makeChain(n int, seed byte, parent *types.Block) ([]*types.Block, []types.Receipts) {
+	var (
+		signer   = types.NewEIP155Signer(params.TestChainConfig.ChainID)
+		blocks   = make([]*types.Block, n)
+		receipts = make([]types.Receipts, n)
+	)
+	for i := 0; i < n; i++ {
+		header := &types.Header{
+			ParentHash: parent.Hash(),
+			Coinbase:   common.Address{seed},
+			Difficulty: params.GenesisDifficulty,
+			Number:     new(big.Int).Add(parent.Number(), common.Big1),
+			GasLimit:   parent.Header().GasLimit,
+			Time:       new(big.Int).Add(parent.Time(), big.NewInt(10)),
+		}
+		tx, _ := types.SignTx(types.NewTransaction(parent.NumberU64(), common.Address{seed}, big.NewInt(1000), 21000, big.NewInt(1), nil), signer, testBankKey)
+		receipt := &types.Receipt{Status: types.ReceiptStatusSuccessful, CumulativeGasUsed: 21000, TxHash: tx.Hash(), GasUsed: 21000}
+
+		blocks[i] = types.NewBlock(header, []*types.Transaction{tx}, nil, []*types.Receipt{receipt})
+		receipts[i] = types.Receipts{receipt}
+		parent = blocks[i]
+	}
+	return blocks, receipts
+}
+
+// newTestProtocolManager creates a new protocol manager for testing purposes,
+// with the given number of blocks already known, and potential notification
+// channels for different events.
+func newTestProtocolManager(mode downloader.SyncMode, blocks int, newtx chan<- []*types.Transaction) (*ProtocolManager, *ethdb.MemDatabase, error) {
+	var (
+		db    = ethdb.NewMemDatabase()
+		gspec = &core.Genesis{
+			Config: params.TestChainConfig,
+			Alloc:  core.GenesisAlloc{testBank: {Balance: testBankFunds}},
+		}
+	)
+	// A few more accounts give the genesis state a real trie to serve
+	for i := byte(1); i <= 16; i++ {
+		gspec.Alloc[common.Address{i}] = core.GenesisAccount{Balance: big.NewInt(int64(i))}
+	}
+	genesis := gspec.MustCommit(db)
+
+	blockchain, err := core.NewBlockChain(db, gspec.Config, ethash.New())
+	if err != nil {
+		return nil, nil, err
+	}
+	chain, receipts := makeChain(blocks, 0, genesis)
+	if _, err := blockchain.InsertChain(chain); err != nil {
+		return nil, nil, err
+	}
+	if _, err := blockchain.InsertReceiptChain(chain, receipts); err != nil {
+		return nil, nil, err
+	}
+	pm, err := NewProtocolManager(DefaultConfig.NetworkId, mode, ethash.New(), blockchain, &testTxPool{added: newtx}, db)
+	if err != nil {
+		return nil, nil, err
+	}
+	pm.Start()
+	return pm, db, nil
+}
+
+// newTestProtocolManagerMust creates a new protocol manager for testing purposes,
+// with the given number of blocks already known, and potential notification
+// channels for different events. In case of an error, the constructor force-
+// fails the test.
+func newTestProtocolManagerMust(t *testing.T, mode downloader.SyncMode, blocks int, newtx chan<- []*types.Transaction) (*ProtocolManager, *ethdb.MemDatabase) {
+	pm, db, err := newTestProtocolManager(mode, blocks, newtx)
+	if err != nil {
+		t.Fatalf("Failed to create protocol manager: %v", err)
+	}
+	return pm, db
+}
+
+// testTxPool is a fake, helper transaction pool for testing purposes
+type testTxPool struct {
+	txFeed event.Feed
+	pool   []*types.Transaction        // Collection of all transactions
+	added  chan<- []*types.Transaction // Notification channel for new transactions
+
+	lock sync.RWMutex // Protects the transaction pool
+}
+
+// AddRemotes appends a batch of transactions to the pool, and notifies any
+// listeners if the addition channel is non nil
+func (p *testTxPool) AddRemotes(txs []*types.Transaction) []error {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+
+	p.pool = append(p.pool, txs...)
+	if p.added != nil {
+		p.added <- txs
+	}
+	return make([]error, len(txs))
+}
+
+// Pending returns all the transactions known to the pool
+func (p *testTxPool) Pending() (map[common.Address]types.Transactions, error) {
+	p.lock.RLock()
+	defer p.lock.RUnlock()
+
+	batches := make(map[common.Address]types.Transactions)
+	for _, tx := range p.pool {
+		from, _ := types.Sender(types.HomesteadSigner{}, tx)
+		batches[from] = append(batches[from], tx)
+	}
+	for _, batch := range batches {
+		sort.Slice(batch, func(i, j int) bool { return batch[i].Nonce() < batch[j].Nonce() })
+	}
+	return batches, nil
+}
+
+func (p *testTxPool) SubscribeNewTxsEvent(ch chan<- core.NewTxsEvent) event.Subscription {
+	return p.txFeed.Subscribe(ch)
+}
+
+// testPeer is a simulated peer to allow testing direct network calls.
+type testPeer struct {
+	net p2p.MsgReadWriter // Network layer reader/writer to simulate remote messaging
+	app *p2p.MsgPipeRW    // Application layer reader/writer to simulate the local side
+	*peer
+}
+
+// newTestPeer creates a new peer registered at the given protocol manager.
+func newTestPeer(t *testing.T, name string, version int, pm *ProtocolManager, shake bool) (*testPeer, <-chan error) {
+	// Create a message pipe to communicate through
+	app, net := p2p.MsgPipe()
+
+	// Generate a random id and create the peer
+	var id discover.NodeID
+	rand.Read(id[:])
+
+	peer := newPeer(version, p2p.NewPeer(id, name, nil), net)
+
+	// Start the peer on a new thread
+	errc := make(chan error, 1)
+	go func() {
+		select {
+		case pm.newPeerCh <- peer:
+			errc <- pm.handle(peer)
+		case <-pm.quitSync:
+			errc <- p2p.DiscQuitting
+		}
+	}()
+	tp := &testPeer{app: app, net: net, peer: peer}
+
+	// Execute any implicitly requested handshakes and return
+	if shake {
+		var (
+			genesis = pm.blockchain.Genesis()
+			head    = pm.blockchain.CurrentBlock()
+			td      = pm.blockchain.GetTd(head.Hash(), head.NumberU64())
+		)
+		forkID := forkid.NewID(pm.blockchain.Config(), genesis.Hash(), head.NumberU64())
+		tp.handshake(t, td, head.Hash(), genesis.Hash(), forkID)
+	}
+	return tp, errc
+}
+
+// handshake simulates a trivial handshake that expects the same state from the
+// remote side as we are simulating locally.
+func (p *testPeer) handshake(t *testing.T, td *big.Int, head common.Hash, genesis common.Hash, forkID forkid.ID) {
+	var msg interface{}
+	switch {
+	case p.version == eth63:
+		msg = &statusData{
+			ProtocolVersion: uint32(p.version),
+			NetworkId:       DefaultConfig.NetworkId,
+			TD:              td,
+			CurrentBlock:    head,
+			GenesisBlock:    genesis,
+		}
+	case p.version == eth64:
+		msg = &statusData64{
+			ProtocolVersion: uint32(p.version),
+			NetworkID:       DefaultConfig.NetworkId,
+			TD:              td,
+			Head:            head,
+			Genesis:         genesis,
+			ForkID:          forkID,
+		}
+	default:
+		t.Fatalf("unsupported eth protocol version: %d", p.version)
+	}
+	if err := p2p.ExpectMsg(p.app, StatusMsg, msg); err != nil {
+		t.Fatalf("status recv: %v", err)
+	}
+	if err := p2p.Send(p.app, StatusMsg, msg); err != nil {
+		t.Fatalf("status send: %v", err)
+	}
+}
+
+// close terminates the local side of the peer, notifying the remote protocol
+// manager of termination.
+func (p *testPeer) close() {
+	p.app.Close()
+}
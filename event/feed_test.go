@@ -0,0 +1,85 @@
+package event
+
+import (
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestFeed(t *testing.T) {
+	var feed Feed
+	var done, subscribed sync.WaitGroup
+	subscriber := func(i int) {
+		defer done.Done()
+
+		subchan := make(chan int)
+		sub := feed.Subscribe(subchan)
+		timeout := time.NewTimer(2 * time.Second)
+		subscribed.Done()
+
+		select {
+		case v := <-subchan:
+			if v != 1 {
+				t.Errorf("%d: received value %d, want 1", i, v)
+			}
+		case <-timeout.C:
+			t.Errorf("%d: receive timeout", i)
+		}
+
+		sub.Unsubscribe()
+		select {
+		case _, ok := <-sub.Err():
+			if ok {
+				t.Errorf("%d: error channel not closed after unsubscribe", i)
+			}
+		case <-timeout.C:
+			t.Errorf("%d: unsubscribe timeout", i)
+		}
+	}
+
+	const n = 100
+	done.Add(n)
+	subscribed.Add(n)
+	for i := 0; i < n; i++ {
+		go subscriber(i)
+	}
+	subscribed.Wait()
+	if nsent := feed.Send(1); nsent != n {
+		t.Errorf("first send delivered %d times, want %d", nsent, n)
+	}
+	if nsent := feed.Send(2); nsent != 0 {
+		t.Errorf("second send delivered %d times, want 0", nsent)
+	}
+	done.Wait()
+}
+
+func TestFeedUnsubscribeBlockedSend(t *testing.T) {
+	var feed Feed
+	ch := make(chan int)
+	sub := feed.Subscribe(ch)
+
+	// 没有人接收 Send会一直阻塞 直到订阅被取消
+	sent := make(chan int)
+	go func() { sent <- feed.Send(1) }()
+	time.Sleep(10 * time.Millisecond)
+	sub.Unsubscribe()
+	select {
+	case n := <-sent:
+		if n != 0 {
+			t.Errorf("Send delivered %d times, want 0", n)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("Send did not unblock after Unsubscribe")
+	}
+}
+
+func TestFeedTypeMismatch(t *testing.T) {
+	var feed Feed
+	feed.Subscribe(make(chan int))
+	defer func() {
+		if recover() == nil {
+			t.Fatal("Send with wrong type did not panic")
+		}
+	}()
+	feed.Send("string")
+}
@@ -0,0 +1,40 @@
+package les
+
+import (
+	"context"
+
+	"myeth/common"
+	"myeth/core"
+	"myeth/core/types"
+	"myeth/event"
+	"myeth/light"
+)
+
+// LesApiBackend implements filters.Backend for light clients, retrieving
+// receipts and bodies on demand from the les servers.
+type LesApiBackend struct {
+	eth *LightEthereum
+
+	//轻节点没有交易池 这个feed永远不会发送事件
+	txFeed event.Feed
+}
+
+// GetReceipts retrieves the receipts of a block, from the network if needed.
+func (b *LesApiBackend) GetReceipts(ctx context.Context, hash common.Hash, number uint64) (types.Receipts, error) {
+	return light.GetBlockReceipts(ctx, b.eth.odr, hash, number)
+}
+
+// GetBody retrieves the body of a block, from the network if needed.
+func (b *LesApiBackend) GetBody(ctx context.Context, hash common.Hash, number uint64) (*types.Body, error) {
+	return light.GetBody(ctx, b.eth.odr, hash, number)
+}
+
+// SubscribeNewTxsEvent returns a subscription that never fires, light clients
+// keep no transaction pool.
+func (b *LesApiBackend) SubscribeNewTxsEvent(ch chan<- core.NewTxsEvent) event.Subscription {
+	return b.txFeed.Subscribe(ch)
+}
+
+func (b *LesApiBackend) SubscribeChainHeadEvent(ch chan<- core.ChainHeadEvent) event.Subscription {
+	return b.eth.blockchain.SubscribeChainHeadEvent(ch)
+}
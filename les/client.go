@@ -0,0 +1,126 @@
+package les
+
+import (
+	"sync"
+
+	"myeth/core"
+	"myeth/eth"
+	"myeth/eth/filters"
+	"myeth/ethdb"
+	"myeth/light"
+	"myeth/node"
+	"myeth/p2p"
+	"myeth/rpc"
+)
+
+// LightEthereum is the light client service. It only syncs the header chain
+// from les servers and retrieves block contents, receipts and state on demand.
+// 轻节点 只同步区块头 其他数据都按需向服务端要并用默克尔证明校验
+type LightEthereum struct {
+	config *eth.Config
+
+	chainDb    ethdb.Database // Block chain database
+	peers      *peerSet
+	retriever  *retrieveManager
+	odr        *LesOdr
+	blockchain *light.LightChain
+
+	protocols     []p2p.Protocol
+	ApiBackend    *LesApiBackend
+	netRPCService *eth.PublicNetAPI
+
+	syncing  int32 // Flag whether header sync is running
+	quitSync chan struct{}
+	wg       sync.WaitGroup
+}
+
+// New creates a new light client service.
+func New(ctx *node.ServiceContext, config *eth.Config) (*LightEthereum, error) {
+	chainDb, err := eth.CreateDB(ctx, "lightchaindata")
+	if err != nil {
+		return nil, err
+	}
+	if _, _, err := core.SetupGenesisBlock(chainDb, config.Genesis); err != nil {
+		return nil, err
+	}
+	leth := &LightEthereum{
+		config:   config,
+		chainDb:  chainDb,
+		peers:    newPeerSet(),
+		quitSync: make(chan struct{}),
+	}
+	leth.ApiBackend = &LesApiBackend{eth: leth}
+	leth.retriever = newRetrieveManager(chainDb, leth.peers, leth.removePeer)
+	leth.odr = NewLesOdr(chainDb, leth.retriever)
+	if leth.blockchain, err = light.NewLightChain(leth.odr, config.Checkpoint); err != nil {
+		return nil, err
+	}
+
+	leth.protocols = make([]p2p.Protocol, 0, len(ClientProtocolVersions))
+	for _, version := range ClientProtocolVersions {
+		version := version
+
+		leth.protocols = append(leth.protocols, p2p.Protocol{
+			Name:    ProtocolName,
+			Version: version,
+			Length:  ProtocolLengths[version],
+			Run: func(p *p2p.Peer, rw p2p.MsgReadWriter) error {
+				peer := newPeer(int(version), config.NetworkId, p, rw)
+
+				leth.wg.Add(1)
+				defer leth.wg.Done()
+				return leth.handle(peer)
+			},
+		})
+	}
+	return leth, nil
+}
+
+// BlockChain returns the ODR backed light chain.
+func (s *LightEthereum) BlockChain() *light.LightChain { return s.blockchain }
+
+// Odr returns the on-demand retrieval backend of the client.
+func (s *LightEthereum) Odr() *LesOdr { return s.odr }
+
+// ChainDb returns the chain database of the client.
+func (s *LightEthereum) ChainDb() ethdb.Database { return s.chainDb }
+
+// Protocols implements node.Service, returning all the currently configured
+// network protocols to start.
+func (s *LightEthereum) Protocols() []p2p.Protocol {
+	return s.protocols
+}
+
+// APIs implements node.Service, returning the collection of RPC services the
+// light client offers.
+func (s *LightEthereum) APIs() []rpc.API {
+	return []rpc.API{
+		{
+			Namespace: "eth",
+			Version:   "1.0",
+			Service:   filters.NewPublicFilterAPI(s.ApiBackend),
+			Public:    true,
+		}, {
+			Namespace: "net",
+			Version:   "1.0",
+			Service:   s.netRPCService,
+			Public:    true,
+		},
+	}
+}
+
+// Start implements node.Service, starting all internal goroutines needed by the
+// light client.
+func (s *LightEthereum) Start(srvr *p2p.Server) error {
+	s.netRPCService = eth.NewPublicNetAPI(srvr, s.config.NetworkId)
+	return nil
+}
+
+// Stop implements node.Service, terminating all internal goroutines used by the
+// light client.
+func (s *LightEthereum) Stop() error {
+	close(s.quitSync)
+	s.peers.Close()
+	s.wg.Wait()
+	return nil
+}
@@ -0,0 +1,233 @@
+package les
+
+import (
+	"context"
+	"sync/atomic"
+	"time"
+
+	"myeth/core/types"
+	"myeth/light"
+	"myeth/log"
+	"myeth/p2p"
+)
+
+// 同步时每一批区块头请求的超时时间 包括换节点重试
+const syncRequestTimeout = 30 * time.Second
+
+// handle is the callback invoked to manage the life cycle of a les server
+// connection. When this function terminates, the peer is disconnected.
+func (s *LightEthereum) handle(p *peer) error {
+	var (
+		genesis = s.blockchain.Genesis()
+		head    = s.blockchain.CurrentHeader()
+		hash    = head.Hash()
+		number  = head.Number.Uint64()
+		td      = s.blockchain.GetTd(hash, number)
+	)
+	if err := p.Handshake(td, hash, number, genesis.Hash(), nil); err != nil {
+		log.Debug("Light Ethereum handshake failed", "peer", p, "err", err)
+		return err
+	}
+	if err := s.peers.Register(p); err != nil {
+		log.Error("Light Ethereum peer registration failed", "peer", p, "err", err)
+		return err
+	}
+	defer s.removePeer(p.id)
+
+	go s.synchronise(p)
+
+	for {
+		if err := s.handleMsg(p); err != nil {
+			return err
+		}
+	}
+}
+
+// removePeer drops a les server from the client.
+func (s *LightEthereum) removePeer(id string) {
+	peer := s.peers.Peer(id)
+	if peer == nil {
+		return
+	}
+	log.Debug("Removing light Ethereum peer", "peer", id)
+	if err := s.peers.Unregister(id); err != nil {
+		log.Error("Peer removal failed", "peer", id, "err", err)
+	}
+	peer.Peer.Disconnect(p2p.DiscUselessPeer)
+}
+
+// handleMsg is invoked whenever an inbound message is received from a remote
+// server. The remote connection is torn down upon returning any error.
+func (s *LightEthereum) handleMsg(p *peer) error {
+	msg, err := p.rw.ReadMsg()
+	if err != nil {
+		return err
+	}
+	if msg.Size > ProtocolMaxMsgSize {
+		return errResp(ErrMsgTooLarge, "%v > %v", msg.Size, ProtocolMaxMsgSize)
+	}
+	defer msg.Discard()
+
+	var deliverMsg *Msg
+
+	switch msg.Code {
+	case StatusMsg:
+		return errResp(ErrExtraStatusMsg, "uncontrolled status message")
+
+	case AnnounceMsg:
+		var req announceData
+		if err := msg.Decode(&req); err != nil {
+			return errResp(ErrDecode, "%v: %v", msg, err)
+		}
+		if req.Td == nil {
+			return errResp(ErrDecode, "missing total difficulty")
+		}
+		p.setHead(&req)
+
+		head := s.blockchain.CurrentHeader()
+		if req.Td.Cmp(s.blockchain.GetTd(head.Hash(), head.Number.Uint64())) > 0 {
+			go s.synchronise(p)
+		}
+
+	case BlockHeadersMsg:
+		var resp struct {
+			ReqID, BV uint64
+			Headers   []*types.Header
+		}
+		if err := msg.Decode(&resp); err != nil {
+			return errResp(ErrDecode, "msg %v: %v", msg, err)
+		}
+		p.fcServer.GotReply(resp.ReqID, resp.BV)
+		deliverMsg = &Msg{MsgType: MsgBlockHeaders, ReqID: resp.ReqID, Obj: resp.Headers}
+
+	case BlockBodiesMsg:
+		var resp struct {
+			ReqID, BV uint64
+			Data      []*types.Body
+		}
+		if err := msg.Decode(&resp); err != nil {
+			return errResp(ErrDecode, "msg %v: %v", msg, err)
+		}
+		p.fcServer.GotReply(resp.ReqID, resp.BV)
+		deliverMsg = &Msg{MsgType: MsgBlockBodies, ReqID: resp.ReqID, Obj: resp.Data}
+
+	case CodeMsg:
+		var resp struct {
+			ReqID, BV uint64
+			Data      [][]byte
+		}
+		if err := msg.Decode(&resp); err != nil {
+			return errResp(ErrDecode, "msg %v: %v", msg, err)
+		}
+		p.fcServer.GotReply(resp.ReqID, resp.BV)
+		deliverMsg = &Msg{MsgType: MsgCode, ReqID: resp.ReqID, Obj: resp.Data}
+
+	case ReceiptsMsg:
+		var resp struct {
+			ReqID, BV uint64
+			Receipts  []types.Receipts
+		}
+		if err := msg.Decode(&resp); err != nil {
+			return errResp(ErrDecode, "msg %v: %v", msg, err)
+		}
+		p.fcServer.GotReply(resp.ReqID, resp.BV)
+		deliverMsg = &Msg{MsgType: MsgReceipts, ReqID: resp.ReqID, Obj: resp.Receipts}
+
+	case ProofsV2Msg:
+		var resp struct {
+			ReqID, BV uint64
+			Data      light.NodeList
+		}
+		if err := msg.Decode(&resp); err != nil {
+			return errResp(ErrDecode, "msg %v: %v", msg, err)
+		}
+		p.fcServer.GotReply(resp.ReqID, resp.BV)
+		deliverMsg = &Msg{MsgType: MsgProofsV2, ReqID: resp.ReqID, Obj: resp.Data}
+
+	case HelperTrieProofsMsg:
+		var resp struct {
+			ReqID, BV uint64
+			Data      HelperTrieResps
+		}
+		if err := msg.Decode(&resp); err != nil {
+			return errResp(ErrDecode, "msg %v: %v", msg, err)
+		}
+		p.fcServer.GotReply(resp.ReqID, resp.BV)
+		deliverMsg = &Msg{MsgType: MsgHelperTrieProofs, ReqID: resp.ReqID, Obj: resp.Data}
+
+	default:
+		return errResp(ErrInvalidMsgCode, "%v", msg.Code)
+	}
+	//超时之后才到的回复没人等了 丢掉就行
+	if deliverMsg != nil {
+		if err := s.retriever.deliver(p, deliverMsg); err != nil {
+			log.Debug("Dropped light response", "peer", p.id, "err", err)
+		}
+	}
+	return nil
+}
+
+// synchronise downloads the header chain up to the head announced by the given
+// server. Only one sync runs at a time, later announcements pick up where it
+// left off.
+// 插入失败说明本地在别的分叉上 往回退一批再试 直到找到共同的祖先
+func (s *LightEthereum) synchronise(p *peer) {
+	if !atomic.CompareAndSwapInt32(&s.syncing, 0, 1) {
+		return
+	}
+	defer atomic.StoreInt32(&s.syncing, 0)
+
+	if cp := s.config.Checkpoint; cp != nil {
+		ctx, cancel := context.WithTimeout(context.Background(), syncRequestTimeout)
+		ok := s.blockchain.SyncCheckpoint(ctx, cp)
+		cancel()
+		if !ok {
+			log.Warn("Failed to sync trusted checkpoint", "section", cp.SectionIndex)
+			return
+		}
+	}
+	origin := s.blockchain.CurrentHeader().Number.Uint64() + 1
+	for {
+		select {
+		case <-s.quitSync:
+			return
+		default:
+		}
+		head := s.blockchain.CurrentHeader()
+		info := p.headBlockInfo()
+		if info.Td.Cmp(s.blockchain.GetTd(head.Hash(), head.Number.Uint64())) <= 0 {
+			return
+		}
+		// A heavier but shorter chain can only be a fork, fetch its head first
+		if origin > info.Number {
+			origin = info.Number
+		}
+		amount := info.Number - origin + 1
+		if amount > MaxHeaderFetch {
+			amount = MaxHeaderFetch
+		}
+		req := &headersRequest{Origin: origin, Amount: amount}
+		ctx, cancel := context.WithTimeout(context.Background(), syncRequestTimeout)
+		err := s.retriever.retrieve(ctx, req)
+		cancel()
+		if err != nil {
+			log.Debug("Failed to retrieve headers", "from", origin, "count", amount, "err", err)
+			return
+		}
+		if _, err := s.blockchain.InsertHeaderChain(req.Headers); err == light.ErrUnknownAncestor {
+			if origin <= 1 {
+				return
+			}
+			back := uint64(MaxHeaderFetch)
+			if origin-1 < back {
+				back = origin - 1
+			}
+			origin -= back
+			continue
+		} else if err != nil {
+			log.Warn("Failed to insert headers", "from", origin, "err", err)
+			return
+		}
+		origin = req.Headers[len(req.Headers)-1].Number.Uint64() + 1
+	}
+}
@@ -0,0 +1,88 @@
+package les
+
+import (
+	"myeth/common"
+	"myeth/eth"
+	"myeth/les/flowcontrol"
+)
+
+const (
+	MaxHeaderFetch           = 192 // Amount of block headers to be fetched per retrieval request
+	MaxBodyFetch             = 32  // Amount of block bodies to be fetched per retrieval request
+	MaxReceiptFetch          = 128 // Amount of transaction receipts to allow fetching per request
+	MaxCodeFetch             = 64  // Amount of contract codes to allow fetching per request
+	MaxProofsFetch           = 64  // Amount of merkle proofs to be fetched per retrieval request
+	MaxHelperTrieProofsFetch = 64  // Amount of merkle proofs to be fetched per retrieval request
+)
+
+// defaultServerParams are the flow control parameters a server assigns to
+// every client.
+var defaultServerParams = flowcontrol.ServerParams{
+	BufLimit:    300000000,
+	MinRecharge: 50000,
+}
+
+// requestCosts is the cost of a request type, a fixed base cost plus a cost
+// for every requested item.
+// 一个请求的最大开销 = baseCost + 条数*reqCost
+type requestCosts struct {
+	baseCost, reqCost uint64
+}
+
+type requestCostTable map[uint64]*requestCosts
+
+// headerQueryItems is the number of items a header query is charged for. A
+// hash based query skipping headers may walk up to eth.MaxNonCanonical
+// headers off the canonical chain on top of the ones it returns.
+//跳跃查询的代价和Skip相关 按可能多读的头一起收费
+func headerQueryItems(query *getBlockHeadersData) uint64 {
+	items := query.Amount
+	if query.Origin.Hash != (common.Hash{}) && query.Skip > 0 {
+		skip := query.Skip
+		if skip > eth.MaxNonCanonical {
+			skip = eth.MaxNonCanonical
+		}
+		items += skip
+	}
+	return items
+}
+
+// defaultRequestCosts is the cost table servers announce to their clients.
+var defaultRequestCosts = requestCostTable{
+	GetBlockHeadersMsg:     {150000, 30000},
+	GetBlockBodiesMsg:      {0, 700000},
+	GetReceiptsMsg:         {0, 1000000},
+	GetCodeMsg:             {0, 450000},
+	GetProofsV2Msg:         {0, 600000},
+	GetHelperTrieProofsMsg: {0, 1000000},
+}
+
+// requestCostList is the network encoding of a request cost table.
+type requestCostList []requestCostListItem
+
+type requestCostListItem struct {
+	MsgCode, BaseCost, ReqCost uint64
+}
+
+func (table requestCostTable) encode() requestCostList {
+	list := make(requestCostList, 0, len(table))
+	for code, costs := range table {
+		list = append(list, requestCostListItem{
+			MsgCode:  code,
+			BaseCost: costs.baseCost,
+			ReqCost:  costs.reqCost,
+		})
+	}
+	return list
+}
+
+func (list requestCostList) decode() requestCostTable {
+	table := make(requestCostTable)
+	for _, e := range list {
+		table[e.MsgCode] = &requestCosts{
+			baseCost: e.BaseCost,
+			reqCost:  e.ReqCost,
+		}
+	}
+	return table
+}
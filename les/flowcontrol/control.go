@@ -0,0 +1,168 @@
+// Package flowcontrol implements a client side flow control mechanism
+package flowcontrol
+
+import (
+	"sync"
+	"time"
+)
+
+const (
+	fcTimeConst  = time.Millisecond
+	safetyMargin = time.Millisecond
+)
+
+// ServerParams are the flow control parameters specified by a server for a client
+//
+// Note: a server can assign different amounts of capacity to each client by giving
+// different parameters to them.
+// 服务端给每个客户端一个缓冲区 每个请求按开销扣减 然后按MinRecharge随时间回填
+type ServerParams struct {
+	BufLimit, MinRecharge uint64
+}
+
+// ClientNode is the flow control system's representation of a client
+// (used in server mode only)
+type ClientNode struct {
+	params   *ServerParams
+	bufValue uint64
+	lastTime time.Time
+	lock     sync.Mutex
+}
+
+// NewClientNode returns a new ClientNode
+func NewClientNode(params *ServerParams) *ClientNode {
+	return &ClientNode{
+		params:   params,
+		bufValue: params.BufLimit,
+		lastTime: time.Now(),
+	}
+}
+
+// recalcBV recharges the buffer according to the time passed since the last
+// update.
+func (peer *ClientNode) recalcBV(now time.Time) {
+	dt := uint64(now.Sub(peer.lastTime))
+	if now.Before(peer.lastTime) {
+		dt = 0
+	}
+	peer.bufValue += peer.params.MinRecharge * dt / uint64(fcTimeConst)
+	if peer.bufValue > peer.params.BufLimit {
+		peer.bufValue = peer.params.BufLimit
+	}
+	peer.lastTime = now
+}
+
+// AcceptRequest returns whether a new request with the given maximum cost can
+// be accepted and if so, deducts the cost from the client's buffer.
+func (peer *ClientNode) AcceptRequest(maxCost uint64) bool {
+	peer.lock.Lock()
+	defer peer.lock.Unlock()
+
+	peer.recalcBV(time.Now())
+	if maxCost > peer.bufValue {
+		return false
+	}
+	peer.bufValue -= maxCost
+	return true
+}
+
+// BufferValue returns the current buffer value of the client, which is sent
+// back in every reply so that the client can correct its estimate.
+func (peer *ClientNode) BufferValue() uint64 {
+	peer.lock.Lock()
+	defer peer.lock.Unlock()
+
+	peer.recalcBV(time.Now())
+	return peer.bufValue
+}
+
+// ServerNode is the flow control system's representation of a server
+// (used in client mode only)
+// 客户端这边估算服务端给自己留的缓冲区 避免发出会被拒绝的请求
+type ServerNode struct {
+	bufEstimate uint64
+	lastTime    time.Time
+	params      *ServerParams
+	sumCost     uint64            // sum of req costs sent to this server
+	pending     map[uint64]uint64 // value = sumCost after sending the given req
+	lock        sync.RWMutex
+}
+
+// NewServerNode returns a new ServerNode
+func NewServerNode(params *ServerParams) *ServerNode {
+	return &ServerNode{
+		bufEstimate: params.BufLimit,
+		lastTime:    time.Now(),
+		params:      params,
+		pending:     make(map[uint64]uint64),
+	}
+}
+
+// recalcBLE recalculates the buffer limit estimate according to the time
+// passed since the last update.
+func (peer *ServerNode) recalcBLE(now time.Time) {
+	if now.Before(peer.lastTime) {
+		return
+	}
+	dt := uint64(now.Sub(peer.lastTime))
+	peer.bufEstimate += peer.params.MinRecharge * dt / uint64(fcTimeConst)
+	if peer.bufEstimate > peer.params.BufLimit {
+		peer.bufEstimate = peer.params.BufLimit
+	}
+	peer.lastTime = now
+}
+
+// CanSend returns the minimum waiting time required before sending a request
+// with the given maximum estimated cost. Second return value is the relative
+// estimated buffer level after sending the request (divided by BufLimit).
+func (peer *ServerNode) CanSend(maxCost uint64) (time.Duration, float64) {
+	peer.lock.Lock()
+	defer peer.lock.Unlock()
+
+	peer.recalcBLE(time.Now())
+	maxCost += uint64(safetyMargin) * peer.params.MinRecharge / uint64(fcTimeConst)
+	if maxCost > peer.params.BufLimit {
+		maxCost = peer.params.BufLimit
+	}
+	if peer.bufEstimate >= maxCost {
+		return 0, float64(peer.bufEstimate-maxCost) / float64(peer.params.BufLimit)
+	}
+	return time.Duration((maxCost - peer.bufEstimate) * uint64(fcTimeConst) / peer.params.MinRecharge), 0
+}
+
+// QueueRequest should be called when the request has been assigned to the given
+// server node, before putting it in the send queue. It is mandatory that requests
+// are sent in the same order as the QueueRequest calls are made.
+func (peer *ServerNode) QueueRequest(reqID, maxCost uint64) {
+	peer.lock.Lock()
+	defer peer.lock.Unlock()
+
+	if peer.bufEstimate < maxCost {
+		peer.bufEstimate = 0
+	} else {
+		peer.bufEstimate -= maxCost
+	}
+	peer.sumCost += maxCost
+	peer.pending[reqID] = peer.sumCost
+}
+
+// GotReply adjusts estimated buffer value according to the value included in
+// the latest request reply.
+func (peer *ServerNode) GotReply(reqID, bv uint64) {
+	peer.lock.Lock()
+	defer peer.lock.Unlock()
+
+	sc, ok := peer.pending[reqID]
+	if !ok {
+		return
+	}
+	delete(peer.pending, reqID)
+
+	// Requests sent after this one were not yet accounted for by the server
+	cc := peer.sumCost - sc
+	peer.bufEstimate = 0
+	if bv > cc {
+		peer.bufEstimate = bv - cc
+	}
+	peer.lastTime = time.Now()
+}
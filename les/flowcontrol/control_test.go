@@ -0,0 +1,51 @@
+package flowcontrol
+
+import (
+	"testing"
+	"time"
+)
+
+// Tests that the server side buffer rejects requests exceeding it and that it
+// recharges over time.
+func TestClientNodeBuffer(t *testing.T) {
+	node := NewClientNode(&ServerParams{BufLimit: 1000, MinRecharge: 1})
+
+	if !node.AcceptRequest(800) {
+		t.Fatalf("request within buffer limit rejected")
+	}
+	if node.AcceptRequest(800) {
+		t.Fatalf("request exceeding remaining buffer accepted")
+	}
+	// Pretend the last update happened long ago, the buffer must be full again
+	node.lastTime = node.lastTime.Add(-time.Second)
+	if bv := node.BufferValue(); bv != 1000 {
+		t.Fatalf("buffer not recharged: have %d, want %d", bv, 1000)
+	}
+}
+
+// Tests that the client side estimate follows the replies of the server and
+// accounts for requests still in flight.
+func TestServerNodeEstimate(t *testing.T) {
+	node := NewServerNode(&ServerParams{BufLimit: 1000, MinRecharge: 1})
+
+	if wait, _ := node.CanSend(500); wait != 0 {
+		t.Fatalf("wait time mismatch with full buffer: have %v, want 0", wait)
+	}
+	node.QueueRequest(1, 500)
+	node.QueueRequest(2, 400)
+
+	// Server replies to the first request with 500 left, the second one is
+	// still to be deducted from that.
+	node.GotReply(1, 500)
+	if node.bufEstimate != 100 {
+		t.Fatalf("buffer estimate mismatch: have %d, want %d", node.bufEstimate, 100)
+	}
+	if wait, _ := node.CanSend(500); wait == 0 {
+		t.Fatalf("request exceeding the estimate allowed without waiting")
+	}
+	// Replies to unknown requests are ignored
+	node.GotReply(3, 1000)
+	if node.bufEstimate != 100 {
+		t.Fatalf("buffer estimate changed by unknown reply: have %d", node.bufEstimate)
+	}
+}
@@ -0,0 +1,45 @@
+package les
+
+import (
+	"context"
+	"errors"
+
+	"myeth/ethdb"
+	"myeth/light"
+)
+
+var errUnsupportedRequest = errors.New("unsupported ODR request")
+
+// LesOdr implements light.OdrBackend
+// 把light包的请求转成les请求发给服务端 校验通过的结果存进本地数据库
+type LesOdr struct {
+	db        ethdb.Database
+	retriever *retrieveManager
+}
+
+// NewLesOdr creates an ODR backend retrieving data through the given retriever.
+func NewLesOdr(db ethdb.Database, retriever *retrieveManager) *LesOdr {
+	return &LesOdr{
+		db:        db,
+		retriever: retriever,
+	}
+}
+
+// Database returns the backing database
+func (odr *LesOdr) Database() ethdb.Database {
+	return odr.db
+}
+
+// Retrieve tries to fetch an object from the LES network.
+// If the network retrieval was successful, it stores the object in local db.
+func (odr *LesOdr) Retrieve(ctx context.Context, req light.OdrRequest) error {
+	lreq := LesRequest(req)
+	if lreq == nil {
+		return errUnsupportedRequest
+	}
+	if err := odr.retriever.retrieve(ctx, lreq); err != nil {
+		return err
+	}
+	req.StoreResult(odr.db)
+	return nil
+}
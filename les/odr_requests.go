@@ -0,0 +1,351 @@
+package les
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+
+	"myeth/common"
+	"myeth/core/rawdb"
+	"myeth/core/types"
+	"myeth/crypto"
+	"myeth/ethdb"
+	"myeth/light"
+	"myeth/rlp"
+	"myeth/trie"
+)
+
+var (
+	errInvalidMessageType  = errors.New("invalid message type")
+	errInvalidEntryCount   = errors.New("invalid number of response entries")
+	errHeaderUnavailable   = errors.New("header unavailable")
+	errTxHashMismatch      = errors.New("transaction hash mismatch")
+	errUncleHashMismatch   = errors.New("uncle hash mismatch")
+	errReceiptHashMismatch = errors.New("receipt hash mismatch")
+	errDataHashMismatch    = errors.New("data hash mismatch")
+	errCHTHashMismatch     = errors.New("cht hash mismatch")
+	errCHTNumberMismatch   = errors.New("cht number mismatch")
+	errHeaderChainBroken   = errors.New("header chain not contiguous")
+)
+
+// LesRequest wraps an ODR request into the les request that is able to send
+// and validate it.
+func LesRequest(req light.OdrRequest) LesOdrRequest {
+	switch r := req.(type) {
+	case *light.BlockRequest:
+		return (*BlockRequest)(r)
+	case *light.ReceiptsRequest:
+		return (*ReceiptsRequest)(r)
+	case *light.TrieRequest:
+		return (*TrieRequest)(r)
+	case *light.CodeRequest:
+		return (*CodeRequest)(r)
+	case *light.ChtRequest:
+		return (*ChtRequest)(r)
+	default:
+		return nil
+	}
+}
+
+// BlockRequest is the ODR request type for block bodies
+type BlockRequest light.BlockRequest
+
+// GetCost returns the cost of the given ODR request according to the serving
+// peer's cost table (implementation of LesOdrRequest)
+func (r *BlockRequest) GetCost(peer *peer) uint64 {
+	return peer.GetRequestCost(GetBlockBodiesMsg, 1)
+}
+
+// CanSend tells if a certain peer is suitable for serving the given request
+func (r *BlockRequest) CanSend(peer *peer) bool {
+	return peer.headBlockInfo().Number >= r.Number
+}
+
+// Request sends an ODR request to the LES network (implementation of LesOdrRequest)
+func (r *BlockRequest) Request(reqID uint64, peer *peer) error {
+	return peer.RequestBodies(reqID, []common.Hash{r.Hash})
+}
+
+// Validate processes an ODR request reply message from the LES network
+// returns true and stores results in memory if the message was a valid reply
+// to the request (implementation of LesOdrRequest)
+func (r *BlockRequest) Validate(db ethdb.Database, msg *Msg) error {
+	// Ensure we have a correct message with a single block body
+	if msg.MsgType != MsgBlockBodies {
+		return errInvalidMessageType
+	}
+	bodies := msg.Obj.([]*types.Body)
+	if len(bodies) != 1 {
+		return errInvalidEntryCount
+	}
+	body := bodies[0]
+
+	// Retrieve our stored header and validate block content against it
+	header := rawdb.ReadHeader(db, r.Hash, r.Number)
+	if header == nil {
+		return errHeaderUnavailable
+	}
+	if header.TxHash != types.DeriveSha(types.Transactions(body.Transactions)) {
+		return errTxHashMismatch
+	}
+	if header.UncleHash != types.CalcUncleHash(body.Uncles) {
+		return errUncleHashMismatch
+	}
+	// Validations passed, encode and store RLP
+	data, err := rlp.EncodeToBytes(body)
+	if err != nil {
+		return err
+	}
+	r.Rlp = data
+	return nil
+}
+
+// ReceiptsRequest is the ODR request type for block receipts by block hash
+type ReceiptsRequest light.ReceiptsRequest
+
+// GetCost returns the cost of the given ODR request according to the serving
+// peer's cost table (implementation of LesOdrRequest)
+func (r *ReceiptsRequest) GetCost(peer *peer) uint64 {
+	return peer.GetRequestCost(GetReceiptsMsg, 1)
+}
+
+// CanSend tells if a certain peer is suitable for serving the given request
+func (r *ReceiptsRequest) CanSend(peer *peer) bool {
+	return peer.headBlockInfo().Number >= r.Number
+}
+
+// Request sends an ODR request to the LES network (implementation of LesOdrRequest)
+func (r *ReceiptsRequest) Request(reqID uint64, peer *peer) error {
+	return peer.RequestReceipts(reqID, []common.Hash{r.Hash})
+}
+
+// Validate processes an ODR request reply message from the LES network
+// returns true and stores results in memory if the message was a valid reply
+// to the request (implementation of LesOdrRequest)
+func (r *ReceiptsRequest) Validate(db ethdb.Database, msg *Msg) error {
+	// Ensure we have a correct message with a single block receipt
+	if msg.MsgType != MsgReceipts {
+		return errInvalidMessageType
+	}
+	receipts := msg.Obj.([]types.Receipts)
+	if len(receipts) != 1 {
+		return errInvalidEntryCount
+	}
+	receipt := receipts[0]
+
+	// Retrieve our stored header and validate receipt content against it
+	header := rawdb.ReadHeader(db, r.Hash, r.Number)
+	if header == nil {
+		return errHeaderUnavailable
+	}
+	if header.ReceiptHash != types.DeriveSha(receipt) {
+		return errReceiptHashMismatch
+	}
+	// Validations passed, store and return
+	r.Receipts = receipt
+	return nil
+}
+
+// TrieRequest is the ODR request type for state/storage trie entries
+type TrieRequest light.TrieRequest
+
+// GetCost returns the cost of the given ODR request according to the serving
+// peer's cost table (implementation of LesOdrRequest)
+func (r *TrieRequest) GetCost(peer *peer) uint64 {
+	return peer.GetRequestCost(GetProofsV2Msg, 1)
+}
+
+// CanSend tells if a certain peer is suitable for serving the given request
+func (r *TrieRequest) CanSend(peer *peer) bool {
+	return peer.headBlockInfo().Number >= r.Id.BlockNumber
+}
+
+// Request sends an ODR request to the LES network (implementation of LesOdrRequest)
+func (r *TrieRequest) Request(reqID uint64, peer *peer) error {
+	req := ProofReq{
+		BHash:  r.Id.BlockHash,
+		AccKey: r.Id.AccKey,
+		Key:    r.Key,
+	}
+	return peer.RequestProofs(reqID, []ProofReq{req})
+}
+
+// Validate processes an ODR request reply message from the LES network
+// returns true and stores results in memory if the message was a valid reply
+// to the request (implementation of LesOdrRequest)
+// 证明要能从本地已知的根推出这个key 不管是存在还是不存在
+func (r *TrieRequest) Validate(db ethdb.Database, msg *Msg) error {
+	if msg.MsgType != MsgProofsV2 {
+		return errInvalidMessageType
+	}
+	proofs := msg.Obj.(light.NodeList)
+
+	// Verify the proof and store if checks out
+	nodeSet := proofs.NodeSet()
+	if _, _, err := trie.VerifyProof(r.Id.Root, r.Key, nodeSet); err != nil {
+		return fmt.Errorf("merkle proof verification failed: %v", err)
+	}
+	r.Proof = nodeSet
+	return nil
+}
+
+// CodeRequest is the ODR request type for contract code
+type CodeRequest light.CodeRequest
+
+// GetCost returns the cost of the given ODR request according to the serving
+// peer's cost table (implementation of LesOdrRequest)
+func (r *CodeRequest) GetCost(peer *peer) uint64 {
+	return peer.GetRequestCost(GetCodeMsg, 1)
+}
+
+// CanSend tells if a certain peer is suitable for serving the given request
+func (r *CodeRequest) CanSend(peer *peer) bool {
+	return peer.headBlockInfo().Number >= r.Id.BlockNumber
+}
+
+// Request sends an ODR request to the LES network (implementation of LesOdrRequest)
+func (r *CodeRequest) Request(reqID uint64, peer *peer) error {
+	req := CodeReq{
+		BHash:  r.Id.BlockHash,
+		AccKey: r.Id.AccKey,
+	}
+	return peer.RequestCode(reqID, []CodeReq{req})
+}
+
+// Validate processes an ODR request reply message from the LES network
+// returns true and stores results in memory if the message was a valid reply
+// to the request (implementation of LesOdrRequest)
+func (r *CodeRequest) Validate(db ethdb.Database, msg *Msg) error {
+	// Ensure we have a correct message with a single code element
+	if msg.MsgType != MsgCode {
+		return errInvalidMessageType
+	}
+	reply := msg.Obj.([][]byte)
+	if len(reply) != 1 {
+		return errInvalidEntryCount
+	}
+	data := reply[0]
+
+	// Verify the data and store if checks out
+	if hash := crypto.Keccak256Hash(data); r.Hash != hash {
+		return errDataHashMismatch
+	}
+	r.Data = data
+	return nil
+}
+
+// ChtRequest is the ODR request type for state/storage trie entries
+type ChtRequest light.ChtRequest
+
+// GetCost returns the cost of the given ODR request according to the serving
+// peer's cost table (implementation of LesOdrRequest)
+func (r *ChtRequest) GetCost(peer *peer) uint64 {
+	return peer.GetRequestCost(GetHelperTrieProofsMsg, 1)
+}
+
+// CanSend tells if a certain peer is suitable for serving the given request
+// 服务端要等段的末尾有足够的确认数才会构建这一段
+func (r *ChtRequest) CanSend(peer *peer) bool {
+	return peer.headBlockInfo().Number+1 >= (r.ChtNum+1)*light.ChtFrequency+light.ChtConfirmations
+}
+
+// Request sends an ODR request to the LES network (implementation of LesOdrRequest)
+func (r *ChtRequest) Request(reqID uint64, peer *peer) error {
+	req := HelperTrieReq{
+		Type:    htCanonical,
+		TrieIdx: r.ChtNum,
+		Key:     light.ChtKey(r.BlockNum),
+		AuxReq:  auxHeader,
+	}
+	return peer.RequestHelperTrieProofs(reqID, []HelperTrieReq{req})
+}
+
+// Validate processes an ODR request reply message from the LES network
+// returns true and stores results in memory if the message was a valid reply
+// to the request (implementation of LesOdrRequest)
+func (r *ChtRequest) Validate(db ethdb.Database, msg *Msg) error {
+	if msg.MsgType != MsgHelperTrieProofs {
+		return errInvalidMessageType
+	}
+	resp := msg.Obj.(HelperTrieResps)
+	if len(resp.AuxData) != 1 {
+		return errInvalidEntryCount
+	}
+	nodeSet := resp.Proofs.NodeSet()
+	headerEnc := resp.AuxData[0]
+	if len(headerEnc) == 0 {
+		return errHeaderUnavailable
+	}
+	header := new(types.Header)
+	if err := rlp.Decode(bytes.NewReader(headerEnc), header); err != nil {
+		return errHeaderUnavailable
+	}
+	// Verify the CHT
+	value, _, err := trie.VerifyProof(r.ChtRoot, light.ChtKey(r.BlockNum), nodeSet)
+	if err != nil {
+		return err
+	}
+	if value == nil {
+		return errCHTHashMismatch
+	}
+	var node light.ChtNode
+	if err := rlp.DecodeBytes(value, &node); err != nil {
+		return err
+	}
+	if node.Hash != header.Hash() {
+		return errCHTHashMismatch
+	}
+	if r.BlockNum != header.Number.Uint64() {
+		return errCHTNumberMismatch
+	}
+	// Verifications passed, store and return
+	r.Header = header
+	r.Proof = nodeSet
+	r.Td = node.Td
+	return nil
+}
+
+// headersRequest fetches a batch of consecutive canonical headers for the
+// header sync of the light client.
+type headersRequest struct {
+	Origin, Amount uint64
+	Headers        []*types.Header
+}
+
+// GetCost returns the cost of the given ODR request according to the serving
+// peer's cost table (implementation of LesOdrRequest)
+func (r *headersRequest) GetCost(peer *peer) uint64 {
+	return peer.GetRequestCost(GetBlockHeadersMsg, int(r.Amount))
+}
+
+// CanSend tells if a certain peer is suitable for serving the given request
+func (r *headersRequest) CanSend(peer *peer) bool {
+	return peer.headBlockInfo().Number >= r.Origin+r.Amount-1
+}
+
+// Request sends an ODR request to the LES network (implementation of LesOdrRequest)
+func (r *headersRequest) Request(reqID uint64, peer *peer) error {
+	return peer.RequestHeadersByNumber(reqID, r.Origin, int(r.Amount), 0, false)
+}
+
+// Validate checks that the reply is the requested contiguous batch of headers,
+// linking them is left to the light chain.
+func (r *headersRequest) Validate(db ethdb.Database, msg *Msg) error {
+	if msg.MsgType != MsgBlockHeaders {
+		return errInvalidMessageType
+	}
+	headers := msg.Obj.([]*types.Header)
+	if uint64(len(headers)) != r.Amount {
+		return errInvalidEntryCount
+	}
+	for i, header := range headers {
+		if header.Number.Uint64() != r.Origin+uint64(i) {
+			return errHeaderChainBroken
+		}
+		if i > 0 && header.ParentHash != headers[i-1].Hash() {
+			return errHeaderChainBroken
+		}
+	}
+	r.Headers = headers
+	return nil
+}
@@ -0,0 +1,432 @@
+package les
+
+import (
+	"errors"
+	"fmt"
+	"math/big"
+	"sync"
+	"time"
+
+	"myeth/common"
+	"myeth/core/types"
+	"myeth/les/flowcontrol"
+	"myeth/light"
+	"myeth/log"
+	"myeth/p2p"
+	"myeth/rlp"
+)
+
+var (
+	errClosed            = errors.New("peer set is closed")
+	errAlreadyRegistered = errors.New("peer is already registered")
+	errNotRegistered     = errors.New("peer is not registered")
+)
+
+const (
+	// 握手必须在这个时间内完成
+	handshakeTimeout = 5 * time.Second
+
+	// maxQueuedAnnounces is the maximum number of head announcements to queue up
+	// before dropping broadcasts. Clients only care about the latest head, so a
+	// slow one can safely miss a few intermediate ones.
+	maxQueuedAnnounces = 4
+)
+
+type peer struct {
+	*p2p.Peer
+
+	rw p2p.MsgReadWriter
+
+	version int    // Protocol version negotiated
+	network uint64 // Network ID being on
+	id      string
+
+	headInfo *announceData
+	lock     sync.RWMutex
+
+	fcClient *flowcontrol.ClientNode // nil if the peer is server only
+	fcServer *flowcontrol.ServerNode // nil if the peer is client only
+	fcCosts  requestCostTable        // request costs announced by the server
+	fcParams flowcontrol.ServerParams
+
+	queuedAnnounces chan announceData // Queue of head announcements to send to the peer
+	term            chan struct{}     // Termination channel to stop the broadcaster
+}
+
+func newPeer(version int, network uint64, p *p2p.Peer, rw p2p.MsgReadWriter) *peer {
+	id := p.ID()
+
+	return &peer{
+		Peer:    p,
+		rw:      rw,
+		version: version,
+		network: network,
+		id:      fmt.Sprintf("%x", id[:8]),
+
+		queuedAnnounces: make(chan announceData, maxQueuedAnnounces),
+		term:            make(chan struct{}),
+	}
+}
+
+// broadcast is a write loop that sends the queued head announcements to the
+// remote peer, so a slow client can't stall the server's announce loop.
+func (p *peer) broadcast() {
+	for {
+		select {
+		case announce := <-p.queuedAnnounces:
+			if err := p.SendAnnounce(announce); err != nil {
+				return
+			}
+
+		case <-p.term:
+			return
+		}
+	}
+}
+
+// close signals the broadcast goroutine to terminate.
+func (p *peer) close() {
+	close(p.term)
+}
+
+// headBlockInfo returns the latest announced head of the peer.
+func (p *peer) headBlockInfo() announceData {
+	p.lock.RLock()
+	defer p.lock.RUnlock()
+
+	return *p.headInfo
+}
+
+// Td retrieves the current total difficulty of a peer.
+func (p *peer) Td() *big.Int {
+	p.lock.RLock()
+	defer p.lock.RUnlock()
+
+	return new(big.Int).Set(p.headInfo.Td)
+}
+
+// setHead updates the head information of the peer after an announcement.
+func (p *peer) setHead(head *announceData) {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+
+	p.headInfo = head
+}
+
+// GetRequestCost returns the maximum cost of a request with the given amount
+// of items according to the cost table announced by the server.
+func (p *peer) GetRequestCost(msgcode uint64, amount int) uint64 {
+	costs := p.fcCosts[msgcode]
+	if costs == nil {
+		return 0
+	}
+	cost := costs.baseCost + costs.reqCost*uint64(amount)
+	if cost > p.fcParams.BufLimit {
+		cost = p.fcParams.BufLimit
+	}
+	return cost
+}
+
+// sendRequest sends a request tagged with its ID to the server.
+func sendRequest(w p2p.MsgWriter, msgcode, reqID uint64, data interface{}) error {
+	type req struct {
+		ReqID uint64
+		Data  interface{}
+	}
+	return p2p.Send(w, msgcode, req{reqID, data})
+}
+
+// sendResponse sends a reply tagged with the request ID and the remaining
+// buffer value of the client.
+func sendResponse(w p2p.MsgWriter, msgcode, reqID, bv uint64, data interface{}) error {
+	type resp struct {
+		ReqID, BV uint64
+		Data      interface{}
+	}
+	return p2p.Send(w, msgcode, resp{reqID, bv, data})
+}
+
+// SendAnnounce announces the availability of a number of blocks through
+// a hash notification.
+func (p *peer) SendAnnounce(request announceData) error {
+	return p2p.Send(p.rw, AnnounceMsg, request)
+}
+
+// AsyncSendAnnounce queues a head announcement for the remote peer. If the
+// peer's broadcast queue is full, the announcement is silently dropped.
+func (p *peer) AsyncSendAnnounce(request announceData) {
+	select {
+	case p.queuedAnnounces <- request:
+	default:
+		log.Debug("Dropping head announcement", "peer", p.id, "number", request.Number, "hash", request.Hash)
+	}
+}
+
+// SendBlockHeaders sends a batch of block headers to the remote peer.
+func (p *peer) SendBlockHeaders(reqID, bv uint64, headers []*types.Header) error {
+	return sendResponse(p.rw, BlockHeadersMsg, reqID, bv, headers)
+}
+
+// SendBlockBodiesRLP sends a batch of block contents to the remote peer from
+// an already RLP encoded format.
+func (p *peer) SendBlockBodiesRLP(reqID, bv uint64, bodies []rlp.RawValue) error {
+	return sendResponse(p.rw, BlockBodiesMsg, reqID, bv, bodies)
+}
+
+// SendCode sends a batch of arbitrary internal data, corresponding to the
+// hashes requested.
+func (p *peer) SendCode(reqID, bv uint64, data [][]byte) error {
+	return sendResponse(p.rw, CodeMsg, reqID, bv, data)
+}
+
+// SendReceiptsRLP sends a batch of transaction receipts, corresponding to the
+// ones requested from an already RLP encoded format.
+func (p *peer) SendReceiptsRLP(reqID, bv uint64, receipts []rlp.RawValue) error {
+	return sendResponse(p.rw, ReceiptsMsg, reqID, bv, receipts)
+}
+
+// SendProofsV2 sends a batch of merkle proofs, corresponding to the ones requested.
+func (p *peer) SendProofsV2(reqID, bv uint64, proofs light.NodeList) error {
+	return sendResponse(p.rw, ProofsV2Msg, reqID, bv, proofs)
+}
+
+// SendHelperTrieProofs sends merkle proofs for helper trie entries
+func (p *peer) SendHelperTrieProofs(reqID, bv uint64, resp HelperTrieResps) error {
+	return sendResponse(p.rw, HelperTrieProofsMsg, reqID, bv, resp)
+}
+
+// RequestHeadersByHash fetches a batch of blocks' headers corresponding to the
+// specified header query, based on the hash of an origin block.
+func (p *peer) RequestHeadersByHash(reqID uint64, origin common.Hash, amount int, skip int, reverse bool) error {
+	return sendRequest(p.rw, GetBlockHeadersMsg, reqID, &getBlockHeadersData{Origin: hashOrNumber{Hash: origin}, Amount: uint64(amount), Skip: uint64(skip), Reverse: reverse})
+}
+
+// RequestHeadersByNumber fetches a batch of blocks' headers corresponding to the
+// specified header query, based on the number of an origin block.
+func (p *peer) RequestHeadersByNumber(reqID uint64, origin uint64, amount int, skip int, reverse bool) error {
+	return sendRequest(p.rw, GetBlockHeadersMsg, reqID, &getBlockHeadersData{Origin: hashOrNumber{Number: origin}, Amount: uint64(amount), Skip: uint64(skip), Reverse: reverse})
+}
+
+// RequestBodies fetches a batch of blocks' bodies corresponding to the hashes
+// specified.
+func (p *peer) RequestBodies(reqID uint64, hashes []common.Hash) error {
+	return sendRequest(p.rw, GetBlockBodiesMsg, reqID, hashes)
+}
+
+// RequestCode fetches a batch of arbitrary data from a node's known state
+// data, corresponding to the specified hashes.
+func (p *peer) RequestCode(reqID uint64, reqs []CodeReq) error {
+	return sendRequest(p.rw, GetCodeMsg, reqID, reqs)
+}
+
+// RequestReceipts fetches a batch of transaction receipts from a remote node.
+func (p *peer) RequestReceipts(reqID uint64, hashes []common.Hash) error {
+	return sendRequest(p.rw, GetReceiptsMsg, reqID, hashes)
+}
+
+// RequestProofs fetches a batch of merkle proofs from a remote node.
+func (p *peer) RequestProofs(reqID uint64, reqs []ProofReq) error {
+	return sendRequest(p.rw, GetProofsV2Msg, reqID, reqs)
+}
+
+// RequestHelperTrieProofs fetches a batch of HelperTrie merkle proofs from a remote node.
+func (p *peer) RequestHelperTrieProofs(reqID uint64, reqs []HelperTrieReq) error {
+	return sendRequest(p.rw, GetHelperTrieProofsMsg, reqID, reqs)
+}
+
+// Handshake executes the les protocol handshake, negotiating version number,
+// network IDs, difficulties, head and genesis blocks. Servers also announce
+// their flow control parameters which the client has to obey.
+// params不为nil表示本节点作为服务端 否则要求对方必须是服务端
+func (p *peer) Handshake(td *big.Int, head common.Hash, headNum uint64, genesis common.Hash, params *flowcontrol.ServerParams) error {
+	send := &statusData{
+		ProtocolVersion: uint32(p.version),
+		NetworkId:       p.network,
+		HeadTd:          td,
+		HeadHash:        head,
+		HeadNum:         headNum,
+		GenesisHash:     genesis,
+	}
+	if params != nil {
+		send.ServeHeaders = true
+		send.FlowControlBL = params.BufLimit
+		send.FlowControlMRR = params.MinRecharge
+		send.FlowControlMRC = defaultRequestCosts.encode()
+	}
+	errc := make(chan error, 2)
+	var status statusData // safe to read after two values have been received from errc
+
+	go func() {
+		errc <- p2p.Send(p.rw, StatusMsg, send)
+	}()
+	go func() {
+		errc <- p.readStatus(&status, genesis)
+	}()
+	timeout := time.NewTimer(handshakeTimeout)
+	defer timeout.Stop()
+	for i := 0; i < 2; i++ {
+		select {
+		case err := <-errc:
+			if err != nil {
+				return err
+			}
+		case <-timeout.C:
+			return p2p.DiscReadTimeout
+		}
+	}
+	if params != nil {
+		p.fcClient = flowcontrol.NewClientNode(params)
+	} else {
+		//客户端只连能提供服务的节点 并且按对方给的参数来估算自己的缓冲区
+		if !status.ServeHeaders || status.FlowControlBL == 0 || status.FlowControlMRR == 0 {
+			return errResp(ErrUselessPeer, "peer cannot serve requests")
+		}
+		p.fcParams = flowcontrol.ServerParams{BufLimit: status.FlowControlBL, MinRecharge: status.FlowControlMRR}
+		p.fcServer = flowcontrol.NewServerNode(&p.fcParams)
+		p.fcCosts = status.FlowControlMRC.decode()
+	}
+	p.headInfo = &announceData{Td: status.HeadTd, Hash: status.HeadHash, Number: status.HeadNum}
+	return nil
+}
+
+func (p *peer) readStatus(status *statusData, genesis common.Hash) error {
+	msg, err := p.rw.ReadMsg()
+	if err != nil {
+		return err
+	}
+	if msg.Code != StatusMsg {
+		return errResp(ErrNoStatusMsg, "first msg has code %x (!= %x)", msg.Code, StatusMsg)
+	}
+	if msg.Size > ProtocolMaxMsgSize {
+		return errResp(ErrMsgTooLarge, "%v > %v", msg.Size, ProtocolMaxMsgSize)
+	}
+	// Decode the handshake and make sure everything matches
+	if err := msg.Decode(status); err != nil {
+		return errResp(ErrDecode, "msg %v: %v", msg, err)
+	}
+	if status.NetworkId != p.network {
+		return errResp(ErrNetworkIdMismatch, "%d (!= %d)", status.NetworkId, p.network)
+	}
+	if int(status.ProtocolVersion) != p.version {
+		return errResp(ErrProtocolVersionMismatch, "%d (!= %d)", status.ProtocolVersion, p.version)
+	}
+	if status.GenesisHash != genesis {
+		return errResp(ErrGenesisBlockMismatch, "%x (!= %x)", status.GenesisHash, genesis)
+	}
+	if status.HeadTd == nil {
+		return errResp(ErrDecode, "missing total difficulty")
+	}
+	return nil
+}
+
+// String implements fmt.Stringer.
+func (p *peer) String() string {
+	return fmt.Sprintf("Peer %s [%s]", p.id,
+		fmt.Sprintf("les/%d", p.version),
+	)
+}
+
+// peerSet represents the collection of active peers currently participating in
+// the Light Ethereum sub-protocol.
+type peerSet struct {
+	peers  map[string]*peer
+	lock   sync.RWMutex
+	closed bool
+}
+
+// newPeerSet creates a new peer set to track the active participants.
+func newPeerSet() *peerSet {
+	return &peerSet{
+		peers: make(map[string]*peer),
+	}
+}
+
+// Register injects a new peer into the working set, or returns an error if the
+// peer is already known. If a new peer it registered, its broadcast loop is also
+// started.
+func (ps *peerSet) Register(p *peer) error {
+	ps.lock.Lock()
+	defer ps.lock.Unlock()
+
+	if ps.closed {
+		return errClosed
+	}
+	if _, ok := ps.peers[p.id]; ok {
+		return errAlreadyRegistered
+	}
+	ps.peers[p.id] = p
+	go p.broadcast()
+	return nil
+}
+
+// Unregister removes a remote peer from the active set, disabling any further
+// actions to/from that particular entity.
+func (ps *peerSet) Unregister(id string) error {
+	ps.lock.Lock()
+	defer ps.lock.Unlock()
+
+	p, ok := ps.peers[id]
+	if !ok {
+		return errNotRegistered
+	}
+	delete(ps.peers, id)
+	p.close()
+	return nil
+}
+
+// Peer retrieves the registered peer with the given id.
+func (ps *peerSet) Peer(id string) *peer {
+	ps.lock.RLock()
+	defer ps.lock.RUnlock()
+
+	return ps.peers[id]
+}
+
+// Len returns if the current number of peers in the set.
+func (ps *peerSet) Len() int {
+	ps.lock.RLock()
+	defer ps.lock.RUnlock()
+
+	return len(ps.peers)
+}
+
+// AllPeers returns all peers in a list
+func (ps *peerSet) AllPeers() []*peer {
+	ps.lock.RLock()
+	defer ps.lock.RUnlock()
+
+	list := make([]*peer, 0, len(ps.peers))
+	for _, p := range ps.peers {
+		list = append(list, p)
+	}
+	return list
+}
+
+// BestPeer retrieves the known peer with the currently highest total difficulty.
+func (ps *peerSet) BestPeer() *peer {
+	ps.lock.RLock()
+	defer ps.lock.RUnlock()
+
+	var (
+		bestPeer *peer
+		bestTd   *big.Int
+	)
+	for _, p := range ps.peers {
+		if td := p.Td(); bestPeer == nil || td.Cmp(bestTd) > 0 {
+			bestPeer, bestTd = p, td
+		}
+	}
+	return bestPeer
+}
+
+// Close disconnects all peers.
+// No new peers can be registered after Close has returned.
+func (ps *peerSet) Close() {
+	ps.lock.Lock()
+	defer ps.lock.Unlock()
+
+	for _, p := range ps.peers {
+		p.Disconnect(p2p.DiscQuitting)
+	}
+	ps.closed = true
+}
@@ -0,0 +1,166 @@
+package les
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"myeth/ethdb"
+	"myeth/light"
+	"myeth/log"
+)
+
+// 一个请求在这个时间内没有回复就换一个节点重试
+const requestTimeout = 5 * time.Second
+
+// Msg types delivered to the retriever
+const (
+	MsgBlockHeaders = iota
+	MsgBlockBodies
+	MsgCode
+	MsgReceipts
+	MsgProofsV2
+	MsgHelperTrieProofs
+)
+
+// Msg encodes a LES message that delivers reply data for a request
+type Msg struct {
+	MsgType int
+	ReqID   uint64
+	Obj     interface{}
+}
+
+// LesOdrRequest is a request the retriever can send to a server and validate
+// the reply of.
+type LesOdrRequest interface {
+	GetCost(*peer) uint64
+	CanSend(*peer) bool
+	Request(uint64, *peer) error
+	Validate(ethdb.Database, *Msg) error
+}
+
+// sentReq is a request waiting for its reply.
+type sentReq struct {
+	peer      *peer
+	deliverCh chan *Msg
+}
+
+// retrieveManager sends requests to suitable servers, matches the replies by
+// request ID and retries with another server on timeout or invalid replies.
+// 选一个流控允许并且链足够高的服务端发请求 回复校验不过就换一个
+type retrieveManager struct {
+	db       ethdb.Database
+	peers    *peerSet
+	dropPeer func(id string)
+
+	lock   sync.Mutex
+	sent   map[uint64]*sentReq
+	nextID uint64
+}
+
+func newRetrieveManager(db ethdb.Database, peers *peerSet, dropPeer func(id string)) *retrieveManager {
+	return &retrieveManager{
+		db:       db,
+		peers:    peers,
+		dropPeer: dropPeer,
+		sent:     make(map[uint64]*sentReq),
+	}
+}
+
+// retrieve sends a request to the servers until a valid reply arrives, no
+// more servers are able to serve it or the context is cancelled.
+func (rm *retrieveManager) retrieve(ctx context.Context, req LesOdrRequest) error {
+	tried := make(map[*peer]struct{})
+	for {
+		p, wait := rm.selectPeer(req, tried)
+		if p == nil {
+			return light.ErrNoPeers
+		}
+		//流控估计缓冲区不够 等回填之后再选一次
+		if wait > 0 {
+			select {
+			case <-time.After(wait):
+				continue
+			case <-ctx.Done():
+				return ctx.Err()
+			}
+		}
+		tried[p] = struct{}{}
+
+		reqID, deliverCh := rm.register(p)
+		p.fcServer.QueueRequest(reqID, req.GetCost(p))
+		if err := req.Request(reqID, p); err != nil {
+			rm.unregister(reqID)
+			continue
+		}
+		timeout := time.NewTimer(requestTimeout)
+		select {
+		case msg := <-deliverCh:
+			timeout.Stop()
+			if err := req.Validate(rm.db, msg); err != nil {
+				log.Debug("Invalid light response", "peer", p.id, "err", err)
+				rm.dropPeer(p.id)
+				continue
+			}
+			return nil
+		case <-timeout.C:
+			rm.unregister(reqID)
+		case <-ctx.Done():
+			timeout.Stop()
+			rm.unregister(reqID)
+			return ctx.Err()
+		}
+	}
+}
+
+// selectPeer picks the not yet tried server able to serve the request with
+// the shortest flow control waiting time.
+func (rm *retrieveManager) selectPeer(req LesOdrRequest, tried map[*peer]struct{}) (*peer, time.Duration) {
+	var (
+		best     *peer
+		bestWait time.Duration
+	)
+	for _, p := range rm.peers.AllPeers() {
+		if _, ok := tried[p]; ok || !req.CanSend(p) {
+			continue
+		}
+		wait, _ := p.fcServer.CanSend(req.GetCost(p))
+		if best == nil || wait < bestWait {
+			best, bestWait = p, wait
+		}
+	}
+	return best, bestWait
+}
+
+// register assigns a new request ID to a request sent to the given peer.
+func (rm *retrieveManager) register(p *peer) (uint64, chan *Msg) {
+	rm.lock.Lock()
+	defer rm.lock.Unlock()
+
+	rm.nextID++
+	ch := make(chan *Msg, 1)
+	rm.sent[rm.nextID] = &sentReq{peer: p, deliverCh: ch}
+	return rm.nextID, ch
+}
+
+func (rm *retrieveManager) unregister(reqID uint64) {
+	rm.lock.Lock()
+	defer rm.lock.Unlock()
+
+	delete(rm.sent, reqID)
+}
+
+// deliver hands a reply to the request waiting for it. Replies to unknown or
+// timed out requests, or coming from a different peer are reported as errors.
+func (rm *retrieveManager) deliver(p *peer, msg *Msg) error {
+	rm.lock.Lock()
+	defer rm.lock.Unlock()
+
+	req, ok := rm.sent[msg.ReqID]
+	if !ok || req.peer != p {
+		return errResp(ErrUnexpectedResponse, "reqID = %v", msg.ReqID)
+	}
+	delete(rm.sent, msg.ReqID)
+	req.deliverCh <- msg
+	return nil
+}
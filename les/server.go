@@ -0,0 +1,257 @@
+package les
+
+import (
+	"errors"
+	"math/big"
+	"sync"
+	"time"
+
+	"myeth/common"
+	"myeth/core"
+	"myeth/core/types"
+	"myeth/eth"
+	"myeth/ethdb"
+	"myeth/event"
+	"myeth/les/flowcontrol"
+	"myeth/light"
+	"myeth/log"
+	"myeth/p2p"
+	"myeth/rlp"
+	"myeth/trie"
+)
+
+const (
+	softResponseLimit = 2 * 1024 * 1024 // Target maximum size of returned blocks, headers or node data.
+
+	// 隔一段时间检查一下有没有新的CHT段可以构建
+	chtCheckInterval = time.Minute
+
+	// chainHeadChanSize is the size of channel listening to ChainHeadEvent.
+	chainHeadChanSize = 10
+)
+
+// errInvalidLightServ is returned if the share of the flow control capacity
+// granted to light clients isn't a percentage.
+var errInvalidLightServ = errors.New("invalid light serve percentage")
+
+// BlockChain is the full chain the server answers light client requests from.
+type BlockChain interface {
+	// Genesis retrieves the chain's genesis block.
+	Genesis() *types.Block
+
+	// CurrentHeader retrieves the current head header of the canonical chain.
+	CurrentHeader() *types.Header
+
+	// GetTd retrieves a block's total difficulty in the canonical chain from the
+	// database by hash and number.
+	GetTd(hash common.Hash, number uint64) *big.Int
+
+	// GetHeader retrieves a block header from the database by hash and number.
+	GetHeader(hash common.Hash, number uint64) *types.Header
+
+	// GetHeaderByHash retrieves a block header from the database by hash.
+	GetHeaderByHash(hash common.Hash) *types.Header
+
+	// GetHeaderByNumber retrieves a block header from the database by number.
+	GetHeaderByNumber(number uint64) *types.Header
+
+	// GetBodyRLP retrieves a block body in RLP encoding from the database by hash.
+	GetBodyRLP(hash common.Hash) rlp.RawValue
+
+	// GetReceiptsByHash retrieves the receipts for all transactions in a given block.
+	GetReceiptsByHash(hash common.Hash) types.Receipts
+
+	// SubscribeChainHeadEvent registers a subscription of ChainHeadEvent.
+	SubscribeChainHeadEvent(ch chan<- core.ChainHeadEvent) event.Subscription
+}
+
+// LesServer serves light clients connecting to a full node: it answers header,
+// body, receipt and merkle proof requests under flow control and maintains the
+// canonical hash trie sections clients use to look up headers by number.
+// 挂在全节点上 给轻节点提供数据
+type LesServer struct {
+	config     *eth.Config
+	blockchain BlockChain
+	chainDb    ethdb.Database
+	triedb     *trie.Database
+	peers      *peerSet
+	maxPeers   int
+	fcParams   flowcontrol.ServerParams // Flow control parameters assigned to every client
+
+	protocols []p2p.Protocol
+
+	headCh  chan core.ChainHeadEvent
+	headSub event.Subscription
+
+	quitSync chan struct{}
+	wg       sync.WaitGroup
+}
+
+// NewLesServer creates a light server attached to the given full node.
+func NewLesServer(e *eth.Ethereum, config *eth.Config) (*LesServer, error) {
+	if config.LightServ <= 0 || config.LightServ > 100 {
+		return nil, errInvalidLightServ
+	}
+	s := &LesServer{
+		config:     config,
+		blockchain: e.BlockChain(),
+		chainDb:    e.ChainDb(),
+		triedb:     trie.NewDatabase(e.ChainDb()),
+		peers:      newPeerSet(),
+		maxPeers:   config.LightPeers,
+		quitSync:   make(chan struct{}),
+	}
+	//LightServ是愿意拿出来服务轻节点的能力百分比 按比例降低缓冲区的回填速度
+	s.fcParams = flowcontrol.ServerParams{
+		BufLimit:    defaultServerParams.BufLimit,
+		MinRecharge: defaultServerParams.MinRecharge * uint64(config.LightServ) / 100,
+	}
+	s.protocols = make([]p2p.Protocol, 0, len(ServerProtocolVersions))
+	for _, version := range ServerProtocolVersions {
+		version := version
+
+		s.protocols = append(s.protocols, p2p.Protocol{
+			Name:    ProtocolName,
+			Version: version,
+			Length:  ProtocolLengths[version],
+			Run: func(p *p2p.Peer, rw p2p.MsgReadWriter) error {
+				peer := newPeer(int(version), config.NetworkId, p, rw)
+
+				s.wg.Add(1)
+				defer s.wg.Done()
+				return s.handle(peer)
+			},
+		})
+	}
+	return s, nil
+}
+
+// Protocols returns the les protocols the server speaks.
+func (s *LesServer) Protocols() []p2p.Protocol {
+	return s.protocols
+}
+
+// Start starts the head announcement and CHT building loops.
+func (s *LesServer) Start(srvr *p2p.Server) {
+	//先订阅再起协程 Start之后的新头都不会漏掉
+	s.headCh = make(chan core.ChainHeadEvent, chainHeadChanSize)
+	s.headSub = s.blockchain.SubscribeChainHeadEvent(s.headCh)
+
+	s.wg.Add(2)
+	go s.broadcastLoop()
+	go s.chtLoop()
+}
+
+// Stop stops the les service and disconnects all light clients.
+func (s *LesServer) Stop() {
+	close(s.quitSync)
+	s.peers.Close()
+	s.wg.Wait()
+}
+
+// removePeer drops a light client from the server.
+func (s *LesServer) removePeer(id string) {
+	peer := s.peers.Peer(id)
+	if peer == nil {
+		return
+	}
+	log.Debug("Removing light Ethereum peer", "peer", id)
+	if err := s.peers.Unregister(id); err != nil {
+		log.Error("Peer removal failed", "peer", id, "err", err)
+	}
+	peer.Peer.Disconnect(p2p.DiscUselessPeer)
+}
+
+// broadcastLoop announces every new chain head to the connected clients,
+// together with the depth of the reorg leading to it.
+func (s *LesServer) broadcastLoop() {
+	defer s.wg.Done()
+	defer s.headSub.Unsubscribe()
+
+	lastHead := s.blockchain.CurrentHeader()
+	for {
+		select {
+		case ev := <-s.headCh:
+			header := ev.Block.Header()
+			hash, number := header.Hash(), header.Number.Uint64()
+			td := s.blockchain.GetTd(hash, number)
+			if td == nil {
+				continue
+			}
+			//新的头不在原来的链上的话 告诉客户端要回退多少个块
+			var reorg uint64
+			if ancestor := s.commonAncestor(header, lastHead); ancestor != nil {
+				reorg = lastHead.Number.Uint64() - ancestor.Number.Uint64()
+			}
+			lastHead = header
+
+			announce := announceData{Hash: hash, Number: number, Td: td, ReorgDepth: reorg}
+			for _, p := range s.peers.AllPeers() {
+				p.AsyncSendAnnounce(announce)
+			}
+		case <-s.quitSync:
+			return
+		}
+	}
+}
+
+// commonAncestor returns the latest header present on the chains of both a
+// and b, or nil if the chains can't be traced back.
+func (s *LesServer) commonAncestor(a, b *types.Header) *types.Header {
+	for a != nil && b != nil && a.Number.Uint64() > b.Number.Uint64() {
+		a = s.blockchain.GetHeader(a.ParentHash, a.Number.Uint64()-1)
+	}
+	for a != nil && b != nil && b.Number.Uint64() > a.Number.Uint64() {
+		b = s.blockchain.GetHeader(b.ParentHash, b.Number.Uint64()-1)
+	}
+	for a != nil && b != nil && a.Hash() != b.Hash() {
+		if a.Number.Uint64() == 0 {
+			return nil
+		}
+		a = s.blockchain.GetHeader(a.ParentHash, a.Number.Uint64()-1)
+		b = s.blockchain.GetHeader(b.ParentHash, b.Number.Uint64()-1)
+	}
+	return a
+}
+
+// chtLoop periodically builds the canonical hash trie sections that got
+// enough confirmations.
+func (s *LesServer) chtLoop() {
+	defer s.wg.Done()
+
+	ticker := time.NewTicker(chtCheckInterval)
+	defer ticker.Stop()
+
+	s.buildChtSections()
+	for {
+		select {
+		case <-ticker.C:
+			s.buildChtSections()
+		case <-s.quitSync:
+			return
+		}
+	}
+}
+
+// buildChtSections processes all the sections that are final by now.
+func (s *LesServer) buildChtSections() {
+	head := s.blockchain.CurrentHeader().Number.Uint64()
+	for {
+		section, _ := light.GetChtSections(s.chainDb)
+		if (section+1)*light.ChtFrequency+light.ChtConfirmations > head+1 {
+			return
+		}
+		root, err := light.BuildChtSection(s.chainDb, section)
+		if err != nil {
+			log.Error("Failed to build CHT section", "section", section, "err", err)
+			return
+		}
+		log.Info("Built CHT section", "section", section, "root", root)
+
+		select {
+		case <-s.quitSync:
+			return
+		default:
+		}
+	}
+}
@@ -0,0 +1,300 @@
+package les
+
+import (
+	"encoding/binary"
+
+	"myeth/common"
+	"myeth/core/rawdb"
+	"myeth/core/state"
+	"myeth/core/types"
+	"myeth/eth"
+	"myeth/light"
+	"myeth/log"
+	"myeth/p2p"
+	"myeth/rlp"
+	"myeth/trie"
+)
+
+// handle is the callback invoked to manage the life cycle of a light client.
+// When this function terminates, the peer is disconnected.
+func (s *LesServer) handle(p *peer) error {
+	if s.peers.Len() >= s.maxPeers {
+		return p2p.DiscTooManyPeers
+	}
+	var (
+		genesis = s.blockchain.Genesis()
+		head    = s.blockchain.CurrentHeader()
+		hash    = head.Hash()
+		number  = head.Number.Uint64()
+		td      = s.blockchain.GetTd(hash, number)
+	)
+	if err := p.Handshake(td, hash, number, genesis.Hash(), &s.fcParams); err != nil {
+		log.Debug("Light Ethereum handshake failed", "peer", p, "err", err)
+		return err
+	}
+	if err := s.peers.Register(p); err != nil {
+		log.Error("Light Ethereum peer registration failed", "peer", p, "err", err)
+		return err
+	}
+	defer s.removePeer(p.id)
+
+	for {
+		if err := s.handleMsg(p); err != nil {
+			return err
+		}
+	}
+}
+
+// reject charges the maximum cost of a request to the client's buffer and
+// reports whether the request should be rejected instead of served.
+// 请求条数超过上限或者缓冲区不够 都直接拒绝
+func (s *LesServer) reject(p *peer, msgcode, reqCnt, maxCnt uint64) bool {
+	if reqCnt > maxCnt {
+		return true
+	}
+	costs := defaultRequestCosts[msgcode]
+	cost := costs.baseCost + reqCnt*costs.reqCost
+	if cost > s.fcParams.BufLimit {
+		cost = s.fcParams.BufLimit
+	}
+	return !p.fcClient.AcceptRequest(cost)
+}
+
+// handleMsg is invoked whenever an inbound message is received from a remote
+// peer. The remote connection is torn down upon returning any error.
+func (s *LesServer) handleMsg(p *peer) error {
+	msg, err := p.rw.ReadMsg()
+	if err != nil {
+		return err
+	}
+	if msg.Size > ProtocolMaxMsgSize {
+		return errResp(ErrMsgTooLarge, "%v > %v", msg.Size, ProtocolMaxMsgSize)
+	}
+	defer msg.Discard()
+
+	switch msg.Code {
+	case StatusMsg:
+		return errResp(ErrExtraStatusMsg, "uncontrolled status message")
+
+	case GetBlockHeadersMsg:
+		var req struct {
+			ReqID uint64
+			Query getBlockHeadersData
+		}
+		if err := msg.Decode(&req); err != nil {
+			return errResp(ErrDecode, "%v: %v", msg, err)
+		}
+		query := req.Query
+		if query.Amount > MaxHeaderFetch {
+			return errResp(ErrRequestRejected, "")
+		}
+		if s.reject(p, msg.Code, headerQueryItems(&query), MaxHeaderFetch+eth.MaxNonCanonical) {
+			return errResp(ErrRequestRejected, "")
+		}
+		headers := eth.QueryHeaders(s.blockchain, s.chainDb, query.Origin.Hash, query.Origin.Number, query.Amount, query.Skip, query.Reverse)
+		return p.SendBlockHeaders(req.ReqID, p.fcClient.BufferValue(), headers)
+
+	case GetBlockBodiesMsg:
+		var req struct {
+			ReqID  uint64
+			Hashes []common.Hash
+		}
+		if err := msg.Decode(&req); err != nil {
+			return errResp(ErrDecode, "msg %v: %v", msg, err)
+		}
+		if s.reject(p, msg.Code, uint64(len(req.Hashes)), MaxBodyFetch) {
+			return errResp(ErrRequestRejected, "")
+		}
+		// Gather blocks until the fetch or network limits is reached
+		var (
+			bytes  int
+			bodies []rlp.RawValue
+		)
+		for _, hash := range req.Hashes {
+			if bytes >= softResponseLimit {
+				break
+			}
+			if data := s.blockchain.GetBodyRLP(hash); len(data) != 0 {
+				bodies = append(bodies, data)
+				bytes += len(data)
+			}
+		}
+		return p.SendBlockBodiesRLP(req.ReqID, p.fcClient.BufferValue(), bodies)
+
+	case GetReceiptsMsg:
+		var req struct {
+			ReqID  uint64
+			Hashes []common.Hash
+		}
+		if err := msg.Decode(&req); err != nil {
+			return errResp(ErrDecode, "msg %v: %v", msg, err)
+		}
+		if s.reject(p, msg.Code, uint64(len(req.Hashes)), MaxReceiptFetch) {
+			return errResp(ErrRequestRejected, "")
+		}
+		// Gather state data until the fetch or network limits is reached
+		var (
+			bytes    int
+			receipts []rlp.RawValue
+		)
+		for _, hash := range req.Hashes {
+			if bytes >= softResponseLimit {
+				break
+			}
+			// Retrieve the requested block's receipts, skipping if unknown to us
+			results := s.blockchain.GetReceiptsByHash(hash)
+			if results == nil {
+				if header := s.blockchain.GetHeaderByHash(hash); header == nil || header.ReceiptHash != types.EmptyRootHash {
+					continue
+				}
+			}
+			// If known, encode and queue for response packet
+			if encoded, err := rlp.EncodeToBytes(results); err != nil {
+				log.Error("Failed to encode receipt", "err", err)
+			} else {
+				receipts = append(receipts, encoded)
+				bytes += len(encoded)
+			}
+		}
+		return p.SendReceiptsRLP(req.ReqID, p.fcClient.BufferValue(), receipts)
+
+	case GetCodeMsg:
+		var req struct {
+			ReqID uint64
+			Reqs  []CodeReq
+		}
+		if err := msg.Decode(&req); err != nil {
+			return errResp(ErrDecode, "msg %v: %v", msg, err)
+		}
+		if s.reject(p, msg.Code, uint64(len(req.Reqs)), MaxCodeFetch) {
+			return errResp(ErrRequestRejected, "")
+		}
+		var (
+			bytes int
+			data  [][]byte
+		)
+		for _, r := range req.Reqs {
+			if bytes >= softResponseLimit {
+				break
+			}
+			header := s.blockchain.GetHeaderByHash(r.BHash)
+			if header == nil {
+				continue
+			}
+			account, err := s.getAccount(header.Root, common.BytesToHash(r.AccKey))
+			if err != nil {
+				continue
+			}
+			code, _ := s.triedb.Node(common.BytesToHash(account.CodeHash))
+			data = append(data, code)
+			bytes += len(code)
+		}
+		return p.SendCode(req.ReqID, p.fcClient.BufferValue(), data)
+
+	case GetProofsV2Msg:
+		var req struct {
+			ReqID uint64
+			Reqs  []ProofReq
+		}
+		if err := msg.Decode(&req); err != nil {
+			return errResp(ErrDecode, "msg %v: %v", msg, err)
+		}
+		if s.reject(p, msg.Code, uint64(len(req.Reqs)), MaxProofsFetch) {
+			return errResp(ErrRequestRejected, "")
+		}
+		//所有证明的节点合并到一个集合里 重复的节点只发一次
+		nodes := light.NewNodeSet()
+		for _, r := range req.Reqs {
+			if nodes.DataSize() >= softResponseLimit {
+				break
+			}
+			header := s.blockchain.GetHeaderByHash(r.BHash)
+			if header == nil {
+				continue
+			}
+			// Open the account or the storage trie the proof is requested from
+			root := header.Root
+			if len(r.AccKey) > 0 {
+				account, err := s.getAccount(header.Root, common.BytesToHash(r.AccKey))
+				if err != nil {
+					continue
+				}
+				root = account.Root
+			}
+			tr, err := trie.NewSecure(root, s.triedb, 0)
+			if err != nil {
+				continue
+			}
+			tr.Prove(r.Key, r.FromLevel, nodes)
+		}
+		return p.SendProofsV2(req.ReqID, p.fcClient.BufferValue(), nodes.NodeList())
+
+	case GetHelperTrieProofsMsg:
+		var req struct {
+			ReqID uint64
+			Reqs  []HelperTrieReq
+		}
+		if err := msg.Decode(&req); err != nil {
+			return errResp(ErrDecode, "msg %v: %v", msg, err)
+		}
+		if s.reject(p, msg.Code, uint64(len(req.Reqs)), MaxHelperTrieProofsFetch) {
+			return errResp(ErrRequestRejected, "")
+		}
+		var (
+			auxBytes int
+			auxData  [][]byte
+		)
+		nodes := light.NewNodeSet()
+		for _, r := range req.Reqs {
+			if nodes.DataSize()+auxBytes >= softResponseLimit {
+				break
+			}
+			if r.Type != htCanonical {
+				continue
+			}
+			sectionHead := rawdb.ReadCanonicalHash(s.chainDb, (r.TrieIdx+1)*light.ChtFrequency-1)
+			root := light.GetChtRoot(s.chainDb, r.TrieIdx, sectionHead)
+			if root == (common.Hash{}) {
+				continue
+			}
+			tr, err := trie.New(root, s.triedb)
+			if err != nil {
+				continue
+			}
+			if r.AuxReq == auxHeader && len(r.Key) == 8 {
+				if header := s.blockchain.GetHeaderByNumber(binary.BigEndian.Uint64(r.Key)); header != nil {
+					data, err := rlp.EncodeToBytes(header)
+					if err != nil {
+						continue
+					}
+					auxData = append(auxData, data)
+					auxBytes += len(data)
+				}
+			}
+			tr.Prove(r.Key, r.FromLevel, nodes)
+		}
+		return p.SendHelperTrieProofs(req.ReqID, p.fcClient.BufferValue(), HelperTrieResps{Proofs: nodes.NodeList(), AuxData: auxData})
+
+	default:
+		return errResp(ErrInvalidMsgCode, "%v", msg.Code)
+	}
+}
+
+// getAccount retrieves an account from the state trie of the given root by its
+// hashed address.
+func (s *LesServer) getAccount(root, hash common.Hash) (state.Account, error) {
+	var account state.Account
+
+	tr, err := trie.New(root, s.triedb)
+	if err != nil {
+		return account, err
+	}
+	blob, err := tr.TryGet(hash[:])
+	if err != nil {
+		return account, err
+	}
+	if err = rlp.DecodeBytes(blob, &account); err != nil {
+		return account, err
+	}
+	return account, nil
+}
@@ -0,0 +1,187 @@
+package les
+
+import (
+	"crypto/rand"
+	"math/big"
+	"testing"
+	"time"
+
+	"myeth/common"
+	"myeth/consensus/ethash"
+	"myeth/core"
+	"myeth/core/types"
+	"myeth/eth"
+	"myeth/ethdb"
+	"myeth/p2p"
+	"myeth/p2p/discover"
+	"myeth/params"
+)
+
+// newTestServer creates a light server on top of an in-memory chain with only
+// the genesis block and starts it.
+func newTestServer(t *testing.T) (*LesServer, *core.BlockChain) {
+	var (
+		db    = ethdb.NewMemDatabase()
+		gspec = &core.Genesis{Config: params.TestChainConfig}
+	)
+	gspec.MustCommit(db)
+
+	blockchain, err := core.NewBlockChain(db, gspec.Config, ethash.New())
+	if err != nil {
+		t.Fatalf("failed to create block chain: %v", err)
+	}
+	s := &LesServer{
+		config:     &eth.DefaultConfig,
+		blockchain: blockchain,
+		chainDb:    db,
+		peers:      newPeerSet(),
+		quitSync:   make(chan struct{}),
+	}
+	s.Start(nil)
+
+	return s, blockchain
+}
+
+// extendChain inserts n empty blocks on top of the current head one by one, so
+// every one of them is announced as a new head.
+func extendChain(blockchain *core.BlockChain, n int) error {
+	parent := blockchain.CurrentBlock()
+	for i := 0; i < n; i++ {
+		header := &types.Header{
+			ParentHash: parent.Hash(),
+			Difficulty: params.GenesisDifficulty,
+			Number:     new(big.Int).Add(parent.Number(), common.Big1),
+			GasLimit:   parent.Header().GasLimit,
+			Time:       new(big.Int).Add(parent.Time(), big.NewInt(10)),
+		}
+		block := types.NewBlock(header, nil, nil, nil)
+		if _, err := blockchain.InsertChain(types.Blocks{block}); err != nil {
+			return err
+		}
+		parent = block
+	}
+	return nil
+}
+
+// newTestPeer creates a light client peer talking through a message pipe and
+// registers it at the server, which starts its broadcaster.
+func newTestPeer(t *testing.T, s *LesServer) (*peer, *p2p.MsgPipeRW) {
+	app, net := p2p.MsgPipe()
+
+	var id discover.NodeID
+	rand.Read(id[:])
+
+	p := newPeer(lpv2, eth.DefaultConfig.NetworkId, p2p.NewPeer(id, "client", nil), net)
+	if err := s.peers.Register(p); err != nil {
+		t.Fatalf("failed to register peer: %v", err)
+	}
+	return p, app
+}
+
+// readAnnounce waits for the next head announcement sent to a peer.
+func readAnnounce(rw p2p.MsgReader, timeout time.Duration) (*announceData, error) {
+	type result struct {
+		announce *announceData
+		err      error
+	}
+	done := make(chan result, 1)
+	go func() {
+		msg, err := rw.ReadMsg()
+		if err != nil {
+			done <- result{nil, err}
+			return
+		}
+		defer msg.Discard()
+
+		var announce announceData
+		if err := msg.Decode(&announce); err != nil {
+			done <- result{nil, err}
+			return
+		}
+		done <- result{&announce, nil}
+	}()
+	select {
+	case res := <-done:
+		return res.announce, res.err
+	case <-time.After(timeout):
+		return nil, nil
+	}
+}
+
+// Tests that a light client which doesn't read its announcements can't stall
+// the server's announce loop, and the others still learn about every new head.
+func TestSlowClientAnnounce(t *testing.T) {
+	//失败时announce循环可能一直卡着 所以只在成功时才停止服务端
+	s, blockchain := newTestServer(t)
+
+	_, slow := newTestPeer(t, s)
+	defer slow.Close()
+	_, fast := newTestPeer(t, s)
+	defer fast.Close()
+
+	// Announce many more heads than the slow client's queue can hold, none of them
+	// being read by the slow client, while the fast one must receive every one
+	for i := 1; i <= 4*maxQueuedAnnounces; i++ {
+		//announce循环卡住的话 链的事件发不出去 插入也会卡住
+		errc := make(chan error, 1)
+		go func() { errc <- extendChain(blockchain, 1) }()
+		select {
+		case err := <-errc:
+			if err != nil {
+				t.Fatalf("head %d: failed to insert block: %v", i, err)
+			}
+		case <-time.After(time.Second):
+			t.Fatalf("head %d: announce loop stalled by slow client", i)
+		}
+		announce, err := readAnnounce(fast, time.Second)
+		if err != nil {
+			t.Fatalf("head %d: failed to read announcement: %v", i, err)
+		}
+		if announce == nil {
+			t.Fatalf("head %d: announce loop stalled by slow client", i)
+		}
+		if announce.Number != uint64(i) {
+			t.Fatalf("head %d: announced number mismatch: have %d, want %d", i, announce.Number, i)
+		}
+	}
+	s.Stop()
+}
+
+// Tests that the broadcaster of a peer exits once the peer is unregistered and
+// doesn't send the announcements queued afterwards.
+func TestBroadcasterExitOnUnregister(t *testing.T) {
+	s, _ := newTestServer(t)
+	defer s.Stop()
+
+	p, app := newTestPeer(t, s)
+	defer app.Close()
+
+	// Make sure the broadcaster is running before unregistering the peer
+	p.AsyncSendAnnounce(announceData{Number: 1, Td: big.NewInt(1)})
+	if announce, err := readAnnounce(app, time.Second); err != nil || announce == nil || announce.Number != 1 {
+		t.Fatalf("first announcement not delivered: %v, %v", announce, err)
+	}
+	if err := s.peers.Unregister(p.id); err != nil {
+		t.Fatalf("failed to unregister peer: %v", err)
+	}
+	// Give the broadcaster time to notice the termination
+	time.Sleep(50 * time.Millisecond)
+
+	p.AsyncSendAnnounce(announceData{Number: 2, Td: big.NewInt(2)})
+	if announce, err := readAnnounce(app, 200*time.Millisecond); announce != nil || err != nil {
+		t.Fatalf("announcement delivered after unregister: %v, %v", announce, err)
+	}
+}
+
+// Tests that the server can't be created with a share of the flow control
+// capacity which isn't a percentage.
+func TestNewLesServerInvalidLightServ(t *testing.T) {
+	for _, serv := range []int{-1, 0, 101} {
+		config := eth.DefaultConfig
+		config.LightServ = serv
+
+		if s, err := NewLesServer(nil, &config); err != errInvalidLightServ || s != nil {
+			t.Errorf("light serve %d: have %v, %v, want %v", serv, s, err, errInvalidLightServ)
+		}
+	}
+}
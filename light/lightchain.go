@@ -0,0 +1,296 @@
+package light
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math/big"
+	"sync"
+	"sync/atomic"
+
+	"myeth/common"
+	"myeth/core"
+	"myeth/core/rawdb"
+	"myeth/core/state"
+	"myeth/core/types"
+	"myeth/event"
+	"myeth/log"
+	"myeth/params"
+)
+
+var (
+	// ErrNoGenesis is returned when the database holds no genesis header.
+	ErrNoGenesis = errors.New("genesis not found in chain")
+
+	// ErrUnknownAncestor is returned when the parent of an inserted header is
+	// not known locally.
+	ErrUnknownAncestor = errors.New("unknown ancestor")
+)
+
+// LightChain represents a canonical chain that by default only handles block
+// headers, downloading block bodies and receipts on demand through an ODR
+// interface. It only does header validation during chain insertion.
+// 轻节点的链 只保存区块头 区块体和收据都是需要的时候通过ODR去取
+type LightChain struct {
+	odr     OdrBackend
+	genesis *types.Header
+
+	currentHeader atomic.Value // Current head of the header chain
+	chainHeadFeed event.Feed
+
+	mu sync.RWMutex // Lock protecting header insertion
+}
+
+// NewLightChain returns a fully initialised light chain using information
+// available in the database. If a trusted checkpoint is given, its CHT root
+// is used to retrieve headers not yet synced locally.
+func NewLightChain(odr OdrBackend, checkpoint *params.TrustedCheckpoint) (*LightChain, error) {
+	db := odr.Database()
+
+	genesisHash := rawdb.ReadCanonicalHash(db, 0)
+	if genesisHash == (common.Hash{}) {
+		return nil, ErrNoGenesis
+	}
+	genesis := rawdb.ReadHeader(db, genesisHash, 0)
+	if genesis == nil {
+		return nil, ErrNoGenesis
+	}
+	// The genesis may have been written by core without a total difficulty
+	if rawdb.ReadTd(db, genesisHash, 0) == nil {
+		rawdb.WriteTd(db, genesisHash, 0, genesis.Difficulty)
+	}
+	bc := &LightChain{
+		odr:     odr,
+		genesis: genesis,
+	}
+	bc.currentHeader.Store(genesis)
+	if head := rawdb.ReadHeadHeaderHash(db); head != (common.Hash{}) {
+		if header := bc.GetHeaderByHash(head); header != nil {
+			bc.currentHeader.Store(header)
+		}
+	}
+	if checkpoint != nil {
+		bc.AddTrustedCheckpoint(checkpoint)
+	}
+	header := bc.CurrentHeader()
+	log.Info("Loaded most recent local header", "number", header.Number, "hash", header.Hash())
+	return bc, nil
+}
+
+// AddTrustedCheckpoint stores the CHT root of a trusted checkpoint, unless
+// more recent sections are already known locally.
+func (bc *LightChain) AddTrustedCheckpoint(cp *params.TrustedCheckpoint) {
+	db := bc.odr.Database()
+	if sections, _ := GetChtSections(db); sections > cp.SectionIndex {
+		return
+	}
+	StoreChtRoot(db, cp.SectionIndex, cp.SectionHead, cp.CHTRoot)
+	StoreChtSections(db, cp.SectionIndex+1, cp.SectionHead)
+	log.Info("Added trusted checkpoint", "section", cp.SectionIndex, "head", cp.SectionHead, "chtroot", cp.CHTRoot)
+}
+
+// SyncCheckpoint fetches the last header of a trusted checkpoint through a CHT
+// proof and makes it the head of the chain if it's ahead of the local one, so
+// header sync can continue from there instead of the genesis block.
+// 返回false表示还拿不到检查点的区块头 调用方应该等下次再试
+func (bc *LightChain) SyncCheckpoint(ctx context.Context, cp *params.TrustedCheckpoint) bool {
+	latest := (cp.SectionIndex+1)*ChtFrequency - 1
+	if bc.CurrentHeader().Number.Uint64() >= latest {
+		return true
+	}
+	header, err := GetHeaderByNumber(ctx, bc.odr, latest)
+	if err != nil || header.Hash() != cp.SectionHead {
+		return false
+	}
+	bc.mu.Lock()
+	defer bc.mu.Unlock()
+
+	head := bc.CurrentHeader()
+	if td := bc.GetTd(header.Hash(), latest); td != nil && td.Cmp(bc.GetTd(head.Hash(), head.Number.Uint64())) > 0 {
+		rawdb.WriteHeadHeaderHash(bc.odr.Database(), header.Hash())
+		bc.currentHeader.Store(header)
+		bc.chainHeadFeed.Send(core.ChainHeadEvent{Block: types.NewBlockWithHeader(header)})
+	}
+	return true
+}
+
+// Odr returns the ODR backend of the chain
+func (bc *LightChain) Odr() OdrBackend {
+	return bc.odr
+}
+
+// Genesis returns the genesis block
+func (bc *LightChain) Genesis() *types.Block {
+	return types.NewBlockWithHeader(bc.genesis)
+}
+
+// CurrentHeader retrieves the current head header of the canonical chain.
+func (bc *LightChain) CurrentHeader() *types.Header {
+	return bc.currentHeader.Load().(*types.Header)
+}
+
+// State returns a new mutable state based on the current head, with missing
+// trie nodes retrieved on demand.
+func (bc *LightChain) State(ctx context.Context) (*state.StateDB, error) {
+	return NewState(ctx, bc.CurrentHeader(), bc.odr)
+}
+
+// StateAt returns a new mutable state based on the given header.
+func (bc *LightChain) StateAt(ctx context.Context, header *types.Header) (*state.StateDB, error) {
+	return NewState(ctx, header, bc.odr)
+}
+
+// GetHeader retrieves a block header from the database by hash and number.
+func (bc *LightChain) GetHeader(hash common.Hash, number uint64) *types.Header {
+	return rawdb.ReadHeader(bc.odr.Database(), hash, number)
+}
+
+// GetHeaderByHash retrieves a block header from the database by hash.
+func (bc *LightChain) GetHeaderByHash(hash common.Hash) *types.Header {
+	number := rawdb.ReadHeaderNumber(bc.odr.Database(), hash)
+	if number == nil {
+		return nil
+	}
+	return bc.GetHeader(hash, *number)
+}
+
+// HasHeader checks if a block header is present in the database or not.
+func (bc *LightChain) HasHeader(hash common.Hash, number uint64) bool {
+	return rawdb.HasHeader(bc.odr.Database(), hash, number)
+}
+
+// GetHeaderByNumber retrieves a canonical block header from the local database
+// by number.
+func (bc *LightChain) GetHeaderByNumber(number uint64) *types.Header {
+	hash := rawdb.ReadCanonicalHash(bc.odr.Database(), number)
+	if hash == (common.Hash{}) {
+		return nil
+	}
+	return bc.GetHeader(hash, number)
+}
+
+// GetHeaderByNumberOdr retrieves a canonical block header by number, falling
+// back to a CHT proof from the network if it's not available locally.
+func (bc *LightChain) GetHeaderByNumberOdr(ctx context.Context, number uint64) (*types.Header, error) {
+	return GetHeaderByNumber(ctx, bc.odr, number)
+}
+
+// GetTd retrieves a block's total difficulty in the canonical chain from the
+// database by hash and number.
+func (bc *LightChain) GetTd(hash common.Hash, number uint64) *big.Int {
+	return rawdb.ReadTd(bc.odr.Database(), hash, number)
+}
+
+// GetBody retrieves a block body (transactions and uncles) from the database
+// or ODR service by hash.
+func (bc *LightChain) GetBody(ctx context.Context, hash common.Hash) (*types.Body, error) {
+	number := rawdb.ReadHeaderNumber(bc.odr.Database(), hash)
+	if number == nil {
+		return nil, ErrNoHeader
+	}
+	return GetBody(ctx, bc.odr, hash, *number)
+}
+
+// GetBlock retrieves a block from the database or ODR service by hash and number.
+func (bc *LightChain) GetBlock(ctx context.Context, hash common.Hash, number uint64) (*types.Block, error) {
+	return GetBlock(ctx, bc.odr, hash, number)
+}
+
+// GetBlockByHash retrieves a block from the database or ODR service by hash.
+func (bc *LightChain) GetBlockByHash(ctx context.Context, hash common.Hash) (*types.Block, error) {
+	number := rawdb.ReadHeaderNumber(bc.odr.Database(), hash)
+	if number == nil {
+		return nil, ErrNoHeader
+	}
+	return bc.GetBlock(ctx, hash, *number)
+}
+
+// GetBlockReceipts retrieves the receipts of a block from the database or ODR
+// service by hash.
+func (bc *LightChain) GetBlockReceipts(ctx context.Context, hash common.Hash) (types.Receipts, error) {
+	number := rawdb.ReadHeaderNumber(bc.odr.Database(), hash)
+	if number == nil {
+		return nil, ErrNoHeader
+	}
+	return GetBlockReceipts(ctx, bc.odr, hash, *number)
+}
+
+// InsertHeaderChain attempts to insert the given header chain in to the local
+// chain, possibly creating a reorg. The headers must be ordered and linked,
+// the first one having a locally known parent. It returns the index of the
+// failing header on error.
+// 只检查父子关系和高度 按总难度决定是否切换规范链
+func (bc *LightChain) InsertHeaderChain(chain []*types.Header) (int, error) {
+	for i := 1; i < len(chain); i++ {
+		if chain[i].Number.Uint64() != chain[i-1].Number.Uint64()+1 || chain[i].ParentHash != chain[i-1].Hash() {
+			return i, fmt.Errorf("non contiguous insert: item %d is #%d [%x…], item %d is #%d [%x…] (parent [%x…])",
+				i-1, chain[i-1].Number, chain[i-1].Hash().Bytes()[:4], i, chain[i].Number, chain[i].Hash().Bytes()[:4], chain[i].ParentHash[:4])
+		}
+	}
+	bc.mu.Lock()
+	defer bc.mu.Unlock()
+
+	var (
+		db      = bc.odr.Database()
+		head    = bc.CurrentHeader()
+		changed = false
+	)
+	for i, header := range chain {
+		hash, number := header.Hash(), header.Number.Uint64()
+		if number == 0 {
+			return i, ErrUnknownAncestor
+		}
+		ptd := bc.GetTd(header.ParentHash, number-1)
+		if ptd == nil {
+			return i, ErrUnknownAncestor
+		}
+		td := new(big.Int).Add(header.Difficulty, ptd)
+		if !bc.HasHeader(hash, number) {
+			rawdb.WriteHeader(db, header)
+			rawdb.WriteTd(db, hash, number, td)
+		}
+		// Switch the canonical chain if the new header has more work
+		if td.Cmp(bc.GetTd(head.Hash(), head.Number.Uint64())) > 0 {
+			bc.setHead(header, head)
+			head, changed = header, true
+		}
+	}
+	if changed {
+		bc.chainHeadFeed.Send(core.ChainHeadEvent{Block: types.NewBlockWithHeader(head)})
+	}
+	return len(chain), nil
+}
+
+// setHead makes header the new canonical head, rewriting the canonical number
+// to hash mappings back to the common ancestor with the old head.
+func (bc *LightChain) setHead(header, old *types.Header) {
+	db := bc.odr.Database()
+
+	// Delete any canonical number assignments above the new head
+	for i := header.Number.Uint64() + 1; i <= old.Number.Uint64(); i++ {
+		rawdb.DeleteCanonicalHash(db, i)
+	}
+	// Overwrite any stale canonical number assignments
+	var (
+		hash   = header.Hash()
+		number = header.Number.Uint64()
+		cur    = header
+	)
+	for rawdb.ReadCanonicalHash(db, number) != hash {
+		rawdb.WriteCanonicalHash(db, hash, number)
+		if number == 0 {
+			break
+		}
+		hash, number = cur.ParentHash, number-1
+		if cur = bc.GetHeader(hash, number); cur == nil {
+			break
+		}
+	}
+	rawdb.WriteHeadHeaderHash(db, header.Hash())
+	bc.currentHeader.Store(header)
+}
+
+// SubscribeChainHeadEvent registers a subscription of ChainHeadEvent.
+func (bc *LightChain) SubscribeChainHeadEvent(ch chan<- core.ChainHeadEvent) event.Subscription {
+	return bc.chainHeadFeed.Subscribe(ch)
+}
@@ -0,0 +1,140 @@
+// Package light implements on-demand retrieval capable state and chain objects
+// for the Ethereum Light Client.
+package light
+
+import (
+	"context"
+	"errors"
+	"math/big"
+
+	"myeth/common"
+	"myeth/core/rawdb"
+	"myeth/core/types"
+	"myeth/ethdb"
+)
+
+// NoOdr is the default context passed to an ODR capable function when the ODR
+// service is not required.
+var NoOdr = context.Background()
+
+// ErrNoPeers is returned if no peers capable of serving a queued request are available
+var ErrNoPeers = errors.New("no suitable peers available")
+
+// OdrBackend is an interface to a backend service that handles ODR retrievals type
+// 轻节点缺什么数据就通过它向les服务端要 拿到并校验后写进本地数据库
+type OdrBackend interface {
+	Database() ethdb.Database
+	Retrieve(ctx context.Context, req OdrRequest) error
+}
+
+// OdrRequest is an interface for retrieval requests
+type OdrRequest interface {
+	StoreResult(db ethdb.Database)
+}
+
+// TrieID identifies a state or account storage trie
+type TrieID struct {
+	BlockHash, Root common.Hash
+	BlockNumber     uint64
+	AccKey          []byte
+}
+
+// StateTrieID returns a TrieID for a state trie belonging to a certain block
+// header.
+func StateTrieID(header *types.Header) *TrieID {
+	return &TrieID{
+		BlockHash:   header.Hash(),
+		BlockNumber: header.Number.Uint64(),
+		AccKey:      nil,
+		Root:        header.Root,
+	}
+}
+
+// StorageTrieID returns a TrieID for a contract storage trie at a given account
+// of a given state trie. It also requires the root hash of the trie for
+// checking Merkle proofs.
+func StorageTrieID(state *TrieID, addrHash, root common.Hash) *TrieID {
+	return &TrieID{
+		BlockHash:   state.BlockHash,
+		BlockNumber: state.BlockNumber,
+		AccKey:      addrHash[:],
+		Root:        root,
+	}
+}
+
+// TrieRequest is the ODR request type for state/storage trie entries
+type TrieRequest struct {
+	OdrRequest
+	Id    *TrieID
+	Key   []byte
+	Proof *NodeSet
+}
+
+// StoreResult stores the retrieved data in local database
+func (req *TrieRequest) StoreResult(db ethdb.Database) {
+	req.Proof.Store(db)
+}
+
+// CodeRequest is the ODR request type for retrieving contract code
+type CodeRequest struct {
+	OdrRequest
+	Id   *TrieID // references storage trie of the account
+	Hash common.Hash
+	Data []byte
+}
+
+// StoreResult stores the retrieved data in local database
+func (req *CodeRequest) StoreResult(db ethdb.Database) {
+	db.Put(req.Hash[:], req.Data)
+}
+
+// BlockRequest is the ODR request type for retrieving block bodies
+type BlockRequest struct {
+	OdrRequest
+	Hash   common.Hash
+	Number uint64
+	Rlp    []byte
+}
+
+// StoreResult stores the retrieved data in local database
+func (req *BlockRequest) StoreResult(db ethdb.Database) {
+	rawdb.WriteBodyRLP(db, req.Hash, req.Number, req.Rlp)
+}
+
+// ReceiptsRequest is the ODR request type for retrieving block bodies
+type ReceiptsRequest struct {
+	OdrRequest
+	Hash     common.Hash
+	Number   uint64
+	Receipts types.Receipts
+}
+
+// StoreResult stores the retrieved data in local database
+func (req *ReceiptsRequest) StoreResult(db ethdb.Database) {
+	rawdb.WriteReceipts(db, req.Hash, req.Number, req.Receipts)
+}
+
+// ChtRequest is the ODR request type for state/storage trie entries
+// 用CHT证明按高度取规范链上的区块头 不需要本地有这一段的头
+type ChtRequest struct {
+	OdrRequest
+	ChtNum, BlockNum uint64
+	ChtRoot          common.Hash
+	Header           *types.Header
+	Td               *big.Int
+	Proof            *NodeSet
+}
+
+// StoreResult stores the retrieved data in local database
+func (req *ChtRequest) StoreResult(db ethdb.Database) {
+	hash, num := req.Header.Hash(), req.Header.Number.Uint64()
+
+	rawdb.WriteHeader(db, req.Header)
+	rawdb.WriteTd(db, hash, num, req.Td)
+	rawdb.WriteCanonicalHash(db, hash, num)
+}
+
+// ChtKey returns the key of a block number in the canonical hash trie.
+func ChtKey(number uint64) []byte {
+	return encodeBlockNumber(number)
+}
@@ -0,0 +1,139 @@
+package light
+
+import (
+	"encoding/binary"
+	"errors"
+	"math/big"
+
+	"myeth/common"
+	"myeth/core/rawdb"
+	"myeth/ethdb"
+	"myeth/rlp"
+	"myeth/trie"
+)
+
+const (
+	// ChtFrequency is the block frequency for creating CHTs
+	// 每这么多个块构建一段CHT
+	ChtFrequency = 4096
+
+	// ChtConfirmations is the number of confirmations needed before a section
+	// is processed, so that it is guaranteed not to be reorged any more.
+	ChtConfirmations = 256
+)
+
+var (
+	// ErrNoHeader is returned when a canonical header needed to build a CHT
+	// section is not available locally.
+	ErrNoHeader = errors.New("header not found")
+
+	// ErrNoTrustedCht is returned if the requested block is not covered by any
+	// locally known canonical hash trie.
+	ErrNoTrustedCht = errors.New("no trusted canonical hash trie")
+)
+
+var (
+	chtRootPrefix  = []byte("chtRoot-") // chtRootPrefix + section (uint64 big endian) + section head hash -> cht root
+	chtSectionsKey = []byte("chtSections")
+)
+
+// ChtNode structures are stored in the Canonical Hash Trie in an RLP encoded format
+type ChtNode struct {
+	Hash common.Hash
+	Td   *big.Int
+}
+
+// encodeBlockNumber encodes a block number as big endian uint64
+func encodeBlockNumber(number uint64) []byte {
+	enc := make([]byte, 8)
+	binary.BigEndian.PutUint64(enc, number)
+	return enc
+}
+
+// GetChtRoot reads the CHT root associated to the given section from the database
+// Note that sectionIdx is specified according to ChtFrequency.
+func GetChtRoot(db ethdb.Database, sectionIdx uint64, sectionHead common.Hash) common.Hash {
+	data, _ := db.Get(append(append(chtRootPrefix, encodeBlockNumber(sectionIdx)...), sectionHead.Bytes()...))
+	return common.BytesToHash(data)
+}
+
+// StoreChtRoot writes the CHT root associated to the given section into the database
+// Note that sectionIdx is specified according to ChtFrequency.
+func StoreChtRoot(db ethdb.Database, sectionIdx uint64, sectionHead, root common.Hash) {
+	db.Put(append(append(chtRootPrefix, encodeBlockNumber(sectionIdx)...), sectionHead.Bytes()...), root.Bytes())
+}
+
+// GetChtSections returns the number of CHT sections known so far and the head
+// hash of the last one.
+func GetChtSections(db ethdb.Database) (uint64, common.Hash) {
+	data, _ := db.Get(chtSectionsKey)
+	if len(data) != 8+common.HashLength {
+		return 0, common.Hash{}
+	}
+	return binary.BigEndian.Uint64(data[:8]), common.BytesToHash(data[8:])
+}
+
+// StoreChtSections stores the number of CHT sections known so far together
+// with the head hash of the last one.
+func StoreChtSections(db ethdb.Database, sections uint64, lastHead common.Hash) {
+	db.Put(chtSectionsKey, append(encodeBlockNumber(sections), lastHead.Bytes()...))
+}
+
+// LatestChtRoot returns the index and root of the most recent CHT section
+// known locally, or ErrNoTrustedCht if none is available yet.
+func LatestChtRoot(db ethdb.Database) (uint64, common.Hash, error) {
+	sections, head := GetChtSections(db)
+	if sections == 0 {
+		return 0, common.Hash{}, ErrNoTrustedCht
+	}
+	root := GetChtRoot(db, sections-1, head)
+	if root == (common.Hash{}) {
+		return 0, common.Hash{}, ErrNoTrustedCht
+	}
+	return sections - 1, root, nil
+}
+
+// BuildChtSection extends the canonical hash trie with the given section and
+// stores the resulting root. The trie is cumulative, the root of a section
+// proves every canonical block from genesis up to the end of the section.
+// 每段CHT都在上一段的基础上继续插入 所以最新的根能证明之前所有的块
+func BuildChtSection(db ethdb.Database, section uint64) (common.Hash, error) {
+	var root common.Hash
+	if section > 0 {
+		if sections, prevHead := GetChtSections(db); sections == section {
+			root = GetChtRoot(db, section-1, prevHead)
+		}
+		if root == (common.Hash{}) {
+			return common.Hash{}, ErrNoTrustedCht
+		}
+	}
+	triedb := trie.NewDatabase(db)
+	t, err := trie.New(root, triedb)
+	if err != nil {
+		return common.Hash{}, err
+	}
+	for num := section * ChtFrequency; num < (section+1)*ChtFrequency; num++ {
+		hash := rawdb.ReadCanonicalHash(db, num)
+		if hash == (common.Hash{}) {
+			return common.Hash{}, ErrNoHeader
+		}
+		td := rawdb.ReadTd(db, hash, num)
+		if td == nil {
+			return common.Hash{}, ErrNoHeader
+		}
+		data, _ := rlp.EncodeToBytes(ChtNode{hash, td})
+		if err := t.TryUpdate(ChtKey(num), data); err != nil {
+			return common.Hash{}, err
+		}
+	}
+	if root, err = t.Commit(nil); err != nil {
+		return common.Hash{}, err
+	}
+	if err := triedb.Commit(root, false); err != nil {
+		return common.Hash{}, err
+	}
+	sectionHead := rawdb.ReadCanonicalHash(db, (section+1)*ChtFrequency-1)
+	StoreChtRoot(db, section, sectionHead, root)
+	StoreChtSections(db, section+1, sectionHead)
+	return root, nil
+}
@@ -0,0 +1,128 @@
+package light
+
+import (
+	"context"
+	"fmt"
+
+	"myeth/common"
+	"myeth/core/state"
+	"myeth/core/types"
+	"myeth/crypto"
+	"myeth/trie"
+)
+
+// NewState creates a state database of the given header whose missing trie
+// nodes are retrieved on demand through the ODR backend.
+func NewState(ctx context.Context, head *types.Header, odr OdrBackend) (*state.StateDB, error) {
+	return state.New(head.Root, NewStateDatabase(ctx, head, odr))
+}
+
+// NewStateDatabase creates an ODR backed state.Database of the given header.
+// 和全节点的state.Database一样的接口 只是本地缺节点的时候会去网络上要证明
+func NewStateDatabase(ctx context.Context, head *types.Header, odr OdrBackend) state.Database {
+	return &odrDatabase{ctx, StateTrieID(head), odr}
+}
+
+type odrDatabase struct {
+	ctx     context.Context
+	id      *TrieID
+	backend OdrBackend
+}
+
+func (db *odrDatabase) OpenTrie(root common.Hash) (state.Trie, error) {
+	return &odrTrie{db: db, id: db.id}, nil
+}
+
+func (db *odrDatabase) OpenStorageTrie(addrHash, root common.Hash) (state.Trie, error) {
+	return &odrTrie{db: db, id: StorageTrieID(db.id, addrHash, root)}, nil
+}
+
+// TrieDB is not available for ODR backed states, their tries are never
+// committed.
+func (db *odrDatabase) TrieDB() *trie.Database {
+	return nil
+}
+
+// ContractCode retrieves the code belonging to the given code hash, fetching it
+// from the network if it's not available locally.
+func (db *odrDatabase) ContractCode(addrHash, codeHash common.Hash) ([]byte, error) {
+	if codeHash == (common.Hash{}) {
+		return nil, nil
+	}
+	code, err := db.backend.Database().Get(codeHash[:])
+	if err == nil && len(code) > 0 {
+		return code, nil
+	}
+	id := *db.id
+	id.AccKey = addrHash[:]
+	req := &CodeRequest{Id: &id, Hash: codeHash}
+	err = db.backend.Retrieve(db.ctx, req)
+	return req.Data, err
+}
+
+type odrTrie struct {
+	db   *odrDatabase
+	id   *TrieID
+	trie *trie.Trie
+}
+
+func (t *odrTrie) TryGet(key []byte) ([]byte, error) {
+	key = crypto.Keccak256(key)
+	var res []byte
+	err := t.do(key, func() (err error) {
+		res, err = t.trie.TryGet(key)
+		return err
+	})
+	return res, err
+}
+
+func (t *odrTrie) TryUpdate(key, value []byte) error {
+	key = crypto.Keccak256(key)
+	return t.do(key, func() error {
+		return t.trie.TryUpdate(key, value)
+	})
+}
+
+func (t *odrTrie) TryDelete(key []byte) error {
+	key = crypto.Keccak256(key)
+	return t.do(key, func() error {
+		return t.trie.TryDelete(key)
+	})
+}
+
+func (t *odrTrie) Commit(onleaf trie.LeafCallback) (common.Hash, error) {
+	if t.trie == nil {
+		return t.id.Root, nil
+	}
+	return t.trie.Commit(onleaf)
+}
+
+func (t *odrTrie) Hash() common.Hash {
+	if t.trie == nil {
+		return t.id.Root
+	}
+	return t.trie.Hash()
+}
+
+// do tries and retries to execute a function until it returns with no error or
+// an error type other than MissingNodeError
+// 缺节点就按key去要一份证明 存进本地后重新打开trie再试一次
+func (t *odrTrie) do(key []byte, fn func() error) error {
+	for {
+		var err error
+		if t.trie == nil {
+			t.trie, err = trie.New(t.id.Root, trie.NewDatabase(t.db.backend.Database()))
+		}
+		if err == nil {
+			err = fn()
+		}
+		if _, ok := err.(*trie.MissingNodeError); !ok {
+			return err
+		}
+		r := &TrieRequest{Id: t.id, Key: key}
+		if err := t.db.backend.Retrieve(t.db.ctx, r); err != nil {
+			return fmt.Errorf("can't fetch trie key %x: %v", key, err)
+		}
+		t.trie = nil
+	}
+}
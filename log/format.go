@@ -0,0 +1,142 @@
+package log
+
+import (
+	"bytes"
+	"fmt"
+	"math/big"
+	"reflect"
+	"strconv"
+	"time"
+)
+
+const (
+	timeFormat  = "01-02|15:04:05.000"
+	termMsgJust = 40
+	floatFormat = 'f'
+	errorKey    = "LOG_ERROR"
+)
+
+// TerminalStringer is an analogous interface to the stdlib stringer, allowing
+// own types to have custom shortened serialization formats when printed to the
+// screen.
+type TerminalStringer interface {
+	TerminalString() string
+}
+
+// formatRecord renders a record in the terminal format:
+//
+//	[LEVEL] [TIME] MESSAGE key=value key=value ...
+//
+// The message is padded so that the context of consecutive records lines up.
+func formatRecord(t time.Time, lvl Lvl, msg string, ctx []interface{}) []byte {
+	b := &bytes.Buffer{}
+	fmt.Fprintf(b, "%s[%s] %s ", lvl.AlignedString(), t.Format(timeFormat), msg)
+
+	// try to justify the log output for short messages
+	if len(ctx) > 0 && len(msg) < termMsgJust {
+		b.Write(bytes.Repeat([]byte{' '}, termMsgJust-len(msg)))
+	}
+	for i := 0; i < len(ctx); i += 2 {
+		if i != 0 {
+			b.WriteByte(' ')
+		}
+		k, ok := ctx[i].(string)
+		if !ok {
+			k, ctx[i+1] = errorKey, formatLogfmtValue(ctx[i])
+		}
+		b.WriteString(escapeString(k))
+		b.WriteByte('=')
+		b.WriteString(formatLogfmtValue(ctx[i+1]))
+	}
+	b.WriteByte('\n')
+	return b.Bytes()
+}
+
+// formatLogfmtValue formats a value for serialization.
+func formatLogfmtValue(value interface{}) string {
+	if value == nil {
+		return "nil"
+	}
+	switch v := value.(type) {
+	case time.Time:
+		// Performance optimization: No need for escaping since the provided
+		// timeFormat doesn't have any escape characters, and escaping is
+		// expensive.
+		return v.Format(timeFormat)
+
+	case *big.Int:
+		if v == nil {
+			return "<nil>"
+		}
+		return v.String()
+	}
+	//带TerminalString的类型(hash 存储大小等)优先用它的简短格式
+	if term, ok := value.(TerminalStringer); ok {
+		// Custom terminal stringer provided, use that
+		return escapeString(term.TerminalString())
+	}
+	value = formatShared(value)
+	switch v := value.(type) {
+	case bool:
+		return strconv.FormatBool(v)
+	case float32:
+		return strconv.FormatFloat(float64(v), floatFormat, 3, 64)
+	case float64:
+		return strconv.FormatFloat(v, floatFormat, 3, 64)
+	case int:
+		return strconv.Itoa(v)
+	case int64:
+		return strconv.FormatInt(v, 10)
+	case uint64:
+		return strconv.FormatUint(v, 10)
+	case string:
+		return escapeString(v)
+	default:
+		return escapeString(fmt.Sprintf("%+v", value))
+	}
+}
+
+// formatShared converts errors, stringers and nil pointers into their textual
+// form, leaving every other value untouched.
+func formatShared(value interface{}) (result interface{}) {
+	defer func() {
+		if err := recover(); err != nil {
+			if v := reflect.ValueOf(value); v.Kind() == reflect.Ptr && v.IsNil() {
+				result = "nil"
+			} else {
+				panic(err)
+			}
+		}
+	}()
+
+	switch v := value.(type) {
+	case time.Time:
+		return v.Format(timeFormat)
+
+	case error:
+		return v.Error()
+
+	case fmt.Stringer:
+		return v.String()
+
+	default:
+		return v
+	}
+}
+
+// escapeString quotes a value if it holds characters that would make the
+// key=value output ambiguous.
+func escapeString(s string) string {
+	needsQuoting := false
+	for _, r := range s {
+		// We quote everything below " (0x34) and above~ (0x7E), plus equal-sign
+		if r <= '"' || r > '~' || r == '=' {
+			needsQuoting = true
+			break
+		}
+	}
+	if !needsQuoting {
+		return s
+	}
+	return strconv.Quote(s)
+}
@@ -0,0 +1,200 @@
+// Package log implements the leveled, key/value logger used across the node.
+// 只保留了go-ethereum log包里用到的部分 输出格式和它的终端格式一致
+package log
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"sync"
+	"time"
+)
+
+// Lvl is the severity of a log record.
+type Lvl int
+
+const (
+	LvlCrit Lvl = iota
+	LvlError
+	LvlWarn
+	LvlInfo
+	LvlDebug
+	LvlTrace
+)
+
+// AlignedString returns a 5-character string containing the name of a Lvl.
+func (l Lvl) AlignedString() string {
+	switch l {
+	case LvlTrace:
+		return "TRACE"
+	case LvlDebug:
+		return "DEBUG"
+	case LvlInfo:
+		return "INFO "
+	case LvlWarn:
+		return "WARN "
+	case LvlError:
+		return "ERROR"
+	case LvlCrit:
+		return "CRIT "
+	default:
+		panic("bad level")
+	}
+}
+
+// String returns the name of a Lvl.
+func (l Lvl) String() string {
+	switch l {
+	case LvlTrace:
+		return "trce"
+	case LvlDebug:
+		return "dbug"
+	case LvlInfo:
+		return "info"
+	case LvlWarn:
+		return "warn"
+	case LvlError:
+		return "eror"
+	case LvlCrit:
+		return "crit"
+	default:
+		panic("bad level")
+	}
+}
+
+// LvlFromString returns the appropriate Lvl from a string name.
+// Useful for parsing command line args and configuration files.
+func LvlFromString(lvlString string) (Lvl, error) {
+	switch lvlString {
+	case "trace", "trce":
+		return LvlTrace, nil
+	case "debug", "dbug":
+		return LvlDebug, nil
+	case "info":
+		return LvlInfo, nil
+	case "warn":
+		return LvlWarn, nil
+	case "error", "eror":
+		return LvlError, nil
+	case "crit":
+		return LvlCrit, nil
+	default:
+		return LvlDebug, fmt.Errorf("unknown level: %v", lvlString)
+	}
+}
+
+// A Logger writes key/value pairs to an output. Every logger carries a context
+// of key/value pairs that is prepended to the pairs of each record it writes.
+type Logger interface {
+	// New returns a new Logger that has this logger's context plus the given context
+	New(ctx ...interface{}) Logger
+
+	// Log a message at the given level with context key/value pairs
+	Trace(msg string, ctx ...interface{})
+	Debug(msg string, ctx ...interface{})
+	Info(msg string, ctx ...interface{})
+	Warn(msg string, ctx ...interface{})
+	Error(msg string, ctx ...interface{})
+	Crit(msg string, ctx ...interface{})
+}
+
+// output is the destination shared by the root logger and all of its children.
+//所有的logger共用一个输出 级别和写入位置都在这里 改一次全局生效
+type output struct {
+	mu  sync.Mutex
+	w   io.Writer
+	lvl Lvl
+}
+
+type logger struct {
+	ctx []interface{}
+	out *output
+}
+
+var root = &logger{out: &output{w: os.Stderr, lvl: LvlInfo}}
+
+// Root returns the root logger.
+func Root() Logger {
+	return root
+}
+
+// SetOutput redirects the records of all loggers to w.
+func SetOutput(w io.Writer) {
+	root.out.mu.Lock()
+	defer root.out.mu.Unlock()
+
+	root.out.w = w
+}
+
+// SetLevel sets the most verbose level that is still written out.
+func SetLevel(lvl Lvl) {
+	root.out.mu.Lock()
+	defer root.out.mu.Unlock()
+
+	root.out.lvl = lvl
+}
+
+// New returns a new logger with the given context.
+// New is a convenient alias for Root().New
+func New(ctx ...interface{}) Logger {
+	return root.New(ctx...)
+}
+
+func (l *logger) New(ctx ...interface{}) Logger {
+	return &logger{ctx: newContext(l.ctx, ctx), out: l.out}
+}
+
+func (l *logger) write(msg string, lvl Lvl, ctx []interface{}) {
+	l.out.mu.Lock()
+	defer l.out.mu.Unlock()
+
+	if lvl > l.out.lvl {
+		return
+	}
+	l.out.w.Write(formatRecord(time.Now(), lvl, msg, newContext(l.ctx, ctx)))
+}
+
+func (l *logger) Trace(msg string, ctx ...interface{}) { l.write(msg, LvlTrace, ctx) }
+func (l *logger) Debug(msg string, ctx ...interface{}) { l.write(msg, LvlDebug, ctx) }
+func (l *logger) Info(msg string, ctx ...interface{})  { l.write(msg, LvlInfo, ctx) }
+func (l *logger) Warn(msg string, ctx ...interface{})  { l.write(msg, LvlWarn, ctx) }
+func (l *logger) Error(msg string, ctx ...interface{}) { l.write(msg, LvlError, ctx) }
+
+func (l *logger) Crit(msg string, ctx ...interface{}) {
+	l.write(msg, LvlCrit, ctx)
+	os.Exit(1)
+}
+
+// newContext concatenates the context of a logger with the context of a record,
+// padding the latter if it holds an odd number of elements.
+//单数个参数说明漏了key或者value 补一个nil 再带上一条错误提示 方便发现调用处写错了
+func newContext(prefix []interface{}, suffix []interface{}) []interface{} {
+	if len(suffix)%2 != 0 {
+		suffix = append(suffix, nil, errorKey, "Normalized odd number of arguments by adding nil")
+	}
+	newCtx := make([]interface{}, len(prefix)+len(suffix))
+	n := copy(newCtx, prefix)
+	copy(newCtx[n:], suffix)
+	return newCtx
+}
+
+// Trace is a convenient alias for Root().Trace
+func Trace(msg string, ctx ...interface{}) { root.write(msg, LvlTrace, ctx) }
+
+// Debug is a convenient alias for Root().Debug
+func Debug(msg string, ctx ...interface{}) { root.write(msg, LvlDebug, ctx) }
+
+// Info is a convenient alias for Root().Info
+func Info(msg string, ctx ...interface{}) { root.write(msg, LvlInfo, ctx) }
+
+// Warn is a convenient alias for Root().Warn
+func Warn(msg string, ctx ...interface{}) { root.write(msg, LvlWarn, ctx) }
+
+// Error is a convenient alias for Root().Error
+func Error(msg string, ctx ...interface{}) { root.write(msg, LvlError, ctx) }
+
+// Crit is a convenient alias for Root().Crit
+func Crit(msg string, ctx ...interface{}) {
+	root.write(msg, LvlCrit, ctx)
+	os.Exit(1)
+}
@@ -0,0 +1,59 @@
+package log
+
+import (
+	"bytes"
+	"errors"
+	"os"
+	"strings"
+	"testing"
+)
+
+func TestLevelFilter(t *testing.T) {
+	var buf bytes.Buffer
+	SetOutput(&buf)
+	SetLevel(LvlInfo)
+	defer SetOutput(os.Stderr)
+	defer SetLevel(LvlInfo)
+
+	Debug("hidden")
+	Info("shown")
+	if out := buf.String(); strings.Contains(out, "hidden") || !strings.Contains(out, "shown") {
+		t.Fatalf("unexpected output: %q", out)
+	}
+	buf.Reset()
+
+	SetLevel(LvlDebug)
+	Debug("hidden")
+	if !strings.Contains(buf.String(), "hidden") {
+		t.Fatalf("debug record not written after raising the level: %q", buf.String())
+	}
+}
+
+func TestFormatContext(t *testing.T) {
+	var buf bytes.Buffer
+	SetOutput(&buf)
+	SetLevel(LvlInfo)
+	defer SetOutput(os.Stderr)
+
+	New("peer", "a1b2").Warn("Dropping peer", "reason", "too slow", "err", errors.New("x=y"))
+	out := buf.String()
+	if !strings.HasPrefix(out, "WARN [") {
+		t.Errorf("missing level prefix: %q", out)
+	}
+	want := `peer=a1b2 reason="too slow" err="x=y"`
+	if !strings.HasSuffix(out, want+"\n") {
+		t.Errorf("context mismatch: have %q, want suffix %q", out, want)
+	}
+}
+
+func TestOddContext(t *testing.T) {
+	var buf bytes.Buffer
+	SetOutput(&buf)
+	SetLevel(LvlInfo)
+	defer SetOutput(os.Stderr)
+
+	Info("Odd", "key")
+	if out := buf.String(); !strings.Contains(out, "key=nil "+errorKey+"=") {
+		t.Errorf("odd context not normalized: %q", out)
+	}
+}
@@ -0,0 +1,30 @@
+// Package metrics provides general system and process level metrics collection.
+// 以太坊用的是go-metrics的一个分支 这里只保留了meter timer gauge histogram这些常用的类型
+package metrics
+
+import (
+	"os"
+	"strings"
+)
+
+// Enabled is checked by the constructor functions for all of the
+// standard metrics. If it is false, the metric returned is a stub.
+//
+// This global kill-switch helps quantify the observer effect and makes
+// for less cluttered pprof profiles.
+var Enabled = false
+
+// MetricsEnabledFlag is the CLI flag name to use to enable metrics collections.
+const MetricsEnabledFlag = "metrics"
+
+// Init enables or disables the metrics system. Since we need this to run before
+// any other code gets to create meters and timers, we'll actually do an ugly hack
+// and peek into the command line args for the metrics flag.
+// 命令行里带了--metrics才会真正统计 否则所有的构造函数都返回空实现
+func init() {
+	for _, arg := range os.Args {
+		if flag := strings.TrimLeft(arg, "-"); flag == MetricsEnabledFlag {
+			Enabled = true
+		}
+	}
+}
@@ -0,0 +1,152 @@
+package metrics
+
+import (
+	"testing"
+	"time"
+)
+
+func init() {
+	Enabled = true
+}
+
+func TestCounter(t *testing.T) {
+	c := NewCounter()
+	c.Inc(5)
+	c.Dec(2)
+	if count := c.Count(); count != 3 {
+		t.Errorf("c.Count(): 3 != %v\n", count)
+	}
+	snapshot := c.Snapshot()
+	c.Inc(1)
+	if count := snapshot.Count(); count != 3 {
+		t.Errorf("snapshot.Count(): 3 != %v\n", count)
+	}
+}
+
+func TestGauge(t *testing.T) {
+	g := NewGauge()
+	g.Update(int64(47))
+	if v := g.Value(); v != 47 {
+		t.Errorf("g.Value(): 47 != %v\n", v)
+	}
+}
+
+func TestMeter(t *testing.T) {
+	m := NewMeter()
+	defer m.Stop()
+	m.Mark(47)
+	if count := m.Count(); count != 47 {
+		t.Errorf("m.Count(): 47 != %v\n", count)
+	}
+	m.Stop()
+	// 停止之后的Mark不再计数
+	m.Mark(1)
+	if count := m.Count(); count != 47 {
+		t.Errorf("m.Count() after Stop: 47 != %v\n", count)
+	}
+}
+
+func TestEWMA1(t *testing.T) {
+	a := NewEWMA1()
+	a.Update(3)
+	a.Tick()
+	if rate := a.Rate(); rate != 0.6 {
+		t.Errorf("initial a.Rate(): 0.6 != %v\n", rate)
+	}
+	a.Tick()
+	if rate := a.Rate(); rate >= 0.6 || rate <= 0.5 {
+		t.Errorf("a.Rate() after one idle tick: %v not in (0.5, 0.6)\n", rate)
+	}
+}
+
+func TestHistogram(t *testing.T) {
+	h := NewHistogram(NewUniformSample(100))
+	for i := 1; i <= 100; i++ {
+		h.Update(int64(i))
+	}
+	if count := h.Count(); count != 100 {
+		t.Errorf("h.Count(): 100 != %v\n", count)
+	}
+	if min := h.Min(); min != 1 {
+		t.Errorf("h.Min(): 1 != %v\n", min)
+	}
+	if max := h.Max(); max != 100 {
+		t.Errorf("h.Max(): 100 != %v\n", max)
+	}
+	if mean := h.Mean(); mean != 50.5 {
+		t.Errorf("h.Mean(): 50.5 != %v\n", mean)
+	}
+	ps := h.Percentiles([]float64{0.5, 0.75, 0.99})
+	if ps[0] != 50.5 || ps[1] != 75.75 || ps[2] != 99.99 {
+		t.Errorf("unexpected percentiles: %v\n", ps)
+	}
+}
+
+func TestUniformSampleBounded(t *testing.T) {
+	s := NewUniformSample(100)
+	for i := 0; i < 1000; i++ {
+		s.Update(int64(i))
+	}
+	if size := s.Size(); size != 100 {
+		t.Errorf("s.Size(): 100 != %v\n", size)
+	}
+	if count := s.Count(); count != 1000 {
+		t.Errorf("s.Count(): 1000 != %v\n", count)
+	}
+}
+
+func TestTimer(t *testing.T) {
+	tm := NewTimer()
+	defer tm.Stop()
+	tm.Update(10 * time.Millisecond)
+	tm.Update(30 * time.Millisecond)
+	if count := tm.Count(); count != 2 {
+		t.Errorf("tm.Count(): 2 != %v\n", count)
+	}
+	if mean := tm.Mean(); mean != float64(20*time.Millisecond) {
+		t.Errorf("tm.Mean(): %v != %v\n", float64(20*time.Millisecond), mean)
+	}
+}
+
+func TestResettingTimer(t *testing.T) {
+	tm := NewResettingTimer()
+	for i := 1; i <= 10; i++ {
+		tm.Update(time.Duration(i))
+	}
+	snap := tm.Snapshot()
+	if ps := snap.Percentiles([]float64{50, 90}); ps[0] != 5 || ps[1] != 9 {
+		t.Errorf("unexpected percentiles: %v\n", ps)
+	}
+	if mean := snap.Mean(); mean != 5.5 {
+		t.Errorf("snap.Mean(): 5.5 != %v\n", mean)
+	}
+	// Snapshot清空了计时器
+	if n := len(tm.Snapshot().Values()); n != 0 {
+		t.Errorf("timer not reset, %d values left", n)
+	}
+}
+
+func TestRegistry(t *testing.T) {
+	r := NewRegistry()
+	c := NewRegisteredCounter("foo", r)
+	if err := r.Register("foo", NewCounter()); err == nil {
+		t.Fatal("duplicate registration succeeded")
+	}
+	if got := GetOrRegisterCounter("foo", r); got != c {
+		t.Errorf("GetOrRegisterCounter returned a different counter")
+	}
+	prefixed := NewPrefixedChildRegistry(r, "peer/")
+	GetOrRegisterMeter("ingress", prefixed).Mark(1)
+	if r.Get("peer/ingress") == nil {
+		t.Error("prefixed meter not registered in parent")
+	}
+	n := 0
+	prefixed.Each(func(string, interface{}) { n++ })
+	if n != 1 {
+		t.Errorf("prefixed registry has %d metrics, want 1", n)
+	}
+	r.Unregister("peer/ingress")
+	if r.Get("peer/ingress") != nil {
+		t.Error("meter still registered after Unregister")
+	}
+}
@@ -1,10 +1,15 @@
 package node
 
 import (
+	"fmt"
+	"net"
 	"reflect"
+	"strings"
 	"sync"
 
+	"myeth/log"
 	"myeth/p2p"
+	"myeth/rpc"
 )
 
 //Node 包含 p2pServer 和 依赖p2pServer的上层 Serivce对象
@@ -18,6 +23,22 @@ type Node struct {
 
 	serviceFuncs []ServiceConstructor     // Service constructors (in dependency order)
 	services     map[reflect.Type]Service // Currently running services
+	serviceOrder []reflect.Type           // 服务的启动顺序 停止时倒序执行
+
+	rpcAPIs []rpc.API // List of APIs currently provided by the node
+
+	ipcEndpoint string       // IPC endpoint to listen at (empty = IPC disabled)
+	ipcListener net.Listener // IPC RPC listener socket to serve API requests
+	ipcHandler  *rpc.Server  // IPC RPC request handler to process the API requests
+
+	httpEndpoint  string       // HTTP endpoint (interface + port) to listen at (empty = HTTP disabled)
+	httpWhitelist []string     // HTTP RPC modules to allow through this endpoint
+	httpListener  net.Listener // HTTP RPC listener socket to server API requests
+	httpHandler   *rpc.Server  // HTTP RPC request handler to process the API requests
+
+	wsEndpoint string       // Websocket endpoint (interface + port) to listen at (empty = websocket disabled)
+	wsListener net.Listener // Websocket RPC listener socket to server API requests
+	wsHandler  *rpc.Server  // Websocket RPC request handler to process the API requests
 
 	stop chan struct{} // Channel to wait for termination notifications
 	lock sync.RWMutex
@@ -28,12 +49,23 @@ func New(conf *Config) (*Node, error) {
 	confCopy := *conf
 
 	return &Node{
-		config: &confCopy,
+		config:       &confCopy,
+		httpEndpoint: confCopy.HTTPEndpoint(),
+		wsEndpoint:   confCopy.WSEndpoint(),
 	}, nil
 }
 
+// Wait blocks the thread until the node is stopped. If the node is not running
+// at the time of invocation, the method immediately returns.
 func (n *Node) Wait() {
+	n.lock.RLock()
+	if n.server == nil {
+		n.lock.RUnlock()
+		return
+	}
 	stop := n.stop
+	n.lock.RUnlock()
+
 	<-stop
 }
 
@@ -44,7 +76,7 @@ func (n *Node) Register(constructor ServiceConstructor) error {
 	defer n.lock.Unlock()
 
 	if n.server != nil {
-		return nil
+		return ErrNodeRunning
 	}
 	n.serviceFuncs = append(n.serviceFuncs, constructor)
 	return nil
@@ -57,20 +89,30 @@ func (n *Node) Register(constructor ServiceConstructor) error {
 // 4. 启动p2pServer
 // 5. 启动以太坊逻辑
 func (n *Node) Start() error {
+	n.lock.Lock()
+	defer n.lock.Unlock()
+
+	// Short circuit if the node's already running
+	if n.server != nil {
+		return ErrNodeRunning
+	}
 
 	//初始化P2P Server
-	//n.serverConfig = n.config.P2P
+	n.serverConfig = n.config.P2P
 	n.config.DataDir = "./geth/"
 	n.serverConfig.PrivateKey = n.config.NodeKey()
 	if n.serverConfig.StaticNodes == nil {
 		n.serverConfig.StaticNodes = n.config.StaticNodes()
 	}
-	n.serverConfig.ListenAddr = n.config.P2P.ListenAddr
+	if n.serverConfig.TrustedNodes == nil {
+		n.serverConfig.TrustedNodes = n.config.TrustedNodes()
+	}
 
 	running := &p2p.Server{Config: n.serverConfig}
 
 	// Otherwise copy and specialize the P2P configuration
 	services := make(map[reflect.Type]Service)
+	order := []reflect.Type{}
 	for _, constructor := range n.serviceFuncs {
 		// Create a new context for the particular service
 		ctx := &ServiceContext{
@@ -83,13 +125,17 @@ func (n *Node) Start() error {
 			return err
 		}
 		kind := reflect.TypeOf(service)
+		if _, exists := services[kind]; exists {
+			return &DuplicateServiceError{Kind: kind}
+		}
 		services[kind] = service
+		order = append(order, kind)
 	}
 
 	// 本节点所支持的协议 是所有服务 共同提供的
 	// Gather the protocols and start the freshly assembled P2P server
-	for _, service := range services {
-		running.Protocols = append(running.Protocols, service.Protocols()...)
+	for _, kind := range order {
+		running.Protocols = append(running.Protocols, services[kind].Protocols()...)
 	}
 
 	//开始P2P Server
@@ -100,11 +146,11 @@ func (n *Node) Start() error {
 	//开启各大服务器
 	// Start each of the services
 	started := []reflect.Type{}
-	for kind, service := range services {
+	for _, kind := range order {
 		// Start the next service, stopping all previous upon failure
-		if err := service.Start(running); err != nil {
-			for _, kind := range started {
-				services[kind].Stop()
+		if err := services[kind].Start(running); err != nil {
+			for i := len(started) - 1; i >= 0; i-- {
+				services[started[i]].Stop()
 			}
 			running.Stop()
 
@@ -114,9 +160,224 @@ func (n *Node) Start() error {
 		started = append(started, kind)
 	}
 
+	//服务都起来之后再开放RPC 因为服务的API依赖Start里创建的对象
+	// Lastly start the configured RPC interfaces
+	if err := n.startRPC(services); err != nil {
+		for i := len(order) - 1; i >= 0; i-- {
+			services[order[i]].Stop()
+		}
+		running.Stop()
+		return err
+	}
+
 	n.server = running
 	n.services = services
+	n.serviceOrder = order
 	n.stop = make(chan struct{})
 
 	return nil
 }
+
+// Server retrieves the currently running P2P network layer. This method is meant
+// only to inspect fields of the currently running server, life cycle management
+// should be left to this Node entity.
+func (n *Node) Server() *p2p.Server {
+	n.lock.RLock()
+	defer n.lock.RUnlock()
+
+	return n.server
+}
+
+// Stop terminates a running node along with all it's services. In the node was
+// not started, an error is returned.
+func (n *Node) Stop() error {
+	n.lock.Lock()
+	defer n.lock.Unlock()
+
+	// Short circuit if the node's not running
+	if n.server == nil {
+		return ErrNodeStopped
+	}
+
+	// Terminate the API, services and the p2p server.
+	// 服务依赖p2pServer 所以先倒序停止服务 再停止p2pServer
+	n.stopWS()
+	n.stopHTTP()
+	n.stopIPC()
+	n.rpcAPIs = nil
+	failure := &StopError{
+		Services: make(map[reflect.Type]error),
+	}
+	for i := len(n.serviceOrder) - 1; i >= 0; i-- {
+		kind := n.serviceOrder[i]
+		if err := n.services[kind].Stop(); err != nil {
+			failure.Services[kind] = err
+		}
+	}
+	n.server.Stop()
+	n.services = nil
+	n.serviceOrder = nil
+	n.server = nil
+
+	// unblock n.Wait
+	close(n.stop)
+
+	if len(failure.Services) > 0 {
+		return failure
+	}
+	return nil
+}
+
+// startRPC is a helper method to start all the various RPC endpoint during node
+// startup. It's not meant to be called at any time afterwards as it makes certain
+// assumptions about the state of the node.
+func (n *Node) startRPC(services map[reflect.Type]Service) error {
+	// Gather all the possible APIs to surface
+	apis := n.apis()
+	for _, service := range services {
+		apis = append(apis, service.APIs()...)
+	}
+	// Start the various API endpoints, terminating all in case of errors
+	//IPC路径要在Start改写DataDir之后再解析
+	n.ipcEndpoint = n.config.IPCEndpoint()
+	if err := n.startIPC(apis); err != nil {
+		return err
+	}
+	if err := n.startHTTP(n.httpEndpoint, apis, n.config.HTTPModules, n.config.HTTPCors, n.config.HTTPVirtualHosts); err != nil {
+		n.stopIPC()
+		return err
+	}
+	if err := n.startWS(n.wsEndpoint, apis, n.config.WSModules, n.config.WSOrigins, n.config.WSExposeAll); err != nil {
+		n.stopHTTP()
+		n.stopIPC()
+		return err
+	}
+	// All API endpoints started successfully
+	n.rpcAPIs = apis
+	return nil
+}
+
+// startIPC initializes and starts the IPC RPC endpoint.
+func (n *Node) startIPC(apis []rpc.API) error {
+	if n.ipcEndpoint == "" {
+		return nil // IPC disabled.
+	}
+	listener, handler, err := rpc.StartIPCEndpoint(n.ipcEndpoint, apis)
+	if err != nil {
+		return err
+	}
+	n.ipcListener = listener
+	n.ipcHandler = handler
+	log.Info("IPC endpoint opened", "url", n.ipcEndpoint)
+	return nil
+}
+
+// stopIPC terminates the IPC RPC endpoint.
+func (n *Node) stopIPC() {
+	if n.ipcListener != nil {
+		n.ipcListener.Close()
+		n.ipcListener = nil
+
+		log.Info("IPC endpoint closed", "endpoint", n.ipcEndpoint)
+	}
+	if n.ipcHandler != nil {
+		n.ipcHandler.Stop()
+		n.ipcHandler = nil
+	}
+}
+
+// startHTTP initializes and starts the HTTP RPC endpoint.
+func (n *Node) startHTTP(endpoint string, apis []rpc.API, modules []string, cors []string, vhosts []string) error {
+	// Short circuit if the HTTP endpoint isn't being exposed
+	if endpoint == "" {
+		return nil
+	}
+	listener, handler, err := rpc.StartHTTPEndpoint(endpoint, apis, modules, cors, vhosts)
+	if err != nil {
+		return err
+	}
+	log.Info("HTTP endpoint opened", "url", fmt.Sprintf("http://%s", endpoint), "cors", strings.Join(cors, ","), "vhosts", strings.Join(vhosts, ","))
+	// All listeners booted successfully
+	n.httpEndpoint = endpoint
+	n.httpListener = listener
+	n.httpHandler = handler
+
+	return nil
+}
+
+// stopHTTP terminates the HTTP RPC endpoint.
+func (n *Node) stopHTTP() {
+	if n.httpListener != nil {
+		n.httpListener.Close()
+		n.httpListener = nil
+
+		log.Info("HTTP endpoint closed", "url", fmt.Sprintf("http://%s", n.httpEndpoint))
+	}
+	if n.httpHandler != nil {
+		n.httpHandler.Stop()
+		n.httpHandler = nil
+	}
+}
+
+// startWS initializes and starts the websocket RPC endpoint.
+func (n *Node) startWS(endpoint string, apis []rpc.API, modules []string, wsOrigins []string, exposeAll bool) error {
+	// Short circuit if the WS endpoint isn't being exposed
+	if endpoint == "" {
+		return nil
+	}
+	listener, handler, err := rpc.StartWSEndpoint(endpoint, apis, modules, wsOrigins, exposeAll)
+	if err != nil {
+		return err
+	}
+	log.Info("WebSocket endpoint opened", "url", fmt.Sprintf("ws://%s", listener.Addr()))
+	// All listeners booted successfully
+	n.wsEndpoint = endpoint
+	n.wsListener = listener
+	n.wsHandler = handler
+
+	return nil
+}
+
+// stopWS terminates the websocket RPC endpoint.
+func (n *Node) stopWS() {
+	if n.wsListener != nil {
+		n.wsListener.Close()
+		n.wsListener = nil
+
+		log.Info("WebSocket endpoint closed", "url", fmt.Sprintf("ws://%s", n.wsEndpoint))
+	}
+	if n.wsHandler != nil {
+		n.wsHandler.Stop()
+		n.wsHandler = nil
+	}
+}
+
+// IPCEndpoint retrieves the current IPC endpoint used by the protocol stack.
+func (n *Node) IPCEndpoint() string {
+	n.lock.RLock()
+	defer n.lock.RUnlock()
+
+	return n.ipcEndpoint
+}
+
+// HTTPEndpoint retrieves the current HTTP endpoint used by the protocol stack.
+func (n *Node) HTTPEndpoint() string {
+	n.lock.RLock()
+	defer n.lock.RUnlock()
+
+	if n.httpListener != nil {
+		return n.httpListener.Addr().String()
+	}
+	return n.httpEndpoint
+}
+
+// WSEndpoint retrieves the current WS endpoint used by the protocol stack.
+func (n *Node) WSEndpoint() string {
+	n.lock.RLock()
+	defer n.lock.RUnlock()
+
+	if n.wsListener != nil {
+		return n.wsListener.Addr().String()
+	}
+	return n.wsEndpoint
+}
@@ -18,6 +18,7 @@ package node
 
 import (
 	"myeth/p2p"
+	"myeth/rpc"
 
 	"myeth/ethdb"
 )
@@ -47,6 +48,9 @@ type Service interface {
 	// Protocols retrieves the P2P protocols the service wishes to start.
 	Protocols() []p2p.Protocol
 
+	// APIs retrieves the list of RPC descriptors the service provides
+	APIs() []rpc.API
+
 	// Start is called after all services have been constructed and the networking
 	// layer was also initialized to spawn any goroutines required by the service.
 	Start(server *p2p.Server) error
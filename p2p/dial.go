@@ -1,9 +1,18 @@
 package p2p
 
 import (
+	"context"
 	"errors"
 	"myeth/p2p/discover"
+	"myeth/p2p/netutil"
 	"net"
+	"time"
+)
+
+const (
+	// This is the amount of time spent waiting in between
+	// redialing a certain node.
+	dialHistoryExpiration = 30 * time.Second
 )
 
 type task interface {
@@ -26,13 +35,29 @@ func (t *dialTask) Do(srv *Server) {
 //dial 先进行TCP 连接 再进行握手检测
 func (t *dialTask) dial(srv *Server, dest *discover.Node) error {
 	//使用server的dialer 生成tcp连接
-	fd, err := srv.Dialer.Dial(dest)
+	fd, err := srv.Dialer.Dial(srv.dialCtx, dest)
 	if err != nil {
 		return err
 	}
+	//拨号期间server可能已经停止了 SetupConn会检查running状态
 	return srv.SetupConn(fd, t.flags, dest)
 }
 
+// waitExpireTask 什么都不做 只是等待dial历史过期
+// 让run loop在没有其他任务的时候也能醒过来重新调度
+type waitExpireTask struct {
+	time.Duration
+}
+
+func (t waitExpireTask) Do(srv *Server) {
+	timer := time.NewTimer(t.Duration)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+	case <-srv.quit:
+	}
+}
+
 type dialstate struct {
 
 	//当前的节点dialing状态map
@@ -40,13 +65,20 @@ type dialstate struct {
 
 	//静态节点的连接任务map
 	static map[discover.NodeID]*dialTask
+
+	//最近拨号过的节点 在过期之前不会再次拨号
+	hist map[discover.NodeID]time.Time
+
+	netrestrict *netutil.Netlist
 }
 
 //make 一定要在 使用之前 make
-func newDialState(static []*discover.Node) *dialstate {
+func newDialState(static []*discover.Node, netrestrict *netutil.Netlist) *dialstate {
 	s := &dialstate{
-		static:  make(map[discover.NodeID]*dialTask),
-		dialing: make(map[discover.NodeID]connFlag),
+		static:      make(map[discover.NodeID]*dialTask),
+		dialing:     make(map[discover.NodeID]connFlag),
+		hist:        make(map[discover.NodeID]time.Time),
+		netrestrict: netrestrict,
 	}
 	for _, n := range static {
 		s.addStatic(n)
@@ -55,7 +87,17 @@ func newDialState(static []*discover.Node) *dialstate {
 }
 
 func (s *dialstate) addStatic(n *discover.Node) {
-	s.static[n.ID] = &dialTask{dest: n}
+	// This overwrites the task instead of updating an existing
+	// entry, giving users the opportunity to force a resolve operation.
+	s.static[n.ID] = &dialTask{flags: staticDialedConn, dest: n}
+}
+
+func (s *dialstate) removeStatic(n *discover.Node) {
+	// This removes a task so future attempts to connect will not be made.
+	delete(s.static, n.ID)
+	// This removes a previous dial timestamp so that application
+	// can force a server to reconnect with chosen peer immediately.
+	delete(s.hist, n.ID)
 }
 
 var (
@@ -67,23 +109,36 @@ var (
 )
 
 //节点连接状态检查 用error来表示连接状态
-func (s *dialstate) checkDial(n *discover.Node) error {
+func (s *dialstate) checkDial(n *discover.Node, peers map[discover.NodeID]*Peer) error {
 	//从map中 取值 vluae, ok := map[key]
 	_, dialing := s.dialing[n.ID]
 	switch {
 	case dialing:
 		return errAlreadyDialing
+	case peers[n.ID] != nil:
+		return errAlreadyConnected
+	case !s.hist[n.ID].IsZero():
+		return errRecentlyDialed
+	case s.netrestrict != nil && !s.netrestrict.Contains(n.IP):
+		return errNotWhitelisted
 	}
 	return nil
 }
 
 //创建新的任务
-func (s *dialstate) newTasks() []task {
+func (s *dialstate) newTasks(nRunning int, peers map[discover.NodeID]*Peer, now time.Time) []task {
 	var newtasks []task
 
+	//过期的拨号记录先清理掉
+	for id, t := range s.hist {
+		if !now.Before(t) {
+			delete(s.hist, id)
+		}
+	}
+
 	//如果静态节点没有连接 创建任务连接
 	for id, t := range s.static {
-		err := s.checkDial(t.dest)
+		err := s.checkDial(t.dest, peers)
 		switch err {
 		case nil:
 			//没有加入dialing map中 说明还没有尝试连接过
@@ -92,12 +147,40 @@ func (s *dialstate) newTasks() []task {
 		}
 	}
 
+	// Launch a timer to wait for the next node to expire if all
+	// candidates have been tried and no task is currently active.
+	// This should prevent cases where the dialer logic is not ticked
+	// because there are no pending events.
+	if nRunning == 0 && len(newtasks) == 0 && len(s.hist) > 0 {
+		t := waitExpireTask{s.nextExpiry().Sub(now)}
+		newtasks = append(newtasks, t)
+	}
 	return newtasks
 }
 
-//对一个节点发起连接 返回一个网络连接
+//任务结束 把节点从dialing里删掉并记录到拨号历史
+func (s *dialstate) taskDone(t task, now time.Time) {
+	switch t := t.(type) {
+	case *dialTask:
+		s.hist[t.dest.ID] = now.Add(dialHistoryExpiration)
+		delete(s.dialing, t.dest.ID)
+	}
+}
+
+//最早过期的拨号记录的时间
+func (s *dialstate) nextExpiry() time.Time {
+	var next time.Time
+	for _, t := range s.hist {
+		if next.IsZero() || t.Before(next) {
+			next = t
+		}
+	}
+	return next
+}
+
+//对一个节点发起连接 返回一个网络连接 ctx取消时放弃拨号
 type NodeDialer interface {
-	Dial(*discover.Node) (net.Conn, error)
+	Dial(context.Context, *discover.Node) (net.Conn, error)
 }
 
 //以太坊使用TCP对发现的节点进行连接
@@ -105,7 +188,7 @@ type TCPDialer struct {
 	*net.Dialer
 }
 
-func (t TCPDialer) Dial(dest *discover.Node) (net.Conn, error) {
+func (t TCPDialer) Dial(ctx context.Context, dest *discover.Node) (net.Conn, error) {
 	addr := net.TCPAddr{IP: dest.IP, Port: int(dest.TCP)}
-	return t.Dialer.Dial("tcp", addr.String())
+	return t.Dialer.DialContext(ctx, "tcp", addr.String())
 }
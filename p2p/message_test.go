@@ -0,0 +1,45 @@
+package p2p
+
+import (
+	"testing"
+	"time"
+)
+
+func TestMsgPipe(t *testing.T) {
+	rw1, rw2 := MsgPipe()
+	go func() {
+		SendItems(rw1, 1, "foo")
+		SendItems(rw1, 2)
+		rw1.Close()
+	}()
+
+	if err := ExpectMsg(rw2, 1, []string{"foo"}); err != nil {
+		t.Fatal(err)
+	}
+	if err := ExpectMsg(rw2, 2, []interface{}{}); err != nil {
+		t.Fatal(err)
+	}
+	if err := ExpectMsg(rw2, 3, nil); err != ErrPipeClosed {
+		t.Fatalf("got error %v, want ErrPipeClosed", err)
+	}
+}
+
+func TestMsgPipeUnblockWrite(t *testing.T) {
+	rw1, rw2 := MsgPipe()
+	done := make(chan error, 1)
+	go func() {
+		done <- SendItems(rw1, 1, "foo")
+	}()
+
+	// 没有人读取 写入会一直阻塞 直到管道被关闭
+	time.Sleep(10 * time.Millisecond)
+	rw2.Close()
+	select {
+	case err := <-done:
+		if err != ErrPipeClosed {
+			t.Errorf("got error %v, want ErrPipeClosed", err)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("write did not unblock")
+	}
+}
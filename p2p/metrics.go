@@ -0,0 +1,150 @@
+// Contains the meters and timers used by the networking layer.
+
+package p2p
+
+import (
+	"fmt"
+	"net"
+	"sync"
+
+	"myeth/metrics"
+	"myeth/p2p/discover"
+)
+
+const (
+	// 单个peer的流量统计都注册在这个前缀下面 peer断开之后会被删掉
+	peerMetricsPrefix = "p2p/peers/"
+)
+
+var (
+	ingressConnectMeter = metrics.NewRegisteredMeter("p2p/InboundConnects", nil)
+	ingressTrafficMeter = metrics.NewRegisteredMeter("p2p/InboundTraffic", nil)
+	egressConnectMeter  = metrics.NewRegisteredMeter("p2p/OutboundConnects", nil)
+	egressTrafficMeter  = metrics.NewRegisteredMeter("p2p/OutboundTraffic", nil)
+)
+
+// meteredConn is a wrapper around a network TCP connection that meters both the
+// inbound and outbound network traffic.
+type meteredConn struct {
+	net.Conn // Network connection to wrap with metering
+
+	lock     sync.RWMutex
+	registry metrics.Registry // per-peer registry, set once the peer is added
+	ingress  metrics.Meter    // per-peer ingress traffic
+	egress   metrics.Meter    // per-peer egress traffic
+}
+
+// newMeteredConn creates a new metered connection, also bumping the ingress or
+// egress connection meter. If the metrics system is disabled, this function
+// returns the original object.
+func newMeteredConn(conn net.Conn, ingress bool) net.Conn {
+	// Short circuit if metrics are disabled
+	if !metrics.Enabled {
+		return conn
+	}
+	// Otherwise bump the connection counters and wrap the connection
+	if ingress {
+		ingressConnectMeter.Mark(1)
+	} else {
+		egressConnectMeter.Mark(1)
+	}
+	return &meteredConn{Conn: conn}
+}
+
+// Read delegates a network read to the underlying connection, bumping the ingress
+// traffic meters along the way.
+func (c *meteredConn) Read(b []byte) (n int, err error) {
+	n, err = c.Conn.Read(b)
+	ingressTrafficMeter.Mark(int64(n))
+	c.lock.RLock()
+	if c.ingress != nil {
+		c.ingress.Mark(int64(n))
+	}
+	c.lock.RUnlock()
+	return n, err
+}
+
+// Write delegates a network write to the underlying connection, bumping the
+// egress traffic meters along the way.
+func (c *meteredConn) Write(b []byte) (n int, err error) {
+	n, err = c.Conn.Write(b)
+	egressTrafficMeter.Mark(int64(n))
+	c.lock.RLock()
+	if c.egress != nil {
+		c.egress.Mark(int64(n))
+	}
+	c.lock.RUnlock()
+	return n, err
+}
+
+// peerAdded registers the per-peer traffic meters once the connection passed
+// both handshakes and the remote node is known. It is only called for peers
+// that were actually added, so duplicate connections to the same node don't
+// clobber each other's meters.
+func (c *meteredConn) peerAdded(id discover.NodeID) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	c.registry = metrics.NewPrefixedChildRegistry(metrics.DefaultRegistry, fmt.Sprintf("%s%x/", peerMetricsPrefix, id[:8]))
+	c.ingress = metrics.GetOrRegisterMeter("ingress", c.registry)
+	c.egress = metrics.GetOrRegisterMeter("egress", c.registry)
+}
+
+// Close delegates a close operation to the underlying connection and drops
+// the per-peer meters from the registry.
+func (c *meteredConn) Close() error {
+	err := c.Conn.Close()
+
+	c.lock.Lock()
+	if c.registry != nil {
+		c.registry.Unregister("ingress")
+		c.registry.Unregister("egress")
+		c.registry, c.ingress, c.egress = nil, nil, nil
+	}
+	c.lock.Unlock()
+	return err
+}
+
+// meteredMsgReadWriter wraps a protocol's MsgReadWriter and meters the number
+// of messages and bytes going through it, broken down by message code.
+// 按 协议/版本/方向/消息码 统计 比如 p2p/eth/63/ingress/0x04/packets
+type meteredMsgReadWriter struct {
+	MsgReadWriter
+	proto Cap
+}
+
+// newMeteredMsgReadWriter wraps a p2p MsgReadWriter with metering support. If
+// the metrics system is disabled, this function returns the original object.
+func newMeteredMsgReadWriter(rw MsgReadWriter, proto Cap) MsgReadWriter {
+	if !metrics.Enabled {
+		return rw
+	}
+	return &meteredMsgReadWriter{MsgReadWriter: rw, proto: proto}
+}
+
+// ReadMsg reads a message from the underlying MsgReadWriter and meters it as
+// ingress traffic.
+func (rw *meteredMsgReadWriter) ReadMsg() (Msg, error) {
+	msg, err := rw.MsgReadWriter.ReadMsg()
+	if err != nil {
+		return msg, err
+	}
+	rw.mark("ingress", msg)
+	return msg, nil
+}
+
+// WriteMsg writes a message to the underlying MsgReadWriter and meters it as
+// egress traffic once the write succeeded.
+func (rw *meteredMsgReadWriter) WriteMsg(msg Msg) error {
+	if err := rw.MsgReadWriter.WriteMsg(msg); err != nil {
+		return err
+	}
+	rw.mark("egress", msg)
+	return nil
+}
+
+func (rw *meteredMsgReadWriter) mark(direction string, msg Msg) {
+	prefix := fmt.Sprintf("p2p/%s/%d/%s/0x%02x/", rw.proto.Name, rw.proto.Version, direction, msg.Code)
+	metrics.GetOrRegisterMeter(prefix+"packets", nil).Mark(1)
+	metrics.GetOrRegisterMeter(prefix+"bytes", nil).Mark(int64(msg.Size))
+}
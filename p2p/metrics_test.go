@@ -0,0 +1,82 @@
+package p2p
+
+import (
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"testing"
+	"time"
+
+	"myeth/crypto"
+	"myeth/metrics"
+	"myeth/p2p/discover"
+)
+
+func TestServerTrafficMetering(t *testing.T) {
+	metrics.Enabled = true
+	defer func() { metrics.Enabled = false }()
+
+	remkey, _ := crypto.GenerateKey()
+	remid := discover.PubkeyID(&remkey.PublicKey)
+
+	sent := make(chan error, 1)
+	proto := Protocol{
+		Name:    "metered",
+		Version: 1,
+		Length:  4,
+		Run: func(p *Peer, rw MsgReadWriter) error {
+			sent <- SendItems(rw, 2, "hello")
+			_, err := rw.ReadMsg()
+			return err
+		},
+	}
+	srv := startTestServer(t, remid, []Protocol{proto})
+	defer srv.Stop()
+
+	events := make(chan *PeerEvent, 4)
+	sub := srv.SubscribeEvents(events)
+	defer sub.Unsubscribe()
+
+	// 协议计量器是全局的 只比较本次测试前后的差值
+	var before int64
+	if m, ok := metrics.Get("p2p/metered/1/egress/0x02/packets").(metrics.Meter); ok {
+		before = m.Count()
+	}
+	fd0, fd1 := net.Pipe()
+	go io.Copy(ioutil.Discard, fd1)
+	if err := srv.SetupConn(fd0, inboundConn, nil); err != nil {
+		t.Fatalf("SetupConn failed: %v", err)
+	}
+	select {
+	case err := <-sent:
+		if err != nil {
+			t.Fatalf("write failed: %v", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("protocol did not send")
+	}
+
+	packets, ok := metrics.Get("p2p/metered/1/egress/0x02/packets").(metrics.Meter)
+	if !ok || packets.Count()-before != 1 {
+		t.Fatalf("egress packet meter missing or wrong: %v", metrics.Get("p2p/metered/1/egress/0x02/packets"))
+	}
+	if bytes := metrics.Get("p2p/metered/1/egress/0x02/bytes").(metrics.Meter); bytes.Count() == 0 {
+		t.Error("egress byte meter not updated")
+	}
+	peerEgress := fmt.Sprintf("%s%x/egress", peerMetricsPrefix, remid[:8])
+	if m, ok := metrics.Get(peerEgress).(metrics.Meter); !ok || m.Count() == 0 {
+		t.Fatalf("per-peer egress meter missing or empty")
+	}
+
+	// 断开之后单个peer的统计要从registry里删除
+	srv.RemovePeer(&discover.Node{ID: remid})
+	for ev := range events {
+		if ev.Type == PeerEventTypeDrop {
+			break
+		}
+	}
+	if metrics.Get(peerEgress) != nil {
+		t.Error("per-peer meter still registered after disconnect")
+	}
+}
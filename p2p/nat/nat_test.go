@@ -0,0 +1,161 @@
+package nat
+
+import (
+	"net"
+	"reflect"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestParse(t *testing.T) {
+	tests := []struct {
+		spec string
+		want Interface
+		err  bool
+	}{
+		{spec: "", want: nil},
+		{spec: "none", want: nil},
+		{spec: "extip:1.2.3.4", want: ExtIP(net.ParseIP("1.2.3.4"))},
+		{spec: "EXTIP:1.2.3.4", want: ExtIP(net.ParseIP("1.2.3.4"))},
+		{spec: "pmp:192.168.0.1", want: &pmp{gw: net.ParseIP("192.168.0.1"), port: pmpPort}},
+		{spec: "extip", err: true},
+		{spec: "extip:foo", err: true},
+		{spec: "bogus", err: true},
+	}
+	for _, tt := range tests {
+		have, err := Parse(tt.spec)
+		if (err != nil) != tt.err {
+			t.Errorf("%q: got error %v, want error %v", tt.spec, err, tt.err)
+			continue
+		}
+		if !reflect.DeepEqual(have, tt.want) {
+			t.Errorf("%q: got %v, want %v", tt.spec, have, tt.want)
+		}
+	}
+	for _, spec := range []string{"any", "upnp", "pmp"} {
+		if m, err := Parse(spec); err != nil {
+			t.Errorf("%q: unexpected error %v", spec, err)
+		} else if _, ok := m.(*autodisc); !ok {
+			t.Errorf("%q: got %T, want autodiscovery", spec, m)
+		}
+	}
+}
+
+// countingNAT records the mapping calls made on it.
+type countingNAT struct {
+	mu       sync.Mutex
+	adds     int
+	deletes  int
+	lifetime time.Duration
+}
+
+func (n *countingNAT) AddMapping(protocol string, extport, intport int, name string, lifetime time.Duration) error {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	n.adds++
+	n.lifetime = lifetime
+	return nil
+}
+
+func (n *countingNAT) DeleteMapping(protocol string, extport, intport int) error {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	n.deletes++
+	return nil
+}
+
+func (n *countingNAT) ExternalIP() (net.IP, error) { return net.IP{1, 2, 3, 4}, nil }
+func (n *countingNAT) String() string              { return "counting" }
+
+func (n *countingNAT) counts() (int, int) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	return n.adds, n.deletes
+}
+
+func TestMapRefresh(t *testing.T) {
+	defer func(d time.Duration) { mapUpdateInterval = d }(mapUpdateInterval)
+	mapUpdateInterval = 20 * time.Millisecond
+
+	m := new(countingNAT)
+	quit := make(chan struct{})
+	done := make(chan struct{})
+	go func() {
+		Map(m, quit, "tcp", 30303, 30303, "test")
+		close(done)
+	}()
+
+	// 映射要在过期之前被反复刷新
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		if adds, _ := m.counts(); adds >= 3 {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("mapping was not refreshed")
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+	close(quit)
+	<-done
+
+	if _, deletes := m.counts(); deletes != 1 {
+		t.Errorf("got %d deletions after quit, want 1", deletes)
+	}
+	if m.lifetime != mapTimeout {
+		t.Errorf("mapping lifetime %v, want %v", m.lifetime, mapTimeout)
+	}
+}
+
+func TestAutoDiscRace(t *testing.T) {
+	var calls int
+	ad := startautodisc("thing", func() Interface {
+		calls++
+		time.Sleep(50 * time.Millisecond)
+		return ExtIP{33, 44, 55, 66}
+	})
+
+	// Spawn a few concurrent calls to ad.ExternalIP.
+	type rval struct {
+		ip  net.IP
+		err error
+	}
+	results := make(chan rval, 10)
+	for i := 0; i < cap(results); i++ {
+		go func() {
+			ip, err := ad.ExternalIP()
+			results <- rval{ip, err}
+		}()
+	}
+
+	// Check that they all return the correct result within the deadline.
+	deadline := time.After(2 * time.Second)
+	for i := 0; i < cap(results); i++ {
+		select {
+		case <-deadline:
+			t.Fatal("deadline exceeded")
+		case rval := <-results:
+			if rval.err != nil {
+				t.Errorf("result %d: unexpected error: %v", i, rval.err)
+			}
+			wantIP := net.IP{33, 44, 55, 66}
+			if !rval.ip.Equal(wantIP) {
+				t.Errorf("result %d: got IP %v, want %v", i, rval.ip, wantIP)
+			}
+		}
+	}
+	if calls != 1 {
+		t.Errorf("discovery ran %d times, want 1", calls)
+	}
+}
+
+func TestAutoDiscNotFound(t *testing.T) {
+	ad := startautodisc("thing", func() Interface { return nil })
+	if _, err := ad.ExternalIP(); err == nil {
+		t.Fatal("expected error when nothing was discovered")
+	}
+	if err := ad.AddMapping("tcp", 1, 1, "test", time.Minute); err == nil {
+		t.Fatal("expected error when nothing was discovered")
+	}
+}
@@ -0,0 +1,201 @@
+package nat
+
+import (
+	"encoding/binary"
+	"fmt"
+	"net"
+	"strings"
+	"time"
+)
+
+const (
+	// pmpPort 网关上NAT-PMP服务的端口 (RFC 6886)
+	pmpPort = 5351
+
+	pmpOpExternalAddr = 0
+	pmpOpMapUDP       = 1
+	pmpOpMapTCP       = 2
+
+	// 首次等待250ms 之后每次翻倍 RFC里最多重试9次 这里只试到2秒左右
+	pmpInitialTimeout = 250 * time.Millisecond
+	pmpMaxTries       = 4
+)
+
+// pmpResultCodes are the error results defined by RFC 6886.
+var pmpResultCodes = map[uint16]string{
+	1: "unsupported version",
+	2: "not authorized/refused",
+	3: "network failure",
+	4: "out of resources",
+	5: "unsupported opcode",
+}
+
+// pmp talks to a NAT-PMP gateway.
+type pmp struct {
+	gw   net.IP
+	port int
+}
+
+func (n *pmp) String() string {
+	return fmt.Sprintf("NAT-PMP(%v)", n.gw)
+}
+
+func (n *pmp) ExternalIP() (net.IP, error) {
+	resp, err := n.call([]byte{0, pmpOpExternalAddr}, 12)
+	if err != nil {
+		return nil, err
+	}
+	return net.IPv4(resp[8], resp[9], resp[10], resp[11]), nil
+}
+
+func (n *pmp) AddMapping(protocol string, extport, intport int, name string, lifetime time.Duration) error {
+	if lifetime <= 0 {
+		return fmt.Errorf("lifetime must not be <= 0")
+	}
+	// Note order of port arguments is switched between our
+	// AddMapping and the client's AddPortMapping.
+	_, err := n.mapPort(protocol, intport, extport, uint32(lifetime/time.Second))
+	return err
+}
+
+func (n *pmp) DeleteMapping(protocol string, extport, intport int) (err error) {
+	// To destroy a mapping, send an add-port with an internalPort of
+	// the internal port to destroy, an external port of zero and a
+	// time of zero.
+	_, err = n.mapPort(protocol, intport, 0, 0)
+	return err
+}
+
+// mapPort sends a mapping request and returns the external port assigned
+// by the gateway.
+func (n *pmp) mapPort(protocol string, intport, extport int, lifetime uint32) (uint16, error) {
+	var op byte
+	switch strings.ToLower(protocol) {
+	case "udp":
+		op = pmpOpMapUDP
+	case "tcp":
+		op = pmpOpMapTCP
+	default:
+		return 0, fmt.Errorf("unknown protocol %q", protocol)
+	}
+	msg := make([]byte, 12)
+	msg[1] = op
+	binary.BigEndian.PutUint16(msg[4:], uint16(intport))
+	binary.BigEndian.PutUint16(msg[6:], uint16(extport))
+	binary.BigEndian.PutUint32(msg[8:], lifetime)
+	resp, err := n.call(msg, 16)
+	if err != nil {
+		return 0, err
+	}
+	return binary.BigEndian.Uint16(resp[10:]), nil
+}
+
+// call sends a request to the gateway and waits for the matching response,
+// retrying with an increasing timeout like the RFC recommends.
+func (n *pmp) call(msg []byte, resultSize int) ([]byte, error) {
+	conn, err := net.DialUDP("udp", nil, &net.UDPAddr{IP: n.gw, Port: n.port})
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+
+	buf := make([]byte, 16)
+	timeout := pmpInitialTimeout
+	for i := 0; i < pmpMaxTries; i++ {
+		if _, err := conn.Write(msg); err != nil {
+			return nil, err
+		}
+		conn.SetReadDeadline(time.Now().Add(timeout))
+		for {
+			size, err := conn.Read(buf)
+			if err != nil {
+				if nerr, ok := err.(net.Error); ok && nerr.Timeout() {
+					break
+				}
+				return nil, err
+			}
+			// 不是对这个请求的应答就继续等
+			if size != resultSize || buf[0] != 0 || buf[1] != msg[1]|0x80 {
+				continue
+			}
+			if code := binary.BigEndian.Uint16(buf[2:]); code != 0 {
+				if reason, ok := pmpResultCodes[code]; ok {
+					return nil, fmt.Errorf("NAT-PMP error: %s", reason)
+				}
+				return nil, fmt.Errorf("NAT-PMP error code %d", code)
+			}
+			return buf[:size], nil
+		}
+		timeout *= 2
+	}
+	return nil, fmt.Errorf("NAT-PMP gateway %v did not respond", n.gw)
+}
+
+// discoverPMP asks all potential gateways for their external address
+// and returns the first one that answers.
+func discoverPMP() Interface {
+	// run external address lookups on all potential gateways
+	gws := potentialGateways()
+	found := make(chan *pmp, len(gws))
+	for i := range gws {
+		gw := gws[i]
+		go func() {
+			c := &pmp{gw: gw, port: pmpPort}
+			if _, err := c.ExternalIP(); err != nil {
+				found <- nil
+				return
+			}
+			found <- c
+		}()
+	}
+	// return the one that responds first.
+	// discovery needs to be quick, so we stop caring about
+	// any responses after a very short timeout.
+	timeout := time.NewTimer(1 * time.Second)
+	defer timeout.Stop()
+	for range gws {
+		select {
+		case c := <-found:
+			if c != nil {
+				return c
+			}
+		case <-timeout.C:
+			return nil
+		}
+	}
+	return nil
+}
+
+var (
+	// LAN IP ranges
+	_, lan10, _  = net.ParseCIDR("10.0.0.0/8")
+	_, lan176, _ = net.ParseCIDR("172.16.0.0/12")
+	_, lan192, _ = net.ParseCIDR("192.168.0.0/16")
+)
+
+// TODO: improve this. We currently assume that (on most networks)
+// the router is X.X.X.1 in a local LAN range.
+func potentialGateways() (gws []net.IP) {
+	ifaces, err := net.Interfaces()
+	if err != nil {
+		return nil
+	}
+	for _, iface := range ifaces {
+		ifaddrs, err := iface.Addrs()
+		if err != nil {
+			return gws
+		}
+		for _, addr := range ifaddrs {
+			if x, ok := addr.(*net.IPNet); ok {
+				if lan10.Contains(x.IP) || lan176.Contains(x.IP) || lan192.Contains(x.IP) {
+					ip := x.IP.Mask(x.Mask).To4()
+					if ip != nil {
+						ip[3] = ip[3] | 0x01
+						gws = append(gws, ip)
+					}
+				}
+			}
+		}
+	}
+	return gws
+}
@@ -0,0 +1,111 @@
+package nat
+
+import (
+	"encoding/binary"
+	"net"
+	"testing"
+	"time"
+)
+
+// fakePMPGateway answers NAT-PMP requests on a local UDP socket.
+type fakePMPGateway struct {
+	conn     *net.UDPConn
+	extIP    net.IP
+	result   uint16 // result code sent in every response
+	requests chan []byte
+}
+
+func newFakePMPGateway(t *testing.T, extIP net.IP, result uint16) *fakePMPGateway {
+	conn, err := net.ListenUDP("udp4", &net.UDPAddr{IP: net.IP{127, 0, 0, 1}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	gw := &fakePMPGateway{conn: conn, extIP: extIP, result: result, requests: make(chan []byte, 10)}
+	go gw.serve()
+	return gw
+}
+
+func (gw *fakePMPGateway) client() *pmp {
+	addr := gw.conn.LocalAddr().(*net.UDPAddr)
+	return &pmp{gw: addr.IP, port: addr.Port}
+}
+
+func (gw *fakePMPGateway) serve() {
+	buf := make([]byte, 64)
+	for {
+		n, from, err := gw.conn.ReadFromUDP(buf)
+		if err != nil {
+			return
+		}
+		req := append([]byte{}, buf[:n]...)
+		gw.requests <- req
+
+		var resp []byte
+		switch req[1] {
+		case pmpOpExternalAddr:
+			resp = make([]byte, 12)
+			copy(resp[8:], gw.extIP.To4())
+		case pmpOpMapUDP, pmpOpMapTCP:
+			resp = make([]byte, 16)
+			copy(resp[8:10], req[4:6])   // internal port
+			copy(resp[10:12], req[6:8])  // external port
+			copy(resp[12:16], req[8:12]) // lifetime
+		default:
+			continue
+		}
+		resp[1] = req[1] | 0x80
+		binary.BigEndian.PutUint16(resp[2:], gw.result)
+		gw.conn.WriteToUDP(resp, from)
+	}
+}
+
+func TestPMPExternalIP(t *testing.T) {
+	gw := newFakePMPGateway(t, net.IP{77, 12, 33, 4}, 0)
+	defer gw.conn.Close()
+
+	ip, err := gw.client().ExternalIP()
+	if err != nil {
+		t.Fatalf("ExternalIP failed: %v", err)
+	}
+	if !ip.Equal(net.IP{77, 12, 33, 4}) {
+		t.Errorf("got external IP %v, want 77.12.33.4", ip)
+	}
+}
+
+func TestPMPMapping(t *testing.T) {
+	gw := newFakePMPGateway(t, net.IP{77, 12, 33, 4}, 0)
+	defer gw.conn.Close()
+	c := gw.client()
+
+	if err := c.AddMapping("tcp", 30304, 30303, "test", 20*time.Minute); err != nil {
+		t.Fatalf("AddMapping failed: %v", err)
+	}
+	req := <-gw.requests
+	if req[1] != pmpOpMapTCP {
+		t.Errorf("wrong opcode %d", req[1])
+	}
+	if intport, extport := binary.BigEndian.Uint16(req[4:]), binary.BigEndian.Uint16(req[6:]); intport != 30303 || extport != 30304 {
+		t.Errorf("wrong ports: internal %d external %d", intport, extport)
+	}
+	if lifetime := binary.BigEndian.Uint32(req[8:]); lifetime != 20*60 {
+		t.Errorf("wrong lifetime %d", lifetime)
+	}
+
+	// 删除映射时外部端口和有效期都是0
+	if err := c.DeleteMapping("udp", 30304, 30303); err != nil {
+		t.Fatalf("DeleteMapping failed: %v", err)
+	}
+	req = <-gw.requests
+	if req[1] != pmpOpMapUDP || binary.BigEndian.Uint16(req[6:]) != 0 || binary.BigEndian.Uint32(req[8:]) != 0 {
+		t.Errorf("bad delete request %x", req)
+	}
+}
+
+func TestPMPRefused(t *testing.T) {
+	gw := newFakePMPGateway(t, net.IP{77, 12, 33, 4}, 2)
+	defer gw.conn.Close()
+
+	if err := gw.client().AddMapping("tcp", 30303, 30303, "test", time.Minute); err == nil {
+		t.Fatal("expected error for refused mapping")
+	}
+}
@@ -0,0 +1,349 @@
+package nat
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	soapRequestTimeout = 3 * time.Second
+	ssdpSearchTimeout  = 3 * time.Second
+)
+
+// ssdpAddr 局域网里UPnP设备发现用的组播地址
+var ssdpAddr = "239.255.255.250:1900"
+
+// 网关设备的类型 以及可以做端口映射的服务类型
+var (
+	igdDeviceTypes = []string{
+		"urn:schemas-upnp-org:device:InternetGatewayDevice:1",
+		"urn:schemas-upnp-org:device:InternetGatewayDevice:2",
+	}
+	wanServiceTypes = []string{
+		"urn:schemas-upnp-org:service:WANIPConnection:1",
+		"urn:schemas-upnp-org:service:WANIPConnection:2",
+		"urn:schemas-upnp-org:service:WANPPPConnection:1",
+	}
+)
+
+// upnp talks to an Internet Gateway Device through the SOAP control
+// endpoint of its WAN connection service.
+type upnp struct {
+	controlURL  string
+	serviceType string
+	deviceName  string
+	client      *http.Client
+}
+
+func (n *upnp) ExternalIP() (addr net.IP, err error) {
+	resp, err := n.call("GetExternalIPAddress", nil)
+	if err != nil {
+		return nil, err
+	}
+	ip := net.ParseIP(resp["NewExternalIPAddress"])
+	if ip == nil {
+		return nil, errors.New("bad IP in response")
+	}
+	return ip, nil
+}
+
+func (n *upnp) AddMapping(protocol string, extport, intport int, desc string, lifetime time.Duration) error {
+	ip, err := n.internalAddress()
+	if err != nil {
+		return err
+	}
+	protocol = strings.ToUpper(protocol)
+	lifetimeS := uint32(lifetime / time.Second)
+	// 先删掉旧的映射 有些路由器不允许覆盖已经存在的映射
+	n.DeleteMapping(protocol, extport, intport)
+	_, err = n.call("AddPortMapping", [][2]string{
+		{"NewRemoteHost", ""},
+		{"NewExternalPort", strconv.Itoa(extport)},
+		{"NewProtocol", protocol},
+		{"NewInternalPort", strconv.Itoa(intport)},
+		{"NewInternalClient", ip.String()},
+		{"NewEnabled", "1"},
+		{"NewPortMappingDescription", desc},
+		{"NewLeaseDuration", strconv.FormatUint(uint64(lifetimeS), 10)},
+	})
+	return err
+}
+
+func (n *upnp) DeleteMapping(protocol string, extport, intport int) error {
+	_, err := n.call("DeletePortMapping", [][2]string{
+		{"NewRemoteHost", ""},
+		{"NewExternalPort", strconv.Itoa(extport)},
+		{"NewProtocol", strings.ToUpper(protocol)},
+	})
+	return err
+}
+
+func (n *upnp) String() string {
+	return "UPNP " + n.serviceType
+}
+
+// internalAddress returns the local address used to reach the gateway,
+// which is the address the gateway has to forward the mapped port to.
+func (n *upnp) internalAddress() (net.IP, error) {
+	u, err := url.Parse(n.controlURL)
+	if err != nil {
+		return nil, err
+	}
+	host := u.Host
+	if u.Port() == "" {
+		host = net.JoinHostPort(u.Hostname(), "80")
+	}
+	// UDP的Dial不会发出任何数据 只是让系统选出本地地址
+	conn, err := net.Dial("udp", host)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+	return conn.LocalAddr().(*net.UDPAddr).IP, nil
+}
+
+// call invokes a SOAP action on the WAN connection service and returns the
+// arguments of the response.
+func (n *upnp) call(action string, args [][2]string) (map[string]string, error) {
+	var body bytes.Buffer
+	body.WriteString(`<?xml version="1.0"?>` +
+		`<s:Envelope xmlns:s="http://schemas.xmlsoap.org/soap/envelope/" s:encodingStyle="http://schemas.xmlsoap.org/soap/encoding/">` +
+		`<s:Body>`)
+	fmt.Fprintf(&body, `<u:%s xmlns:u="%s">`, action, n.serviceType)
+	for _, arg := range args {
+		fmt.Fprintf(&body, "<%s>", arg[0])
+		xml.EscapeText(&body, []byte(arg[1]))
+		fmt.Fprintf(&body, "</%s>", arg[0])
+	}
+	fmt.Fprintf(&body, `</u:%s></s:Body></s:Envelope>`, action)
+
+	req, err := http.NewRequest("POST", n.controlURL, &body)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", `text/xml; charset="utf-8"`)
+	req.Header.Set("SOAPAction", fmt.Sprintf(`"%s#%s"`, n.serviceType, action))
+	resp, err := n.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	data, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("%s: %s", action, soapFault(data, resp.Status))
+	}
+	return soapResponseArgs(data)
+}
+
+// soapResponseArgs collects the child elements of the action response.
+func soapResponseArgs(data []byte) (map[string]string, error) {
+	var envelope struct {
+		Body struct {
+			Response struct {
+				Args []struct {
+					XMLName xml.Name
+					Value   string `xml:",chardata"`
+				} `xml:",any"`
+			} `xml:",any"`
+		} `xml:"Body"`
+	}
+	if err := xml.Unmarshal(data, &envelope); err != nil {
+		return nil, err
+	}
+	args := make(map[string]string)
+	for _, arg := range envelope.Body.Response.Args {
+		args[arg.XMLName.Local] = strings.TrimSpace(arg.Value)
+	}
+	return args, nil
+}
+
+// soapFault extracts the UPnP error description of a failed call.
+func soapFault(data []byte, status string) string {
+	var envelope struct {
+		Body struct {
+			Fault struct {
+				Detail struct {
+					UPnPError struct {
+						Code        int    `xml:"errorCode"`
+						Description string `xml:"errorDescription"`
+					} `xml:"UPnPError"`
+				} `xml:"detail"`
+			} `xml:"Fault"`
+		} `xml:"Body"`
+	}
+	if err := xml.Unmarshal(data, &envelope); err != nil || envelope.Body.Fault.Detail.UPnPError.Code == 0 {
+		return status
+	}
+	e := envelope.Body.Fault.Detail.UPnPError
+	return fmt.Sprintf("UPnP error %d: %s", e.Code, e.Description)
+}
+
+// upnpRoot is the part of a device description that is needed to find the
+// WAN connection service.
+type upnpRoot struct {
+	URLBase string     `xml:"URLBase"`
+	Device  upnpDevice `xml:"device"`
+}
+
+type upnpDevice struct {
+	DeviceType   string        `xml:"deviceType"`
+	FriendlyName string        `xml:"friendlyName"`
+	Devices      []upnpDevice  `xml:"deviceList>device"`
+	Services     []upnpService `xml:"serviceList>service"`
+}
+
+type upnpService struct {
+	ServiceType string `xml:"serviceType"`
+	ControlURL  string `xml:"controlURL"`
+}
+
+// findService searches the device tree for a WAN connection service.
+func (d *upnpDevice) findService() *upnpService {
+	for i := range d.Services {
+		for _, typ := range wanServiceTypes {
+			if d.Services[i].ServiceType == typ {
+				return &d.Services[i]
+			}
+		}
+	}
+	for i := range d.Devices {
+		if s := d.Devices[i].findService(); s != nil {
+			return s
+		}
+	}
+	return nil
+}
+
+// discoverUPnP searches for Internet Gateway Devices
+// and returns the first one it can find on the local network.
+func discoverUPnP() Interface {
+	var dev *upnp
+	ssdpSearch(igdDeviceTypes, ssdpSearchTimeout, func(location string) bool {
+		d, err := newUPnP(location)
+		if err != nil {
+			return false
+		}
+		dev = d
+		return true
+	})
+	if dev == nil {
+		return nil
+	}
+	return dev
+}
+
+// newUPnP reads the device description at the given location and
+// sets up a client for its WAN connection service.
+func newUPnP(location string) (*upnp, error) {
+	client := &http.Client{Timeout: soapRequestTimeout}
+	resp, err := client.Get(location)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("can't fetch device description: %s", resp.Status)
+	}
+	var root upnpRoot
+	if err := xml.NewDecoder(resp.Body).Decode(&root); err != nil {
+		return nil, err
+	}
+	isIGD := false
+	for _, typ := range igdDeviceTypes {
+		if root.Device.DeviceType == typ {
+			isIGD = true
+		}
+	}
+	if !isIGD {
+		return nil, fmt.Errorf("not an internet gateway device: %s", root.Device.DeviceType)
+	}
+	service := root.Device.findService()
+	if service == nil {
+		return nil, errors.New("no WAN connection service")
+	}
+	// 控制地址可能是相对路径 相对于URLBase或者描述文件的地址
+	base, err := url.Parse(location)
+	if err != nil {
+		return nil, err
+	}
+	if root.URLBase != "" {
+		if base, err = url.Parse(root.URLBase); err != nil {
+			return nil, err
+		}
+	}
+	ctrl, err := base.Parse(service.ControlURL)
+	if err != nil {
+		return nil, err
+	}
+	return &upnp{
+		controlURL:  ctrl.String(),
+		serviceType: service.ServiceType,
+		deviceName:  root.Device.FriendlyName,
+		client:      client,
+	}, nil
+}
+
+// ssdpSearch multicasts M-SEARCH requests for the given device types and
+// passes the description location of every responding device to found,
+// until found returns true or the timeout expires.
+func ssdpSearch(types []string, timeout time.Duration, found func(location string) bool) {
+	addr, err := net.ResolveUDPAddr("udp4", ssdpAddr)
+	if err != nil {
+		return
+	}
+	conn, err := net.ListenUDP("udp4", nil)
+	if err != nil {
+		return
+	}
+	defer conn.Close()
+
+	for _, typ := range types {
+		req := "M-SEARCH * HTTP/1.1\r\n" +
+			"HOST: 239.255.255.250:1900\r\n" +
+			"MAN: \"ssdp:discover\"\r\n" +
+			"MX: 2\r\n" +
+			"ST: " + typ + "\r\n\r\n"
+		if _, err := conn.WriteTo([]byte(req), addr); err != nil {
+			return
+		}
+	}
+
+	var (
+		seen = make(map[string]bool)
+		buf  = make([]byte, 2048)
+	)
+	conn.SetReadDeadline(time.Now().Add(timeout))
+	for {
+		n, _, err := conn.ReadFrom(buf)
+		if err != nil {
+			// 超时说明所有设备都已经应答过了
+			return
+		}
+		resp, err := http.ReadResponse(bufio.NewReader(bytes.NewReader(buf[:n])), nil)
+		if err != nil {
+			continue
+		}
+		resp.Body.Close()
+		loc := resp.Header.Get("Location")
+		if loc == "" || seen[loc] {
+			continue
+		}
+		seen[loc] = true
+		if found(loc) {
+			return
+		}
+	}
+}
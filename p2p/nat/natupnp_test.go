@@ -0,0 +1,202 @@
+package nat
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+const fakeIGDDescription = `<?xml version="1.0"?>
+<root xmlns="urn:schemas-upnp-org:device-1-0">
+  <device>
+    <deviceType>urn:schemas-upnp-org:device:InternetGatewayDevice:1</deviceType>
+    <friendlyName>fake router</friendlyName>
+    <deviceList>
+      <device>
+        <deviceType>urn:schemas-upnp-org:device:WANDevice:1</deviceType>
+        <deviceList>
+          <device>
+            <deviceType>urn:schemas-upnp-org:device:WANConnectionDevice:1</deviceType>
+            <serviceList>
+              <service>
+                <serviceType>urn:schemas-upnp-org:service:WANIPConnection:1</serviceType>
+                <controlURL>/ctl/IPConn</controlURL>
+              </service>
+            </serviceList>
+          </device>
+        </deviceList>
+      </device>
+    </deviceList>
+  </device>
+</root>`
+
+// fakeIGD is a local stand-in for an Internet Gateway Device. It answers
+// SSDP searches on a UDP socket and SOAP calls over HTTP.
+type fakeIGD struct {
+	t    *testing.T
+	ssdp *net.UDPConn
+	srv  *httptest.Server
+
+	mu      sync.Mutex
+	actions []string
+	args    []map[string]string
+}
+
+func newFakeIGD(t *testing.T) *fakeIGD {
+	igd := &fakeIGD{t: t}
+	mux := http.NewServeMux()
+	mux.HandleFunc("/desc.xml", func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, fakeIGDDescription)
+	})
+	mux.HandleFunc("/ctl/IPConn", igd.serveSOAP)
+	igd.srv = httptest.NewServer(mux)
+
+	var err error
+	igd.ssdp, err = net.ListenUDP("udp4", &net.UDPAddr{IP: net.IP{127, 0, 0, 1}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	go igd.serveSSDP()
+	return igd
+}
+
+func (igd *fakeIGD) close() {
+	igd.ssdp.Close()
+	igd.srv.Close()
+}
+
+func (igd *fakeIGD) serveSSDP() {
+	buf := make([]byte, 2048)
+	for {
+		n, from, err := igd.ssdp.ReadFromUDP(buf)
+		if err != nil {
+			return
+		}
+		if !strings.HasPrefix(string(buf[:n]), "M-SEARCH") {
+			continue
+		}
+		resp := "HTTP/1.1 200 OK\r\n" +
+			"ST: urn:schemas-upnp-org:device:InternetGatewayDevice:1\r\n" +
+			"LOCATION: " + igd.srv.URL + "/desc.xml\r\n\r\n"
+		igd.ssdp.WriteToUDP([]byte(resp), from)
+	}
+}
+
+func (igd *fakeIGD) serveSOAP(w http.ResponseWriter, r *http.Request) {
+	action := r.Header.Get("SOAPAction")
+	action = strings.Trim(action[strings.Index(action, "#")+1:], `"`)
+	body, _ := ioutil.ReadAll(r.Body)
+	args, err := soapResponseArgs(body)
+	if err != nil {
+		igd.t.Errorf("bad SOAP request: %v", err)
+	}
+	igd.mu.Lock()
+	igd.actions = append(igd.actions, action)
+	igd.args = append(igd.args, args)
+	igd.mu.Unlock()
+
+	var resp string
+	switch action {
+	case "GetExternalIPAddress":
+		resp = "<NewExternalIPAddress>77.12.33.4</NewExternalIPAddress>"
+	case "AddPortMapping":
+		if args["NewExternalPort"] == "1" {
+			w.WriteHeader(http.StatusInternalServerError)
+			fmt.Fprint(w, `<s:Envelope xmlns:s="http://schemas.xmlsoap.org/soap/envelope/"><s:Body><s:Fault>`+
+				`<detail><UPnPError xmlns="urn:schemas-upnp-org:control-1-0"><errorCode>718</errorCode>`+
+				`<errorDescription>ConflictInMappingEntry</errorDescription></UPnPError></detail></s:Fault></s:Body></s:Envelope>`)
+			return
+		}
+	}
+	fmt.Fprintf(w, `<s:Envelope xmlns:s="http://schemas.xmlsoap.org/soap/envelope/"><s:Body>`+
+		`<u:%sResponse xmlns:u="urn:schemas-upnp-org:service:WANIPConnection:1">%s</u:%sResponse></s:Body></s:Envelope>`,
+		action, resp, action)
+}
+
+func (igd *fakeIGD) lastCall() (string, map[string]string) {
+	igd.mu.Lock()
+	defer igd.mu.Unlock()
+	if len(igd.actions) == 0 {
+		return "", nil
+	}
+	return igd.actions[len(igd.actions)-1], igd.args[len(igd.args)-1]
+}
+
+func TestUPnPDiscoveryAndMapping(t *testing.T) {
+	igd := newFakeIGD(t)
+	defer igd.close()
+	defer func(addr string) { ssdpAddr = addr }(ssdpAddr)
+	ssdpAddr = igd.ssdp.LocalAddr().String()
+
+	m := UPnP()
+	ip, err := m.ExternalIP()
+	if err != nil {
+		t.Fatalf("ExternalIP failed: %v", err)
+	}
+	if !ip.Equal(net.IP{77, 12, 33, 4}) {
+		t.Errorf("got external IP %v, want 77.12.33.4", ip)
+	}
+	if s := m.String(); s != "UPNP urn:schemas-upnp-org:service:WANIPConnection:1" {
+		t.Errorf("unexpected name after discovery: %q", s)
+	}
+
+	if err := m.AddMapping("tcp", 30304, 30303, "ethereum p2p", 20*time.Minute); err != nil {
+		t.Fatalf("AddMapping failed: %v", err)
+	}
+	action, args := igd.lastCall()
+	if action != "AddPortMapping" {
+		t.Fatalf("last action %q, want AddPortMapping", action)
+	}
+	want := map[string]string{
+		"NewExternalPort":           "30304",
+		"NewInternalPort":           "30303",
+		"NewProtocol":               "TCP",
+		"NewInternalClient":         "127.0.0.1",
+		"NewPortMappingDescription": "ethereum p2p",
+		"NewLeaseDuration":          "1200",
+	}
+	for k, v := range want {
+		if args[k] != v {
+			t.Errorf("%s: got %q, want %q", k, args[k], v)
+		}
+	}
+
+	if err := m.DeleteMapping("tcp", 30304, 30303); err != nil {
+		t.Fatalf("DeleteMapping failed: %v", err)
+	}
+	if action, args := igd.lastCall(); action != "DeletePortMapping" || args["NewExternalPort"] != "30304" {
+		t.Errorf("unexpected delete call %q %v", action, args)
+	}
+}
+
+func TestUPnPFault(t *testing.T) {
+	igd := newFakeIGD(t)
+	defer igd.close()
+
+	dev, err := newUPnP(igd.srv.URL + "/desc.xml")
+	if err != nil {
+		t.Fatalf("newUPnP failed: %v", err)
+	}
+	err = dev.AddMapping("udp", 1, 1, "test", time.Minute)
+	if err == nil || !strings.Contains(err.Error(), "718") {
+		t.Fatalf("expected UPnP error 718, got %v", err)
+	}
+}
+
+func TestUPnPDescriptionNotIGD(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		desc := strings.Replace(fakeIGDDescription, "InternetGatewayDevice", "MediaServer", 1)
+		fmt.Fprint(w, desc)
+	}))
+	defer srv.Close()
+
+	if _, err := newUPnP(srv.URL); err == nil {
+		t.Fatal("expected error for non-gateway device")
+	}
+}
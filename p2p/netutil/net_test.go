@@ -0,0 +1,93 @@
+package netutil
+
+import (
+	"net"
+	"reflect"
+	"testing"
+)
+
+func TestParseNetlist(t *testing.T) {
+	var tests = []struct {
+		input    string
+		wantErr  error
+		wantList *Netlist
+	}{
+		{
+			input:    "",
+			wantList: &Netlist{},
+		},
+		{
+			input:    "127.0.0.0/8",
+			wantErr:  nil,
+			wantList: &Netlist{{IP: net.IP{127, 0, 0, 0}, Mask: net.CIDRMask(8, 32)}},
+		},
+		{
+			input:   "127.0.0.0/44",
+			wantErr: &net.ParseError{Type: "CIDR address", Text: "127.0.0.0/44"},
+		},
+		{
+			input: "127.0.0.0/16, 23.23.23.23/24,",
+			wantList: &Netlist{
+				{IP: net.IP{127, 0, 0, 0}, Mask: net.CIDRMask(16, 32)},
+				{IP: net.IP{23, 23, 23, 0}, Mask: net.CIDRMask(24, 32)},
+			},
+		},
+	}
+
+	for _, test := range tests {
+		l, err := ParseNetlist(test.input)
+		if !reflect.DeepEqual(err, test.wantErr) {
+			t.Errorf("%q: got error %q, want %q", test.input, err, test.wantErr)
+			continue
+		}
+		if !reflect.DeepEqual(l, test.wantList) {
+			t.Errorf("%q: got %v, want %v", test.input, l, test.wantList)
+		}
+	}
+}
+
+func TestNetlistContains(t *testing.T) {
+	var nilList *Netlist
+	if nilList.Contains(net.IP{127, 0, 0, 1}) {
+		t.Error("nil list contains an address")
+	}
+
+	l, _ := ParseNetlist("10.0.0.0/8, 192.168.1.0/24, fd00::/8")
+	for _, tt := range []struct {
+		ip   string
+		want bool
+	}{
+		{"10.1.2.3", true},
+		{"192.168.1.200", true},
+		{"192.168.2.1", false},
+		{"127.0.0.1", false},
+		{"fd12::1", true},
+		{"fe80::1", false},
+	} {
+		if have := l.Contains(net.ParseIP(tt.ip)); have != tt.want {
+			t.Errorf("Contains(%s) = %v, want %v", tt.ip, have, tt.want)
+		}
+	}
+}
+
+func TestIsLAN(t *testing.T) {
+	for _, tt := range []struct {
+		ip   string
+		want bool
+	}{
+		{"127.0.0.1", true},
+		{"10.0.1.1", true},
+		{"172.31.255.1", true},
+		{"192.168.1.1", true},
+		{"::1", true},
+		{"fe80::1", true},
+		{"fd12::1", true},
+		{"172.32.0.1", false},
+		{"1.2.3.4", false},
+		{"2001:db8::1", false},
+	} {
+		if have := IsLAN(net.ParseIP(tt.ip)); have != tt.want {
+			t.Errorf("IsLAN(%s) = %v, want %v", tt.ip, have, tt.want)
+		}
+	}
+}
@@ -4,20 +4,36 @@ import (
 	"errors"
 	"fmt"
 	"io"
+	"myeth/event"
 	"myeth/p2p/discover"
+	"myeth/rlp"
+	"net"
 	"sort"
 	"sync"
 	"time"
 )
 
+var (
+	ErrShuttingDown = errors.New("shutting down")
+)
+
 const (
-	baseProtocolVersion    = 5
+	baseProtocolVersion    = 6
 	baseProtocolLength     = uint64(16)
 	baseProtocolMaxMsgSize = 2 * 1024
 
+	// minProtocolVersion 能够兼容的最低基础协议版本 更老的节点直接断开
+	minProtocolVersion = 4
+
 	snappyProtocolVersion = 5
 
+	// chunkedProtocolVersion 从这个版本开始支持RLPx分片传输大消息
+	chunkedProtocolVersion = 6
+
 	pingInterval = 15 * time.Second
+
+	// 连续两个ping都没有收到pong 就认为连接已经失效
+	pongTimeout = 2 * pingInterval
 )
 
 const (
@@ -37,26 +53,39 @@ type protoRW struct {
 	in chan Msg //网络连接会把收到的网络包 放到chan变量里面 通知到eth里的handlemsg里面
 	//通知变量
 	closed <-chan struct{}
-	wstart <-chan struct{}
+	wstart chan struct{} //本协议的写入令牌 每个协议各自排队 大消息的分片可以在协议之间交错发送
 
-	werr   chan<- error //网络连接写入的时候发生了错误
-	offset uint64       //协议命令字的偏移量 每个service的msg code都是从0 开始的 所以要用偏移量 来区别
-	w      MsgWriter    //网络conn 的接口 用来从protoRW里 发出去消息
+	werr      chan<- error //网络连接写入的时候发生了错误
+	offset    uint64       //协议命令字的偏移量 每个service的msg code都是从0 开始的 所以要用偏移量 来区别
+	protoType uint16       //RLPx帧头里的capability-id 从1开始 0留给基础协议
+	w         MsgWriter    //网络conn 的接口 用来从protoRW里 发出去消息
 }
 
 func (rw *protoRW) WriteMsg(msg Msg) (err error) {
 	if msg.Code >= rw.Length {
-		return errors.New("超出了这个协议的命令字范围")
+		//超出了这个协议的命令字范围
+		return newPeerError(errInvalidMsgCode, "not handled")
 	}
 
 	msg.Code += rw.offset
 	select {
 	case <-rw.wstart:
 		//通过rlpx 将数据发出去了
-		err = rw.w.WriteMsg(msg)
-		rw.werr <- err
+		if pw, ok := rw.w.(protoWriter); ok {
+			err = pw.writeProtoMsg(rw.protoType, msg)
+		} else {
+			err = rw.w.WriteMsg(msg)
+		}
+		// 写入出错要通知run loop断开连接 只需要报告第一个错误
+		if err != nil {
+			select {
+			case rw.werr <- err:
+			default:
+			}
+		}
+		rw.wstart <- struct{}{}
 	case <-rw.closed:
-		err = fmt.Errorf("shutting down")
+		err = ErrShuttingDown
 	}
 	return err
 }
@@ -83,6 +112,11 @@ type Peer struct {
 	wg       sync.WaitGroup
 	protoErr chan error //协议层错误 收发包错误
 	closed   chan struct{}
+	disc     chan DiscReason //主动断开连接的请求
+	pong     chan struct{}   //收到pong之后通知pingLoop
+
+	// events receives message send / receive events if set
+	events *event.Feed
 }
 
 //握手协议
@@ -106,52 +140,110 @@ func countMatchingProtocols(protocols []Protocol, caps []Cap) int {
 			}
 		}
 	}
-	n++
 	return n
 }
 
 //创建 protoRW proto Reader Writer功能 主要的功能是对每个service的msgcode 做一个映射
+// matchProtocols creates structures for matching named subprotocols. For every
+// protocol name the highest version supported by both sides is selected, and
+// the matched protocols are assigned contiguous message code ranges in
+// alphabetical order of their names, starting right after the base protocol.
 func matchProtocols(protocols []Protocol, caps []Cap, rw MsgReadWriter) map[string]*protoRW {
 	//将支持的协议数组进行排序
 	sort.Sort(capsByNameAndVersion(caps))
-	offset := baseProtocolLength
-	result := make(map[string]*protoRW)
 
-outer:
-	//对本地协议和远端peer支持的协议进行逐个的比较
+	//对本地协议和远端peer支持的协议进行逐个的比较 同名协议只保留双方共同支持的最高版本
+	matched := make(map[string]Protocol)
 	for _, cap := range caps {
 		for _, proto := range protocols {
-			//协议 和 版本号 一致
-			if proto.Name == cap.Name && proto.Version == cap.Version {
-				//因为caps数组已经按照版本号排序了 所以如果找到了同名协议 肯定是之前有一个老的版本在map里了
-				if old := result[cap.Name]; old != nil {
-					//新的协议会覆盖老的 所以把老协议删掉
-					offset -= old.Length
-				}
-
-				result[cap.Name] = &protoRW{Protocol: proto, offset: offset, in: make(chan Msg), w: rw}
-
-				continue outer
+			if proto.Name != cap.Name || proto.Version != cap.Version {
+				continue
+			}
+			if old, ok := matched[cap.Name]; !ok || old.Version < proto.Version {
+				matched[cap.Name] = proto
 			}
 		}
 	}
+	names := make([]string, 0, len(matched))
+	for name := range matched {
+		names = append(names, name)
+	}
+	sort.Strings(names)
 
+	//按名字顺序分配连续的msgcode区间 protoType就是在帧头里标记协议用的编号
+	offset := baseProtocolLength
+	result := make(map[string]*protoRW, len(matched))
+	for i, name := range names {
+		proto := matched[name]
+		result[name] = &protoRW{Protocol: proto, offset: offset, protoType: uint16(i + 1), in: make(chan Msg), w: rw}
+		offset += proto.Length
+	}
 	return result
 }
 
 func newPeer(conn *conn, protocols []Protocol) *Peer {
-	protomap := matchProtocols(protocols, conn.caps, conn)
+	// 直接把transport交给protoRW 这样rlpx可以在帧头里标记协议类型
+	protomap := matchProtocols(protocols, conn.caps, conn.transport)
 	p := &Peer{
-		rw:      conn,
-		running: protomap,
+		rw:       conn,
+		running:  protomap,
+		disc:     make(chan DiscReason),
+		protoErr: make(chan error, len(protomap)+1), // protocols + pingLoop
+		closed:   make(chan struct{}),
+		pong:     make(chan struct{}, 1),
 	}
 	return p
 }
 
+// NewPeer returns a peer for testing purposes.
+func NewPeer(id discover.NodeID, name string, caps []Cap) *Peer {
+	pipe, _ := net.Pipe()
+	conn := &conn{fd: pipe, transport: nil, id: id, caps: caps, name: name}
+	peer := newPeer(conn, nil)
+	close(peer.closed) // ensures Disconnect doesn't block
+	return peer
+}
+
+// ID returns the node's public key.
 func (p *Peer) ID() discover.NodeID {
 	return p.rw.id
 }
 
+// Name returns the node name that the remote node advertised.
+func (p *Peer) Name() string {
+	return p.rw.name
+}
+
+// Caps returns the capabilities (supported subprotocols) of the remote peer.
+func (p *Peer) Caps() []Cap {
+	// TODO: maybe return copy
+	return p.rw.caps
+}
+
+// RemoteAddr returns the remote address of the network connection.
+func (p *Peer) RemoteAddr() net.Addr {
+	return p.rw.fd.RemoteAddr()
+}
+
+// LocalAddr returns the local address of the network connection.
+func (p *Peer) LocalAddr() net.Addr {
+	return p.rw.fd.LocalAddr()
+}
+
+// String implements fmt.Stringer.
+func (p *Peer) String() string {
+	return fmt.Sprintf("Peer %x %v", p.rw.id[:8], p.rw.fd.RemoteAddr())
+}
+
+// Disconnect terminates the peer connection with the given reason.
+// It returns immediately and does not wait until the connection is closed.
+func (p *Peer) Disconnect(reason DiscReason) {
+	select {
+	case p.disc <- reason:
+	case <-p.closed:
+	}
+}
+
 //开启一个循环 读取网络消息
 func (p *Peer) readLoop(errc chan<- error) {
 	defer p.wg.Done()
@@ -177,20 +269,40 @@ func (p *Peer) getProto(code uint64) (*protoRW, error) {
 			return proto, nil
 		}
 	}
-	return nil, errors.New("fuck")
+	return nil, newPeerError(errInvalidMsgCode, "%d", code)
 }
 
 //tcp消息的第一层处理
 func (p *Peer) handle(msg Msg) error {
 	switch {
+	case msg.Code < baseProtocolLength && msg.Size > baseProtocolMaxMsgSize:
+		//基础协议的消息都很小 超过上限说明对方有问题
+		msg.Discard()
+		return newPeerError(errInvalidMsg, "base protocol message too large (code %d, size %d)", msg.Code, msg.Size)
 	case msg.Code == pingMsg:
 		msg.Discard()
 		go SendItems(p.rw, pongMsg)
+	case msg.Code == pongMsg:
+		msg.Discard()
+		select {
+		case p.pong <- struct{}{}:
+		default:
+		}
+	case msg.Code == discMsg:
+		//远端主动断开 把断开原因作为错误返回给run
+		var reason [1]DiscReason
+		// This is the last message. We don't need to discard or
+		// check errors because, the connection will be closed after it.
+		rlp.Decode(msg.Payload, &reason)
+		return reason[0]
+	case msg.Code < baseProtocolLength:
+		// ignore other base protocol messages
+		return msg.Discard()
 	default:
 		//eth子协议
 		proto, err := p.getProto(msg.Code)
 		if err != nil {
-			return fmt.Errorf("msg code out of range: %v", msg.Code)
+			return err
 		}
 
 		select {
@@ -203,59 +315,170 @@ func (p *Peer) handle(msg Msg) error {
 	return nil
 }
 
-//定时发送心跳包
+//定时发送心跳包 同时检查对方是否及时回复了pong
 func (p *Peer) pingLoop() {
 	ping := time.NewTimer(pingInterval)
 	defer p.wg.Done()
 	defer ping.Stop()
+
+	lastPong := time.Now()
 	for {
 		select {
 		case <-ping.C:
+			if time.Since(lastPong) > pongTimeout {
+				p.protoErr <- DiscReadTimeout
+				return
+			}
 			if err := SendItems(p.rw, pingMsg); err != nil {
 				p.protoErr <- err
 				return
 			}
 			ping.Reset(pingInterval)
+		case <-p.pong:
+			lastPong = time.Now()
 		case <-p.closed:
 			return
 		}
 	}
 }
 
-func (p *Peer) run() (err error) {
+// run 返回的remoteRequested表示连接是否是远端主动断开的
+// err 是断开连接的原因 远端断开时是对方发来的DiscReason
+func (p *Peer) run() (remoteRequested bool, err error) {
 	var (
-		readErr  = make(chan error, 1)
 		writeErr = make(chan error, 1)
+		readErr  = make(chan error, 1)
+		reason   DiscReason // sent to the peer
 	)
 
 	p.wg.Add(2)
 	go p.readLoop(readErr)
 	go p.pingLoop()
+
+	// Start all protocol handlers.
 	p.startProtocols(writeErr)
 
 loop:
 	//启动一个循环 来等待连接结束
 	for {
 		select {
-
+		case err = <-writeErr:
+			//某个协议写入失败 连接已经不可用了
+			reason = DiscNetworkError
+			break loop
 		case err = <-readErr:
-			//读取部分发生错误
+			//读取部分发生错误 如果是DiscReason 说明是对方发来的断开消息
+			if r, ok := err.(DiscReason); ok {
+				remoteRequested = true
+				reason = r
+			} else if isTimeout(err) {
+				//连接空闲太久 没有任何数据过来
+				err = DiscReadTimeout
+				reason = DiscReadTimeout
+			} else {
+				reason = DiscNetworkError
+			}
 			break loop
 		case err = <-p.protoErr:
+			//协议层出错 断开前告诉对方具体原因
+			reason = discReasonForError(err)
+			break loop
+		case err = <-p.disc:
+			//外部请求断开 比如RemovePeer
+			reason = discReasonForError(err)
 			break loop
 		}
 	}
 
-	return nil
+	//通知所有协议和读写循环退出 关闭连接后等待它们全部结束
+	close(p.closed)
+	p.rw.close(reason)
+	p.wg.Wait()
+	return remoteRequested, err
+}
+
+// isTimeout reports whether err is a network timeout, i.e. a read deadline
+// expired before the remote end sent anything.
+func isTimeout(err error) bool {
+	nerr, ok := err.(net.Error)
+	return ok && nerr.Timeout()
 }
 
 func (p *Peer) startProtocols(writeErr chan<- error) {
+	p.wg.Add(len(p.running))
 	for _, proto := range p.running {
+		proto := proto
+		proto.closed = p.closed
+		proto.wstart = make(chan struct{}, 1)
+		proto.wstart <- struct{}{}
 		proto.werr = writeErr
 
+		var rw MsgReadWriter = proto
+		rw = newMeteredMsgReadWriter(rw, proto.cap())
+		if p.events != nil {
+			rw = newMsgEventer(rw, p.events, p.ID(), proto.Name)
+		}
+
 		//执行每一个协议的run函数 将他们启动起来
 		go func() {
-			proto.Run(p, proto)
+			err := proto.Run(p, rw)
+			if err == nil {
+				err = errProtocolReturned
+			}
+			p.protoErr <- err
+			p.wg.Done()
 		}()
 	}
 }
+
+// PeerInfo represents a short summary of the information known about a connected
+// peer. Sub-protocol independent fields are contained and initialized here, with
+// protocol specifics delegated to all connected sub-protocols.
+type PeerInfo struct {
+	ID      string   `json:"id"`   // Unique node identifier (also the encryption key)
+	Name    string   `json:"name"` // Name of the node, including client type, version, OS, custom data
+	Caps    []string `json:"caps"` // Sum-protocols advertised by this particular peer
+	Network struct {
+		LocalAddress  string `json:"localAddress"`  // Local endpoint of the TCP data connection
+		RemoteAddress string `json:"remoteAddress"` // Remote endpoint of the TCP data connection
+		Inbound       bool   `json:"inbound"`
+		Trusted       bool   `json:"trusted"`
+		Static        bool   `json:"static"`
+	} `json:"network"`
+	Protocols map[string]interface{} `json:"protocols"` // Sub-protocol specific metadata fields
+}
+
+// Info gathers and returns a collection of metadata known about a peer.
+func (p *Peer) Info() *PeerInfo {
+	// Gather the protocol capabilities
+	var caps []string
+	for _, cap := range p.Caps() {
+		caps = append(caps, cap.String())
+	}
+	// Assemble the generic peer metadata
+	info := &PeerInfo{
+		ID:        p.ID().String(),
+		Name:      p.Name(),
+		Caps:      caps,
+		Protocols: make(map[string]interface{}),
+	}
+	info.Network.LocalAddress = p.LocalAddr().String()
+	info.Network.RemoteAddress = p.RemoteAddr().String()
+	info.Network.Inbound = p.rw.is(inboundConn)
+	info.Network.Trusted = p.rw.is(trustedConn)
+	info.Network.Static = p.rw.is(staticDialedConn)
+
+	// Gather all the running protocol infos
+	for _, proto := range p.running {
+		protoInfo := interface{}("unknown")
+		if query := proto.Protocol.PeerInfo; query != nil {
+			if metadata := query(p.ID()); metadata != nil {
+				protoInfo = metadata
+			} else {
+				protoInfo = "handshake"
+			}
+		}
+		info.Protocols[proto.Name] = protoInfo
+	}
+	return info
+}
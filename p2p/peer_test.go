@@ -0,0 +1,155 @@
+package p2p
+
+import (
+	"fmt"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestMatchProtocols(t *testing.T) {
+	tests := []struct {
+		local  []Cap
+		remote []Cap
+		match  map[string]protoRW
+	}{
+		{
+			// no shared protocols
+			local:  []Cap{{"a", 1}},
+			remote: []Cap{{"b", 1}},
+			match:  map[string]protoRW{},
+		},
+		{
+			// the highest version supported by both sides wins
+			local:  []Cap{{"a", 1}, {"a", 2}, {"a", 3}},
+			remote: []Cap{{"a", 3}, {"a", 1}, {"a", 2}, {"a", 4}},
+			match:  map[string]protoRW{"a": {Protocol: Protocol{Version: 3}, offset: 16, protoType: 1}},
+		},
+		{
+			// versions only one side knows about are ignored
+			local:  []Cap{{"a", 1}, {"a", 3}},
+			remote: []Cap{{"a", 2}, {"a", 3}, {"b", 1}},
+			match:  map[string]protoRW{"a": {Protocol: Protocol{Version: 3}, offset: 16, protoType: 1}},
+		},
+		{
+			// offsets are contiguous in name order regardless of the order of the caps
+			local:  []Cap{{"c", 1}, {"b", 2}, {"b", 1}, {"a", 1}},
+			remote: []Cap{{"b", 1}, {"b", 2}, {"a", 1}, {"c", 1}},
+			match: map[string]protoRW{
+				"a": {Protocol: Protocol{Version: 1}, offset: 16, protoType: 1},
+				"b": {Protocol: Protocol{Version: 2}, offset: 16 + 1, protoType: 2},
+				"c": {Protocol: Protocol{Version: 1}, offset: 16 + 1 + 2, protoType: 3},
+			},
+		},
+	}
+	for i, tt := range tests {
+		// 协议的消息数量等于版本号 方便计算偏移量
+		var protocols []Protocol
+		for _, cap := range tt.local {
+			protocols = append(protocols, Protocol{Name: cap.Name, Version: cap.Version, Length: uint64(cap.Version)})
+		}
+		result := matchProtocols(protocols, tt.remote, nil)
+		if len(result) != len(tt.match) {
+			t.Errorf("test %d: matched %d protocols, want %d", i, len(result), len(tt.match))
+			continue
+		}
+		for name, want := range tt.match {
+			have, ok := result[name]
+			if !ok {
+				t.Errorf("test %d: protocol %q not matched", i, name)
+				continue
+			}
+			if have.Version != want.Version || have.offset != want.offset || have.protoType != want.protoType {
+				t.Errorf("test %d: protocol %q mismatch: have v%d offset %d type %d, want v%d offset %d type %d",
+					i, name, have.Version, have.offset, have.protoType, want.Version, want.offset, want.protoType)
+			}
+		}
+	}
+}
+
+func TestCountMatchingProtocols(t *testing.T) {
+	protocols := []Protocol{{Name: "a", Version: 1}, {Name: "b", Version: 1}}
+	if n := countMatchingProtocols(protocols, []Cap{{"c", 1}, {"a", 2}}); n != 0 {
+		t.Errorf("got %d matching protocols, want 0", n)
+	}
+	if n := countMatchingProtocols(protocols, []Cap{{"a", 1}, {"b", 1}}); n != 2 {
+		t.Errorf("got %d matching protocols, want 2", n)
+	}
+}
+
+// TestPeerMultipleProtocols runs several subprotocols over a single RLPx
+// connection and checks that every message arrives at the right protocol
+// with its original code.
+func TestPeerMultipleProtocols(t *testing.T) {
+	rlpx0, rlpx1, id0, id1 := newRLPXPair(t)
+	protoHandshakePair(t, rlpx0, rlpx1, id0, id1, baseProtocolVersion, baseProtocolVersion)
+
+	// 两端都支持的协议是 a/1 和 b/2, c和d只有一端支持
+	caps0 := []Cap{{"a", 1}, {"b", 1}, {"b", 2}, {"c", 1}}
+	caps1 := []Cap{{"a", 1}, {"b", 1}, {"b", 2}, {"d", 1}}
+
+	received := make(chan error, 4)
+	makeProtocols := func(caps []Cap, send bool) []Protocol {
+		var protocols []Protocol
+		for _, cap := range caps {
+			cap := cap
+			protocols = append(protocols, Protocol{
+				Name:    cap.Name,
+				Version: cap.Version,
+				Length:  uint64(cap.Version) + 2,
+				Run: func(p *Peer, rw MsgReadWriter) error {
+					// 每个协议发送自己最大的命令字 另一端检查收到的内容
+					code := uint64(cap.Version + 1)
+					if send {
+						if err := SendItems(rw, code, cap.String()); err != nil {
+							return err
+						}
+					} else {
+						received <- ExpectMsg(rw, code, []string{cap.String()})
+					}
+					_, err := rw.ReadMsg()
+					return err
+				},
+			})
+		}
+		return protocols
+	}
+
+	peer0 := newPeer(&conn{fd: rlpx0.fd, transport: rlpx0, id: id1, caps: caps1}, makeProtocols(caps0, true))
+	peer1 := newPeer(&conn{fd: rlpx1.fd, transport: rlpx1, id: id0, caps: caps0}, makeProtocols(caps1, false))
+	if !reflect.DeepEqual(protoNames(peer0), []string{"a/1", "b/2"}) || !reflect.DeepEqual(protoNames(peer1), []string{"a/1", "b/2"}) {
+		t.Fatalf("wrong matched protocols: %v / %v", protoNames(peer0), protoNames(peer1))
+	}
+	errc := make(chan error, 2)
+	go func() { _, err := peer0.run(); errc <- err }()
+	go func() { _, err := peer1.run(); errc <- err }()
+
+	for i := 0; i < 2; i++ {
+		select {
+		case err := <-received:
+			if err != nil {
+				t.Errorf("protocol message mismatch: %v", err)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatal("timed out waiting for protocol messages")
+		}
+	}
+	peer0.Disconnect(DiscQuitting)
+	for i := 0; i < 2; i++ {
+		select {
+		case <-errc:
+		case <-time.After(5 * time.Second):
+			t.Fatal("peers did not shut down")
+		}
+	}
+}
+
+func protoNames(p *Peer) []string {
+	names := make([]string, 0, len(p.running))
+	for _, name := range []string{"a", "b", "c", "d"} {
+		if proto, ok := p.running[name]; ok {
+			names = append(names, fmt.Sprintf("%s/%d", proto.Name, proto.Version))
+		}
+	}
+	return names
+}
@@ -18,6 +18,8 @@ package p2p
 
 import (
 	"fmt"
+
+	"myeth/p2p/discover"
 )
 
 // Protocol represents a P2P subprotocol implementation.
@@ -36,11 +38,15 @@ type Protocol struct {
 
 	Run func(peer *Peer, rw MsgReadWriter) error
 
-	//两个函数不着急要
-	/*
-		NodeInfo func() interface{}
-		PeerInfo func(id discover.NodeID) interface{}
-	*/
+	// NodeInfo is an optional helper method to retrieve protocol specific metadata
+	// about the host node.
+	// 本节点在这个协议上的状态 比如eth协议的链头和难度
+	NodeInfo func() interface{}
+
+	// PeerInfo is an optional helper method to retrieve protocol specific metadata
+	// about a certain peer in the network. If an info retrieval function is set,
+	// but returns nil, it is assumed that the protocol handshake is still running.
+	PeerInfo func(id discover.NodeID) interface{}
 }
 
 func (p Protocol) cap() Cap {
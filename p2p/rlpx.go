@@ -75,13 +75,24 @@ const (
 	// This is effectively the amount of time a connection can be idle.
 	frameReadTimeout = 30 * time.Second
 
+	// Maximum time allowed for receiving the body of a frame once
+	// its header has arrived. A peer that announces a frame and then
+	// stalls is dropped after this much time.
+	frameBodyReadTimeout = 10 * time.Second
+
 	// Maximum amount of time allowed for writing a complete message.
 	frameWriteTimeout = 20 * time.Second
 )
 
-// errPlainMessageTooLarge is returned if a decompressed message length exceeds
-// the allowed 24 bits (i.e. length >= 16MB).
-var errPlainMessageTooLarge = errors.New("message length >= 16MB")
+var (
+	// errPlainMessageTooLarge is returned if a decompressed message length exceeds
+	// the allowed 24 bits (i.e. length >= 16MB).
+	errPlainMessageTooLarge = errors.New("message length >= 16MB")
+
+	// errFrameTooLarge is returned if the frame header announces more
+	// data than the connection currently accepts.
+	errFrameTooLarge = errors.New("frame size exceeds limit")
+)
 
 // rlpx is the transport protocol used by actual (non-test) connections.
 // It wraps the frame encoder with locks and read/write deadlines.
@@ -100,17 +111,20 @@ func newRLPX(fd net.Conn) transport {
 func (t *rlpx) ReadMsg() (Msg, error) {
 	t.rmu.Lock()
 	defer t.rmu.Unlock()
-	t.fd.SetReadDeadline(time.Now().Add(frameReadTimeout))
 	return t.rw.ReadMsg()
 }
 
+// WriteMsg doesn't hold wmu for the whole message, the frame writer locks
+// and sets the write deadline per frame so that chunked messages of several
+// protocols can be sent interleaved.
 func (t *rlpx) WriteMsg(msg Msg) error {
-	t.wmu.Lock()
-	defer t.wmu.Unlock()
-	t.fd.SetWriteDeadline(time.Now().Add(frameWriteTimeout))
 	return t.rw.WriteMsg(msg)
 }
 
+func (t *rlpx) writeProtoMsg(protoType uint16, msg Msg) error {
+	return t.rw.writeProtoMsg(protoType, msg)
+}
+
 func (t *rlpx) close(err error) {
 	t.wmu.Lock()
 	defer t.wmu.Unlock()
@@ -123,7 +137,9 @@ func (t *rlpx) close(err error) {
 			// a write deadline. Because of this only try to send
 			// the disconnect reason message if there is no error.
 			if err := t.fd.SetWriteDeadline(time.Now().Add(discWriteTimeout)); err == nil {
-				SendItems(t.rw, discMsg, r)
+				if size, payload, err := rlp.EncodeToReader([]DiscReason{r}); err == nil {
+					t.rw.writeMsg(0, Msg{Code: discMsg, Size: uint32(size), Payload: payload}, discWriteTimeout)
+				}
 			}
 		}
 	}
@@ -137,6 +153,17 @@ func (t *rlpx) doProtoHandshake(our *protoHandshake) (their *protoHandshake, err
 	// as the error so it can be tracked elsewhere.
 	werr := make(chan error, 1)
 	go func() { werr <- Send(t.rw, handshakeMsg, our) }()
+	// 握手完成之前只接受很小的帧 防止对方让我们分配大块内存
+	t.rw.maxFrameSize = baseProtocolMaxMsgSize
+	defer func() {
+		// 开启分片之后对方发来的每一帧都不会超过frameChunkSize
+		// 帧头里的长度不包括头部和补齐的字节 所以不需要再加上这部分
+		if t.rw.chunked {
+			t.rw.maxFrameSize = frameChunkSize
+		} else {
+			t.rw.maxFrameSize = maxUint24
+		}
+	}()
 	if their, err = readProtocolHandshake(t.rw, our); err != nil {
 		<-werr // make sure the write terminates too
 		return nil, err
@@ -145,7 +172,11 @@ func (t *rlpx) doProtoHandshake(our *protoHandshake) (their *protoHandshake, err
 		return nil, fmt.Errorf("write error: %v", err)
 	}
 	// If the protocol version supports Snappy encoding, upgrade immediately
-	t.rw.snappy = their.Version >= snappyProtocolVersion
+	// 双方的版本都支持snappy才能开启压缩 否则老版本的节点解不开消息
+	t.rw.snappy = our.Version >= snappyProtocolVersion && their.Version >= snappyProtocolVersion
+	// 分片传输同样要求双方都支持 老节点只认识单帧的消息
+	t.rw.chunked = our.Version >= chunkedProtocolVersion && their.Version >= chunkedProtocolVersion
+	t.rw.frameDeadlines = true
 
 	return their, nil
 }
@@ -177,6 +208,12 @@ func readProtocolHandshake(rw MsgReader, our *protoHandshake) (*protoHandshake,
 	if (hs.ID == discover.NodeID{}) {
 		return nil, DiscInvalidIdentity
 	}
+	// Newer versions are allowed by the spec and are expected to stay
+	// compatible, only peers speaking a version older than what we can
+	// still talk to are rejected.
+	if hs.Version < minProtocolVersion {
+		return nil, DiscIncompatibleVersion
+	}
 	return &hs, nil
 }
 
@@ -560,18 +597,54 @@ func xor(one, other []byte) (xor []byte) {
 }
 
 var (
-	// this is used in place of actual frame header data.
-	// TODO: replace this when Msg contains the protocol type code.
+	// zeroHeader is the header data written by peers which don't tag
+	// frames: protocol-type 0 and context-id 0.
 	zeroHeader = []byte{0xC2, 0x80, 0x80}
 	// sixteen zero bytes
 	zero16 = make([]byte, 16)
 )
 
-// rlpxFrameRW implements a simplified version of RLPx framing.
-// chunked messages are not supported and all headers are equal to
-// zeroHeader.
+const (
+	// frameChunkSize 分片传输时每一帧最多携带的数据量
+	frameChunkSize = 64 * 1024
+
+	// maxChunkedMsgSize 开启分片传输之后单个消息允许的最大长度
+	// 必须大于单帧能携带的maxUint24 否则分片反而比老的传输方式能发的消息更小
+	maxChunkedMsgSize = 32 * 1024 * 1024
+
+	// maxPendingPackets 同时处于接收中的分片消息个数上限
+	maxPendingPackets = 16
+
+	// maxPendingBytes 每个连接上所有未接收完的分片消息加起来最多缓存这么多数据
+	// 按最大消息长度计算 保证两个协议同时传最大的消息也能收完
+	maxPendingBytes = 2 * maxChunkedMsgSize
+)
+
+var errMessageTooLarge = errors.New("message too large")
+
+// protoWriter is implemented by transports which can tag the frames of a
+// message with the capability it belongs to.
+type protoWriter interface {
+	writeProtoMsg(protoType uint16, msg Msg) error
+}
+
+// pendingPacket 正在接收中的分片消息
+type pendingPacket struct {
+	buf  []byte
+	size uint64 // total-packet-size announced in the first frame
+}
+
+// rlpxFrameRW implements RLPx framing.
+//
+// Every frame header carries the header data [protocol-type, context-id].
+// If chunking was negotiated, messages larger than frameChunkSize are split
+// into several frames sharing a non-zero context-id, the first one of which
+// also carries the total packet size. Peers which always send zeroHeader
+// keep working since a context-id of zero denotes a single-frame message.
 //
-// rlpxFrameRW is not safe for concurrent use from multiple goroutines.
+// Writes may be issued concurrently, the egress state is locked per frame
+// so that chunked messages of different protocols interleave. ReadMsg is not
+// safe for concurrent use from multiple goroutines.
 type rlpxFrameRW struct {
 	conn io.ReadWriter
 	enc  cipher.Stream
@@ -581,7 +654,20 @@ type rlpxFrameRW struct {
 	egressMAC  hash.Hash
 	ingressMAC hash.Hash
 
-	snappy bool
+	snappy  bool
+	chunked bool //双方都支持分片传输
+
+	// 握手阶段由handshakeTimeout统一控制超时 握手完成之后才按帧设置超时
+	frameDeadlines bool
+
+	// maxFrameSize 是允许读取的最大帧长度 在分配帧缓存之前检查
+	maxFrameSize uint32
+
+	wmu       sync.Mutex // protects the egress stream and contextID
+	contextID uint16     // last context-id used for a chunked message
+
+	pending      map[uint32]*pendingPacket // 分片消息 key是protocol-type和context-id
+	pendingBytes uint64                    // pending里已经缓存的数据量
 }
 
 func newRLPXFrameRW(conn io.ReadWriter, s secrets) *rlpxFrameRW {
@@ -597,21 +683,42 @@ func newRLPXFrameRW(conn io.ReadWriter, s secrets) *rlpxFrameRW {
 	// for encryption is ephemeral.
 	iv := make([]byte, encc.BlockSize())
 	return &rlpxFrameRW{
-		conn:       conn,
-		enc:        cipher.NewCTR(encc, iv),
-		dec:        cipher.NewCTR(encc, iv),
-		macCipher:  macc,
-		egressMAC:  s.EgressMAC,
-		ingressMAC: s.IngressMAC,
+		conn:         conn,
+		enc:          cipher.NewCTR(encc, iv),
+		dec:          cipher.NewCTR(encc, iv),
+		macCipher:    macc,
+		egressMAC:    s.EgressMAC,
+		ingressMAC:   s.IngressMAC,
+		maxFrameSize: maxUint24,
+		pending:      make(map[uint32]*pendingPacket),
+	}
+}
+
+// maxMsgSize returns the largest message (before compression) the
+// connection can carry.
+func (rw *rlpxFrameRW) maxMsgSize() uint32 {
+	if rw.chunked {
+		return maxChunkedMsgSize
 	}
+	return maxUint24
 }
 
 func (rw *rlpxFrameRW) WriteMsg(msg Msg) error {
+	return rw.writeMsg(0, msg, frameWriteTimeout)
+}
+
+func (rw *rlpxFrameRW) writeProtoMsg(protoType uint16, msg Msg) error {
+	return rw.writeMsg(protoType, msg, frameWriteTimeout)
+}
+
+// writeMsg writes msg tagged with the given protocol type. Each frame must
+// be written within timeout.
+func (rw *rlpxFrameRW) writeMsg(protoType uint16, msg Msg, timeout time.Duration) error {
 	ptype, _ := rlp.EncodeToBytes(msg.Code)
 
 	// if snappy is enabled, compress message now
 	if rw.snappy {
-		if msg.Size > maxUint24 {
+		if msg.Size > rw.maxMsgSize() {
 			return errPlainMessageTooLarge
 		}
 		payload, _ := ioutil.ReadAll(msg.Payload)
@@ -620,14 +727,63 @@ func (rw *rlpxFrameRW) WriteMsg(msg Msg) error {
 		msg.Payload = bytes.NewReader(payload)
 		msg.Size = uint32(len(payload))
 	}
+	fsize := uint64(len(ptype)) + uint64(msg.Size)
+	if !rw.chunked || fsize <= frameChunkSize {
+		if fsize > uint64(maxUint24) {
+			return errors.New("message size overflows uint24")
+		}
+		header := []uint64{uint64(protoType), 0}
+		return rw.writeFrame(header, ptype, msg.Payload, uint32(fsize), timeout)
+	}
+	if fsize > maxChunkedMsgSize {
+		return errMessageTooLarge
+	}
+
+	// 分片发送 所有帧共用一个context-id 第一帧带上消息总长度
+	contextID := rw.nextContextID()
+	header := []uint64{uint64(protoType), uint64(contextID), fsize}
+	body := io.LimitReader(msg.Payload, int64(frameChunkSize-len(ptype)))
+	if err := rw.writeFrame(header, ptype, body, frameChunkSize, timeout); err != nil {
+		return err
+	}
+	header = header[:2]
+	for left := fsize - frameChunkSize; left > 0; {
+		size := uint64(frameChunkSize)
+		if left < size {
+			size = left
+		}
+		body := io.LimitReader(msg.Payload, int64(size))
+		if err := rw.writeFrame(header, nil, body, uint32(size), timeout); err != nil {
+			return err
+		}
+		left -= size
+	}
+	return nil
+}
+
+func (rw *rlpxFrameRW) nextContextID() uint16 {
+	rw.wmu.Lock()
+	defer rw.wmu.Unlock()
+	// context-id 0 is reserved for single-frame messages.
+	rw.contextID++
+	if rw.contextID == 0 {
+		rw.contextID = 1
+	}
+	return rw.contextID
+}
+
+// writeFrame writes a single frame whose content is ptype followed by
+// fsize-len(ptype) bytes of body.
+func (rw *rlpxFrameRW) writeFrame(header []uint64, ptype []byte, body io.Reader, fsize uint32, timeout time.Duration) error {
+	rw.wmu.Lock()
+	defer rw.wmu.Unlock()
+	rw.setWriteDeadline(timeout)
+
 	// write header
 	headbuf := make([]byte, 32)
-	fsize := uint32(len(ptype)) + msg.Size
-	if fsize > maxUint24 {
-		return errors.New("message size overflows uint24")
-	}
-	putInt24(fsize, headbuf) // TODO: check overflow
-	copy(headbuf[3:], zeroHeader)
+	putInt24(fsize, headbuf)
+	hdata, _ := rlp.EncodeToBytes(header)
+	copy(headbuf[3:16], hdata)
 	rw.enc.XORKeyStream(headbuf[:16], headbuf[:16]) // first half is now encrypted
 
 	// write header MAC
@@ -642,8 +798,10 @@ func (rw *rlpxFrameRW) WriteMsg(msg Msg) error {
 	if _, err := tee.Write(ptype); err != nil {
 		return err
 	}
-	if _, err := io.Copy(tee, msg.Payload); err != nil {
+	if n, err := io.Copy(tee, body); err != nil {
 		return err
+	} else if uint64(n) != uint64(fsize)-uint64(len(ptype)) {
+		return errors.New("message payload shorter than announced size")
 	}
 	if padding := fsize % 16; padding > 0 {
 		if _, err := tee.Write(zero16[:16-padding]); err != nil {
@@ -660,19 +818,138 @@ func (rw *rlpxFrameRW) WriteMsg(msg Msg) error {
 }
 
 func (rw *rlpxFrameRW) ReadMsg() (msg Msg, err error) {
+	for {
+		header, frame, err := rw.readFrame()
+		if err != nil {
+			return msg, err
+		}
+		var packet []byte
+		switch {
+		case len(header) >= 3:
+			// 分片消息的第一帧
+			p, err := rw.startPacket(header, frame)
+			if err != nil {
+				return msg, err
+			}
+			if p == nil {
+				continue
+			}
+			packet = p
+		case len(header) == 2 && header[1] != 0:
+			// 分片消息的后续帧
+			p, err := rw.continuePacket(header, frame)
+			if err != nil {
+				return msg, err
+			}
+			if p == nil {
+				continue
+			}
+			packet = p
+		default:
+			packet = frame
+		}
+		return rw.decodePacket(packet)
+	}
+}
+
+func packetKey(protoType, contextID uint64) uint32 {
+	return uint32(protoType)<<16 | uint32(contextID)
+}
+
+// startPacket begins reassembly of a chunked packet. It returns the complete
+// packet if it already fits in the first frame.
+func (rw *rlpxFrameRW) startPacket(header []uint64, frame []byte) ([]byte, error) {
+	protoType, contextID, total := header[0], header[1], header[2]
+	switch {
+	case !rw.chunked:
+		return nil, errors.New("unexpected chunked frame")
+	case contextID == 0 || contextID > 0xffff || protoType > 0xffff:
+		return nil, errors.New("invalid chunked frame header")
+	case total > maxChunkedMsgSize:
+		return nil, errMessageTooLarge
+	case uint64(len(frame)) > total:
+		return nil, errors.New("frame exceeds total packet size")
+	}
+	key := packetKey(protoType, contextID)
+	if rw.pending[key] != nil {
+		return nil, fmt.Errorf("duplicate chunked packet %d/%d", protoType, contextID)
+	}
+	if uint64(len(frame)) == total {
+		return frame, nil
+	}
+	if len(rw.pending) >= maxPendingPackets {
+		return nil, errors.New("too many pending chunked packets")
+	}
+	if err := rw.reservePending(len(frame)); err != nil {
+		return nil, err
+	}
+	// 缓存随着数据的到达逐渐增长 不按照对方声明的总长度一次性分配
+	rw.pending[key] = &pendingPacket{buf: frame, size: total}
+	return nil, nil
+}
+
+// continuePacket appends a frame to a pending chunked packet. It returns the
+// packet once all of its data has arrived.
+func (rw *rlpxFrameRW) continuePacket(header []uint64, frame []byte) ([]byte, error) {
+	protoType, contextID := header[0], header[1]
+	if protoType > 0xffff || contextID > 0xffff {
+		return nil, errors.New("invalid chunked frame header")
+	}
+	key := packetKey(protoType, contextID)
+	p := rw.pending[key]
+	if p == nil {
+		return nil, fmt.Errorf("unknown chunked packet %d/%d", protoType, contextID)
+	}
+	if uint64(len(p.buf))+uint64(len(frame)) > p.size {
+		return nil, errors.New("frame exceeds total packet size")
+	}
+	if err := rw.reservePending(len(frame)); err != nil {
+		return nil, err
+	}
+	p.buf = append(p.buf, frame...)
+	if uint64(len(p.buf)) < p.size {
+		return nil, nil
+	}
+	delete(rw.pending, key)
+	rw.pendingBytes -= uint64(len(p.buf))
+	return p.buf, nil
+}
+
+// reservePending accounts for n more bytes of buffered chunk data, failing
+// if the connection would hold more than maxPendingBytes.
+func (rw *rlpxFrameRW) reservePending(n int) error {
+	if rw.pendingBytes+uint64(n) > maxPendingBytes {
+		return errors.New("too much pending chunked data")
+	}
+	rw.pendingBytes += uint64(n)
+	return nil
+}
+
+// readFrame reads a single frame, returning the decoded header data and the
+// decrypted frame content.
+func (rw *rlpxFrameRW) readFrame() ([]uint64, []byte, error) {
 	// read the header
+	rw.setReadDeadline(frameReadTimeout)
 	headbuf := make([]byte, 32)
 	if _, err := io.ReadFull(rw.conn, headbuf); err != nil {
-		return msg, err
+		return nil, nil, err
 	}
 	// verify header mac
 	shouldMAC := updateMAC(rw.ingressMAC, rw.macCipher, headbuf[:16])
 	if !hmac.Equal(shouldMAC, headbuf[16:]) {
-		return msg, errors.New("bad header MAC")
+		return nil, nil, errors.New("bad header MAC")
 	}
 	rw.dec.XORKeyStream(headbuf[:16], headbuf[:16]) // first half is now decrypted
 	fsize := readInt24(headbuf)
-	// ignore protocol type for now
+	if fsize > rw.maxFrameSize {
+		return nil, nil, errFrameTooLarge
+	}
+	var header []uint64
+	if err := rlp.NewStream(bytes.NewReader(headbuf[3:16]), 13).Decode(&header); err != nil {
+		return nil, nil, fmt.Errorf("invalid frame header: %v", err)
+	}
+	// 帧头已经到了 剩下的内容必须在较短的时间内收到
+	rw.setReadDeadline(frameBodyReadTimeout)
 
 	// read the frame content
 	var rsize = fsize // frame size rounded up to 16 byte boundary
@@ -681,25 +958,29 @@ func (rw *rlpxFrameRW) ReadMsg() (msg Msg, err error) {
 	}
 	framebuf := make([]byte, rsize)
 	if _, err := io.ReadFull(rw.conn, framebuf); err != nil {
-		return msg, err
+		return nil, nil, err
 	}
 
 	// read and validate frame MAC. we can re-use headbuf for that.
 	rw.ingressMAC.Write(framebuf)
 	fmacseed := rw.ingressMAC.Sum(nil)
 	if _, err := io.ReadFull(rw.conn, headbuf[:16]); err != nil {
-		return msg, err
+		return nil, nil, err
 	}
 	shouldMAC = updateMAC(rw.ingressMAC, rw.macCipher, fmacseed)
 	if !hmac.Equal(shouldMAC, headbuf[:16]) {
-		return msg, errors.New("bad frame MAC")
+		return nil, nil, errors.New("bad frame MAC")
 	}
 
 	// decrypt frame content
 	rw.dec.XORKeyStream(framebuf, framebuf)
+	return header, framebuf[:fsize], nil
+}
 
+// decodePacket decodes the message code and payload of a complete packet.
+func (rw *rlpxFrameRW) decodePacket(packet []byte) (msg Msg, err error) {
 	// decode message code
-	content := bytes.NewReader(framebuf[:fsize])
+	content := bytes.NewReader(packet)
 	if err := rlp.Decode(content, &msg.Code); err != nil {
 		return msg, err
 	}
@@ -712,22 +993,52 @@ func (rw *rlpxFrameRW) ReadMsg() (msg Msg, err error) {
 		if err != nil {
 			return msg, err
 		}
+		//解压之前先根据头部记录的长度检查大小 避免分配过大的内存
 		size, err := snappy.DecodedLen(payload)
 		if err != nil {
 			return msg, err
 		}
-		if size > int(maxUint24) {
+		if size > int(rw.maxMsgSize()) {
 			return msg, errPlainMessageTooLarge
 		}
 		payload, err = snappy.Decode(nil, payload)
 		if err != nil {
 			return msg, err
 		}
+		if len(payload) != size {
+			return msg, errors.New("snappy decoded length mismatch")
+		}
 		msg.Size, msg.Payload = uint32(size), bytes.NewReader(payload)
 	}
 	return msg, nil
 }
 
+// setWriteDeadline sets a write deadline on the underlying connection
+// if it supports one.
+func (rw *rlpxFrameRW) setWriteDeadline(d time.Duration) {
+	if !rw.frameDeadlines {
+		return
+	}
+	if c, ok := rw.conn.(interface {
+		SetWriteDeadline(time.Time) error
+	}); ok {
+		c.SetWriteDeadline(time.Now().Add(d))
+	}
+}
+
+// setReadDeadline sets a read deadline on the underlying connection
+// if it supports one. In-memory transports without deadlines are left alone.
+func (rw *rlpxFrameRW) setReadDeadline(d time.Duration) {
+	if !rw.frameDeadlines {
+		return
+	}
+	if c, ok := rw.conn.(interface {
+		SetReadDeadline(time.Time) error
+	}); ok {
+		c.SetReadDeadline(time.Now().Add(d))
+	}
+}
+
 // updateMAC reseeds the given hash with encrypted seed.
 // it returns the first 16 bytes of the hash sum after seeding.
 func updateMAC(mac hash.Hash, block cipher.Block, seed []byte) []byte {
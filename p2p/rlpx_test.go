@@ -0,0 +1,276 @@
+package p2p
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"math/rand"
+	"net"
+	"testing"
+
+	"myeth/crypto"
+	"myeth/p2p/discover"
+	"myeth/rlp"
+)
+
+// newRLPXPair 通过net.Pipe创建一对完成加密握手的rlpx连接
+func newRLPXPair(t *testing.T) (*rlpx, *rlpx, discover.NodeID, discover.NodeID) {
+	prv0, _ := crypto.GenerateKey()
+	prv1, _ := crypto.GenerateKey()
+	id0 := discover.PubkeyID(&prv0.PublicKey)
+	id1 := discover.PubkeyID(&prv1.PublicKey)
+
+	fd0, fd1 := net.Pipe()
+	rlpx0 := newRLPX(fd0).(*rlpx)
+	rlpx1 := newRLPX(fd1).(*rlpx)
+
+	errc := make(chan error, 1)
+	go func() {
+		_, err := rlpx1.doEncHandshake(prv1, nil)
+		errc <- err
+	}()
+	if _, err := rlpx0.doEncHandshake(prv0, &discover.Node{ID: id1}); err != nil {
+		t.Fatalf("initiator handshake failed: %v", err)
+	}
+	if err := <-errc; err != nil {
+		t.Fatalf("receiver handshake failed: %v", err)
+	}
+	return rlpx0, rlpx1, id0, id1
+}
+
+// protoHandshakePair 在两端同时执行协议握手 v0/v1是双方声明的基础协议版本
+func protoHandshakePair(t *testing.T, rlpx0, rlpx1 *rlpx, id0, id1 discover.NodeID, v0, v1 uint64) {
+	errc := make(chan error, 1)
+	go func() {
+		_, err := rlpx1.doProtoHandshake(&protoHandshake{Version: v1, Name: "b", ID: id1})
+		errc <- err
+	}()
+	if _, err := rlpx0.doProtoHandshake(&protoHandshake{Version: v0, Name: "a", ID: id0}); err != nil {
+		t.Fatalf("handshake failed: %v", err)
+	}
+	if err := <-errc; err != nil {
+		t.Fatalf("remote handshake failed: %v", err)
+	}
+}
+
+func TestProtocolHandshakeSnappy(t *testing.T) {
+	tests := []struct {
+		v0, v1 uint64
+		snappy bool
+	}{
+		{v0: 5, v1: 5, snappy: true},
+		{v0: 4, v1: 5, snappy: false},
+		{v0: 5, v1: 4, snappy: false},
+		{v0: 4, v1: 4, snappy: false},
+	}
+	for i, tt := range tests {
+		t.Run(fmt.Sprintf("%d-%d", tt.v0, tt.v1), func(t *testing.T) {
+			rlpx0, rlpx1, id0, id1 := newRLPXPair(t)
+			defer rlpx0.close(nil)
+			defer rlpx1.close(nil)
+
+			protoHandshakePair(t, rlpx0, rlpx1, id0, id1, tt.v0, tt.v1)
+			if rlpx0.rw.snappy != tt.snappy || rlpx1.rw.snappy != tt.snappy {
+				t.Fatalf("test %d: snappy mismatch: have %v/%v, want %v", i, rlpx0.rw.snappy, rlpx1.rw.snappy, tt.snappy)
+			}
+
+			// A highly compressible payload must survive the round trip
+			// no matter whether compression was negotiated.
+			payload := bytes.Repeat([]byte("myeth"), 1000)
+			errc := make(chan error, 1)
+			go func() {
+				errc <- rlpx0.WriteMsg(Msg{Code: 8, Size: uint32(len(payload)), Payload: bytes.NewReader(payload)})
+			}()
+			msg, err := rlpx1.ReadMsg()
+			if err != nil {
+				t.Fatalf("test %d: read error: %v", i, err)
+			}
+			if err := <-errc; err != nil {
+				t.Fatalf("test %d: write error: %v", i, err)
+			}
+			if msg.Code != 8 || msg.Size != uint32(len(payload)) {
+				t.Fatalf("test %d: message mismatch: code %d size %d", i, msg.Code, msg.Size)
+			}
+			content, _ := ioutil.ReadAll(msg.Payload)
+			if !bytes.Equal(content, payload) {
+				t.Fatalf("test %d: payload mismatch", i)
+			}
+		})
+	}
+}
+
+func TestRLPXChunkedMessages(t *testing.T) {
+	tests := []struct {
+		v0, v1  uint64
+		size    int
+		chunked bool
+	}{
+		{v0: 6, v1: 6, size: 1000, chunked: true},
+		{v0: 6, v1: 6, size: 3*frameChunkSize + 17, chunked: true},
+		// spans many frames
+		{v0: 6, v1: 6, size: maxChunkedMsgSize / 2, chunked: true},
+		// too large for a single frame
+		{v0: 6, v1: 6, size: int(maxUint24) + 1024, chunked: true},
+		// version 5 peers only understand single frames
+		{v0: 5, v1: 6, size: 3*frameChunkSize + 17, chunked: false},
+		{v0: 6, v1: 5, size: 3*frameChunkSize + 17, chunked: false},
+	}
+	for i, tt := range tests {
+		rlpx0, rlpx1, id0, id1 := newRLPXPair(t)
+		protoHandshakePair(t, rlpx0, rlpx1, id0, id1, tt.v0, tt.v1)
+		if rlpx0.rw.chunked != tt.chunked || rlpx1.rw.chunked != tt.chunked {
+			t.Fatalf("test %d: chunked mismatch: have %v/%v, want %v", i, rlpx0.rw.chunked, rlpx1.rw.chunked, tt.chunked)
+		}
+
+		payload := make([]byte, tt.size)
+		rand.Read(payload)
+		errc := make(chan error, 1)
+		go func() {
+			errc <- rlpx0.writeProtoMsg(1, Msg{Code: 0x10, Size: uint32(len(payload)), Payload: bytes.NewReader(payload)})
+		}()
+		msg, err := rlpx1.ReadMsg()
+		if err != nil {
+			t.Fatalf("test %d: read error: %v", i, err)
+		}
+		if err := <-errc; err != nil {
+			t.Fatalf("test %d: write error: %v", i, err)
+		}
+		content, _ := ioutil.ReadAll(msg.Payload)
+		if msg.Code != 0x10 || !bytes.Equal(content, payload) {
+			t.Fatalf("test %d: message mismatch: code %d size %d", i, msg.Code, len(content))
+		}
+		rlpx0.close(nil)
+		rlpx1.close(nil)
+	}
+}
+
+func TestRLPXChunkedFrameLimit(t *testing.T) {
+	tests := []struct {
+		v0, v1   uint64
+		size     uint32
+		rejected bool
+	}{
+		{v0: 6, v1: 6, size: frameChunkSize, rejected: false},
+		{v0: 6, v1: 6, size: frameChunkSize + 1, rejected: true},
+		// without chunking a single frame may carry a whole message
+		{v0: 5, v1: 6, size: frameChunkSize + 1, rejected: false},
+	}
+	for i, tt := range tests {
+		rlpx0, rlpx1, id0, id1 := newRLPXPair(t)
+		protoHandshakePair(t, rlpx0, rlpx1, id0, id1, tt.v0, tt.v1)
+
+		// 绕过writeMsg直接写一个大帧 模拟不按规矩分片的对端
+		// 写入的内容没有压缩 接收端也不解压
+		rlpx1.rw.snappy = false
+		ptype, _ := rlp.EncodeToBytes(uint64(0x10))
+		body := bytes.NewReader(make([]byte, int(tt.size)-len(ptype)))
+		go rlpx0.rw.writeFrame([]uint64{1, 0}, ptype, body, tt.size, frameWriteTimeout)
+
+		_, err := rlpx1.ReadMsg()
+		if tt.rejected && err != errFrameTooLarge {
+			t.Errorf("test %d: got error %v, want %v", i, err, errFrameTooLarge)
+		}
+		if !tt.rejected && err != nil {
+			t.Errorf("test %d: unexpected error: %v", i, err)
+		}
+		rlpx0.close(nil)
+		rlpx1.close(nil)
+	}
+}
+
+func TestRLPXChunkedInterleaving(t *testing.T) {
+	rlpx0, rlpx1, id0, id1 := newRLPXPair(t)
+	defer rlpx0.close(nil)
+	defer rlpx1.close(nil)
+	protoHandshakePair(t, rlpx0, rlpx1, id0, id1, baseProtocolVersion, baseProtocolVersion)
+
+	// Two protocols write at the same time. Their frames may interleave
+	// on the wire and both messages must still be reassembled intact.
+	big := make([]byte, 8*frameChunkSize)
+	rand.Read(big)
+	small := []byte("small message")
+
+	errc := make(chan error, 2)
+	go func() {
+		errc <- rlpx0.writeProtoMsg(1, Msg{Code: 0x10, Size: uint32(len(big)), Payload: bytes.NewReader(big)})
+	}()
+	go func() {
+		errc <- rlpx0.writeProtoMsg(2, Msg{Code: 0x20, Size: uint32(len(small)), Payload: bytes.NewReader(small)})
+	}()
+
+	received := make(map[uint64][]byte)
+	for len(received) < 2 {
+		msg, err := rlpx1.ReadMsg()
+		if err != nil {
+			t.Fatalf("read error: %v", err)
+		}
+		received[msg.Code], _ = ioutil.ReadAll(msg.Payload)
+	}
+	for i := 0; i < 2; i++ {
+		if err := <-errc; err != nil {
+			t.Fatalf("write error: %v", err)
+		}
+	}
+	if !bytes.Equal(received[0x10], big) {
+		t.Errorf("big message mismatch")
+	}
+	if !bytes.Equal(received[0x20], small) {
+		t.Errorf("small message mismatch")
+	}
+}
+
+func TestRLPXChunkedPendingLimit(t *testing.T) {
+	rw := &rlpxFrameRW{chunked: true, pending: make(map[uint32]*pendingPacket)}
+	frame := make([]byte, maxChunkedMsgSize-frameChunkSize)
+
+	// 每个消息都差最后一帧 缓存的数据超过上限时断开
+	for id := uint64(1); ; id++ {
+		_, err := rw.startPacket([]uint64{1, id, maxChunkedMsgSize}, frame)
+		if id*uint64(len(frame)) <= maxPendingBytes {
+			if err != nil {
+				t.Fatalf("packet %d: unexpected error: %v", id, err)
+			}
+			continue
+		}
+		if err == nil {
+			t.Fatalf("packet %d: buffered %d bytes without error", id, rw.pendingBytes)
+		}
+		break
+	}
+	if rw.pendingBytes > maxPendingBytes {
+		t.Errorf("pending bytes %d exceed limit %d", rw.pendingBytes, maxPendingBytes)
+	}
+	// completing a packet releases its data
+	before := rw.pendingBytes
+	packet, err := rw.continuePacket([]uint64{1, 1}, make([]byte, frameChunkSize))
+	if err != nil || len(packet) != maxChunkedMsgSize {
+		t.Fatalf("completing packet failed: len %d, err %v", len(packet), err)
+	}
+	if rw.pendingBytes != before-uint64(len(frame)) {
+		t.Errorf("pending bytes %d after completion, want %d", rw.pendingBytes, before-uint64(len(frame)))
+	}
+}
+
+func TestProtocolHandshakeIncompatibleVersion(t *testing.T) {
+	key, _ := crypto.GenerateKey()
+	id := discover.PubkeyID(&key.PublicKey)
+	our := &protoHandshake{Version: baseProtocolVersion, Name: "a", ID: id}
+	tests := []struct {
+		version uint64
+		err     error
+	}{
+		{version: minProtocolVersion - 1, err: DiscIncompatibleVersion},
+		{version: 0, err: DiscIncompatibleVersion},
+		{version: minProtocolVersion, err: nil},
+		// newer versions are allowed by the spec
+		{version: baseProtocolVersion + 1, err: nil},
+	}
+	for i, tt := range tests {
+		rw0, rw1 := MsgPipe()
+		go Send(rw0, handshakeMsg, &protoHandshake{Version: tt.version, Name: "b", ID: id})
+		if _, err := readProtocolHandshake(rw1, our); err != tt.err {
+			t.Errorf("test %d: version %d: got error %v, want %v", i, tt.version, err, tt.err)
+		}
+		rw0.Close()
+	}
+}
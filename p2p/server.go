@@ -1,13 +1,31 @@
 package p2p
 
 import (
+	"context"
 	"crypto/ecdsa"
 	"errors"
 	"fmt"
 	"net"
+	"sort"
 	"sync"
+	"sync/atomic"
+	"time"
 
+	"myeth/event"
+	"myeth/log"
 	"myeth/p2p/discover"
+	"myeth/p2p/nat"
+	"myeth/p2p/netutil"
+)
+
+const (
+	// inboundThrottleTime 同一个IP两次入站连接之间至少要间隔这么久
+	inboundThrottleTime = 30 * time.Second
+)
+
+var (
+	errServerStopped    = errors.New("server stopped")
+	errInboundThrottled = errors.New("too many attempts")
 )
 
 // Config holds Server options.
@@ -31,6 +49,24 @@ type Config struct {
 	// maintained and re-connected on disconnects.
 	StaticNodes []*discover.Node
 
+	// Trusted nodes are flagged as trusted on connect and reported as such in
+	// PeerInfo. Inbound connections from their IPs are exempt from the
+	// per-IP throttle. The server enforces no peer limit, so there are no
+	// slots reserved for them.
+	TrustedNodes []*discover.Node
+
+	// If set to a non-nil value, only hosts that match one of the
+	// IP networks contained in the list are considered. This applies
+	// to inbound connections, dialed nodes and discovered nodes.
+	// 只允许和这些网段里的节点通信
+	NetRestrict *netutil.Netlist `toml:",omitempty"`
+
+	// If set to a non-nil value, the given NAT port mapper
+	// is used to make the listening port available to the
+	// Internet.
+	// 在NAT后面的时候用来做端口映射 并对外宣告网关的外部地址
+	NAT nat.Interface `toml:",omitempty"`
+
 	//节点名称
 	// Name sets the node name of this server.
 	// Use common.MakeName to create a name that follows existing conventions.
@@ -40,9 +76,21 @@ type Config struct {
 	// If Dialer is set to a non-nil value, the given Dialer
 	// is used to dial outbound peer connections.
 	Dialer NodeDialer `toml:"-"`
+
+	// If EnableMsgEvents is set then the server will emit PeerEvents
+	// whenever a message is sent to or received from a peer
+	// 每个消息都发事件开销不小 默认只发add/drop事件
+	EnableMsgEvents bool
 }
 
-type connFlag int
+type connFlag int32
+
+const (
+	dynDialedConn connFlag = 1 << iota
+	staticDialedConn
+	inboundConn
+	trustedConn
+)
 
 // conn wraps a network connection with information gathered
 // during the two handshakes.
@@ -62,26 +110,51 @@ type Server struct {
 	// Config fields may not be modified while the server is running.
 	Config
 
+	// Hooks for testing. These are useful because we can inhibit
+	// the whole protocol stack.
+	newTransport func(net.Conn) transport
+
 	lock sync.Mutex // protects running
 
 	running bool
 
+	ourID    discover.NodeID // 本节点的ID 由私钥推导
 	listener net.Listener
+	natIP    net.IP // NAT网关的外部地址 没有配置NAT时为nil
+
+	//最近连入过的IP 只在listenLoop里访问
+	inboundHistory expHeap
+	//可信节点的IP 由run loop维护 listenLoop据此跳过入站限流
+	trustedMu  sync.RWMutex
+	trustedIPs map[string]bool
 	//本节点的握手包
 	ourHandshake *protoHandshake
 
-	loopWG sync.WaitGroup // loop, listenLoop
+	loopWG   sync.WaitGroup // loop, listenLoop
+	peerFeed event.Feed
 
 	quit          chan struct{}
+	dialCtx       context.Context // 拨号用的context Stop时取消
+	cancelDial    context.CancelFunc
+	addstatic     chan *discover.Node
+	removestatic  chan *discover.Node
+	addtrusted    chan *discover.Node
+	removetrusted chan *discover.Node
 	posthandshake chan *conn
 	addpeer       chan *conn
 	delpeer       chan peerDrop
+	peerOp        chan peerOpFunc
+	peerOpDone    chan struct{}
 }
 
+//在run loop里对peers map执行的操作 外部不能直接访问peers
+type peerOpFunc func(map[discover.NodeID]*Peer)
+
 //用来描述断掉连接的结构体
 type peerDrop struct {
 	*Peer
-	err error
+	err       error
+	requested bool // true if signaled by the peer
 }
 
 // sharedUDPConn implements a shared connection. Write sends messages to the underlying connection while read returns
@@ -108,24 +181,180 @@ type transport interface {
 	close(err error)
 }
 
-func (srv *Server) newTransport(fd net.Conn) transport {
-	return newRLPX(fd)
+func (c *conn) String() string {
+	s := flagString(c.flags)
+	if (c.id != discover.NodeID{}) {
+		s += " " + c.id.String()
+	}
+	s += " " + c.fd.RemoteAddr().String()
+	return s
+}
+
+func flagString(f connFlag) string {
+	s := ""
+	if f&trustedConn != 0 {
+		s += "-trusted"
+	}
+	if f&dynDialedConn != 0 {
+		s += "-dyndial"
+	}
+	if f&staticDialedConn != 0 {
+		s += "-staticdial"
+	}
+	if f&inboundConn != 0 {
+		s += "-inbound"
+	}
+	if s != "" {
+		s = s[1:]
+	}
+	return s
+}
+
+//flags 会在run loop 和 peer的goroutine里同时被访问 所以用atomic读写
+func (c *conn) is(f connFlag) bool {
+	flags := connFlag(atomic.LoadInt32((*int32)(&c.flags)))
+	return flags&f != 0
+}
+
+func (c *conn) set(f connFlag, val bool) {
+	for {
+		oldFlags := connFlag(atomic.LoadInt32((*int32)(&c.flags)))
+		flags := oldFlags
+		if val {
+			flags |= f
+		} else {
+			flags &= ^f
+		}
+		if atomic.CompareAndSwapInt32((*int32)(&c.flags), int32(oldFlags), int32(flags)) {
+			return
+		}
+	}
+}
+
+// Peers returns all connected peers.
+func (srv *Server) Peers() []*Peer {
+	var ps []*Peer
+	select {
+	// Note: We'd love to put this function into a variable but
+	// that seems to cause a weird compiler error in some
+	// environments.
+	case srv.peerOp <- func(peers map[discover.NodeID]*Peer) {
+		for _, p := range peers {
+			ps = append(ps, p)
+		}
+	}:
+		<-srv.peerOpDone
+	case <-srv.quit:
+	}
+	return ps
+}
+
+// PeerCount returns the number of connected peers.
+func (srv *Server) PeerCount() int {
+	var count int
+	select {
+	case srv.peerOp <- func(ps map[discover.NodeID]*Peer) { count = len(ps) }:
+		<-srv.peerOpDone
+	case <-srv.quit:
+	}
+	return count
+}
+
+// SubscribeEvents subscribes the given channel to peer events
+func (srv *Server) SubscribeEvents(ch chan *PeerEvent) event.Subscription {
+	return srv.peerFeed.Subscribe(ch)
+}
+
+// Self returns the local node's endpoint information.
+func (srv *Server) Self() *discover.Node {
+	srv.lock.Lock()
+	defer srv.lock.Unlock()
+
+	if !srv.running {
+		return &discover.Node{IP: net.ParseIP("0.0.0.0")}
+	}
+	return srv.makeSelf(srv.listener)
+}
+
+func (srv *Server) makeSelf(listener net.Listener) *discover.Node {
+	// Inbound connections disabled, use zero address.
+	if listener == nil {
+		return &discover.Node{IP: net.ParseIP("0.0.0.0"), ID: srv.ourID}
+	}
+	// Otherwise inject the listener address too
+	addr := listener.Addr().(*net.TCPAddr)
+	ip := addr.IP
+	if srv.natIP != nil {
+		// 别的节点要通过网关的外部地址才能连进来
+		ip = srv.natIP
+	}
+	return &discover.Node{
+		ID:  srv.ourID,
+		IP:  ip,
+		TCP: uint16(addr.Port),
+	}
+}
+
+// AddPeer connects to the given node and maintains the connection until the
+// server is shut down. If the connection fails for any reason, the server will
+// attempt to reconnect the peer.
+func (srv *Server) AddPeer(node *discover.Node) {
+	select {
+	case srv.addstatic <- node:
+	case <-srv.quit:
+	}
+}
+
+// RemovePeer disconnects from the given node
+func (srv *Server) RemovePeer(node *discover.Node) {
+	select {
+	case srv.removestatic <- node:
+	case <-srv.quit:
+	}
+}
+
+// AddTrustedPeer adds the given node to the trusted node set. A connected peer
+// with that ID is flagged as trusted immediately.
+func (srv *Server) AddTrustedPeer(node *discover.Node) {
+	select {
+	case srv.addtrusted <- node:
+	case <-srv.quit:
+	}
+}
+
+// RemoveTrustedPeer removes the given node from the trusted peer set.
+func (srv *Server) RemoveTrustedPeer(node *discover.Node) {
+	select {
+	case srv.removetrusted <- node:
+	case <-srv.quit:
+	}
 }
 
-// Start starts running the server.
-// Servers can not be re-used after stopping.
+// Start starts running the server. A server that failed to start or has been
+// stopped can be started again.
 func (srv *Server) Start() (err error) {
 	srv.lock.Lock()
 	defer srv.lock.Unlock()
 	if srv.running {
 		return errors.New("server already running")
 	}
-	srv.running = true
+	//先做完检查再置running 否则启动失败后Stop会关闭nil的quit
+	if srv.PrivateKey == nil {
+		return fmt.Errorf("Server.PrivateKey must be set to a non-nil key")
+	}
+	srv.ourID = discover.PubkeyID(&srv.PrivateKey.PublicKey)
 
 	srv.quit = make(chan struct{})
+	srv.dialCtx, srv.cancelDial = context.WithCancel(context.Background())
 	srv.addpeer = make(chan *conn)
 	srv.delpeer = make(chan peerDrop)
 	srv.posthandshake = make(chan *conn)
+	srv.addstatic = make(chan *discover.Node)
+	srv.removestatic = make(chan *discover.Node)
+	srv.addtrusted = make(chan *discover.Node)
+	srv.removetrusted = make(chan *discover.Node)
+	srv.peerOp = make(chan peerOpFunc)
+	srv.peerOpDone = make(chan struct{})
 
 	//discovery 功能先屏蔽掉
 	// var (
@@ -157,20 +386,27 @@ func (srv *Server) Start() (err error) {
 	// }
 	// srv.ntab = ntab
 
+	if srv.newTransport == nil {
+		srv.newTransport = newRLPX
+	}
 	if srv.Dialer == nil {
-		srv.Dialer = TCPDialer{&net.Dialer{}}
+		srv.Dialer = TCPDialer{&net.Dialer{Timeout: defaultDialTimeout}}
 	}
 
-	dialer := newDialState(srv.StaticNodes)
+	dialer := newDialState(srv.StaticNodes, srv.NetRestrict)
 	// handshake
 	// 本节点的握手包
-	srv.ourHandshake = &protoHandshake{Version: baseProtocolVersion, Name: srv.Name}
+	srv.ourHandshake = &protoHandshake{Version: baseProtocolVersion, Name: srv.Name, ID: srv.ourID}
 	for _, p := range srv.Protocols {
 		srv.ourHandshake.Caps = append(srv.ourHandshake.Caps, p.cap())
 	}
 
-	if err := srv.startListening(); err != nil {
-		return err
+	// ListenAddr为空时不监听 只能主动拨号或者由外部调用SetupConn接入 模拟网络就是这样用的
+	if srv.ListenAddr != "" {
+		if err := srv.startListening(); err != nil {
+			srv.cancelDial()
+			return err
+		}
 	}
 
 	srv.loopWG.Add(1)
@@ -182,6 +418,21 @@ func (srv *Server) Start() (err error) {
 // Stop terminates the server and all active peer connections.
 // It blocks until all active connections have been closed.
 func (srv *Server) Stop() {
+	srv.lock.Lock()
+	if !srv.running {
+		srv.lock.Unlock()
+		return
+	}
+	srv.running = false
+	if srv.listener != nil {
+		// this unblocks listener Accept
+		srv.listener.Close()
+	}
+	close(srv.quit)
+	// abort dials that are still in progress
+	srv.cancelDial()
+	srv.lock.Unlock()
+	srv.loopWG.Wait()
 }
 
 //开启TCP 监听别的peer消息
@@ -197,6 +448,22 @@ func (srv *Server) startListening() error {
 	srv.loopWG.Add(1)
 	go srv.listenLoop()
 
+	if srv.NAT != nil {
+		// Map the TCP listening port if NAT is configured.
+		// 环回地址不用做映射 外面本来也连不进来
+		if !laddr.IP.IsLoopback() {
+			srv.loopWG.Add(1)
+			go func() {
+				nat.Map(srv.NAT, srv.quit, "tcp", laddr.Port, laddr.Port, "ethereum p2p")
+				srv.loopWG.Done()
+			}()
+		}
+		if ip, err := srv.NAT.ExternalIP(); err == nil {
+			srv.natIP = ip
+		} else {
+			log.Debug("Couldn't get external IP", "interface", srv.NAT, "err", err)
+		}
+	}
 	return nil
 }
 
@@ -235,23 +502,79 @@ func (srv *Server) listenLoop() {
 			fd, err = srv.listener.Accept()
 			if tempErr, ok := err.(tempError); ok && tempErr.Temporary() {
 				continue
+			} else if err != nil {
+				//listener被Stop关闭了 退出监听循环
+				return
 			}
 			//接入了一个无错链接
 			break
 		}
 
-		//以太坊在这里多做一层IP限制
+		//以太坊在这里多做一层IP限制 不在白名单里的和连得太频繁的IP直接断开
+		remoteIP := netutil.AddrIP(fd.RemoteAddr())
+		if err := srv.checkInboundConn(remoteIP, time.Now()); err != nil {
+			log.Debug("Rejected inbound connection", "addr", fd.RemoteAddr(), "err", err)
+			fd.Close()
+			slots <- struct{}{}
+			continue
+		}
 
 		go func() {
-			//链接建立 进行握手 同时释放掉 占用的chan
-			go srv.SetupConn(fd, 0, nil)
+			//链接建立 进行握手 握手结束后释放掉 占用的chan
+			srv.SetupConn(fd, inboundConn, nil)
 			slots <- struct{}{}
 		}()
 	}
 }
 
+// checkInboundConn decides whether a connection accepted by the listener
+// may proceed to the handshake.
+func (srv *Server) checkInboundConn(remoteIP net.IP, now time.Time) error {
+	if remoteIP == nil {
+		return nil
+	}
+	// Reject connections that do not match NetRestrict.
+	if srv.NetRestrict != nil && !srv.NetRestrict.Contains(remoteIP) {
+		return errNotWhitelisted
+	}
+	// Reject peers that try too often, except for local and trusted ones.
+	//还没有握手 不知道对方的ID 所以只能按IP来限制
+	if netutil.IsLAN(remoteIP) || srv.isTrustedIP(remoteIP) {
+		return nil
+	}
+	srv.inboundHistory.expire(now)
+	if srv.inboundHistory.contains(remoteIP.String()) {
+		return errInboundThrottled
+	}
+	srv.inboundHistory.add(remoteIP.String(), now.Add(inboundThrottleTime))
+	return nil
+}
+
+// isTrustedIP reports whether ip belongs to one of the trusted nodes.
+func (srv *Server) isTrustedIP(ip net.IP) bool {
+	srv.trustedMu.RLock()
+	defer srv.trustedMu.RUnlock()
+	return srv.trustedIPs[ip.String()]
+}
+
+// setTrustedIPs publishes the addresses of the trusted node set to the
+// listener.
+func (srv *Server) setTrustedIPs(trusted map[discover.NodeID]*discover.Node) {
+	ips := make(map[string]bool, len(trusted))
+	for _, n := range trusted {
+		if n.IP != nil {
+			ips[n.IP.String()] = true
+		}
+	}
+	srv.trustedMu.Lock()
+	srv.trustedIPs = ips
+	srv.trustedMu.Unlock()
+}
+
 //握手的工作
 func (srv *Server) SetupConn(fd net.Conn, flags connFlag, dialDest *discover.Node) error {
+	//统计这个连接的收发流量 metrics没有打开时直接返回原连接
+	fd = newMeteredConn(fd, flags&inboundConn != 0)
 	c := &conn{fd: fd, transport: srv.newTransport(fd), flags: flags, cont: make(chan error)}
 	err := srv.setupConn(c, flags, dialDest)
 	if err != nil {
@@ -266,14 +589,13 @@ func (srv *Server) setupConn(c *conn, flags connFlag, dialDest *discover.Node) e
 	running := srv.running
 	srv.lock.Unlock()
 	if !running {
-		return nil
+		return errServerStopped
 	}
 	// Run the encryption handshake.
 	var err error
 	//NEED DO!!这里的c.id 和 dialDest里面的有不同吗
 	if c.id, err = c.doEncHandshake(srv.PrivateKey, dialDest); err != nil {
-		fmt.Println(err.Error())
-		//srv.log.Trace("Failed RLPx handshake", "addr", c.fd.RemoteAddr(), "conn", c.flags, "err", err)
+		log.Trace("Failed RLPx handshake", "addr", c.fd.RemoteAddr(), "conn", c.flags, "err", err)
 		return err
 	}
 
@@ -303,7 +625,7 @@ func (srv *Server) checkpoint(c *conn, stage chan<- *conn) error {
 	select {
 	case stage <- c:
 	case <-srv.quit:
-		return nil
+		return errServerStopped
 	}
 
 	//在此等待p2pServer的Run loop中的链接 操作执行完毕 并返回对应错误
@@ -311,11 +633,13 @@ func (srv *Server) checkpoint(c *conn, stage chan<- *conn) error {
 	case err := <-c.cont:
 		return err
 	case <-srv.quit:
-		return nil
+		return errServerStopped
 	}
 }
 
 const (
+	defaultDialTimeout = 15 * time.Second
+
 	maxActiveDialTasks = 16
 )
 
@@ -326,6 +650,8 @@ func (srv *Server) run(dialer *dialstate) {
 	var (
 		//当前连接到的节点map
 		peers = make(map[discover.NodeID]*Peer)
+		//可信节点集合 连接建立时会给conn打上trustedConn标记
+		trusted = make(map[discover.NodeID]*discover.Node, len(srv.TrustedNodes))
 		//任务执行完成后的通知chan列表
 		taskdone = make(chan task, maxActiveDialTasks)
 		//正在执行的task
@@ -334,6 +660,13 @@ func (srv *Server) run(dialer *dialstate) {
 		queuedTasks []task
 	)
 
+	// Put trusted nodes into a map to speed up checks.
+	// Trusted peers are loaded on startup or added via AddTrustedPeer RPC.
+	for _, n := range srv.TrustedNodes {
+		trusted[n.ID] = n
+	}
+	srv.setTrustedIPs(trusted)
+
 	//删除一个正在执行的任务
 	delTask := func(t task) {
 		for i := range runningTasks {
@@ -366,7 +699,7 @@ func (srv *Server) run(dialer *dialstate) {
 		queuedTasks = startTasks(queuedTasks)
 		//当前运行任务不够最大可运行数 创建更多的新任务
 		if len(runningTasks) < maxActiveDialTasks {
-			nt := dialer.newTasks()
+			nt := dialer.newTasks(len(runningTasks)+len(queuedTasks), peers, time.Now())
 			queuedTasks = append(queuedTasks, startTasks(nt)...)
 		}
 	}
@@ -380,24 +713,78 @@ running:
 		case <-srv.quit:
 			break running
 
+		case n := <-srv.addstatic:
+			// This channel is used by AddPeer to add to the
+			// ephemeral static peer list. Add it to the dialer,
+			// it will keep the node connected.
+			dialer.addStatic(n)
+
+		case n := <-srv.removestatic:
+			// This channel is used by RemovePeer to send a
+			// disconnect request to a peer and begin the
+			// stop keeping the node connected.
+			dialer.removeStatic(n)
+			if p, ok := peers[n.ID]; ok {
+				p.Disconnect(DiscRequested)
+			}
+
+		case n := <-srv.addtrusted:
+			// This channel is used by AddTrustedPeer to add an enode
+			// to the trusted node set.
+			trusted[n.ID] = n
+			srv.setTrustedIPs(trusted)
+			// Mark any already-connected peer as trusted
+			if p, ok := peers[n.ID]; ok {
+				p.rw.set(trustedConn, true)
+			}
+
+		case n := <-srv.removetrusted:
+			// This channel is used by RemoveTrustedPeer to remove an enode
+			// from the trusted node set.
+			delete(trusted, n.ID)
+			srv.setTrustedIPs(trusted)
+			// Unmark any already-connected peer as trusted
+			if p, ok := peers[n.ID]; ok {
+				p.rw.set(trustedConn, false)
+			}
+
+		case op := <-srv.peerOp:
+			// This channel is used by Peers and PeerCount.
+			op(peers)
+			srv.peerOpDone <- struct{}{}
+
 		case t := <-taskdone:
+			//任务完成 通知dialer更新连接状态
+			dialer.taskDone(t, time.Now())
 			delTask(t)
 
 		case c := <-srv.posthandshake:
 			//第一阶段加密handshake操作完毕
+			if trusted[c.id] != nil {
+				// Ensure that the trusted flag is set before the checks run.
+				c.set(trustedConn, true)
+			}
 
 			select {
-			case c.cont <- srv.encHandshakeChecks(c):
+			case c.cont <- srv.encHandshakeChecks(peers, c):
 			case <-srv.quit:
 				break running
 			}
 		case c := <-srv.addpeer:
 			//doProtoHandshake
-			err := srv.protoHandshakeChecks(c)
+			err := srv.protoHandshakeChecks(peers, c)
 			if err == nil {
 				//握手完成 run peer开始
 				// The handshakes are done and it passed all checks.
 				p := newPeer(c, srv.Protocols)
+				// If message events are enabled, pass the peerFeed
+				// to the peer
+				if srv.EnableMsgEvents {
+					p.events = &srv.peerFeed
+				}
+				if mc, ok := c.fd.(*meteredConn); ok {
+					mc.peerAdded(c.id)
+				}
 
 				go srv.runPeer(p)
 				peers[c.id] = p
@@ -409,41 +796,128 @@ running:
 				break running
 			}
 		case pd := <-srv.delpeer:
+			// A peer disconnected.
 			delete(peers, pd.ID())
+			log.Debug("Removing p2p peer", "id", pd.ID().String()[:16], "req", pd.requested, "err", pd.err)
 		}
+	}
 
+	// 退出流程: 不再启动新的拨号任务 通知所有peer断开
+	// Disconnect all peers.
+	for _, p := range peers {
+		p.Disconnect(DiscQuitting)
+	}
+	// Wait for peers to shut down. Pending connections are not handled
+	// here and will terminate soon-ish because srv.quit is closed.
+	for len(peers) > 0 {
+		p := <-srv.delpeer
+		delete(peers, p.ID())
+	}
+	// 等待正在运行的拨号任务结束 拨号已被Stop取消 排队的任务直接丢弃
+	for range runningTasks {
+		<-taskdone
 	}
 }
 
-func (srv *Server) protoHandshakeChecks(c *conn) error {
+func (srv *Server) protoHandshakeChecks(peers map[discover.NodeID]*Peer, c *conn) error {
 	//先检测协议是否能匹配
 	if len(srv.Protocols) > 0 && countMatchingProtocols(srv.Protocols, c.caps) == 0 {
-		return nil
+		return DiscUselessPeer
 	}
-
-	return srv.encHandshakeChecks(c)
+	// Repeat the encryption handshake checks because the
+	// peer set might have changed between the handshakes.
+	return srv.encHandshakeChecks(peers, c)
 }
 
-//这里面有
-func (srv *Server) encHandshakeChecks(c *conn) error {
-	return nil
-	// switch {
-	// case !c.is(trustedConn|staticDialedConn) && len(peers) >= srv.MaxPeers:
-	// 	return DiscTooManyPeers
-	// case !c.is(trustedConn) && c.is(inboundConn) && inboundCount >= srv.maxInboundConns():
-	// 	return DiscTooManyPeers
-	// case peers[c.id] != nil:
-	// 	return DiscAlreadyConnected
-	// case c.id == srv.Self().ID:
-	// 	return DiscSelf
-	// default:
-	// 	return nil
-	// }
+//加密握手之后的检查 重复连接和连到自己都要拒绝掉
+func (srv *Server) encHandshakeChecks(peers map[discover.NodeID]*Peer, c *conn) error {
+	switch {
+	case peers[c.id] != nil:
+		return DiscAlreadyConnected
+	case c.id == srv.ourID:
+		return DiscSelf
+	default:
+		return nil
+	}
 }
 
 //run peer 为每一个peer 开启一个 goroutine
 func (srv *Server) runPeer(p *Peer) {
-	err := p.run()
+	// broadcast peer add
+	srv.peerFeed.Send(&PeerEvent{
+		Type: PeerEventTypeAdd,
+		Peer: p.ID(),
+	})
+
+	remoteRequested, err := p.run()
+
+	// broadcast peer drop
+	srv.peerFeed.Send(&PeerEvent{
+		Type:  PeerEventTypeDrop,
+		Peer:  p.ID(),
+		Error: err.Error(),
+	})
+
+	// Note: run waits for existing peers to be sent on srv.delpeer
+	// before returning, so this send should not select on srv.quit.
+	srv.delpeer <- peerDrop{p, err, remoteRequested}
+}
+
+// NodeInfo represents a short summary of the information known about the host.
+type NodeInfo struct {
+	ID    string `json:"id"`    // Unique node identifier (also the encryption key)
+	Name  string `json:"name"`  // Name of the node, including client type, version, OS, custom data
+	Enode string `json:"enode"` // Enode URL for adding this peer from remote peers
+	IP    string `json:"ip"`    // IP address of the node
+	Ports struct {
+		Discovery int `json:"discovery"` // UDP listening port for discovery protocol
+		Listener  int `json:"listener"`  // TCP listening port for RLPx
+	} `json:"ports"`
+	ListenAddr string                 `json:"listenAddr"`
+	Protocols  map[string]interface{} `json:"protocols"`
+}
 
-	srv.delpeer <- peerDrop{p, err}
+// NodeInfo gathers and returns a collection of metadata known about the host.
+func (srv *Server) NodeInfo() *NodeInfo {
+	node := srv.Self()
+
+	// Gather and assemble the generic node infos
+	info := &NodeInfo{
+		Name:       srv.Name,
+		Enode:      node.String(),
+		ID:         node.ID.String(),
+		IP:         node.IP.String(),
+		ListenAddr: srv.ListenAddr,
+		Protocols:  make(map[string]interface{}),
+	}
+	info.Ports.Discovery = int(node.UDP)
+	info.Ports.Listener = int(node.TCP)
+
+	// Gather all the running protocol infos (only once per protocol type)
+	for _, proto := range srv.Protocols {
+		if _, ok := info.Protocols[proto.Name]; !ok {
+			nodeInfo := interface{}("unknown")
+			if query := proto.NodeInfo; query != nil {
+				nodeInfo = query()
+			}
+			info.Protocols[proto.Name] = nodeInfo
+		}
+	}
+	return info
+}
+
+// PeersInfo returns an array of metadata objects describing connected peers.
+func (srv *Server) PeersInfo() []*PeerInfo {
+	// Gather all the generic and sub-protocol specific infos
+	infos := make([]*PeerInfo, 0, srv.PeerCount())
+	for _, peer := range srv.Peers() {
+		if peer != nil {
+			infos = append(infos, peer.Info())
+		}
+	}
+	// Sort the result array alphabetically by node identifier
+	sort.Slice(infos, func(i, j int) bool {
+		return infos[i].ID < infos[j].ID
+	})
+	return infos
 }
@@ -0,0 +1,398 @@
+package p2p
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"io"
+	"io/ioutil"
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	"myeth/crypto"
+	"myeth/crypto/sha3"
+	"myeth/p2p/discover"
+	"myeth/p2p/netutil"
+)
+
+// testTransport 跳过加密握手的transport 帧仍然经过rlpxFrameRW 只是密钥全部为零
+type testTransport struct {
+	id discover.NodeID
+	*rlpx
+
+	caps []Cap
+}
+
+func newTestTransport(id discover.NodeID, caps []Cap, fd net.Conn) transport {
+	wrapped := newRLPX(fd).(*rlpx)
+	wrapped.rw = newRLPXFrameRW(fd, secrets{
+		MAC:        zero16,
+		AES:        zero16,
+		IngressMAC: sha3.NewKeccak256(),
+		EgressMAC:  sha3.NewKeccak256(),
+	})
+	return &testTransport{id: id, rlpx: wrapped, caps: caps}
+}
+
+func (c *testTransport) doEncHandshake(prv *ecdsa.PrivateKey, dialDest *discover.Node) (discover.NodeID, error) {
+	return c.id, nil
+}
+
+func (c *testTransport) doProtoHandshake(our *protoHandshake) (*protoHandshake, error) {
+	return &protoHandshake{ID: c.id, Name: "test", Caps: c.caps}, nil
+}
+
+func startTestServer(t *testing.T, remoteID discover.NodeID, protocols []Protocol) *Server {
+	key, _ := crypto.GenerateKey()
+	var caps []Cap
+	for _, p := range protocols {
+		caps = append(caps, p.cap())
+	}
+	srv := &Server{
+		Config: Config{
+			Name:       "test",
+			ListenAddr: "127.0.0.1:0",
+			PrivateKey: key,
+			Protocols:  protocols,
+		},
+		newTransport: func(fd net.Conn) transport { return newTestTransport(remoteID, caps, fd) },
+	}
+	if err := srv.Start(); err != nil {
+		t.Fatalf("Could not start server: %v", err)
+	}
+	return srv
+}
+
+func TestServerSetupConnFakeTransport(t *testing.T) {
+	remkey, _ := crypto.GenerateKey()
+	remid := discover.PubkeyID(&remkey.PublicKey)
+
+	started := make(chan *Peer, 1)
+	done := make(chan error, 1)
+	proto := Protocol{
+		Name:    "test",
+		Version: 1,
+		Length:  2,
+		Run: func(p *Peer, rw MsgReadWriter) error {
+			started <- p
+			if err := SendItems(rw, 1, "hello"); err != nil {
+				done <- err
+				return err
+			}
+			_, err := rw.ReadMsg()
+			done <- err
+			return err
+		},
+	}
+	srv := startTestServer(t, remid, []Protocol{proto})
+
+	fd0, fd1 := net.Pipe()
+	remote := newTestTransport(srv.ourID, nil, fd1)
+	defer remote.close(nil)
+	if err := srv.SetupConn(fd0, inboundConn, nil); err != nil {
+		t.Fatalf("SetupConn failed: %v", err)
+	}
+
+	select {
+	case p := <-started:
+		if p.ID() != remid {
+			t.Errorf("peer has wrong ID: got %x, want %x", p.ID(), remid)
+		}
+		if p.Name() != "test" {
+			t.Errorf("peer has wrong name: %q", p.Name())
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("protocol did not start")
+	}
+	// 子协议的消息码要加上基础协议的偏移
+	if err := ExpectMsg(remote, baseProtocolLength+1, []string{"hello"}); err != nil {
+		t.Fatal(err)
+	}
+
+	// Stopping the server must disconnect the peer with DiscQuitting
+	// and terminate the protocol handler.
+	stopped := make(chan struct{})
+	go func() {
+		srv.Stop()
+		close(stopped)
+	}()
+	if err := ExpectMsg(remote, discMsg, []DiscReason{DiscQuitting}); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("protocol handler did not return")
+	}
+	select {
+	case <-stopped:
+	case <-time.After(5 * time.Second):
+		t.Fatal("server did not stop")
+	}
+}
+
+func TestServerPeerEventsAndInfo(t *testing.T) {
+	remkey, _ := crypto.GenerateKey()
+	remid := discover.PubkeyID(&remkey.PublicKey)
+
+	proto := Protocol{
+		Name:     "test",
+		Version:  1,
+		Length:   2,
+		NodeInfo: func() interface{} { return "node-info" },
+		Run: func(p *Peer, rw MsgReadWriter) error {
+			_, err := rw.ReadMsg()
+			return err
+		},
+	}
+	srv := startTestServer(t, remid, []Protocol{proto})
+	defer srv.Stop()
+
+	events := make(chan *PeerEvent, 4)
+	sub := srv.SubscribeEvents(events)
+	defer sub.Unsubscribe()
+
+	fd0, fd1 := net.Pipe()
+	go io.Copy(ioutil.Discard, fd1)
+	if err := srv.SetupConn(fd0, inboundConn, nil); err != nil {
+		t.Fatalf("SetupConn failed: %v", err)
+	}
+	select {
+	case ev := <-events:
+		if ev.Type != PeerEventTypeAdd || ev.Peer != remid {
+			t.Fatalf("unexpected event: %+v", ev)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("no add event")
+	}
+
+	if n := srv.PeerCount(); n != 1 {
+		t.Fatalf("PeerCount: got %d, want 1", n)
+	}
+	infos := srv.PeersInfo()
+	if len(infos) != 1 {
+		t.Fatalf("PeersInfo: got %d entries, want 1", len(infos))
+	}
+	info := infos[0]
+	if info.ID != remid.String() || !info.Network.Inbound || info.Network.Static {
+		t.Errorf("unexpected peer info: %+v", info)
+	}
+	if info.Protocols["test"] != "unknown" {
+		t.Errorf("protocol info: got %v, want unknown", info.Protocols["test"])
+	}
+
+	node := srv.NodeInfo()
+	if !strings.HasPrefix(node.Enode, "enode://"+srv.ourID.String()+"@") {
+		t.Errorf("unexpected enode URL %q", node.Enode)
+	}
+	if node.Protocols["test"] != "node-info" {
+		t.Errorf("node protocol info: got %v", node.Protocols["test"])
+	}
+
+	srv.RemovePeer(&discover.Node{ID: remid})
+	select {
+	case ev := <-events:
+		if ev.Type != PeerEventTypeDrop || ev.Peer != remid || ev.Error == "" {
+			t.Fatalf("unexpected event: %+v", ev)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("no drop event")
+	}
+}
+
+func TestServerCheckInboundConn(t *testing.T) {
+	restrict, _ := netutil.ParseNetlist("1.2.0.0/16, 10.0.0.0/8")
+	srv := &Server{Config: Config{NetRestrict: restrict}}
+	trustedKey, _ := crypto.GenerateKey()
+	trustedID := discover.PubkeyID(&trustedKey.PublicKey)
+	srv.setTrustedIPs(map[discover.NodeID]*discover.Node{
+		trustedID: discover.NewNode(trustedID, net.IP{1, 2, 0, 9}, 30303, 30303),
+	})
+	now := time.Now()
+
+	tests := []struct {
+		ip   net.IP
+		time time.Time
+		err  error
+	}{
+		{ip: net.IP{192, 168, 0, 1}, time: now, err: errNotWhitelisted},
+		{ip: net.IP{1, 2, 0, 1}, time: now, err: nil},
+		// the same address is throttled until the window has passed
+		{ip: net.IP{1, 2, 0, 1}, time: now.Add(time.Second), err: errInboundThrottled},
+		{ip: net.IP{1, 2, 0, 2}, time: now.Add(time.Second), err: nil},
+		{ip: net.IP{1, 2, 0, 1}, time: now.Add(inboundThrottleTime + time.Second), err: nil},
+		// LAN and trusted addresses are never throttled
+		{ip: net.IP{10, 0, 0, 1}, time: now, err: nil},
+		{ip: net.IP{10, 0, 0, 1}, time: now.Add(time.Second), err: nil},
+		{ip: net.IP{1, 2, 0, 9}, time: now, err: nil},
+		{ip: net.IP{1, 2, 0, 9}, time: now.Add(time.Second), err: nil},
+		// connections without an IP (e.g. net.Pipe) are not checked
+		{ip: nil, time: now, err: nil},
+	}
+	for i, tt := range tests {
+		if err := srv.checkInboundConn(tt.ip, tt.time); err != tt.err {
+			t.Errorf("test %d: %v: got error %v, want %v", i, tt.ip, err, tt.err)
+		}
+	}
+}
+
+func TestServerNetRestrictListener(t *testing.T) {
+	restrict, _ := netutil.ParseNetlist("10.0.0.0/8")
+	key, _ := crypto.GenerateKey()
+	srv := &Server{Config: Config{
+		Name:        "test",
+		ListenAddr:  "127.0.0.1:0",
+		PrivateKey:  key,
+		NetRestrict: restrict,
+	}}
+	if err := srv.Start(); err != nil {
+		t.Fatalf("Could not start server: %v", err)
+	}
+	defer srv.Stop()
+
+	// 127.0.0.1不在白名单里 连接应该在握手之前就被关掉
+	fd, err := net.Dial("tcp", srv.listener.Addr().String())
+	if err != nil {
+		t.Fatalf("dial failed: %v", err)
+	}
+	defer fd.Close()
+	fd.SetReadDeadline(time.Now().Add(5 * time.Second))
+	if _, err := fd.Read(make([]byte, 1)); err != io.EOF {
+		t.Fatalf("expected connection to be closed, got %v", err)
+	}
+}
+
+func TestDialStateNetRestrict(t *testing.T) {
+	restrict, _ := netutil.ParseNetlist("10.0.0.0/8")
+	var id discover.NodeID
+	s := newDialState(nil, restrict)
+	if err := s.checkDial(discover.NewNode(id, net.IP{127, 0, 0, 1}, 30303, 30303), nil); err != errNotWhitelisted {
+		t.Errorf("got error %v, want %v", err, errNotWhitelisted)
+	}
+	if err := s.checkDial(discover.NewNode(id, net.IP{10, 1, 1, 1}, 30303, 30303), nil); err != nil {
+		t.Errorf("got error %v for whitelisted node", err)
+	}
+}
+
+// fakeNAT records the port mappings requested by the server.
+type fakeNAT struct {
+	extIP   net.IP
+	added   chan int
+	deleted chan int
+}
+
+func (n *fakeNAT) AddMapping(protocol string, extport, intport int, name string, lifetime time.Duration) error {
+	n.added <- extport
+	return nil
+}
+
+func (n *fakeNAT) DeleteMapping(protocol string, extport, intport int) error {
+	n.deleted <- extport
+	return nil
+}
+
+func (n *fakeNAT) ExternalIP() (net.IP, error) { return n.extIP, nil }
+func (n *fakeNAT) String() string              { return "fake" }
+
+func TestServerNAT(t *testing.T) {
+	m := &fakeNAT{extIP: net.IP{77, 12, 33, 4}, added: make(chan int, 1), deleted: make(chan int, 1)}
+	key, _ := crypto.GenerateKey()
+	srv := &Server{Config: Config{
+		Name:       "test",
+		ListenAddr: ":0",
+		PrivateKey: key,
+		NAT:        m,
+	}}
+	if err := srv.Start(); err != nil {
+		t.Fatalf("Could not start server: %v", err)
+	}
+	port := srv.listener.Addr().(*net.TCPAddr).Port
+
+	select {
+	case extport := <-m.added:
+		if extport != port {
+			t.Errorf("mapped port %d, want %d", extport, port)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("listening port was not mapped")
+	}
+	// 对外宣告的是网关的外部地址
+	self := srv.Self()
+	if !self.IP.Equal(m.extIP) || int(self.TCP) != port {
+		t.Errorf("advertised endpoint %v:%d, want %v:%d", self.IP, self.TCP, m.extIP, port)
+	}
+
+	srv.Stop()
+	select {
+	case extport := <-m.deleted:
+		if extport != port {
+			t.Errorf("deleted mapping for port %d, want %d", extport, port)
+		}
+	default:
+		t.Fatal("mapping not deleted on shutdown")
+	}
+}
+
+func TestServerStartWithoutKey(t *testing.T) {
+	srv := &Server{Config: Config{Name: "test"}}
+	if err := srv.Start(); err == nil {
+		t.Fatal("Start succeeded without a private key")
+	}
+	// a failed Start leaves the server stopped
+	srv.Stop()
+
+	srv.PrivateKey, _ = crypto.GenerateKey()
+	if err := srv.Start(); err != nil {
+		t.Fatalf("Could not start server after failed attempt: %v", err)
+	}
+	srv.Stop()
+
+	// a stopped server can be started again
+	if err := srv.Start(); err != nil {
+		t.Fatalf("Could not restart stopped server: %v", err)
+	}
+	srv.Stop()
+}
+
+// blockingDialer 拨号一直挂起 直到ctx被取消
+type blockingDialer struct {
+	dialing chan struct{}
+}
+
+func (d *blockingDialer) Dial(ctx context.Context, dest *discover.Node) (net.Conn, error) {
+	d.dialing <- struct{}{}
+	<-ctx.Done()
+	return nil, ctx.Err()
+}
+
+func TestServerStopCancelsDials(t *testing.T) {
+	key, _ := crypto.GenerateKey()
+	remkey, _ := crypto.GenerateKey()
+	dialer := &blockingDialer{dialing: make(chan struct{}, 1)}
+	srv := &Server{Config: Config{
+		Name:        "test",
+		PrivateKey:  key,
+		StaticNodes: []*discover.Node{discover.NewNode(discover.PubkeyID(&remkey.PublicKey), net.IP{127, 0, 0, 1}, 30303, 30303)},
+		Dialer:      dialer,
+	}}
+	if err := srv.Start(); err != nil {
+		t.Fatalf("Could not start server: %v", err)
+	}
+	select {
+	case <-dialer.dialing:
+	case <-time.After(5 * time.Second):
+		t.Fatal("static node not dialed")
+	}
+
+	stopped := make(chan struct{})
+	go func() {
+		srv.Stop()
+		close(stopped)
+	}()
+	select {
+	case <-stopped:
+	case <-time.After(2 * time.Second):
+		t.Fatal("Stop waited for the pending dial")
+	}
+}
@@ -0,0 +1,263 @@
+package adapters
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"sync"
+
+	"myeth/event"
+	"myeth/node"
+	"myeth/p2p"
+	"myeth/p2p/discover"
+)
+
+// SimAdapter is a NodeAdapter which creates in-memory simulation nodes and
+// connects them using in-memory net.Pipe connections
+// 所有节点都跑在同一个进程里 节点之间用net.Pipe连接 不占用任何端口
+type SimAdapter struct {
+	mtx      sync.RWMutex
+	nodes    map[discover.NodeID]*SimNode
+	services map[string]ServiceFunc
+}
+
+// NewSimAdapter creates a SimAdapter which is capable of running in-memory
+// simulation nodes running any of the given services (the services to run on a
+// particular node are passed to the NewNode function in the NodeConfig)
+func NewSimAdapter(services map[string]ServiceFunc) *SimAdapter {
+	return &SimAdapter{
+		nodes:    make(map[discover.NodeID]*SimNode),
+		services: services,
+	}
+}
+
+// Name returns the name of the adapter for logging purposes
+func (s *SimAdapter) Name() string {
+	return "sim-adapter"
+}
+
+// NewNode returns a new SimNode using the given config
+func (s *SimAdapter) NewNode(config *NodeConfig) (Node, error) {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+
+	// check a node with the ID doesn't already exist
+	id := config.ID
+	if _, exists := s.nodes[id]; exists {
+		return nil, fmt.Errorf("node already exists: %s", id)
+	}
+
+	// check the services are valid
+	if len(config.Services) == 0 {
+		return nil, errors.New("node must have at least one service")
+	}
+	for _, service := range config.Services {
+		if _, exists := s.services[service]; !exists {
+			return nil, fmt.Errorf("unknown node service %q", service)
+		}
+	}
+
+	n, err := node.New(&node.Config{
+		P2P: p2p.Config{
+			PrivateKey:      config.PrivateKey,
+			Name:            config.Name,
+			Dialer:          s,
+			EnableMsgEvents: true,
+		},
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	simNode := &SimNode{
+		ID:      id,
+		config:  config,
+		node:    n,
+		adapter: s,
+		running: make(map[string]node.Service),
+	}
+	// 服务只注册一次 节点重启时node.Node会用同样的构造函数重新创建服务
+	for _, name := range config.Services {
+		if err := n.Register(simNode.newService(name)); err != nil {
+			return nil, err
+		}
+	}
+	s.nodes[id] = simNode
+	return simNode, nil
+}
+
+// Dial implements the p2p.NodeDialer interface by connecting to the node using
+// an in-memory net.Pipe connection
+func (s *SimAdapter) Dial(ctx context.Context, dest *discover.Node) (conn net.Conn, err error) {
+	node, ok := s.GetNode(dest.ID)
+	if !ok {
+		return nil, fmt.Errorf("unknown node: %s", dest.ID)
+	}
+	srv := node.Server()
+	if srv == nil {
+		return nil, fmt.Errorf("node not running: %s", dest.ID)
+	}
+	// 管道的一端交给目标节点 相当于它的listener接受了一个新连接
+	pipe1, pipe2 := net.Pipe()
+	go srv.SetupConn(pipe1, 0, nil)
+	return pipe2, nil
+}
+
+// GetNode returns the node with the given ID if it exists
+func (s *SimAdapter) GetNode(id discover.NodeID) (*SimNode, bool) {
+	s.mtx.RLock()
+	defer s.mtx.RUnlock()
+	node, ok := s.nodes[id]
+	return node, ok
+}
+
+// SimNode is an in-memory simulation node which connects to other nodes using
+// an in-memory net.Pipe connection (see SimAdapter.Dial)
+type SimNode struct {
+	lock      sync.RWMutex
+	ID        discover.NodeID
+	config    *NodeConfig
+	adapter   *SimAdapter
+	node      *node.Node
+	running   map[string]node.Service
+	snapshots map[string][]byte // service snapshots used by the next Start
+}
+
+// newService wraps the named ServiceFunc into a node.ServiceConstructor which
+// passes the simulation context and records the running service
+func (sn *SimNode) newService(name string) node.ServiceConstructor {
+	return func(nodeCtx *node.ServiceContext) (node.Service, error) {
+		ctx := &ServiceContext{
+			NodeContext: nodeCtx,
+			Config:      sn.config,
+		}
+		if sn.snapshots != nil {
+			ctx.Snapshot = sn.snapshots[name]
+		}
+		service, err := sn.adapter.services[name](ctx)
+		if err != nil {
+			return nil, err
+		}
+		sn.running[name] = service
+		return service, nil
+	}
+}
+
+// Addr returns the node's discovery address
+func (sn *SimNode) Addr() []byte {
+	return []byte(sn.Node().String())
+}
+
+// Node returns a discover.Node representing the SimNode
+func (sn *SimNode) Node() *discover.Node {
+	return discover.NewNode(sn.ID, net.IP{127, 0, 0, 1}, 30303, 30303)
+}
+
+// Start starts the node's services, restoring them from the given snapshots
+func (sn *SimNode) Start(snapshots map[string][]byte) error {
+	sn.lock.Lock()
+	defer sn.lock.Unlock()
+
+	sn.snapshots = snapshots
+	sn.running = make(map[string]node.Service)
+	return sn.node.Start()
+}
+
+// Stop closes the node's services and the underlying p2p server
+func (sn *SimNode) Stop() error {
+	sn.lock.Lock()
+	defer sn.lock.Unlock()
+
+	if err := sn.node.Stop(); err != nil {
+		return err
+	}
+	sn.running = make(map[string]node.Service)
+	return nil
+}
+
+// Service returns a running service by name
+func (sn *SimNode) Service(name string) node.Service {
+	sn.lock.RLock()
+	defer sn.lock.RUnlock()
+	return sn.running[name]
+}
+
+// Services returns a copy of the underlying services
+func (sn *SimNode) Services() []node.Service {
+	sn.lock.RLock()
+	defer sn.lock.RUnlock()
+	services := make([]node.Service, 0, len(sn.running))
+	for _, service := range sn.running {
+		services = append(services, service)
+	}
+	return services
+}
+
+// Server returns the underlying p2p.Server, nil if the node isn't running
+func (sn *SimNode) Server() *p2p.Server {
+	return sn.node.Server()
+}
+
+// Snapshots creates snapshots of the running services which implement
+// Snapshotter
+func (sn *SimNode) Snapshots() (map[string][]byte, error) {
+	sn.lock.RLock()
+	defer sn.lock.RUnlock()
+
+	snapshots := make(map[string][]byte)
+	for name, service := range sn.running {
+		s, ok := service.(Snapshotter)
+		if !ok {
+			continue
+		}
+		data, err := s.Snapshot()
+		if err != nil {
+			return nil, fmt.Errorf("error taking snapshot of service %q: %v", name, err)
+		}
+		snapshots[name] = data
+	}
+	return snapshots, nil
+}
+
+// SubscribeEvents subscribes the given channel to peer events from the
+// underlying p2p.Server
+func (sn *SimNode) SubscribeEvents(ch chan *p2p.PeerEvent) (event.Subscription, error) {
+	srv := sn.Server()
+	if srv == nil {
+		return nil, fmt.Errorf("node not running: %s", sn.ID)
+	}
+	return srv.SubscribeEvents(ch), nil
+}
+
+// AddPeer connects the running node to the given peer
+func (sn *SimNode) AddPeer(peer *discover.Node) error {
+	srv := sn.Server()
+	if srv == nil {
+		return fmt.Errorf("node not running: %s", sn.ID)
+	}
+	srv.AddPeer(peer)
+	return nil
+}
+
+// RemovePeer disconnects the running node from the given peer
+func (sn *SimNode) RemovePeer(peer *discover.Node) error {
+	srv := sn.Server()
+	if srv == nil {
+		return fmt.Errorf("node not running: %s", sn.ID)
+	}
+	srv.RemovePeer(peer)
+	return nil
+}
+
+// NodeInfo returns information about the node
+func (sn *SimNode) NodeInfo() *p2p.NodeInfo {
+	server := sn.Server()
+	if server == nil {
+		return &p2p.NodeInfo{
+			ID:    sn.ID.String(),
+			Enode: sn.Node().String(),
+		}
+	}
+	return server.NodeInfo()
+}
@@ -0,0 +1,216 @@
+package simulations
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"testing"
+	"time"
+
+	"myeth/node"
+	"myeth/p2p"
+	"myeth/p2p/discover"
+	"myeth/p2p/simulations/adapters"
+	"myeth/rpc"
+)
+
+// testService keeps a peer connected until the peer disconnects and
+// remembers how often it was started, which is restored from snapshots.
+type testService struct {
+	starts int
+}
+
+func newTestService(ctx *adapters.ServiceContext) (node.Service, error) {
+	s := &testService{}
+	if len(ctx.Snapshot) > 0 {
+		if err := json.Unmarshal(ctx.Snapshot, &s.starts); err != nil {
+			return nil, err
+		}
+	}
+	return s, nil
+}
+
+func (s *testService) Protocols() []p2p.Protocol {
+	return []p2p.Protocol{{
+		Name:    "test",
+		Version: 1,
+		Length:  1,
+		Run: func(peer *p2p.Peer, rw p2p.MsgReadWriter) error {
+			for {
+				msg, err := rw.ReadMsg()
+				if err != nil {
+					return err
+				}
+				msg.Discard()
+			}
+		},
+	}}
+}
+
+func (s *testService) APIs() []rpc.API { return nil }
+
+func (s *testService) Start(*p2p.Server) error {
+	s.starts++
+	return nil
+}
+
+func (s *testService) Stop() error { return nil }
+
+func (s *testService) Snapshot() ([]byte, error) {
+	return json.Marshal(s.starts)
+}
+
+func newTestNetwork(t *testing.T, nodeCount int) (*Network, []discover.NodeID) {
+	adapter := adapters.NewSimAdapter(adapters.Services{"test": newTestService})
+	network := NewNetwork(adapter, &NetworkConfig{DefaultService: "test"})
+	ids := make([]discover.NodeID, nodeCount)
+	for i := range ids {
+		node, err := network.NewNode()
+		if err != nil {
+			t.Fatalf("error creating node: %s", err)
+		}
+		if err := network.Start(node.ID()); err != nil {
+			t.Fatalf("error starting node: %s", err)
+		}
+		ids[i] = node.ID()
+	}
+	return network, ids
+}
+
+// TestSimulationRing connects the nodes of a network in a ring and waits
+// until every connection has been reported up by the nodes themselves.
+func TestSimulationRing(t *testing.T) {
+	network, ids := newTestNetwork(t, 4)
+	defer network.Shutdown()
+
+	events := make(chan *Event)
+	sub := network.Events().Subscribe(events)
+	defer sub.Unsubscribe()
+
+	trigger := make(chan discover.NodeID)
+	go func() {
+		for {
+			select {
+			case ev := <-events:
+				// only trigger on conn up events reported by the nodes
+				if ev.Type != EventTypeConn || ev.Control || !ev.Conn.Up {
+					continue
+				}
+				select {
+				case trigger <- ev.Conn.One:
+				case <-sub.Err():
+					return
+				}
+			case <-sub.Err():
+				return
+			}
+		}
+	}()
+
+	action := func(ctx context.Context) error {
+		for i, id := range ids {
+			if err := network.Connect(id, ids[(i+1)%len(ids)]); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+	// The check runs while DidConnect may be blocked on the event feed with the
+	// network lock held, so look the nodes up before the simulation starts.
+	nodes := make(map[discover.NodeID]*Node, len(ids))
+	for _, id := range ids {
+		nodes[id] = network.GetNode(id)
+	}
+	check := func(ctx context.Context, id discover.NodeID) (bool, error) {
+		node := nodes[id]
+		if node == nil {
+			return false, fmt.Errorf("unknown node: %s", id)
+		}
+		return len(node.Node.(*adapters.SimNode).Server().Peers()) > 0, nil
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	result := NewSimulation(network).Run(ctx, &Step{
+		Action:  action,
+		Trigger: trigger,
+		Expect:  &Expectation{Nodes: ids, Check: check},
+	})
+	if result.Error != nil {
+		t.Fatalf("simulation failed: %s", result.Error)
+	}
+	for i, id := range ids {
+		conn := network.GetConn(id, ids[(i+1)%len(ids)])
+		if conn == nil || !conn.Up {
+			t.Errorf("connection %d not up: %v", i, conn)
+		}
+	}
+	if len(result.NetworkEvents) == 0 {
+		t.Error("no network events recorded")
+	}
+}
+
+// TestNetworkSnapshot saves a network as JSON and loads it into a fresh
+// network, checking that nodes, connections and service state survive.
+func TestNetworkSnapshot(t *testing.T) {
+	network, ids := newTestNetwork(t, 2)
+	defer network.Shutdown()
+
+	events := make(chan *Event, 16)
+	sub := network.Events().Subscribe(events)
+	defer sub.Unsubscribe()
+	if err := network.Connect(ids[0], ids[1]); err != nil {
+		t.Fatalf("error connecting nodes: %s", err)
+	}
+	waitConn(t, events, true)
+
+	snap, err := network.Snapshot()
+	if err != nil {
+		t.Fatalf("error taking snapshot: %s", err)
+	}
+	data, err := json.Marshal(snap)
+	if err != nil {
+		t.Fatalf("error encoding snapshot: %s", err)
+	}
+	var loaded Snapshot
+	if err := json.Unmarshal(data, &loaded); err != nil {
+		t.Fatalf("error decoding snapshot: %s", err)
+	}
+
+	adapter := adapters.NewSimAdapter(adapters.Services{"test": newTestService})
+	restored := NewNetwork(adapter, &NetworkConfig{DefaultService: "test"})
+	defer restored.Shutdown()
+	revents := make(chan *Event, 16)
+	rsub := restored.Events().Subscribe(revents)
+	defer rsub.Unsubscribe()
+	if err := restored.Load(&loaded); err != nil {
+		t.Fatalf("error loading snapshot: %s", err)
+	}
+	waitConn(t, revents, true)
+
+	for _, id := range ids {
+		node := restored.GetNode(id)
+		if node == nil || !node.Up {
+			t.Fatalf("node %s not restored", id)
+		}
+		service := node.Node.(*adapters.SimNode).Service("test").(*testService)
+		if service.starts != 2 {
+			t.Errorf("node %s: service start count mismatch: got %d, want 2", id, service.starts)
+		}
+	}
+}
+
+// waitConn waits for a non-control conn event with the given state.
+func waitConn(t *testing.T, events chan *Event, up bool) {
+	timeout := time.After(5 * time.Second)
+	for {
+		select {
+		case ev := <-events:
+			if ev.Type == EventTypeConn && !ev.Control && ev.Conn.Up == up {
+				return
+			}
+		case <-timeout:
+			t.Fatal("timed out waiting for conn event")
+		}
+	}
+}
@@ -0,0 +1,15 @@
+package params
+
+import "math/big"
+
+const (
+	GasLimitBoundDivisor uint64 = 1024    // The bound divisor of the gas limit, used in update calculations.
+	MinGasLimit          uint64 = 5000    // Minimum the gas limit may ever be.
+	GenesisGasLimit      uint64 = 4712388 // Gas limit of the Genesis block.
+
+	MaximumExtraDataSize uint64 = 32 // Maximum size extra data may be after Genesis.
+)
+
+var (
+	GenesisDifficulty = big.NewInt(131072) // Difficulty of the Genesis block.
+)
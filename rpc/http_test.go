@@ -0,0 +1,125 @@
+package rpc
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func newTestHTTPServer(t *testing.T, cors, vhosts []string) *httptest.Server {
+	server := NewServer()
+	if err := server.RegisterName("test", new(Service)); err != nil {
+		t.Fatal(err)
+	}
+	return httptest.NewServer(NewHTTPServer(cors, vhosts, server).Handler)
+}
+
+func TestHTTPErrorResponseWithDelete(t *testing.T) {
+	testHTTPErrorResponse(t, http.MethodDelete, contentType, "", http.StatusMethodNotAllowed)
+}
+
+func TestHTTPErrorResponseWithPut(t *testing.T) {
+	testHTTPErrorResponse(t, http.MethodPut, contentType, "", http.StatusMethodNotAllowed)
+}
+
+func TestHTTPErrorResponseWithMaxContentLength(t *testing.T) {
+	body := make([]rune, maxRequestContentLength+1)
+	testHTTPErrorResponse(t, http.MethodPost, contentType, string(body), http.StatusRequestEntityTooLarge)
+}
+
+func TestHTTPErrorResponseWithEmptyContentType(t *testing.T) {
+	testHTTPErrorResponse(t, http.MethodPost, "", "", http.StatusUnsupportedMediaType)
+}
+
+func TestHTTPErrorResponseWithValidRequest(t *testing.T) {
+	testHTTPErrorResponse(t, http.MethodPost, contentType, "", 0)
+}
+
+func testHTTPErrorResponse(t *testing.T, method, contentType, body string, expected int) {
+	request := httptest.NewRequest(method, "http://url.com", strings.NewReader(body))
+	request.Header.Set("content-type", contentType)
+	if code, _ := validateRequest(request); code != expected {
+		t.Fatalf("response code should be %d not %d", expected, code)
+	}
+}
+
+func TestHTTPRoundtrip(t *testing.T) {
+	ts := newTestHTTPServer(t, nil, []string{"localhost"})
+	defer ts.Close()
+
+	resp, err := http.Post(ts.URL, contentType, strings.NewReader(`{"jsonrpc":"2.0","id":7,"method":"test_echo","params":["x",3]}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+
+	var out response
+	if err := json.NewDecoder(resp.Body).Decode(&out); err != nil {
+		t.Fatal(err)
+	}
+	if out.Error != nil || string(out.Id) != "7" {
+		t.Fatalf("unexpected response: %+v", out)
+	}
+	if !strings.Contains(string(out.Result), `"String":"x"`) {
+		t.Errorf("unexpected result: %s", out.Result)
+	}
+}
+
+func TestHTTPVirtualHosts(t *testing.T) {
+	ts := newTestHTTPServer(t, nil, []string{"localhost"})
+	defer ts.Close()
+
+	tests := []struct {
+		host string
+		code int
+	}{
+		{"localhost:8545", http.StatusOK},
+		{"LOCALHOST", http.StatusOK},
+		{"127.0.0.1:8545", http.StatusOK},
+		{"evil.com", http.StatusForbidden},
+		{"evil.com:8545", http.StatusForbidden},
+	}
+	for _, tt := range tests {
+		req, _ := http.NewRequest(http.MethodPost, ts.URL, strings.NewReader(`{"jsonrpc":"2.0","id":1,"method":"rpc_modules"}`))
+		req.Header.Set("content-type", contentType)
+		req.Host = tt.host
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		if resp.StatusCode != tt.code {
+			t.Errorf("host %s: status mismatch: got %d, want %d", tt.host, resp.StatusCode, tt.code)
+		}
+	}
+}
+
+func TestHTTPCors(t *testing.T) {
+	ts := newTestHTTPServer(t, []string{"http://allowed.org"}, []string{"*"})
+	defer ts.Close()
+
+	preflight := func(origin string) *http.Response {
+		req, _ := http.NewRequest(http.MethodOptions, ts.URL, nil)
+		req.Header.Set("Origin", origin)
+		req.Header.Set("Access-Control-Request-Method", http.MethodPost)
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		return resp
+	}
+	resp := preflight("http://allowed.org")
+	if got := resp.Header.Get("Access-Control-Allow-Origin"); got != "http://allowed.org" {
+		t.Errorf("allowed origin: Access-Control-Allow-Origin mismatch: got %q", got)
+	}
+	if got := resp.Header.Get("Access-Control-Allow-Methods"); got == "" {
+		t.Errorf("allowed origin: missing Access-Control-Allow-Methods")
+	}
+	resp = preflight("http://denied.org")
+	if got := resp.Header.Get("Access-Control-Allow-Origin"); got != "" {
+		t.Errorf("denied origin: unexpected Access-Control-Allow-Origin %q", got)
+	}
+}
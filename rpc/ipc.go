@@ -0,0 +1,21 @@
+package rpc
+
+import (
+	"net"
+
+	"myeth/log"
+)
+
+// ServeListener accepts connections on l, serving JSON-RPC on them.
+func (srv *Server) ServeListener(l net.Listener) error {
+	for {
+		conn, err := l.Accept()
+		if netErr, ok := err.(net.Error); ok && netErr.Temporary() {
+			log.Error("RPC accept error", "err", err)
+			continue
+		} else if err != nil {
+			return err
+		}
+		go srv.ServeCodec(NewJSONCodec(conn), OptionMethodInvocation|OptionSubscriptions)
+	}
+}
@@ -0,0 +1,13 @@
+// +build !darwin,!dragonfly,!freebsd,!linux,!nacl,!netbsd,!openbsd,!solaris
+
+package rpc
+
+import (
+	"errors"
+	"net"
+)
+
+// ipcListen is not available without Unix domain sockets.
+func ipcListen(endpoint string) (net.Listener, error) {
+	return nil, errors.New("IPC is not supported on this platform")
+}
@@ -0,0 +1,39 @@
+// +build darwin dragonfly freebsd linux nacl netbsd openbsd solaris
+
+package rpc
+
+import (
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestIPCRoundtrip(t *testing.T) {
+	dir, err := ioutil.TempDir("", "rpc-ipc-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	endpoint := filepath.Join(dir, "sub", "test.ipc")
+	l, server, err := StartIPCEndpoint(endpoint, []API{{Namespace: "test", Service: new(Service)}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer server.Stop()
+	defer l.Close()
+
+	conn, err := net.Dial("unix", endpoint)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	var resp response
+	roundtrip(t, conn, `{"jsonrpc":"2.0","id":"a","method":"test_echo","params":["ipc",1]}`, &resp)
+	if resp.Error != nil || string(resp.Id) != `"a"` {
+		t.Fatalf("unexpected response: %+v", resp)
+	}
+}
@@ -0,0 +1,318 @@
+package rpc
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"reflect"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+const (
+	jsonrpcVersion           = "2.0"
+	serviceMethodSeparator   = "_"
+	subscribeMethodSuffix    = "_subscribe"
+	unsubscribeMethodSuffix  = "_unsubscribe"
+	notificationMethodSuffix = "_subscription"
+)
+
+type jsonRequest struct {
+	Method  string          `json:"method"`
+	Version string          `json:"jsonrpc"`
+	Id      json.RawMessage `json:"id,omitempty"`
+	Payload json.RawMessage `json:"params,omitempty"`
+}
+
+type jsonSuccessResponse struct {
+	Version string      `json:"jsonrpc"`
+	Id      interface{} `json:"id"`
+	Result  interface{} `json:"result"`
+}
+
+type jsonError struct {
+	Code    int         `json:"code"`
+	Message string      `json:"message"`
+	Data    interface{} `json:"data,omitempty"`
+}
+
+// jsonSubscription is the payload of a subscription notification.
+type jsonSubscription struct {
+	Subscription string      `json:"subscription"`
+	Result       interface{} `json:"result,omitempty"`
+}
+
+type jsonNotification struct {
+	Version string           `json:"jsonrpc"`
+	Method  string           `json:"method"`
+	Params  jsonSubscription `json:"params"`
+}
+
+type jsonErrResponse struct {
+	Version string      `json:"jsonrpc"`
+	Id      interface{} `json:"id"`
+	Error   jsonError   `json:"error"`
+}
+
+func (err *jsonError) Error() string {
+	if err.Message == "" {
+		return fmt.Sprintf("json-rpc error %d", err.Code)
+	}
+	return err.Message
+}
+
+func (err *jsonError) ErrorCode() int {
+	return err.Code
+}
+
+// jsonCodec reads and writes JSON-RPC messages to the underlying connection. It
+// also has support for parsing arguments and serializing (result) objects.
+type jsonCodec struct {
+	closer sync.Once                 // close closed channel once
+	closed chan interface{}          // closed on Close
+	decMu  sync.Mutex                // guards the decoder
+	decode func(v interface{}) error // decoder to allow multiple transports
+	encMu  sync.Mutex                // guards the encoder
+	encode func(v interface{}) error // encoder to allow multiple transports
+	rw     io.ReadWriteCloser        // connection
+}
+
+// NewCodec creates a new RPC server codec with support for JSON-RPC 2.0 based
+// on explicitly given encoding and decoding methods.
+func NewCodec(rwc io.ReadWriteCloser, encode, decode func(v interface{}) error) ServerCodec {
+	return &jsonCodec{
+		closed: make(chan interface{}),
+		encode: encode,
+		decode: decode,
+		rw:     rwc,
+	}
+}
+
+// NewJSONCodec creates a new RPC server codec with support for JSON-RPC 2.0.
+func NewJSONCodec(rwc io.ReadWriteCloser) ServerCodec {
+	enc := json.NewEncoder(rwc)
+	dec := json.NewDecoder(rwc)
+	dec.UseNumber()
+
+	return &jsonCodec{
+		closed: make(chan interface{}),
+		encode: enc.Encode,
+		decode: dec.Decode,
+		rw:     rwc,
+	}
+}
+
+// isBatch returns true when the first non-whitespace characters is '['
+func isBatch(msg json.RawMessage) bool {
+	for _, c := range msg {
+		// skip insignificant whitespace (http://www.ietf.org/rfc/rfc4627.txt)
+		if c == 0x20 || c == 0x09 || c == 0x0a || c == 0x0d {
+			continue
+		}
+		return c == '['
+	}
+	return false
+}
+
+// ReadRequestHeaders will read new requests without parsing the arguments. It will
+// return a collection of requests, an indication if these requests are in batch
+// form or an error when the incoming message could not be read/parsed.
+//
+// Only a failure to read a JSON value from the stream is reported as an error,
+// malformed requests are returned as elements carrying their own error so they
+// can be answered without dropping the connection.
+func (c *jsonCodec) ReadRequestHeaders() ([]rpcRequest, bool, Error) {
+	c.decMu.Lock()
+	defer c.decMu.Unlock()
+
+	var incomingMsg json.RawMessage
+	if err := c.decode(&incomingMsg); err != nil {
+		return nil, false, &invalidMessageError{err.Error()}
+	}
+	if isBatch(incomingMsg) {
+		return parseBatchRequest(incomingMsg)
+	}
+	return []rpcRequest{parseRequest(incomingMsg)}, false, nil
+}
+
+// checkReqId returns an error when the given reqId isn't valid for RPC method calls.
+// valid id's are strings, numbers or null
+func checkReqId(reqId json.RawMessage) error {
+	if string(reqId) == "null" {
+		return nil
+	}
+	if _, err := strconv.ParseFloat(string(reqId), 64); err == nil {
+		return nil
+	}
+	var str string
+	if err := json.Unmarshal(reqId, &str); err == nil {
+		return nil
+	}
+	return fmt.Errorf("invalid request id")
+}
+
+// parseRequest will parse a single request from the given RawMessage. Requests
+// without an id are notifications and are returned with a nil id.
+func parseRequest(incomingMsg json.RawMessage) rpcRequest {
+	var in jsonRequest
+	if err := json.Unmarshal(incomingMsg, &in); err != nil {
+		return rpcRequest{id: json.RawMessage("null"), err: &invalidRequestError{err.Error()}}
+	}
+	return toRPCRequest(&in)
+}
+
+// parseBatchRequest will parse a batch request into a collection of requests from the given RawMessage, an indication
+// if the request was a batch or an error when the request could not be read.
+func parseBatchRequest(incomingMsg json.RawMessage) ([]rpcRequest, bool, Error) {
+	var in []json.RawMessage
+	if err := json.Unmarshal(incomingMsg, &in); err != nil {
+		return nil, false, &invalidMessageError{err.Error()}
+	}
+	// an empty batch is answered with a single error, not an empty array
+	if len(in) == 0 {
+		return []rpcRequest{{id: json.RawMessage("null"), err: &invalidRequestError{"empty batch"}}}, false, nil
+	}
+	requests := make([]rpcRequest, len(in))
+	for i, r := range in {
+		requests[i] = parseRequest(r)
+	}
+	return requests, true, nil
+}
+
+// toRPCRequest validates a decoded request object and splits its method into
+// the service and method name.
+func toRPCRequest(in *jsonRequest) rpcRequest {
+	var id interface{}
+	if len(in.Id) > 0 {
+		if err := checkReqId(in.Id); err != nil {
+			return rpcRequest{id: json.RawMessage("null"), err: &invalidRequestError{err.Error()}}
+		}
+		id = in.Id
+	}
+	if in.Version != jsonrpcVersion {
+		return rpcRequest{id: orNull(id), err: &invalidRequestError{fmt.Sprintf("invalid jsonrpc version %q", in.Version)}}
+	}
+
+	// subscribe are special, they will always use `subscribeMethod` as first param in the payload
+	if strings.HasSuffix(in.Method, subscribeMethodSuffix) {
+		if len(in.Payload) > 0 {
+			// first param must be subscription name
+			var subscribeMethod [1]string
+			if err := json.Unmarshal(in.Payload, &subscribeMethod); err == nil && subscribeMethod[0] != "" {
+				service := strings.TrimSuffix(in.Method, subscribeMethodSuffix)
+				return rpcRequest{service: service, method: subscribeMethod[0], id: id, isPubSub: true, params: in.Payload}
+			}
+		}
+		return rpcRequest{id: orNull(id), err: &invalidRequestError{"Unable to parse subscription request"}}
+	}
+
+	if strings.HasSuffix(in.Method, unsubscribeMethodSuffix) {
+		return rpcRequest{method: in.Method, id: id, isPubSub: true, params: in.Payload}
+	}
+	elems := strings.Split(in.Method, serviceMethodSeparator)
+	if len(elems) != 2 {
+		return rpcRequest{id: id, err: &methodNotFoundError{in.Method, ""}}
+	}
+	if len(in.Payload) == 0 {
+		return rpcRequest{service: elems[0], method: elems[1], id: id}
+	}
+	return rpcRequest{service: elems[0], method: elems[1], id: id, params: in.Payload}
+}
+
+// orNull replaces a missing id with an explicit null so that malformed
+// requests are still answered.
+func orNull(id interface{}) interface{} {
+	if id == nil {
+		return json.RawMessage("null")
+	}
+	return id
+}
+
+// ParseRequestArguments tries to parse the given params (json.RawMessage) with the given
+// types. It returns the parsed values or an error when the parsing failed.
+func (c *jsonCodec) ParseRequestArguments(argTypes []reflect.Type, params interface{}) ([]reflect.Value, Error) {
+	if params == nil {
+		return parsePositionalArguments(nil, argTypes)
+	}
+	args, ok := params.(json.RawMessage)
+	if !ok {
+		return nil, &invalidParamsError{"Invalid params supplied"}
+	}
+	return parsePositionalArguments(args, argTypes)
+}
+
+// parsePositionalArguments tries to parse the given args to an array of values with the
+// given types. It returns the parsed values or an error when the args could not be
+// parsed. Missing optional arguments are returned as reflect.Zero values.
+func parsePositionalArguments(rawArgs json.RawMessage, types []reflect.Type) ([]reflect.Value, Error) {
+	args := make([]reflect.Value, 0, len(types))
+	if len(rawArgs) > 0 {
+		// Read beginning of the args array.
+		dec := json.NewDecoder(bytes.NewReader(rawArgs))
+		if tok, _ := dec.Token(); tok != json.Delim('[') {
+			return nil, &invalidParamsError{"non-array args"}
+		}
+		// Read args.
+		for i := 0; dec.More(); i++ {
+			if i >= len(types) {
+				return nil, &invalidParamsError{fmt.Sprintf("too many arguments, want at most %d", len(types))}
+			}
+			argval := reflect.New(types[i])
+			if err := dec.Decode(argval.Interface()); err != nil {
+				return nil, &invalidParamsError{fmt.Sprintf("invalid argument %d: %v", i, err)}
+			}
+			args = append(args, argval.Elem())
+		}
+		// Read end of args array.
+		if _, err := dec.Token(); err != nil {
+			return nil, &invalidParamsError{err.Error()}
+		}
+	}
+	// Set any missing args to nil.
+	for i := len(args); i < len(types); i++ {
+		if types[i].Kind() != reflect.Ptr {
+			return nil, &invalidParamsError{fmt.Sprintf("missing value for required argument %d", i)}
+		}
+		args = append(args, reflect.Zero(types[i]))
+	}
+	return args, nil
+}
+
+// CreateResponse will create a JSON-RPC success response with the given id and reply as result.
+func (c *jsonCodec) CreateResponse(id interface{}, reply interface{}) interface{} {
+	return &jsonSuccessResponse{Version: jsonrpcVersion, Id: id, Result: reply}
+}
+
+// CreateErrorResponse will create a JSON-RPC error response with the given id and error.
+func (c *jsonCodec) CreateErrorResponse(id interface{}, err Error) interface{} {
+	return &jsonErrResponse{Version: jsonrpcVersion, Id: orNull(id), Error: jsonError{Code: err.ErrorCode(), Message: err.Error()}}
+}
+
+// CreateNotification will create a JSON-RPC notification with the given subscription id and event as params.
+func (c *jsonCodec) CreateNotification(subid, namespace string, event interface{}) interface{} {
+	return &jsonNotification{Version: jsonrpcVersion, Method: namespace + notificationMethodSuffix,
+		Params: jsonSubscription{Subscription: subid, Result: event}}
+}
+
+// Write message to client
+func (c *jsonCodec) Write(res interface{}) error {
+	c.encMu.Lock()
+	defer c.encMu.Unlock()
+
+	return c.encode(res)
+}
+
+// Close the underlying connection
+func (c *jsonCodec) Close() {
+	c.closer.Do(func() {
+		close(c.closed)
+		c.rw.Close()
+	})
+}
+
+// Closed returns a channel which will be closed when Close is called
+func (c *jsonCodec) Closed() <-chan interface{} {
+	return c.closed
+}
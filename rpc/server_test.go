@@ -0,0 +1,246 @@
+package rpc
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net"
+	"reflect"
+	"testing"
+	"time"
+)
+
+type Service struct{}
+
+type Args struct {
+	S string
+}
+
+type Result struct {
+	String string
+	Int    int
+	Args   *Args
+}
+
+func (s *Service) NoArgsRets() {}
+
+func (s *Service) Echo(str string, i int, args *Args) Result {
+	return Result{str, i, args}
+}
+
+func (s *Service) EchoWithCtx(ctx context.Context, str string, i int, args *Args) Result {
+	return Result{str, i, args}
+}
+
+func (s *Service) Fail() error {
+	return errors.New("fail")
+}
+
+func (s *Service) InvalidRets(i int) (int, int) {
+	return 0, 0
+}
+
+func (s *Service) Sleep(ctx context.Context) error {
+	<-ctx.Done()
+	return ctx.Err()
+}
+
+func (s *Service) Crash() int {
+	panic("boom")
+}
+
+type response struct {
+	Version string          `json:"jsonrpc"`
+	Id      json.RawMessage `json:"id"`
+	Result  json.RawMessage `json:"result"`
+	Error   *jsonError      `json:"error"`
+}
+
+func TestServerRegisterName(t *testing.T) {
+	server := NewServer()
+	service := new(Service)
+
+	if err := server.RegisterName("calc", service); err != nil {
+		t.Fatalf("%v", err)
+	}
+	if len(server.services) != 2 {
+		t.Fatalf("Expected 2 service entries, got %d", len(server.services))
+	}
+	svc, ok := server.services["calc"]
+	if !ok {
+		t.Fatalf("Expected service calc to be registered")
+	}
+	want := []string{"noArgsRets", "echo", "echoWithCtx", "fail", "sleep", "crash"}
+	if len(svc.callbacks) != len(want) {
+		t.Fatalf("Expected %d callbacks for service 'calc', got %d", len(want), len(svc.callbacks))
+	}
+	for _, name := range want {
+		if _, ok := svc.callbacks[name]; !ok {
+			t.Errorf("missing callback %q", name)
+		}
+	}
+	if !svc.callbacks["echoWithCtx"].hasCtx {
+		t.Errorf("echoWithCtx not recognised as context method")
+	}
+}
+
+// serve starts the server on one end of a pipe and returns the other end.
+func serve(t *testing.T) (*Server, net.Conn) {
+	server := NewServer()
+	if err := server.RegisterName("test", new(Service)); err != nil {
+		t.Fatal(err)
+	}
+	serverConn, clientConn := net.Pipe()
+	go server.ServeCodec(NewJSONCodec(serverConn), OptionMethodInvocation)
+	return server, clientConn
+}
+
+func roundtrip(t *testing.T, conn net.Conn, req string, out interface{}) {
+	conn.SetDeadline(time.Now().Add(2 * time.Second))
+	if _, err := conn.Write([]byte(req)); err != nil {
+		t.Fatalf("write error: %v", err)
+	}
+	if err := json.NewDecoder(conn).Decode(out); err != nil {
+		t.Fatalf("decode error for %s: %v", req, err)
+	}
+}
+
+func TestServerMethodExecution(t *testing.T) {
+	server, conn := serve(t)
+	defer server.Stop()
+	defer conn.Close()
+
+	for _, method := range []string{"test_echo", "test_echoWithCtx"} {
+		var resp response
+		roundtrip(t, conn, `{"jsonrpc":"2.0","id":1,"method":"`+method+`","params":["s",12,{"S":"x"}]}`, &resp)
+		if resp.Error != nil {
+			t.Fatalf("%s: unexpected error %v", method, resp.Error)
+		}
+		var result Result
+		if err := json.Unmarshal(resp.Result, &result); err != nil {
+			t.Fatal(err)
+		}
+		if want := (Result{"s", 12, &Args{"x"}}); !reflect.DeepEqual(result, want) {
+			t.Errorf("%s: result mismatch: got %+v, want %+v", method, result, want)
+		}
+		if string(resp.Id) != "1" {
+			t.Errorf("%s: id mismatch: got %s", method, resp.Id)
+		}
+	}
+}
+
+func TestServerErrorCodes(t *testing.T) {
+	server, conn := serve(t)
+	defer server.Stop()
+	defer conn.Close()
+
+	tests := []struct {
+		req  string
+		code int
+	}{
+		{`{"jsonrpc":"2.0","id":1,"method":"test_missing"}`, -32601},
+		{`{"jsonrpc":"2.0","id":1,"method":"nonamespace"}`, -32601},
+		{`{"jsonrpc":"2.0","id":1,"method":"test_echo","params":[1]}`, -32602},
+		{`{"jsonrpc":"2.0","id":1,"method":"test_echo","params":["s"]}`, -32602},
+		{`{"jsonrpc":"2.0","id":1,"method":"test_noArgsRets","params":[1]}`, -32602},
+		{`{"jsonrpc":"1.0","id":1,"method":"test_noArgsRets"}`, -32600},
+		{`{"jsonrpc":"2.0","id":{},"method":"test_noArgsRets"}`, -32600},
+		{`[]`, -32600},
+		{`{"jsonrpc":"2.0","id":1,"method":"test_fail"}`, -32000},
+		{`{"jsonrpc":"2.0","id":1,"method":"test_crash"}`, -32000},
+	}
+	for _, tt := range tests {
+		var resp response
+		roundtrip(t, conn, tt.req, &resp)
+		if resp.Error == nil {
+			t.Errorf("%s: expected error, got result %s", tt.req, resp.Result)
+			continue
+		}
+		if resp.Error.Code != tt.code {
+			t.Errorf("%s: error code mismatch: got %d, want %d", tt.req, resp.Error.Code, tt.code)
+		}
+	}
+}
+
+func TestServerParseError(t *testing.T) {
+	server, conn := serve(t)
+	defer server.Stop()
+	defer conn.Close()
+
+	var resp response
+	roundtrip(t, conn, `{"jsonrpc":"2.0",`+"\n}", &resp)
+	if resp.Error == nil || resp.Error.Code != -32700 {
+		t.Fatalf("expected parse error, got %+v", resp.Error)
+	}
+	if string(resp.Id) != "null" {
+		t.Errorf("parse error id mismatch: got %s, want null", resp.Id)
+	}
+}
+
+func TestServerBatchAndNotifications(t *testing.T) {
+	server, conn := serve(t)
+	defer server.Stop()
+	defer conn.Close()
+
+	// Notifications are never answered, so the next response belongs to the batch.
+	conn.SetDeadline(time.Now().Add(2 * time.Second))
+	if _, err := conn.Write([]byte(`{"jsonrpc":"2.0","method":"test_noArgsRets"}`)); err != nil {
+		t.Fatal(err)
+	}
+	var resps []response
+	roundtrip(t, conn, `[
+		{"jsonrpc":"2.0","id":1,"method":"test_echo","params":["a",1]},
+		{"jsonrpc":"2.0","method":"test_fail"},
+		{"jsonrpc":"2.0","id":"two","method":"test_missing"}
+	]`, &resps)
+	if len(resps) != 2 {
+		t.Fatalf("expected 2 responses, got %d", len(resps))
+	}
+	if string(resps[0].Id) != "1" || resps[0].Error != nil {
+		t.Errorf("first response mismatch: %+v", resps[0])
+	}
+	if string(resps[1].Id) != `"two"` || resps[1].Error == nil || resps[1].Error.Code != -32601 {
+		t.Errorf("second response mismatch: %+v", resps[1])
+	}
+}
+
+func TestServerContextCancellation(t *testing.T) {
+	server := NewServer()
+	if err := server.RegisterName("test", new(Service)); err != nil {
+		t.Fatal(err)
+	}
+	serverConn, clientConn := net.Pipe()
+
+	done := make(chan struct{})
+	go func() {
+		server.ServeCodec(NewJSONCodec(serverConn), OptionMethodInvocation)
+		close(done)
+	}()
+	clientConn.SetDeadline(time.Now().Add(2 * time.Second))
+	if _, err := clientConn.Write([]byte(`{"jsonrpc":"2.0","id":1,"method":"test_sleep"}`)); err != nil {
+		t.Fatal(err)
+	}
+	// Dropping the connection must cancel the pending call.
+	clientConn.Close()
+	select {
+	case <-done:
+	case <-time.After(2 * time.Second):
+		t.Fatal("pending call not cancelled on disconnect")
+	}
+}
+
+func TestServerModules(t *testing.T) {
+	server, conn := serve(t)
+	defer server.Stop()
+	defer conn.Close()
+
+	var resp response
+	roundtrip(t, conn, `{"jsonrpc":"2.0","id":1,"method":"rpc_modules"}`, &resp)
+	var modules map[string]string
+	if err := json.Unmarshal(resp.Result, &modules); err != nil {
+		t.Fatal(err)
+	}
+	if want := map[string]string{"rpc": "1.0", "test": "1.0"}; !reflect.DeepEqual(modules, want) {
+		t.Errorf("modules mismatch: got %v, want %v", modules, want)
+	}
+}
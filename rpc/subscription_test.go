@@ -0,0 +1,190 @@
+package rpc
+
+import (
+	"context"
+	"encoding/json"
+	"net"
+	"strings"
+	"testing"
+	"time"
+)
+
+type NotificationTestService struct {
+	unsubscribed chan string
+}
+
+func (s *NotificationTestService) Echo(i int) int {
+	return i
+}
+
+// SomeSubscription sends n notifications carrying val and then waits for the
+// client to unsubscribe or to go away.
+func (s *NotificationTestService) SomeSubscription(ctx context.Context, n, val int) (*Subscription, error) {
+	notifier, supported := NotifierFromContext(ctx)
+	if !supported {
+		return nil, ErrNotificationsUnsupported
+	}
+
+	// by explicitly creating an subscription we make sure that the subscription id is send back to the client
+	// before the first subscription.Notify is called. Otherwise the events might be send before the response
+	// for the eth_subscribe method.
+	subscription := notifier.CreateSubscription()
+
+	go func() {
+		// test expects n events, if we begin sending event immediately some events
+		// will probably be dropped since the subscription ID might not be send to
+		// the client.
+		time.Sleep(50 * time.Millisecond)
+		for i := 0; i < n; i++ {
+			if err := notifier.Notify(subscription.ID, val+i); err != nil {
+				return
+			}
+		}
+		<-subscription.Err()
+		if s.unsubscribed != nil {
+			s.unsubscribed <- string(subscription.ID)
+		}
+	}()
+
+	return subscription, nil
+}
+
+type notification struct {
+	Method string `json:"method"`
+	Params struct {
+		Subscription string `json:"subscription"`
+		Result       int    `json:"result"`
+	} `json:"params"`
+}
+
+func serveNotifications(t *testing.T, service *NotificationTestService) (net.Conn, *json.Decoder) {
+	server := NewServer()
+	if err := server.RegisterName("eth", service); err != nil {
+		t.Fatalf("unable to register test service %v", err)
+	}
+	serverConn, clientConn := net.Pipe()
+	go server.ServeCodec(NewJSONCodec(serverConn), OptionMethodInvocation|OptionSubscriptions)
+	clientConn.SetDeadline(time.Now().Add(5 * time.Second))
+	return clientConn, json.NewDecoder(clientConn)
+}
+
+func TestNotifications(t *testing.T) {
+	service := &NotificationTestService{unsubscribed: make(chan string, 1)}
+	conn, dec := serveNotifications(t, service)
+	defer conn.Close()
+
+	if _, err := conn.Write([]byte(`{"jsonrpc":"2.0","id":1,"method":"eth_subscribe","params":["someSubscription",5,10]}`)); err != nil {
+		t.Fatal(err)
+	}
+	var resp response
+	if err := dec.Decode(&resp); err != nil {
+		t.Fatal(err)
+	}
+	if resp.Error != nil {
+		t.Fatalf("subscribe failed: %v", resp.Error)
+	}
+	var subid string
+	if err := json.Unmarshal(resp.Result, &subid); err != nil || !strings.HasPrefix(subid, "0x") {
+		t.Fatalf("invalid subscription id %s", resp.Result)
+	}
+	for i := 0; i < 5; i++ {
+		var n notification
+		if err := dec.Decode(&n); err != nil {
+			t.Fatal(err)
+		}
+		if n.Method != "eth_subscription" || n.Params.Subscription != subid || n.Params.Result != 10+i {
+			t.Fatalf("unexpected notification %d: %+v", i, n)
+		}
+	}
+
+	// Unsubscribing must succeed once and terminate the producer.
+	if _, err := conn.Write([]byte(`{"jsonrpc":"2.0","id":2,"method":"eth_unsubscribe","params":["` + subid + `"]}`)); err != nil {
+		t.Fatal(err)
+	}
+	if err := dec.Decode(&resp); err != nil {
+		t.Fatal(err)
+	}
+	if resp.Error != nil || string(resp.Result) != "true" {
+		t.Fatalf("unsubscribe failed: %+v", resp)
+	}
+	select {
+	case id := <-service.unsubscribed:
+		if id != subid {
+			t.Fatalf("wrong subscription unsubscribed: got %s, want %s", id, subid)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("subscription not cancelled on unsubscribe")
+	}
+	if _, err := conn.Write([]byte(`{"jsonrpc":"2.0","id":3,"method":"eth_unsubscribe","params":["` + subid + `"]}`)); err != nil {
+		t.Fatal(err)
+	}
+	if err := dec.Decode(&resp); err != nil {
+		t.Fatal(err)
+	}
+	if resp.Error == nil {
+		t.Fatal("expected error for unknown subscription")
+	}
+}
+
+func TestSubscriptionCleanupOnDisconnect(t *testing.T) {
+	service := &NotificationTestService{unsubscribed: make(chan string, 1)}
+	conn, dec := serveNotifications(t, service)
+
+	if _, err := conn.Write([]byte(`{"jsonrpc":"2.0","id":1,"method":"eth_subscribe","params":["someSubscription",0,0]}`)); err != nil {
+		t.Fatal(err)
+	}
+	var resp response
+	if err := dec.Decode(&resp); err != nil || resp.Error != nil {
+		t.Fatalf("subscribe failed: %v %v", err, resp.Error)
+	}
+	conn.Close()
+
+	select {
+	case <-service.unsubscribed:
+	case <-time.After(time.Second):
+		t.Fatal("subscription not cancelled on disconnect")
+	}
+}
+
+func TestSubscriptionErrors(t *testing.T) {
+	conn, dec := serveNotifications(t, new(NotificationTestService))
+	defer conn.Close()
+
+	tests := []struct {
+		req  string
+		code int
+	}{
+		{`{"jsonrpc":"2.0","id":1,"method":"eth_subscribe"}`, -32600},
+		{`{"jsonrpc":"2.0","id":1,"method":"eth_subscribe","params":["unknown"]}`, -32601},
+		{`{"jsonrpc":"2.0","id":1,"method":"eth_subscribe","params":["someSubscription","x"]}`, -32602},
+		{`{"jsonrpc":"2.0","id":1,"method":"eth_unsubscribe","params":[]}`, -32602},
+	}
+	for _, tt := range tests {
+		if _, err := conn.Write([]byte(tt.req)); err != nil {
+			t.Fatal(err)
+		}
+		var resp response
+		if err := dec.Decode(&resp); err != nil {
+			t.Fatal(err)
+		}
+		if resp.Error == nil || resp.Error.Code != tt.code {
+			t.Errorf("%s: expected error code %d, got %+v", tt.req, tt.code, resp.Error)
+		}
+	}
+}
+
+func TestSubscriptionWithoutNotifier(t *testing.T) {
+	server := NewServer()
+	if err := server.RegisterName("eth", new(NotificationTestService)); err != nil {
+		t.Fatal(err)
+	}
+	serverConn, clientConn := net.Pipe()
+	defer clientConn.Close()
+	go server.ServeCodec(NewJSONCodec(serverConn), OptionMethodInvocation)
+
+	var resp response
+	roundtrip(t, clientConn, `{"jsonrpc":"2.0","id":1,"method":"eth_subscribe","params":["someSubscription",1,1]}`, &resp)
+	if resp.Error == nil || resp.Error.Message != ErrNotificationsUnsupported.Error() {
+		t.Fatalf("expected notifications unsupported error, got %+v", resp.Error)
+	}
+}
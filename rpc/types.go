@@ -0,0 +1,87 @@
+package rpc
+
+import (
+	"reflect"
+	"sync"
+)
+
+// API describes the set of methods offered over the RPC interface
+type API struct {
+	Namespace string      // namespace under which the rpc methods of Service are exposed
+	Version   string      // api version
+	Service   interface{} // receiver instance which holds the methods
+	Public    bool        // indication if the methods must be considered safe for public use
+}
+
+// callback is a method callback which was registered in the server
+type callback struct {
+	rcvr        reflect.Value  // receiver of method
+	method      reflect.Method // callback
+	argTypes    []reflect.Type // input argument types
+	hasCtx      bool           // method's first argument is a context (not included in argTypes)
+	errPos      int            // err return idx, of -1 when method cannot return error
+	isSubscribe bool           // indication if the callback is a subscription
+}
+
+// service represents a registered object
+type service struct {
+	name          string        // name for service
+	typ           reflect.Type  // receiver type
+	callbacks     callbacks     // registered handlers
+	subscriptions subscriptions // available subscriptions/notifications
+}
+
+// serverRequest is an incoming request
+type serverRequest struct {
+	id            interface{} // nil for notifications
+	svcname       string
+	callb         *callback
+	args          []reflect.Value
+	isUnsubscribe bool
+	err           Error
+}
+
+type serviceRegistry map[string]*service // collection of services
+type callbacks map[string]*callback      // collection of RPC callbacks
+type subscriptions map[string]*callback  // collection of subscription callbacks
+
+// Server represents a RPC server
+type Server struct {
+	services serviceRegistry
+
+	run      int32
+	codecsMu sync.Mutex
+	codecs   map[ServerCodec]struct{}
+}
+
+// rpcRequest represents a raw incoming RPC request
+type rpcRequest struct {
+	service  string
+	method   string
+	id       interface{} // nil for notifications
+	isPubSub bool
+	params   interface{}
+	err      Error // invalid batch element
+}
+
+// ServerCodec implements reading, parsing and writing RPC messages for the server side of
+// a RPC session. Implementations must be go-routine safe since the codec can be called in
+// multiple go-routines concurrently.
+type ServerCodec interface {
+	// Read next request
+	ReadRequestHeaders() ([]rpcRequest, bool, Error)
+	// Parse request argument to the given types
+	ParseRequestArguments(argTypes []reflect.Type, params interface{}) ([]reflect.Value, Error)
+	// Assemble success response, expects response id and payload
+	CreateResponse(id interface{}, reply interface{}) interface{}
+	// Assemble error response, expects response id and error
+	CreateErrorResponse(id interface{}, err Error) interface{}
+	// Create notification response
+	CreateNotification(id, namespace string, event interface{}) interface{}
+	// Write msg to client.
+	Write(msg interface{}) error
+	// Close underlying data stream
+	Close()
+	// Closed when underlying connection is closed
+	Closed() <-chan interface{}
+}
@@ -0,0 +1,304 @@
+package rpc
+
+import (
+	"bufio"
+	"crypto/sha1"
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+)
+
+// websocket opcodes (RFC 6455 section 5.2)
+const (
+	wsContinuation = 0x0
+	wsText         = 0x1
+	wsBinary       = 0x2
+	wsClose        = 0x8
+	wsPing         = 0x9
+	wsPong         = 0xa
+)
+
+const (
+	wsGUID         = "258EAFA5-E914-47DA-95CA-C5AB0DC85B11"
+	wsMaxFrameSize = 15 * 1024 * 1024 // 单帧上限 防止恶意客户端耗尽内存
+	wsMaxControl   = 125              // control frames may not carry more payload
+)
+
+var (
+	errWSUnmasked    = errors.New("websocket: client frame not masked")
+	errWSOpcode      = errors.New("websocket: unknown opcode")
+	errWSFrameTooBig = errors.New("websocket: frame too large")
+)
+
+// NewWSServer creates a new websocket RPC server around an API provider.
+func NewWSServer(allowedOrigins []string, srv *Server) *http.Server {
+	return &http.Server{Handler: srv.WebsocketHandler(allowedOrigins)}
+}
+
+// WebsocketHandler returns a handler that serves JSON-RPC to WebSocket connections.
+//
+// allowedOrigins is the list of origins browsers may connect from. To allow
+// connections with any origin, pass "*". Clients that send no Origin header
+// (i.e. everything that is not a browser) are always accepted.
+func (srv *Server) WebsocketHandler(allowedOrigins []string) http.Handler {
+	return &wsHandler{server: srv, origins: wsOrigins(allowedOrigins)}
+}
+
+type wsHandler struct {
+	server  *Server
+	origins map[string]struct{}
+}
+
+// wsOrigins builds the origin whitelist, defaulting to the local host when
+// nothing was configured.
+func wsOrigins(allowedOrigins []string) map[string]struct{} {
+	origins := make(map[string]struct{})
+	for _, origin := range allowedOrigins {
+		origins[strings.ToLower(origin)] = struct{}{}
+	}
+	// allow localhost if no allowedOrigins are specified.
+	if len(origins) == 0 {
+		origins["http://localhost"] = struct{}{}
+		if hostname, err := os.Hostname(); err == nil {
+			origins["http://"+strings.ToLower(hostname)] = struct{}{}
+		}
+	}
+	return origins
+}
+
+// ServeHTTP upgrades the connection and serves JSON-RPC on it until the
+// client goes away, implements http.Handler
+func (h *wsHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if origin := r.Header.Get("Origin"); origin != "" {
+		_, all := h.origins["*"]
+		_, ok := h.origins[strings.ToLower(origin)]
+		if !all && !ok {
+			http.Error(w, fmt.Sprintf("origin %s not allowed", origin), http.StatusForbidden)
+			return
+		}
+	}
+	conn, err := upgradeWebsocket(w, r)
+	if err != nil {
+		return
+	}
+	h.server.ServeCodec(NewJSONCodec(conn), OptionMethodInvocation|OptionSubscriptions)
+}
+
+// upgradeWebsocket performs the server side of the opening handshake and takes
+// over the underlying connection. Errors are reported to the client.
+func upgradeWebsocket(w http.ResponseWriter, r *http.Request) (*wsConn, error) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return nil, errors.New("websocket: bad method")
+	}
+	if !headerContains(r.Header, "Connection", "upgrade") || !headerContains(r.Header, "Upgrade", "websocket") {
+		http.Error(w, "websocket upgrade required", http.StatusBadRequest)
+		return nil, errors.New("websocket: not an upgrade request")
+	}
+	if r.Header.Get("Sec-Websocket-Version") != "13" {
+		w.Header().Set("Sec-Websocket-Version", "13")
+		http.Error(w, "unsupported websocket version", http.StatusUpgradeRequired)
+		return nil, errors.New("websocket: unsupported version")
+	}
+	key := r.Header.Get("Sec-Websocket-Key")
+	if key == "" {
+		http.Error(w, "missing websocket key", http.StatusBadRequest)
+		return nil, errors.New("websocket: missing key")
+	}
+	hj, ok := w.(http.Hijacker)
+	if !ok {
+		http.Error(w, "websocket not supported", http.StatusInternalServerError)
+		return nil, errors.New("websocket: response does not implement http.Hijacker")
+	}
+	conn, brw, err := hj.Hijack()
+	if err != nil {
+		return nil, err
+	}
+	handshake := "HTTP/1.1 101 Switching Protocols\r\n" +
+		"Upgrade: websocket\r\n" +
+		"Connection: Upgrade\r\n" +
+		"Sec-WebSocket-Accept: " + wsAcceptKey(key) + "\r\n\r\n"
+	if _, err := brw.WriteString(handshake); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	if err := brw.Flush(); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	return &wsConn{conn: conn, br: brw.Reader}, nil
+}
+
+// wsAcceptKey computes the Sec-WebSocket-Accept value for the client's key.
+func wsAcceptKey(key string) string {
+	h := sha1.New()
+	h.Write([]byte(key + wsGUID))
+	return base64.StdEncoding.EncodeToString(h.Sum(nil))
+}
+
+// headerContains reports whether the comma separated header contains token.
+func headerContains(header http.Header, name, token string) bool {
+	for _, value := range header[http.CanonicalHeaderKey(name)] {
+		for _, v := range strings.Split(value, ",") {
+			if strings.EqualFold(strings.TrimSpace(v), token) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// wsConn exposes a websocket connection as a byte stream. Reads return the
+// concatenated payload of all data frames, every Write is sent as a single
+// text frame. Control frames are handled transparently.
+type wsConn struct {
+	conn net.Conn
+	br   *bufio.Reader
+
+	remaining uint64  // unread payload bytes of the current frame
+	mask      [4]byte // masking key of the current frame
+	maskPos   int
+
+	wmu    sync.Mutex // guards frame writes, pongs are sent from the reader
+	closer sync.Once
+}
+
+// Read implements io.Reader.
+func (c *wsConn) Read(p []byte) (int, error) {
+	for c.remaining == 0 {
+		if err := c.nextFrame(); err != nil {
+			return 0, err
+		}
+	}
+	if uint64(len(p)) > c.remaining {
+		p = p[:c.remaining]
+	}
+	n, err := c.br.Read(p)
+	for i := 0; i < n; i++ {
+		p[i] ^= c.mask[c.maskPos&3]
+		c.maskPos++
+	}
+	c.remaining -= uint64(n)
+	return n, err
+}
+
+// nextFrame reads frame headers until a data frame arrives, answering any
+// control frames on the way.
+func (c *wsConn) nextFrame() error {
+	var head [2]byte
+	if _, err := io.ReadFull(c.br, head[:]); err != nil {
+		return err
+	}
+	opcode := head[0] & 0x0f
+	masked := head[1]&0x80 != 0
+	length := uint64(head[1] & 0x7f)
+
+	switch length {
+	case 126:
+		var ext [2]byte
+		if _, err := io.ReadFull(c.br, ext[:]); err != nil {
+			return err
+		}
+		length = uint64(binary.BigEndian.Uint16(ext[:]))
+	case 127:
+		var ext [8]byte
+		if _, err := io.ReadFull(c.br, ext[:]); err != nil {
+			return err
+		}
+		length = binary.BigEndian.Uint64(ext[:])
+	}
+	if !masked {
+		return errWSUnmasked
+	}
+	if length > wsMaxFrameSize {
+		return errWSFrameTooBig
+	}
+	if _, err := io.ReadFull(c.br, c.mask[:]); err != nil {
+		return err
+	}
+	c.maskPos = 0
+
+	switch opcode {
+	case wsText, wsBinary, wsContinuation:
+		c.remaining = length
+		return nil
+
+	case wsPing, wsPong, wsClose:
+		if length > wsMaxControl {
+			return errWSFrameTooBig
+		}
+		payload := make([]byte, length)
+		if _, err := io.ReadFull(c.br, payload); err != nil {
+			return err
+		}
+		for i := range payload {
+			payload[i] ^= c.mask[i&3]
+		}
+		switch opcode {
+		case wsPing:
+			return c.writeFrame(wsPong, payload)
+		case wsClose:
+			//回显关闭码 然后结束读取
+			if len(payload) > 2 {
+				payload = payload[:2]
+			}
+			c.writeFrame(wsClose, payload)
+			return io.EOF
+		}
+		return nil
+
+	default:
+		return errWSOpcode
+	}
+}
+
+// writeFrame sends a single unmasked frame to the client.
+func (c *wsConn) writeFrame(opcode byte, payload []byte) error {
+	c.wmu.Lock()
+	defer c.wmu.Unlock()
+
+	header := make([]byte, 2, 10)
+	header[0] = 0x80 | opcode
+	switch n := len(payload); {
+	case n <= 125:
+		header[1] = byte(n)
+	case n <= 0xffff:
+		header[1] = 126
+		header = append(header, 0, 0)
+		binary.BigEndian.PutUint16(header[2:], uint16(n))
+	default:
+		header[1] = 127
+		header = append(header, 0, 0, 0, 0, 0, 0, 0, 0)
+		binary.BigEndian.PutUint64(header[2:], uint64(n))
+	}
+	if _, err := c.conn.Write(header); err != nil {
+		return err
+	}
+	_, err := c.conn.Write(payload)
+	return err
+}
+
+// Write implements io.Writer.
+func (c *wsConn) Write(p []byte) (int, error) {
+	if err := c.writeFrame(wsText, p); err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
+
+// Close sends a normal closure frame and closes the connection.
+func (c *wsConn) Close() error {
+	var err error
+	c.closer.Do(func() {
+		c.writeFrame(wsClose, []byte{0x03, 0xe8})
+		err = c.conn.Close()
+	})
+	return err
+}
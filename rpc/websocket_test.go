@@ -0,0 +1,124 @@
+package rpc
+
+import (
+	"bufio"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/json"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+// wsTestClient is a minimal websocket client speaking text frames.
+type wsTestClient struct {
+	conn net.Conn
+	br   *bufio.Reader
+}
+
+func dialWS(t *testing.T, url, origin string) (*wsTestClient, *http.Response) {
+	conn, err := net.Dial("tcp", strings.TrimPrefix(url, "http://"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn.SetDeadline(time.Now().Add(2 * time.Second))
+
+	key := make([]byte, 16)
+	rand.Read(key)
+	req, _ := http.NewRequest(http.MethodGet, url, nil)
+	req.Header.Set("Connection", "Upgrade")
+	req.Header.Set("Upgrade", "websocket")
+	req.Header.Set("Sec-WebSocket-Version", "13")
+	req.Header.Set("Sec-WebSocket-Key", base64.StdEncoding.EncodeToString(key))
+	if origin != "" {
+		req.Header.Set("Origin", origin)
+	}
+	if err := req.Write(conn); err != nil {
+		t.Fatal(err)
+	}
+	br := bufio.NewReader(conn)
+	resp, err := http.ReadResponse(br, req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &wsTestClient{conn, br}, resp
+}
+
+func (c *wsTestClient) send(t *testing.T, msg string) {
+	mask := [4]byte{1, 2, 3, 4}
+	payload := []byte(msg)
+	header := []byte{0x80 | wsText, 0x80 | 126, 0, 0}
+	binary.BigEndian.PutUint16(header[2:], uint16(len(payload)))
+	for i := range payload {
+		payload[i] ^= mask[i&3]
+	}
+	frame := append(append(header, mask[:]...), payload...)
+	if _, err := c.conn.Write(frame); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func (c *wsTestClient) recv(t *testing.T) (byte, []byte) {
+	var head [2]byte
+	if _, err := io.ReadFull(c.br, head[:]); err != nil {
+		t.Fatal(err)
+	}
+	length := int(head[1] & 0x7f)
+	if length == 126 {
+		var ext [2]byte
+		io.ReadFull(c.br, ext[:])
+		length = int(binary.BigEndian.Uint16(ext[:]))
+	}
+	payload := make([]byte, length)
+	if _, err := io.ReadFull(c.br, payload); err != nil {
+		t.Fatal(err)
+	}
+	return head[0] & 0x0f, payload
+}
+
+func newTestWSServer(t *testing.T, origins []string) *httptest.Server {
+	server := NewServer()
+	if err := server.RegisterName("test", new(Service)); err != nil {
+		t.Fatal(err)
+	}
+	return httptest.NewServer(server.WebsocketHandler(origins))
+}
+
+func TestWebsocketRoundtrip(t *testing.T) {
+	ts := newTestWSServer(t, []string{"http://allowed.org"})
+	defer ts.Close()
+
+	client, resp := dialWS(t, ts.URL, "http://allowed.org")
+	defer client.conn.Close()
+	if resp.StatusCode != http.StatusSwitchingProtocols {
+		t.Fatalf("handshake failed: %s", resp.Status)
+	}
+	client.send(t, `{"jsonrpc":"2.0","id":1,"method":"test_echo","params":["ws",2]}`)
+	op, payload := client.recv(t)
+	if op != wsText {
+		t.Fatalf("unexpected opcode %d", op)
+	}
+	var out response
+	if err := json.Unmarshal(payload, &out); err != nil {
+		t.Fatal(err)
+	}
+	if out.Error != nil || !strings.Contains(string(out.Result), `"String":"ws"`) {
+		t.Fatalf("unexpected response: %s", payload)
+	}
+}
+
+func TestWebsocketOriginCheck(t *testing.T) {
+	ts := newTestWSServer(t, []string{"http://allowed.org"})
+	defer ts.Close()
+
+	client, resp := dialWS(t, ts.URL, "http://evil.org")
+	defer client.conn.Close()
+	if resp.StatusCode != http.StatusForbidden {
+		t.Fatalf("expected forbidden, got %s", resp.Status)
+	}
+}
@@ -21,8 +21,8 @@ import (
 	"container/heap"
 	"errors"
 
-	"github.com/ethereum/go-ethereum/common"
-	"github.com/ethereum/go-ethereum/rlp"
+	"myeth/common"
+	"myeth/rlp"
 )
 
 // Iterator is a key-value trie iterator that traverses a Trie.
@@ -20,11 +20,11 @@ import (
 	"bytes"
 	"fmt"
 
-	"github.com/ethereum/go-ethereum/common"
-	"github.com/ethereum/go-ethereum/crypto"
-	"github.com/ethereum/go-ethereum/ethdb"
-	"github.com/ethereum/go-ethereum/log"
-	"github.com/ethereum/go-ethereum/rlp"
+	"myeth/common"
+	"myeth/crypto"
+	"myeth/ethdb"
+	"myeth/log"
+	"myeth/rlp"
 )
 
 // Prove constructs a merkle proof for key. The result contains all encoded nodes
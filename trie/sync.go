@@ -20,8 +20,9 @@ import (
 	"errors"
 	"fmt"
 
-	"github.com/ethereum/go-ethereum/common"
-	"github.com/ethereum/go-ethereum/ethdb"
+	"myeth/common"
+	"myeth/ethdb"
+
 	"gopkg.in/karalabe/cookiejar.v2/collections/prque"
 )
 
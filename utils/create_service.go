@@ -2,17 +2,36 @@ package utils
 
 import (
 	"myeth/eth"
+	"myeth/eth/downloader"
+	"myeth/les"
 	"myeth/node"
 )
 
-//创建一个全节点
+//创建一个全节点 轻同步模式下创建轻节点 全节点开启LightServ的话同时给轻节点提供服务
 func RegisterEthService(stack *node.Node) {
 	var err error
 
-	err = stack.Register(func(ctx *node.ServiceContext) (node.Service, error) {
-		fullNode, err := eth.New(ctx)
-		return fullNode, err
-	})
+	cfg := eth.DefaultConfig
+	if cfg.SyncMode == downloader.LightSync {
+		err = stack.Register(func(ctx *node.ServiceContext) (node.Service, error) {
+			return les.New(ctx, &cfg)
+		})
+	} else {
+		err = stack.Register(func(ctx *node.ServiceContext) (node.Service, error) {
+			fullNode, err := eth.New(ctx, &cfg)
+			if err != nil {
+				return nil, err
+			}
+			if cfg.LightServ > 0 {
+				ls, err := les.NewLesServer(fullNode, &cfg)
+				if err != nil {
+					return nil, err
+				}
+				fullNode.AddLesServer(ls)
+			}
+			return fullNode, nil
+		})
+	}
 
 	if err != nil {
 		return